@@ -3,6 +3,7 @@ CREATE EXTENSION IF NOT EXISTS timescaledb;
 CREATE TABLE IF NOT EXISTS telemetry (
     id SERIAL,
     timestamp TIMESTAMPTZ NOT NULL,
+    spacecraft_id INTEGER NOT NULL DEFAULT 1,
     packet_id INTEGER NOT NULL,
     packet_seq_ctrl INTEGER NOT NULL,
     subsystem_id INTEGER NOT NULL,
@@ -12,6 +13,18 @@ CREATE TABLE IF NOT EXISTS telemetry (
     signal_strength REAL NOT NULL,
     is_anomaly BOOLEAN DEFAULT FALSE,
     anomaly_type VARCHAR(50),
+    import_id INTEGER,
+    station VARCHAR(50),
+    earth_received_at TIMESTAMPTZ,
+    rssi_dbm REAL,
+    snr_db REAL,
+    corrected_bits INTEGER,
+    onboard_time TIMESTAMPTZ,
+    corrected_time TIMESTAMPTZ,
+    is_late BOOLEAN NOT NULL DEFAULT FALSE,
+    late_seconds REAL,
+    housekeeping_structure_id INTEGER,
+    stream_xid XID8 NOT NULL DEFAULT pg_current_xact_id(),
     created_at TIMESTAMPTZ DEFAULT NOW(),
     PRIMARY KEY (id, timestamp)
 );
@@ -20,6 +33,8 @@ CREATE TABLE IF NOT EXISTS telemetry (
 CREATE INDEX IF NOT EXISTS idx_telemetry_timestamp ON telemetry (timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_telemetry_anomaly ON telemetry (is_anomaly, timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_telemetry_subsystem ON telemetry (subsystem_id, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_telemetry_keyset ON telemetry (timestamp DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_telemetry_stream ON telemetry (stream_xid, id);
 
 
 SELECT create_hypertable('telemetry', 'timestamp', if_not_exists => TRUE);
@@ -47,12 +62,80 @@ SELECT
 FROM telemetry
 GROUP BY bucket, subsystem_id;
 
+CREATE MATERIALIZED VIEW IF NOT EXISTS telemetry_minutely_avg
+WITH (timescaledb.continuous, timescaledb.materialized_only = true) AS
+SELECT
+    time_bucket('1 minute', timestamp) AS bucket,
+    subsystem_id,
+    AVG(temperature) as avg_temperature,
+    MIN(temperature) as min_temperature,
+    MAX(temperature) as max_temperature,
+    AVG(battery) as avg_battery,
+    MIN(battery) as min_battery,
+    MAX(battery) as max_battery,
+    AVG(altitude) as avg_altitude,
+    MIN(altitude) as min_altitude,
+    MAX(altitude) as max_altitude,
+    AVG(signal_strength) as avg_signal_strength,
+    MIN(signal_strength) as min_signal_strength,
+    MAX(signal_strength) as max_signal_strength,
+    COUNT(*) as packet_count,
+    COUNT(*) FILTER (WHERE is_anomaly) as anomaly_count
+FROM telemetry
+GROUP BY bucket, subsystem_id;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS telemetry_daily_avg
+WITH (timescaledb.continuous, timescaledb.materialized_only = true) AS
+SELECT
+    time_bucket('1 day', timestamp) AS bucket,
+    subsystem_id,
+    AVG(temperature) as avg_temperature,
+    MIN(temperature) as min_temperature,
+    MAX(temperature) as max_temperature,
+    AVG(battery) as avg_battery,
+    MIN(battery) as min_battery,
+    MAX(battery) as max_battery,
+    AVG(altitude) as avg_altitude,
+    MIN(altitude) as min_altitude,
+    MAX(altitude) as max_altitude,
+    AVG(signal_strength) as avg_signal_strength,
+    MIN(signal_strength) as min_signal_strength,
+    MAX(signal_strength) as max_signal_strength,
+    COUNT(*) as packet_count,
+    COUNT(*) FILTER (WHERE is_anomaly) as anomaly_count
+FROM telemetry
+GROUP BY bucket, subsystem_id;
+
+-- The API reads materialized buckets only and queries the raw hypertable for
+-- the edge the refresh policies have not reached yet. Policies refresh from
+-- the start of the data so late and bulk-imported rows are picked up.
+ALTER MATERIALIZED VIEW telemetry_hourly_avg SET (timescaledb.materialized_only = true);
+
+SELECT add_continuous_aggregate_policy('telemetry_minutely_avg',
+    start_offset => NULL,
+    end_offset => INTERVAL '1 minute',
+    schedule_interval => INTERVAL '1 minute',
+    if_not_exists => TRUE);
+
+SELECT add_continuous_aggregate_policy('telemetry_hourly_avg',
+    start_offset => NULL,
+    end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '15 minutes',
+    if_not_exists => TRUE);
+
+SELECT add_continuous_aggregate_policy('telemetry_daily_avg',
+    start_offset => NULL,
+    end_offset => INTERVAL '1 day',
+    schedule_interval => INTERVAL '1 hour',
+    if_not_exists => TRUE);
+
 
 CREATE TABLE IF NOT EXISTS anomaly_history (
     id SERIAL,
     telemetry_id INTEGER NOT NULL,
     telemetry_timestamp TIMESTAMPTZ NOT NULL,
     timestamp TIMESTAMPTZ NOT NULL,
+    spacecraft_id INTEGER NOT NULL DEFAULT 1,
     anomaly_type VARCHAR(50) NOT NULL,
     parameter_name VARCHAR(50) NOT NULL,
     parameter_value REAL NOT NULL,
@@ -60,6 +143,18 @@ CREATE TABLE IF NOT EXISTS anomaly_history (
     severity VARCHAR(20) DEFAULT 'WARNING',
     acknowledged BOOLEAN DEFAULT FALSE,
     acknowledged_at TIMESTAMPTZ,
+    acknowledged_by VARCHAR(100),
+    acknowledgement_note TEXT,
+    is_derived BOOLEAN NOT NULL DEFAULT FALSE,
+    revision INTEGER NOT NULL DEFAULT 1,
+    first_id INTEGER,
+    reprocess_job_id INTEGER,
+    incident_id INTEGER,
+    suppressed BOOLEAN NOT NULL DEFAULT FALSE,
+    silence_id INTEGER,
+    import_id INTEGER,
+    superseded_at TIMESTAMPTZ,
+    stream_xid XID8 NOT NULL DEFAULT pg_current_xact_id(),
     created_at TIMESTAMPTZ DEFAULT NOW(),
     PRIMARY KEY (id, timestamp)
 );
@@ -68,85 +163,1194 @@ CREATE TABLE IF NOT EXISTS anomaly_history (
 CREATE INDEX IF NOT EXISTS idx_anomaly_history_timestamp ON anomaly_history (timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_anomaly_history_type ON anomaly_history (anomaly_type, timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_anomaly_history_acknowledged ON anomaly_history (acknowledged, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_anomaly_history_telemetry ON anomaly_history (telemetry_id, telemetry_timestamp);
+CREATE INDEX IF NOT EXISTS idx_anomaly_history_incident ON anomaly_history (incident_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_anomaly_history_keyset ON anomaly_history (timestamp DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_anomaly_history_stream ON anomaly_history (stream_xid, id);
+CREATE INDEX IF NOT EXISTS idx_anomaly_history_first ON anomaly_history (first_id);
 
 
 SELECT create_hypertable('anomaly_history', 'timestamp', if_not_exists => TRUE);
 
 
+-- Limit rules for every parameter, downlinked or derived. The insert triggers
+-- and the reprocessing job all evaluate these rows, so a threshold change here
+-- applies everywhere. When several parameters of one packet are out of limits,
+-- the rule with the highest priority is reported.
+CREATE TABLE IF NOT EXISTS parameter_limits (
+    parameter_name VARCHAR(50) PRIMARY KEY,
+    low_threshold REAL,
+    low_anomaly_type VARCHAR(50),
+    high_threshold REAL,
+    high_anomaly_type VARCHAR(50),
+    severity VARCHAR(20) NOT NULL DEFAULT 'WARNING',
+    priority INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO parameter_limits (
+    parameter_name, low_threshold, low_anomaly_type, high_threshold, high_anomaly_type, priority
+) VALUES
+    ('temperature', 20.0, 'LOW_TEMPERATURE', 35.0, 'HIGH_TEMPERATURE', 1),
+    ('battery', 40.0, 'LOW_BATTERY', NULL, NULL, 2),
+    ('altitude', 400.0, 'LOW_ALTITUDE', NULL, NULL, 3),
+    ('signal_strength', -80.0, 'WEAK_SIGNAL', NULL, NULL, 4),
+    ('battery_health', 30.0, 'LOW_BATTERY_HEALTH', NULL, NULL, 5)
+ON CONFLICT (parameter_name) DO NOTHING;
+
+
+CREATE OR REPLACE FUNCTION classify_parameter(name_val VARCHAR, value_val REAL)
+RETURNS TABLE (
+    anomaly_type VARCHAR(50),
+    threshold_value REAL,
+    severity VARCHAR(20),
+    priority INTEGER
+) AS $$
+    SELECT
+        CASE WHEN l.high_threshold IS NOT NULL AND value_val > l.high_threshold
+             THEN l.high_anomaly_type ELSE l.low_anomaly_type END,
+        CASE WHEN l.high_threshold IS NOT NULL AND value_val > l.high_threshold
+             THEN l.high_threshold ELSE l.low_threshold END,
+        l.severity,
+        l.priority
+    FROM parameter_limits l
+    WHERE l.parameter_name = name_val
+    AND ((l.high_threshold IS NOT NULL AND value_val > l.high_threshold)
+      OR (l.low_threshold IS NOT NULL AND value_val < l.low_threshold));
+$$ LANGUAGE sql STABLE;
+
+
+CREATE OR REPLACE FUNCTION classify_telemetry(
+    temperature_val REAL,
+    battery_val REAL,
+    altitude_val REAL,
+    signal_strength_val REAL
+)
+RETURNS TABLE (
+    anomaly_type VARCHAR(50),
+    parameter_name VARCHAR(50),
+    parameter_value REAL,
+    threshold_value REAL,
+    severity VARCHAR(20)
+) AS $$
+    SELECT c.anomaly_type, v.name, v.value, c.threshold_value, c.severity
+    FROM (VALUES
+        ('temperature'::VARCHAR(50), temperature_val),
+        ('battery', battery_val),
+        ('altitude', altitude_val),
+        ('signal_strength', signal_strength_val)
+    ) AS v(name, value)
+    CROSS JOIN LATERAL classify_parameter(v.name, v.value) c
+    ORDER BY c.priority DESC
+    LIMIT 1;
+$$ LANGUAGE sql STABLE;
+
+
 CREATE OR REPLACE FUNCTION detect_anomaly()
 RETURNS TRIGGER AS $$
 DECLARE
-    anomaly_detected BOOLEAN := FALSE;
-    anomaly_type_val VARCHAR(50) := '';
-    param_name VARCHAR(50) := '';
-    threshold_val REAL := 0;
+    result RECORD;
 BEGIN
-    IF NEW.temperature > 35.0 THEN
-        anomaly_detected := TRUE;
-        anomaly_type_val := 'HIGH_TEMPERATURE';
-        param_name := 'temperature';
-        threshold_val := 35.0;
-    ELSIF NEW.temperature < 20.0 THEN
-        anomaly_detected := TRUE;
-        anomaly_type_val := 'LOW_TEMPERATURE';
-        param_name := 'temperature';
-        threshold_val := 20.0;
+    SELECT * INTO result
+    FROM classify_telemetry(NEW.temperature, NEW.battery, NEW.altitude, NEW.signal_strength);
+
+    IF FOUND THEN
+        NEW.is_anomaly := TRUE;
+        NEW.anomaly_type := result.anomaly_type;
+
+        INSERT INTO anomaly_history (
+            telemetry_id, telemetry_timestamp, timestamp, spacecraft_id, anomaly_type, parameter_name,
+            parameter_value, threshold_value, severity, import_id
+        ) VALUES (
+            NEW.id, NEW.timestamp, NEW.timestamp, NEW.spacecraft_id, result.anomaly_type, result.parameter_name,
+            result.parameter_value, result.threshold_value, result.severity, NEW.import_id
+        );
     END IF;
 
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP TRIGGER IF EXISTS trigger_detect_anomaly ON telemetry;
+CREATE TRIGGER trigger_detect_anomaly
+    BEFORE INSERT ON telemetry
+    FOR EACH ROW
+    EXECUTE FUNCTION detect_anomaly();
+
+
+-- Derived parameters are computed by telemetry-ingestion from the expression
+-- whenever a packet updates their inputs. Values land in derived_values and go
+-- through the same parameter_limits rules as downlinked parameters.
+CREATE TABLE IF NOT EXISTS derived_parameters (
+    name VARCHAR(50) PRIMARY KEY,
+    expression TEXT NOT NULL,
+    unit VARCHAR(20),
+    description TEXT,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+INSERT INTO derived_parameters (name, expression, unit, description) VALUES
+    ('battery_health', 'battery * (1 - abs(temperature - 25) / 50)', '%',
+     'Battery level derated by distance from the optimal cell temperature'),
+    ('thermal_margin', 'min(temperature - 20, 35 - temperature)', 'C',
+     'Distance to the nearest temperature limit')
+ON CONFLICT (name) DO NOTHING;
+
+
+CREATE TABLE IF NOT EXISTS derived_values (
+    telemetry_id INTEGER NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    parameter_name VARCHAR(50) NOT NULL,
+    value REAL NOT NULL,
+    is_anomaly BOOLEAN DEFAULT FALSE,
+    anomaly_type VARCHAR(50),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (parameter_name, timestamp, telemetry_id)
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_derived_values_telemetry ON derived_values (telemetry_id, timestamp);
+
+
+SELECT create_hypertable('derived_values', 'timestamp', if_not_exists => TRUE);
+
+
+CREATE OR REPLACE FUNCTION detect_derived_anomaly()
+RETURNS TRIGGER AS $$
+DECLARE
+    result RECORD;
+    source_spacecraft_id INTEGER;
+    source_import_id INTEGER;
+BEGIN
+    SELECT * INTO result
+    FROM classify_parameter(NEW.parameter_name, NEW.value);
+
+    IF FOUND THEN
+        NEW.is_anomaly := TRUE;
+        NEW.anomaly_type := result.anomaly_type;
+
+        SELECT t.spacecraft_id, t.import_id INTO source_spacecraft_id, source_import_id
+        FROM telemetry t
+        WHERE t.id = NEW.telemetry_id AND t.timestamp = NEW.timestamp;
 
-    IF NEW.battery < 40.0 THEN
-        anomaly_detected := TRUE;
-        anomaly_type_val := 'LOW_BATTERY';
-        param_name := 'battery';
-        threshold_val := 40.0;
+        INSERT INTO anomaly_history (
+            telemetry_id, telemetry_timestamp, timestamp, spacecraft_id, anomaly_type, parameter_name,
+            parameter_value, threshold_value, severity, is_derived, import_id
+        ) VALUES (
+            NEW.telemetry_id, NEW.timestamp, NEW.timestamp, COALESCE(source_spacecraft_id, 1),
+            result.anomaly_type, NEW.parameter_name,
+            NEW.value, result.threshold_value, result.severity, TRUE, source_import_id
+        );
     END IF;
 
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP TRIGGER IF EXISTS trigger_detect_derived_anomaly ON derived_values;
+CREATE TRIGGER trigger_detect_derived_anomaly
+    BEFORE INSERT ON derived_values
+    FOR EACH ROW
+    EXECUTE FUNCTION detect_derived_anomaly();
+
+
+-- Incidents group consecutive anomaly_history rows with the same spacecraft,
+-- parameter and anomaly type. A row joins an incident when it falls within
+-- incident_gap() of the incident's span; otherwise it opens a new one. An
+-- incident closes once no sample has been seen for incident_gap(), and its
+-- closed_at is the time of its last sample.
+CREATE TABLE IF NOT EXISTS incidents (
+    id SERIAL PRIMARY KEY,
+    spacecraft_id INTEGER NOT NULL,
+    parameter_name VARCHAR(50) NOT NULL,
+    anomaly_type VARCHAR(50) NOT NULL,
+    severity VARCHAR(20) NOT NULL DEFAULT 'WARNING',
+    status VARCHAR(20) NOT NULL DEFAULT 'OPEN',
+    opened_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    closed_at TIMESTAMPTZ,
+    peak_value REAL NOT NULL,
+    peak_at TIMESTAMPTZ NOT NULL,
+    threshold_value REAL NOT NULL,
+    sample_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
 
-    IF NEW.altitude < 400.0 THEN
-        anomaly_detected := TRUE;
-        anomaly_type_val := 'LOW_ALTITUDE';
-        param_name := 'altitude';
-        threshold_val := 400.0;
+CREATE INDEX IF NOT EXISTS idx_incidents_key ON incidents (spacecraft_id, parameter_name, anomaly_type, last_seen_at DESC);
+CREATE INDEX IF NOT EXISTS idx_incidents_status ON incidents (status, opened_at DESC);
+
+
+CREATE OR REPLACE FUNCTION incident_gap()
+RETURNS INTERVAL AS $$
+    SELECT INTERVAL '5 minutes';
+$$ LANGUAGE sql IMMUTABLE;
+
+
+CREATE OR REPLACE FUNCTION severity_rank(severity_val VARCHAR)
+RETURNS INTEGER AS $$
+    SELECT CASE severity_val
+        WHEN 'CRITICAL' THEN 3
+        WHEN 'WARNING' THEN 2
+        WHEN 'INFO' THEN 1
+        ELSE 0
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+
+CREATE OR REPLACE FUNCTION assign_incident()
+RETURNS TRIGGER AS $$
+DECLARE
+    gap INTERVAL := incident_gap();
+    inc incidents%ROWTYPE;
+    last_seen TIMESTAMPTZ;
+BEGIN
+    SELECT * INTO inc
+    FROM incidents
+    WHERE spacecraft_id = NEW.spacecraft_id
+    AND parameter_name = NEW.parameter_name
+    AND anomaly_type = NEW.anomaly_type
+    AND status <> 'SUPERSEDED'
+    AND NEW.timestamp BETWEEN opened_at - gap AND last_seen_at + gap
+    ORDER BY last_seen_at DESC
+    LIMIT 1
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        INSERT INTO incidents (
+            spacecraft_id, parameter_name, anomaly_type, severity, status,
+            opened_at, last_seen_at, closed_at, peak_value, peak_at, threshold_value, sample_count
+        ) VALUES (
+            NEW.spacecraft_id, NEW.parameter_name, NEW.anomaly_type, NEW.severity,
+            CASE WHEN NEW.timestamp < NOW() - gap THEN 'CLOSED' ELSE 'OPEN' END,
+            NEW.timestamp, NEW.timestamp,
+            CASE WHEN NEW.timestamp < NOW() - gap THEN NEW.timestamp END,
+            NEW.parameter_value, NEW.timestamp, NEW.threshold_value, 1
+        )
+        RETURNING id INTO NEW.incident_id;
+        RETURN NEW;
     END IF;
 
+    last_seen := GREATEST(inc.last_seen_at, NEW.timestamp);
+
+    UPDATE incidents SET
+        opened_at = LEAST(opened_at, NEW.timestamp),
+        last_seen_at = last_seen,
+        status = CASE WHEN last_seen < NOW() - gap THEN 'CLOSED' ELSE 'OPEN' END,
+        closed_at = CASE WHEN last_seen < NOW() - gap THEN last_seen END,
+        peak_value = CASE WHEN ABS(NEW.parameter_value - NEW.threshold_value) > ABS(peak_value - threshold_value)
+                          THEN NEW.parameter_value ELSE peak_value END,
+        peak_at = CASE WHEN ABS(NEW.parameter_value - NEW.threshold_value) > ABS(peak_value - threshold_value)
+                       THEN NEW.timestamp ELSE peak_at END,
+        severity = CASE WHEN severity_rank(NEW.severity) > severity_rank(severity)
+                        THEN NEW.severity ELSE severity END,
+        sample_count = sample_count + 1,
+        updated_at = NOW()
+    WHERE id = inc.id;
+
+    NEW.incident_id := inc.id;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP TRIGGER IF EXISTS trigger_assign_incident ON anomaly_history;
+CREATE TRIGGER trigger_assign_incident
+    BEFORE INSERT ON anomaly_history
+    FOR EACH ROW
+    EXECUTE FUNCTION assign_incident();
+
+
+-- Silences suppress anomalies during planned activities such as discharge
+-- tests. Suppressed anomalies are still recorded and grouped into incidents,
+-- but are left out of the current status and are not notified. NULL scope
+-- columns match any value; a silence applies to anomalies whose timestamp
+-- falls in [starts_at, ends_at).
+CREATE TABLE IF NOT EXISTS silences (
+    id SERIAL PRIMARY KEY,
+    spacecraft_id INTEGER,
+    parameter_name VARCHAR(50),
+    anomaly_type VARCHAR(50),
+    starts_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    reason TEXT NOT NULL,
+    created_by VARCHAR(100) NOT NULL,
+    expired_by VARCHAR(100),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    CHECK (ends_at >= starts_at)
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_silences_window ON silences (ends_at, starts_at);
+
+
+CREATE OR REPLACE FUNCTION matching_silence(
+    spacecraft_val INTEGER,
+    parameter_val VARCHAR,
+    anomaly_type_val VARCHAR,
+    ts TIMESTAMPTZ
+)
+RETURNS INTEGER AS $$
+    SELECT id
+    FROM silences
+    WHERE ts >= starts_at AND ts < ends_at
+    AND (spacecraft_id IS NULL OR spacecraft_id = spacecraft_val)
+    AND (parameter_name IS NULL OR parameter_name = parameter_val)
+    AND (anomaly_type IS NULL OR anomaly_type = anomaly_type_val)
+    ORDER BY created_at
+    LIMIT 1;
+$$ LANGUAGE sql STABLE;
+
+
+CREATE OR REPLACE FUNCTION apply_silence()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.silence_id := matching_silence(NEW.spacecraft_id, NEW.parameter_name, NEW.anomaly_type, NEW.timestamp);
+    NEW.suppressed := NEW.silence_id IS NOT NULL;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP TRIGGER IF EXISTS trigger_apply_silence ON anomaly_history;
+CREATE TRIGGER trigger_apply_silence
+    BEFORE INSERT ON anomaly_history
+    FOR EACH ROW
+    EXECUTE FUNCTION apply_silence();
+
+
+-- Whether the current anomaly recorded for a telemetry row is suppressed.
+CREATE OR REPLACE FUNCTION telemetry_suppressed(telemetry_id_val INTEGER, ts TIMESTAMPTZ)
+RETURNS BOOLEAN AS $$
+    SELECT EXISTS (
+        SELECT 1
+        FROM anomaly_history
+        WHERE telemetry_id = telemetry_id_val
+        AND telemetry_timestamp = ts
+        AND NOT is_derived
+        AND superseded_at IS NULL
+        AND suppressed
+    );
+$$ LANGUAGE sql STABLE;
+
+
+-- Called periodically by telemetry-api.
+CREATE OR REPLACE FUNCTION close_stale_incidents()
+RETURNS INTEGER AS $$
+    WITH closed AS (
+        UPDATE incidents
+        SET status = 'CLOSED', closed_at = last_seen_at, updated_at = NOW()
+        WHERE status = 'OPEN'
+        AND last_seen_at < NOW() - incident_gap()
+        RETURNING id
+    )
+    SELECT COUNT(*)::INTEGER FROM closed;
+$$ LANGUAGE sql;
+
+
+-- Recomputes sample counts and peaks from the current (non-superseded)
+-- anomaly rows after a reprocess job. Incidents left without any current row
+-- are marked SUPERSEDED.
+CREATE OR REPLACE FUNCTION refresh_incidents(from_ts TIMESTAMPTZ, to_ts TIMESTAMPTZ)
+RETURNS VOID AS $$
+    UPDATE incidents i SET
+        sample_count = COALESCE(s.sample_count, 0),
+        peak_value = COALESCE(s.peak_value, i.peak_value),
+        peak_at = COALESCE(s.peak_at, i.peak_at),
+        status = CASE WHEN s.sample_count IS NULL THEN 'SUPERSEDED' ELSE i.status END,
+        updated_at = NOW()
+    FROM incidents x
+    LEFT JOIN LATERAL (
+        SELECT COUNT(*) OVER () AS sample_count, h.parameter_value AS peak_value, h.timestamp AS peak_at
+        FROM anomaly_history h
+        WHERE h.incident_id = x.id AND h.superseded_at IS NULL
+        ORDER BY ABS(h.parameter_value - h.threshold_value) DESC
+        LIMIT 1
+    ) s ON TRUE
+    WHERE i.id = x.id
+    AND x.last_seen_at >= from_ts - incident_gap()
+    AND x.opened_at < to_ts + incident_gap();
+$$ LANGUAGE sql;
 
-    IF NEW.signal_strength < -80.0 THEN
-        anomaly_detected := TRUE;
-        anomaly_type_val := 'WEAK_SIGNAL';
-        param_name := 'signal_strength';
-        threshold_val := -80.0;
+
+-- Revisions of one anomaly, written by reprocessing or when a better copy of
+-- its packet replaces the stored one, share first_id, the id of the first
+-- revision. A new row continues the latest superseded revision with the same
+-- spacecraft, sample time, parameter and anomaly type.
+CREATE OR REPLACE FUNCTION link_anomaly_revision()
+RETURNS TRIGGER AS $$
+BEGIN
+    SELECT h.first_id INTO NEW.first_id
+    FROM anomaly_history h
+    WHERE h.timestamp = NEW.timestamp
+    AND h.spacecraft_id = NEW.spacecraft_id
+    AND h.parameter_name = NEW.parameter_name
+    AND h.anomaly_type = NEW.anomaly_type
+    AND h.is_derived = NEW.is_derived
+    AND h.superseded_at IS NOT NULL
+    ORDER BY h.id DESC
+    LIMIT 1;
+    NEW.first_id := COALESCE(NEW.first_id, NEW.id);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP TRIGGER IF EXISTS trigger_link_anomaly_revision ON anomaly_history;
+CREATE TRIGGER trigger_link_anomaly_revision
+    BEFORE INSERT ON anomaly_history
+    FOR EACH ROW
+    EXECUTE FUNCTION link_anomaly_revision();
+
+
+-- Operator comments on anomalies and the audit trail of every acknowledgement
+-- change, used for shift handovers. anomaly_id is the revision commented on or
+-- changed; the thread and trail of an anomaly cover all its revisions.
+CREATE TABLE IF NOT EXISTS anomaly_comments (
+    id SERIAL PRIMARY KEY,
+    anomaly_id INTEGER NOT NULL,
+    author VARCHAR(100) NOT NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_anomaly_comments_anomaly ON anomaly_comments (anomaly_id, created_at);
+
+
+CREATE TABLE IF NOT EXISTS anomaly_audit (
+    id SERIAL PRIMARY KEY,
+    anomaly_id INTEGER NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    operator VARCHAR(100) NOT NULL,
+    note TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_anomaly_audit_anomaly ON anomaly_audit (anomaly_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_anomaly_audit_created ON anomaly_audit (created_at DESC);
+
+
+-- Admin jobs that re-run classify_telemetry() over historical data.
+CREATE TABLE IF NOT EXISTS reprocess_jobs (
+    id SERIAL PRIMARY KEY,
+    start_time TIMESTAMPTZ NOT NULL,
+    end_time TIMESTAMPTZ NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING',
+    total_rows INTEGER NOT NULL DEFAULT 0,
+    processed_rows INTEGER NOT NULL DEFAULT 0,
+    anomaly_rows INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    requested_by VARCHAR(100),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+
+-- At most one job is pending or running at a time. The process running a job
+-- holds a session advisory lock on it, so a job whose lock is free has been
+-- orphaned by a process that died.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_reprocess_jobs_active ON reprocess_jobs ((TRUE))
+WHERE status IN ('PENDING', 'RUNNING');
+
+
+-- Files of recorded packets or CSV loaded by `telemetry-ingestion import` or
+-- its upload endpoint. Telemetry and anomalies from an import carry its id.
+CREATE TABLE IF NOT EXISTS telemetry_imports (
+    id SERIAL PRIMARY KEY,
+    file_name TEXT,
+    file_sha256 CHAR(64),
+    format VARCHAR(10) NOT NULL,
+    spacecraft_id INTEGER NOT NULL,
+    station VARCHAR(50),
+    status VARCHAR(20) NOT NULL DEFAULT 'RUNNING',
+    accepted INTEGER NOT NULL DEFAULT 0,
+    duplicate INTEGER NOT NULL DEFAULT 0,
+    rejected INTEGER NOT NULL DEFAULT 0,
+    skipped INTEGER NOT NULL DEFAULT 0,
+    first_timestamp TIMESTAMPTZ,
+    last_timestamp TIMESTAMPTZ,
+    error TEXT,
+    imported_by VARCHAR(100),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_telemetry_imports_sha256 ON telemetry_imports (file_sha256);
+
+
+-- Ground stations packets are received from. Stations are configured through
+-- the API or registered by telemetry-ingestion the first time they are seen,
+-- named by a station header or after the sender's address (origin). Datagrams
+-- from within address are attributed to the station.
+CREATE TABLE IF NOT EXISTS ground_stations (
+    id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(100),
+    address CIDR,
+    description TEXT,
+    origin VARCHAR(20) NOT NULL DEFAULT 'configured',
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+
+-- One row per packet, keyed on what identifies it on board. Redundant ground
+-- stations deliver the same packets; telemetry-ingestion keeps a single
+-- telemetry row per key, from the station whose copy had the best quality
+-- (0 = failed packet error control, 1 = unchecked, 2 = verified).
+CREATE TABLE IF NOT EXISTS telemetry_packets (
+    spacecraft_id INTEGER NOT NULL,
+    apid INTEGER NOT NULL,
+    seq_count INTEGER NOT NULL,
+    onboard_time TIMESTAMPTZ NOT NULL,
+    telemetry_id INTEGER,
+    telemetry_timestamp TIMESTAMPTZ,
+    station VARCHAR(50) NOT NULL,
+    quality SMALLINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (spacecraft_id, apid, seq_count, onboard_time)
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_telemetry_packets_telemetry ON telemetry_packets (telemetry_id, telemetry_timestamp);
+
+
+SELECT create_hypertable('telemetry_packets', 'onboard_time', if_not_exists => TRUE);
+
+
+-- Every copy of a packet received, by station. outcome is STORED for the
+-- first copy, REPLACED for a better copy that took the stored one's place
+-- and DUPLICATE for the rest.
+CREATE TABLE IF NOT EXISTS packet_receptions (
+    id SERIAL,
+    received_at TIMESTAMPTZ NOT NULL,
+    spacecraft_id INTEGER NOT NULL,
+    apid INTEGER NOT NULL,
+    seq_count INTEGER NOT NULL,
+    onboard_time TIMESTAMPTZ NOT NULL,
+    station VARCHAR(50) NOT NULL,
+    quality SMALLINT NOT NULL,
+    outcome VARCHAR(20) NOT NULL,
+    import_id INTEGER,
+    source_address INET,
+    earth_received_at TIMESTAMPTZ,
+    rssi_dbm REAL,
+    snr_db REAL,
+    corrected_bits INTEGER,
+    pass_id INTEGER,
+    PRIMARY KEY (id, received_at)
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_packet_receptions_station ON packet_receptions (station, received_at DESC);
+CREATE INDEX IF NOT EXISTS idx_packet_receptions_packet ON packet_receptions (spacecraft_id, apid, seq_count, onboard_time);
+CREATE INDEX IF NOT EXISTS idx_packet_receptions_pass ON packet_receptions (pass_id);
+
+
+SELECT create_hypertable('packet_receptions', 'received_at', if_not_exists => TRUE);
+
+
+-- Datagrams that could not be decoded, for per-station error rates.
+CREATE TABLE IF NOT EXISTS rejected_packets (
+    id SERIAL,
+    received_at TIMESTAMPTZ NOT NULL,
+    station VARCHAR(50) NOT NULL,
+    source_address INET,
+    length INTEGER NOT NULL,
+    error TEXT NOT NULL,
+    PRIMARY KEY (id, received_at)
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_rejected_packets_station ON rejected_packets (station, received_at DESC);
+
+
+SELECT create_hypertable('rejected_packets', 'received_at', if_not_exists => TRUE);
+
+
+-- Contacts between a spacecraft and a ground station, inferred from the
+-- packets the station receives. A packet joins a pass when its earth-received
+-- time falls within pass_silence() of the pass; otherwise it opens a new one
+-- (acquisition of signal). A pass closes once nothing has been received for
+-- pass_silence(), and its los_at (loss of signal) is the time of its last
+-- packet. lost_packets counts sequence counts skipped within the pass.
+CREATE TABLE IF NOT EXISTS passes (
+    id SERIAL PRIMARY KEY,
+    spacecraft_id INTEGER NOT NULL,
+    station VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'OPEN',
+    aos_at TIMESTAMPTZ NOT NULL,
+    last_packet_at TIMESTAMPTZ NOT NULL,
+    los_at TIMESTAMPTZ,
+    packet_count INTEGER NOT NULL DEFAULT 0,
+    lost_packets INTEGER NOT NULL DEFAULT 0,
+    anomaly_count INTEGER NOT NULL DEFAULT 0,
+    min_signal_strength REAL,
+    max_signal_strength REAL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_passes_key ON passes (spacecraft_id, station, last_packet_at DESC);
+CREATE INDEX IF NOT EXISTS idx_passes_status ON passes (status, aos_at DESC);
+CREATE INDEX IF NOT EXISTS idx_passes_aos ON passes (aos_at DESC);
+
+
+CREATE OR REPLACE FUNCTION pass_silence()
+RETURNS INTERVAL AS $$
+    SELECT INTERVAL '30 seconds';
+$$ LANGUAGE sql IMMUTABLE;
+
+
+-- Called by telemetry-ingestion for every copy of a packet a station
+-- receives. Returns the id of the pass the packet belongs to.
+CREATE OR REPLACE FUNCTION record_pass_packet(
+    p_spacecraft_id INTEGER,
+    p_station VARCHAR,
+    p_at TIMESTAMPTZ,
+    p_signal REAL,
+    p_anomaly BOOLEAN
+)
+RETURNS INTEGER AS $$
+DECLARE
+    gap INTERVAL := pass_silence();
+    pass passes%ROWTYPE;
+    last_packet TIMESTAMPTZ;
+BEGIN
+    -- Packets of a station are assigned one at a time, so concurrent
+    -- packets cannot open two passes.
+    PERFORM pg_advisory_xact_lock(p_spacecraft_id, hashtext(p_station));
+
+    SELECT * INTO pass
+    FROM passes
+    WHERE spacecraft_id = p_spacecraft_id
+    AND station = p_station
+    AND p_at BETWEEN aos_at - gap AND last_packet_at + gap
+    ORDER BY last_packet_at DESC
+    LIMIT 1
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        INSERT INTO passes (
+            spacecraft_id, station, status, aos_at, last_packet_at, los_at,
+            packet_count, anomaly_count, min_signal_strength, max_signal_strength
+        ) VALUES (
+            p_spacecraft_id, p_station,
+            CASE WHEN p_at < NOW() - gap THEN 'CLOSED' ELSE 'OPEN' END,
+            p_at, p_at,
+            CASE WHEN p_at < NOW() - gap THEN p_at END,
+            1, CASE WHEN p_anomaly THEN 1 ELSE 0 END, p_signal, p_signal
+        )
+        RETURNING id INTO pass.id;
+        RETURN pass.id;
     END IF;
 
+    last_packet := GREATEST(pass.last_packet_at, p_at);
 
-    IF anomaly_detected THEN
-        NEW.is_anomaly := TRUE;
-        NEW.anomaly_type := anomaly_type_val;
-        
+    UPDATE passes SET
+        aos_at = LEAST(aos_at, p_at),
+        last_packet_at = last_packet,
+        status = CASE WHEN last_packet < NOW() - gap THEN 'CLOSED' ELSE 'OPEN' END,
+        los_at = CASE WHEN last_packet < NOW() - gap THEN last_packet END,
+        packet_count = packet_count + 1,
+        anomaly_count = anomaly_count + CASE WHEN p_anomaly THEN 1 ELSE 0 END,
+        min_signal_strength = LEAST(min_signal_strength, p_signal),
+        max_signal_strength = GREATEST(max_signal_strength, p_signal),
+        updated_at = NOW()
+    WHERE id = pass.id;
+
+    RETURN pass.id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Called periodically by telemetry-api, so passes close even when ingestion
+-- has stopped receiving altogether.
+CREATE OR REPLACE FUNCTION close_stale_passes()
+RETURNS INTEGER AS $$
+    WITH closed AS (
+        UPDATE passes
+        SET status = 'CLOSED', los_at = last_packet_at, updated_at = NOW()
+        WHERE status = 'OPEN'
+        AND last_packet_at < NOW() - pass_silence()
+        RETURNING id
+    )
+    SELECT COUNT(*)::INTEGER FROM closed;
+$$ LANGUAGE sql;
+
+
+-- Spacecraft clock correlation. telemetry-ingestion samples pairs of a
+-- packet's onboard time and the ground time it was sent at, its earth-received
+-- time less the one-way light time. telemetry-api periodically fits the
+-- samples of each spacecraft to an offset and a drift, corrects the onboard
+-- times of stored telemetry with the fit and raises a clock_drift anomaly when
+-- the drift is outside its parameter_limits.
+CREATE TABLE IF NOT EXISTS clock_samples (
+    id SERIAL PRIMARY KEY,
+    spacecraft_id INTEGER NOT NULL,
+    station VARCHAR(50),
+    onboard_time TIMESTAMPTZ NOT NULL,
+    earth_received_at TIMESTAMPTZ NOT NULL,
+    light_time_seconds DOUBLE PRECISION NOT NULL,
+    offset_seconds DOUBLE PRECISION NOT NULL,
+    telemetry_id INTEGER NOT NULL,
+    telemetry_timestamp TIMESTAMPTZ NOT NULL,
+    import_id INTEGER,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_clock_samples_key ON clock_samples (spacecraft_id, onboard_time DESC);
+
+
+-- A model maps onboard time t to ground time
+-- t + offset_seconds + drift_ppm * 1e-6 * (t - reference_time).
+CREATE TABLE IF NOT EXISTS clock_models (
+    id SERIAL PRIMARY KEY,
+    spacecraft_id INTEGER NOT NULL,
+    reference_time TIMESTAMPTZ NOT NULL,
+    offset_seconds DOUBLE PRECISION NOT NULL,
+    drift_ppm DOUBLE PRECISION NOT NULL,
+    sample_count INTEGER NOT NULL,
+    first_sample_at TIMESTAMPTZ NOT NULL,
+    last_sample_id INTEGER NOT NULL,
+    rms_residual_seconds DOUBLE PRECISION NOT NULL,
+    max_residual_seconds DOUBLE PRECISION NOT NULL,
+    drift_exceeded BOOLEAN NOT NULL DEFAULT FALSE,
+    fitted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_clock_models_key ON clock_models (spacecraft_id, fitted_at DESC);
+
+
+INSERT INTO parameter_limits (
+    parameter_name, low_threshold, low_anomaly_type, high_threshold, high_anomaly_type, priority
+) VALUES
+    ('clock_drift', -20.0, 'CLOCK_DRIFT', 20.0, 'CLOCK_DRIFT', 0)
+ON CONFLICT (parameter_name) DO NOTHING;
+
+
+-- Ground time of an onboard time by the latest model of the spacecraft, or
+-- the onboard time itself before the first fit.
+CREATE OR REPLACE FUNCTION correct_onboard_time(p_spacecraft_id INTEGER, p_onboard TIMESTAMPTZ)
+RETURNS TIMESTAMPTZ AS $$
+    SELECT COALESCE((
+        SELECT p_onboard + make_interval(secs => m.offset_seconds
+            + m.drift_ppm * 1e-6 * EXTRACT(EPOCH FROM p_onboard - m.reference_time))
+        FROM clock_models m
+        WHERE m.spacecraft_id = p_spacecraft_id
+        ORDER BY m.fitted_at DESC, m.id DESC
+        LIMIT 1
+    ), p_onboard);
+$$ LANGUAGE sql STABLE;
+
+
+-- Called periodically by telemetry-api. Fits the samples within p_window of
+-- the latest one by least squares, applies the model to stored telemetry from
+-- the first sample on and returns its id, or NULL when there is nothing new
+-- to fit or too few samples.
+CREATE OR REPLACE FUNCTION fit_clock_model(
+    p_spacecraft_id INTEGER,
+    p_window INTERVAL,
+    p_min_samples INTEGER
+)
+RETURNS INTEGER AS $$
+DECLARE
+    latest clock_samples%ROWTYPE;
+    fit RECORD;
+    residual RECORD;
+    alarm RECORD;
+    exceeded BOOLEAN;
+    model_id INTEGER;
+BEGIN
+    SELECT * INTO latest
+    FROM clock_samples
+    WHERE spacecraft_id = p_spacecraft_id
+    ORDER BY onboard_time DESC, id DESC
+    LIMIT 1;
+
+    IF NOT FOUND OR EXISTS (
+        SELECT 1 FROM clock_models
+        WHERE spacecraft_id = p_spacecraft_id
+        AND last_sample_id >= (SELECT MAX(id) FROM clock_samples WHERE spacecraft_id = p_spacecraft_id)
+    ) THEN
+        RETURN NULL;
+    END IF;
+
+    -- Offsets are regressed on seconds since the latest sample, so the
+    -- intercept is the offset at reference_time.
+    SELECT regr_intercept(s.offset_seconds, s.x) AS offset_seconds,
+           regr_slope(s.offset_seconds, s.x) AS drift,
+           COUNT(*) AS sample_count,
+           MIN(s.onboard_time) AS first_sample_at,
+           MIN(s.telemetry_timestamp) AS first_stored_at,
+           MAX(s.id) AS last_sample_id
+    INTO fit
+    FROM (
+        SELECT id, onboard_time, telemetry_timestamp, offset_seconds,
+               EXTRACT(EPOCH FROM onboard_time - latest.onboard_time)::DOUBLE PRECISION AS x
+        FROM clock_samples
+        WHERE spacecraft_id = p_spacecraft_id
+        AND onboard_time > latest.onboard_time - p_window
+    ) s;
+
+    IF fit.sample_count < p_min_samples OR fit.drift IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT COALESCE(sqrt(AVG(r * r)), 0) AS rms, COALESCE(MAX(ABS(r)), 0) AS max
+    INTO residual
+    FROM (
+        SELECT offset_seconds - fit.offset_seconds
+               - fit.drift * EXTRACT(EPOCH FROM onboard_time - latest.onboard_time)::DOUBLE PRECISION AS r
+        FROM clock_samples
+        WHERE spacecraft_id = p_spacecraft_id
+        AND onboard_time > latest.onboard_time - p_window
+    ) s;
+
+    SELECT * INTO alarm FROM classify_parameter('clock_drift', (fit.drift * 1e6)::REAL);
+    exceeded := FOUND;
+
+    INSERT INTO clock_models (
+        spacecraft_id, reference_time, offset_seconds, drift_ppm, sample_count, first_sample_at,
+        last_sample_id, rms_residual_seconds, max_residual_seconds, drift_exceeded
+    ) VALUES (
+        p_spacecraft_id, latest.onboard_time, fit.offset_seconds, fit.drift * 1e6, fit.sample_count,
+        fit.first_sample_at, fit.last_sample_id, residual.rms, residual.max, exceeded
+    )
+    RETURNING id INTO model_id;
+
+    IF exceeded THEN
         INSERT INTO anomaly_history (
-            telemetry_id, telemetry_timestamp, timestamp, anomaly_type, parameter_name, 
-            parameter_value, threshold_value
+            telemetry_id, telemetry_timestamp, timestamp, spacecraft_id, anomaly_type, parameter_name,
+            parameter_value, threshold_value, severity, is_derived
         ) VALUES (
-            NEW.id, NEW.timestamp, NEW.timestamp, anomaly_type_val, param_name,
-            CASE 
-                WHEN param_name = 'temperature' THEN NEW.temperature
-                WHEN param_name = 'battery' THEN NEW.battery
-                WHEN param_name = 'altitude' THEN NEW.altitude
-                WHEN param_name = 'signal_strength' THEN NEW.signal_strength
-            END,
-            threshold_val
+            latest.telemetry_id, latest.telemetry_timestamp, latest.telemetry_timestamp, p_spacecraft_id,
+            alarm.anomaly_type, 'clock_drift', (fit.drift * 1e6)::REAL, alarm.threshold_value,
+            alarm.severity, TRUE
         );
     END IF;
 
-    RETURN NEW;
+    UPDATE telemetry
+    SET corrected_time = onboard_time + make_interval(secs => fit.offset_seconds
+        + fit.drift * EXTRACT(EPOCH FROM onboard_time - latest.onboard_time)::DOUBLE PRECISION)
+    WHERE spacecraft_id = p_spacecraft_id
+    AND timestamp >= fit.first_stored_at
+    AND onboard_time >= fit.first_sample_at;
+
+    RETURN model_id;
 END;
 $$ LANGUAGE plpgsql;
 
 
-DROP TRIGGER IF EXISTS trigger_detect_anomaly ON telemetry;
-CREATE TRIGGER trigger_detect_anomaly
-    BEFORE INSERT ON telemetry
+-- ECSS PUS-C services. Housekeeping reports (ST[3]) are stored as telemetry
+-- with their structure; the parameters of a structure are listed in the order
+-- their values appear in a report and must be the downlinked parameters.
+CREATE TABLE IF NOT EXISTS housekeeping_structures (
+    structure_id INTEGER PRIMARY KEY,
+    parameters TEXT[] NOT NULL,
+    description TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+INSERT INTO housekeeping_structures (structure_id, parameters, description) VALUES
+    (1, ARRAY['temperature', 'battery', 'altitude', 'signal_strength'], 'Platform status')
+ON CONFLICT (structure_id) DO NOTHING;
+
+
+CREATE INDEX IF NOT EXISTS idx_telemetry_housekeeping ON telemetry (housekeeping_structure_id, timestamp DESC)
+    WHERE housekeeping_structure_id IS NOT NULL;
+
+
+-- Onboard events: packets of the event APID and ST[5] event reports, keyed
+-- like telemetry_packets. timestamp is the onboard time and severity is INFO,
+-- LOW, MEDIUM or HIGH. telemetry-ingestion formats message from the template
+-- of event_id in event_dictionary when it stores the event; text events have
+-- event_id 0 and no name. data is the auxiliary data of an ST[5] report.
+CREATE TABLE IF NOT EXISTS event_dictionary (
+    event_id INTEGER PRIMARY KEY CHECK (event_id > 0),
+    name VARCHAR(100) NOT NULL UNIQUE,
+    message TEXT NOT NULL,
+    description TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+INSERT INTO event_dictionary (event_id, name, message, description) VALUES
+    (1, 'HEATER_ON', 'Heater {0} on', 'A thermal control heater was switched on'),
+    (2, 'HEATER_OFF', 'Heater {0} off', 'A thermal control heater was switched off'),
+    (3, 'SAFE_MODE_ENTERED', 'Safe mode entered, battery at {0}%', 'The spacecraft entered safe mode'),
+    (4, 'SAFE_MODE_EXITED', 'Safe mode exited', 'The spacecraft resumed nominal operations'),
+    (5, 'OVERTEMPERATURE', 'Temperature {0} C above limit {1} C', 'A temperature exceeded its onboard limit'),
+    (6, 'LOW_SIGNAL', 'Downlink signal degraded to {0} dB', 'The downlink signal fell below its onboard limit')
+ON CONFLICT (event_id) DO NOTHING;
+
+
+CREATE TABLE IF NOT EXISTS events (
+    id SERIAL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    spacecraft_id INTEGER NOT NULL,
+    apid INTEGER NOT NULL,
+    seq_count INTEGER NOT NULL,
+    subsystem_id INTEGER NOT NULL,
+    severity VARCHAR(20) NOT NULL,
+    event_id INTEGER NOT NULL,
+    name VARCHAR(100),
+    message TEXT NOT NULL,
+    arguments REAL[],
+    data BYTEA,
+    station VARCHAR(50) NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    import_id INTEGER,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (spacecraft_id, apid, seq_count, timestamp)
+);
+
+
+-- The text that event searches match, with the name's words split on
+-- underscores. The simple configuration keeps words such as on and off,
+-- which English drops as stop words.
+CREATE OR REPLACE FUNCTION event_search_document(name_val VARCHAR, message_val TEXT)
+RETURNS TSVECTOR AS $$
+    SELECT to_tsvector('simple', replace(COALESCE(name_val, ''), '_', ' ') || ' ' || message_val);
+$$ LANGUAGE sql IMMUTABLE;
+
+
+CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events (timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_events_event ON events (event_id, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_events_severity ON events (severity, timestamp DESC);
+CREATE INDEX IF NOT EXISTS idx_events_text_search ON events USING GIN (event_search_document(name, message));
+
+
+SELECT create_hypertable('events', 'timestamp', if_not_exists => TRUE);
+
+
+-- Telecommands tracked through their request verification reports (ST[1]).
+-- A report joins the command with its request ID (APID and sequence count)
+-- whose reports are within command_gap() of it; otherwise it opens a new one,
+-- as sequence counts wrap. status follows the latest stage reported and a
+-- failure at any stage is final.
+CREATE TABLE IF NOT EXISTS commands (
+    id SERIAL PRIMARY KEY,
+    spacecraft_id INTEGER NOT NULL,
+    request_apid INTEGER NOT NULL,
+    request_seq_count INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    stage VARCHAR(20) NOT NULL,
+    failure_code INTEGER,
+    report_count INTEGER NOT NULL DEFAULT 0,
+    first_report_at TIMESTAMPTZ NOT NULL,
+    last_report_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_commands_key ON commands (spacecraft_id, request_apid, request_seq_count, last_report_at DESC);
+CREATE INDEX IF NOT EXISTS idx_commands_status ON commands (status, last_report_at DESC);
+
+
+CREATE TABLE IF NOT EXISTS command_verifications (
+    id SERIAL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    spacecraft_id INTEGER NOT NULL,
+    apid INTEGER NOT NULL,
+    seq_count INTEGER NOT NULL,
+    command_id INTEGER,
+    request_apid INTEGER NOT NULL,
+    request_seq_count INTEGER NOT NULL,
+    stage VARCHAR(20) NOT NULL,
+    success BOOLEAN NOT NULL,
+    step_id INTEGER,
+    failure_code INTEGER,
+    failure_data BYTEA,
+    station VARCHAR(50) NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    import_id INTEGER,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (spacecraft_id, apid, seq_count, timestamp)
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_command_verifications_command ON command_verifications (command_id, timestamp);
+
+
+CREATE OR REPLACE FUNCTION command_gap()
+RETURNS INTERVAL AS $$
+    SELECT INTERVAL '1 hour';
+$$ LANGUAGE sql IMMUTABLE;
+
+
+CREATE OR REPLACE FUNCTION verification_stage_rank(stage_val VARCHAR)
+RETURNS INTEGER AS $$
+    SELECT CASE stage_val
+        WHEN 'ACCEPTANCE' THEN 1
+        WHEN 'START' THEN 2
+        WHEN 'PROGRESS' THEN 3
+        WHEN 'COMPLETION' THEN 4
+        ELSE 0
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+
+-- Runs after insert so that duplicate reports, which ON CONFLICT DO NOTHING
+-- skips, are not counted.
+CREATE OR REPLACE FUNCTION track_command()
+RETURNS TRIGGER AS $$
+DECLARE
+    cmd RECORD;
+    new_status VARCHAR(20);
+    cmd_id INTEGER;
+BEGIN
+    new_status := CASE
+        WHEN NOT NEW.success THEN 'FAILED'
+        WHEN NEW.stage = 'ACCEPTANCE' THEN 'ACCEPTED'
+        WHEN NEW.stage = 'START' THEN 'STARTED'
+        WHEN NEW.stage = 'PROGRESS' THEN 'IN_PROGRESS'
+        ELSE 'COMPLETED'
+    END;
+
+    SELECT * INTO cmd
+    FROM commands
+    WHERE spacecraft_id = NEW.spacecraft_id
+    AND request_apid = NEW.request_apid
+    AND request_seq_count = NEW.request_seq_count
+    AND NEW.timestamp BETWEEN first_report_at - command_gap() AND last_report_at + command_gap()
+    ORDER BY last_report_at DESC
+    LIMIT 1
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        INSERT INTO commands (
+            spacecraft_id, request_apid, request_seq_count, status, stage, failure_code,
+            report_count, first_report_at, last_report_at
+        ) VALUES (
+            NEW.spacecraft_id, NEW.request_apid, NEW.request_seq_count, new_status, NEW.stage,
+            NEW.failure_code, 1, NEW.timestamp, NEW.timestamp
+        )
+        RETURNING id INTO cmd_id;
+    ELSE
+        cmd_id := cmd.id;
+        UPDATE commands SET
+            status = CASE
+                WHEN status = 'FAILED' THEN status
+                WHEN new_status = 'FAILED'
+                    OR verification_stage_rank(NEW.stage) >= verification_stage_rank(stage) THEN new_status
+                ELSE status
+            END,
+            stage = CASE
+                WHEN status = 'FAILED' THEN stage
+                WHEN new_status = 'FAILED'
+                    OR verification_stage_rank(NEW.stage) >= verification_stage_rank(stage) THEN NEW.stage
+                ELSE stage
+            END,
+            failure_code = CASE
+                WHEN status <> 'FAILED' AND new_status = 'FAILED' THEN NEW.failure_code
+                ELSE failure_code
+            END,
+            report_count = report_count + 1,
+            first_report_at = LEAST(first_report_at, NEW.timestamp),
+            last_report_at = GREATEST(last_report_at, NEW.timestamp),
+            updated_at = NOW()
+        WHERE id = cmd_id;
+    END IF;
+
+    UPDATE command_verifications SET command_id = cmd_id
+    WHERE spacecraft_id = NEW.spacecraft_id AND apid = NEW.apid
+    AND seq_count = NEW.seq_count AND timestamp = NEW.timestamp;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP TRIGGER IF EXISTS trigger_track_command ON command_verifications;
+CREATE TRIGGER trigger_track_command
+    AFTER INSERT ON command_verifications
     FOR EACH ROW
-    EXECUTE FUNCTION detect_anomaly();
+    EXECUTE FUNCTION track_command();
+
+
+-- Wake the notifier when a live anomaly is recorded. Reprocessed revisions
+-- and imports describe historical data and suppressed anomalies are
+-- silenced, so none of them is announced.
+CREATE OR REPLACE FUNCTION notify_anomaly()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('anomaly_created', NEW.id::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS anomaly_notify_trigger ON anomaly_history;
+CREATE TRIGGER anomaly_notify_trigger
+    AFTER INSERT ON anomaly_history
+    FOR EACH ROW
+    WHEN (NEW.reprocess_job_id IS NULL AND NEW.import_id IS NULL AND NOT NEW.suppressed)
+    EXECUTE FUNCTION notify_anomaly();
+
+
+-- Wake telemetry-api stream clients after new telemetry or anomaly rows.
+-- Statement-level, so a multi-row insert sends a single notification. Clients
+-- read rows by stream_xid, the transaction that inserted them, rather than by
+-- id, as concurrent transactions commit ids out of order.
+CREATE OR REPLACE FUNCTION notify_stream()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('telemetry_stream', TG_TABLE_NAME);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS telemetry_stream_trigger ON telemetry;
+CREATE TRIGGER telemetry_stream_trigger
+    AFTER INSERT ON telemetry
+    FOR EACH STATEMENT
+    EXECUTE FUNCTION notify_stream();
+
+DROP TRIGGER IF EXISTS anomaly_stream_trigger ON anomaly_history;
+CREATE TRIGGER anomaly_stream_trigger
+    AFTER INSERT ON anomaly_history
+    FOR EACH STATEMENT
+    EXECUTE FUNCTION notify_stream();
+
+
+-- One row per channel delivery made by telemetry-notifier.
+CREATE TABLE IF NOT EXISTS notification_log (
+    id SERIAL PRIMARY KEY,
+    anomaly_id INTEGER NOT NULL,
+    route VARCHAR(100) NOT NULL,
+    channel VARCHAR(100) NOT NULL,
+    escalation BOOLEAN NOT NULL DEFAULT FALSE,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    -- When the route escalates the anomaly if it is still unacknowledged;
+    -- read back on startup so pending escalations survive a restart.
+    due_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+
+CREATE INDEX IF NOT EXISTS idx_notification_log_anomaly ON notification_log (anomaly_id);
+CREATE INDEX IF NOT EXISTS idx_notification_log_due ON notification_log (due_at) WHERE due_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_notification_log_created ON notification_log (created_at DESC);
+
+
+-- Position of the notifier in anomaly_history, the stream_xid and id of the
+-- last anomaly read, so restarts neither replay old anomalies nor miss ones
+-- recorded while it was down.
+CREATE TABLE IF NOT EXISTS notifier_state (
+    name VARCHAR(50) PRIMARY KEY,
+    last_xid XID8 NOT NULL,
+    last_id INTEGER NOT NULL
+);
 
 
 GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA public TO telemetry_user;
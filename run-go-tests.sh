@@ -25,6 +25,8 @@ run_and_report() {
 }
 
 run_and_report telemetry-api
+run_and_report telemetry-ingestion
+run_and_report telemetry-notifier
 run_and_report telemetry-generator
 
 echo "All Go unit tests completed." 
\ No newline at end of file
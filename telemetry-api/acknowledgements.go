@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+type AcknowledgeRequest struct {
+	IDs        []int  `json:"ids"`
+	IncidentID int    `json:"incident_id"`
+	Operator   string `json:"operator"`
+	Note       string `json:"note"`
+}
+
+type AcknowledgeResult struct {
+	Updated   []int `json:"updated"`
+	Unchanged []int `json:"unchanged"`
+}
+
+type AnomalyComment struct {
+	ID        int       `json:"id"`
+	AnomalyID int       `json:"anomaly_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CommentRequest struct {
+	Author string `json:"author"`
+	Body   string `json:"body"`
+}
+
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	AnomalyID int       `json:"anomaly_id"`
+	Action    string    `json:"action"`
+	Operator  string    `json:"operator"`
+	Note      *string   `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const maxAcknowledgeBatch = 1000
+
+// anomalyRevisionIDs selects the ids of every revision of the anomaly with
+// id $1, so comments and the audit trail survive reprocessing and replaced
+// copies.
+const anomalyRevisionIDs = `
+	SELECT r.id
+	FROM anomaly_history a
+	JOIN anomaly_history r ON r.first_id = a.first_id
+	WHERE a.id = $1
+`
+
+// setAcknowledged changes the acknowledgement state of the current revision of
+// each anomaly and writes one audit row per anomaly that actually changed.
+func setAcknowledged(ids []int, acknowledged bool, operator, note string) (AcknowledgeResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return AcknowledgeResult{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := updateAcknowledgements(tx, ids, acknowledged, operator, note)
+	if err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// updateAcknowledgements makes the changes of setAcknowledged within tx.
+func updateAcknowledgements(tx *sql.Tx, ids []int, acknowledged bool, operator, note string) (AcknowledgeResult, error) {
+	result := AcknowledgeResult{Updated: make([]int, 0), Unchanged: make([]int, 0)}
+
+	var rows *sql.Rows
+	var err error
+	if acknowledged {
+		rows, err = tx.Query(`
+			UPDATE anomaly_history
+			SET acknowledged = TRUE, acknowledged_at = NOW(),
+				acknowledged_by = $2, acknowledgement_note = NULLIF($3, '')
+			WHERE id = ANY($1) AND superseded_at IS NULL AND NOT acknowledged
+			RETURNING id
+		`, pq.Array(ids), operator, note)
+	} else {
+		rows, err = tx.Query(`
+			UPDATE anomaly_history
+			SET acknowledged = FALSE, acknowledged_at = NULL,
+				acknowledged_by = NULL, acknowledgement_note = NULL
+			WHERE id = ANY($1) AND superseded_at IS NULL AND acknowledged
+			RETURNING id
+		`, pq.Array(ids))
+	}
+	if err != nil {
+		return result, err
+	}
+
+	updated := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return result, err
+		}
+		updated[id] = true
+		result.Updated = append(result.Updated, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	action := "ACKNOWLEDGE"
+	if !acknowledged {
+		action = "UNACKNOWLEDGE"
+	}
+	if len(result.Updated) > 0 {
+		_, err = tx.Exec(`
+			INSERT INTO anomaly_audit (anomaly_id, action, operator, note)
+			SELECT unnest($1::int[]), $2, $3, NULLIF($4, '')
+		`, pq.Array(result.Updated), action, operator, note)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for _, id := range ids {
+		if !updated[id] {
+			result.Unchanged = append(result.Unchanged, id)
+		}
+	}
+	return result, nil
+}
+
+// anomalyIDsForRequest resolves the anomalies targeted by a bulk request,
+// either listed explicitly or all current rows of an incident.
+func anomalyIDsForRequest(req AcknowledgeRequest) ([]int, error) {
+	ids := req.IDs
+	if req.IncidentID != 0 {
+		rows, err := db.Query(`
+			SELECT id FROM anomaly_history
+			WHERE incident_id = $1 AND superseded_at IS NULL
+		`, req.IncidentID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func validateAcknowledgeRequest(req AcknowledgeRequest, bulk bool) error {
+	if strings.TrimSpace(req.Operator) == "" {
+		return invalidField("operator", "operator is required")
+	}
+	if bulk && len(req.IDs) == 0 && req.IncidentID == 0 {
+		return invalidField("ids", "ids or incident_id is required")
+	}
+	if len(req.IDs) > maxAcknowledgeBatch {
+		return invalidField("ids", "at most %d ids per request", maxAcknowledgeBatch)
+	}
+	return nil
+}
+
+func acknowledgeAnomalies(c *fiber.Ctx) error {
+	return changeAcknowledgements(c, true)
+}
+
+func unacknowledgeAnomalies(c *fiber.Ctx) error {
+	return changeAcknowledgements(c, false)
+}
+
+func changeAcknowledgements(c *fiber.Ctx, acknowledged bool) error {
+	var req AcknowledgeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+	if err := validateAcknowledgeRequest(req, true); err != nil {
+		return sendError(c, err)
+	}
+
+	ids, err := anomalyIDsForRequest(req)
+	if err != nil {
+		return sendError(c, internalError("Failed to resolve anomalies", err))
+	}
+	if len(ids) > maxAcknowledgeBatch {
+		field := "ids"
+		if len(req.IDs) == 0 {
+			field = "incident_id"
+		}
+		return sendError(c, invalidField(field, "request covers %d anomalies; at most %d per request", len(ids), maxAcknowledgeBatch))
+	}
+
+	result, err := setAcknowledged(ids, acknowledged, req.Operator, req.Note)
+	if err != nil {
+		return sendError(c, internalError("Failed to update acknowledgements", err))
+	}
+
+	return c.JSON(result)
+}
+
+func acknowledgeAnomaly(c *fiber.Ctx) error {
+	return changeAcknowledgement(c, true)
+}
+
+func unacknowledgeAnomaly(c *fiber.Ctx) error {
+	return changeAcknowledgement(c, false)
+}
+
+func changeAcknowledgement(c *fiber.Ctx, acknowledged bool) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	var req AcknowledgeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+	if err := validateAcknowledgeRequest(req, false); err != nil {
+		return sendError(c, err)
+	}
+
+	if _, err := setAcknowledged([]int{id}, acknowledged, req.Operator, req.Note); err != nil {
+		return sendError(c, internalError("Failed to update acknowledgement", err))
+	}
+
+	anomaly, err := scanAnomaly(db.QueryRow(`
+		SELECT `+anomalyColumns+`
+		FROM anomaly_history
+		WHERE id = $1 AND superseded_at IS NULL
+	`, id))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Anomaly not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get anomaly", err))
+	}
+
+	return c.JSON(anomaly)
+}
+
+func getAnomalyComments(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, anomaly_id, author, body, created_at
+		FROM anomaly_comments
+		WHERE anomaly_id IN (`+anomalyRevisionIDs+`)
+		ORDER BY created_at ASC, id ASC
+	`, id)
+	if err != nil {
+		return sendError(c, internalError("Failed to query comments", err))
+	}
+	defer rows.Close()
+
+	comments := make([]AnomalyComment, 0)
+	for rows.Next() {
+		var cm AnomalyComment
+		if err := rows.Scan(&cm.ID, &cm.AnomalyID, &cm.Author, &cm.Body, &cm.CreatedAt); err != nil {
+			log.Printf("Error scanning comment row: %v", err)
+			continue
+		}
+		comments = append(comments, cm)
+	}
+
+	return c.JSON(comments)
+}
+
+func addAnomalyComment(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	var req CommentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+	if strings.TrimSpace(req.Author) == "" {
+		return sendError(c, invalidField("author", "author and body are required"))
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		return sendError(c, invalidField("body", "author and body are required"))
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM anomaly_history WHERE id = $1)`, id).Scan(&exists); err != nil {
+		return sendError(c, internalError("Failed to look up anomaly", err))
+	}
+	if !exists {
+		return sendError(c, notFound("Anomaly not found"))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return sendError(c, internalError("Failed to add comment", err))
+	}
+	defer tx.Rollback()
+
+	comment := AnomalyComment{AnomalyID: id, Author: req.Author, Body: req.Body}
+	err = tx.QueryRow(`
+		INSERT INTO anomaly_comments (anomaly_id, author, body)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, id, req.Author, req.Body).Scan(&comment.ID, &comment.CreatedAt)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO anomaly_audit (anomaly_id, action, operator, note)
+			VALUES ($1, 'COMMENT', $2, $3)
+		`, id, req.Author, req.Body)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to add comment", err))
+	}
+
+	return c.Status(201).JSON(comment)
+}
+
+func getAnomalyAudit(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	return queryAuditTrail(c, `
+		SELECT id, anomaly_id, action, operator, note, created_at
+		FROM anomaly_audit
+		WHERE anomaly_id IN (`+anomalyRevisionIDs+`)
+		ORDER BY created_at ASC, id ASC
+	`, id)
+}
+
+// getAuditTrail lists acknowledgement changes and comments across all
+// anomalies, newest first, for shift handovers.
+func getAuditTrail(c *fiber.Ctx) error {
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+	operator := c.Query("operator")
+
+	query := `
+		SELECT id, anomaly_id, action, operator, note, created_at
+		FROM anomaly_audit
+		WHERE 1=1
+	`
+	args := []interface{}{}
+	argCount := 0
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND created_at >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND created_at <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	if operator != "" {
+		argCount++
+		query += fmt.Sprintf(" AND operator = $%d", argCount)
+		args = append(args, operator)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	return queryAuditTrail(c, query, args...)
+}
+
+func queryAuditTrail(c *fiber.Ctx, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query audit trail", err))
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.AnomalyID, &e.Action, &e.Operator, &e.Note, &e.CreatedAt); err != nil {
+			log.Printf("Error scanning audit row: %v", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return c.JSON(entries)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAcknowledgeRequest(t *testing.T) {
+	assert.NoError(t, validateAcknowledgeRequest(AcknowledgeRequest{Operator: "alice"}, false))
+	assert.NoError(t, validateAcknowledgeRequest(AcknowledgeRequest{Operator: "alice", IDs: []int{1, 2}}, true))
+	assert.NoError(t, validateAcknowledgeRequest(AcknowledgeRequest{Operator: "alice", IncidentID: 3}, true))
+
+	app := fiber.New()
+	app.Post("/api/v1/telemetry/anomalies/acknowledge", acknowledgeAnomalies)
+	app.Post("/api/v1/telemetry/anomalies/:id/acknowledge", acknowledgeAnomaly)
+	app.Post("/api/v1/telemetry/anomalies/:id/comments", addAnomalyComment)
+
+	tooMany := strings.Repeat("1,", maxAcknowledgeBatch) + "1"
+	cases := []struct {
+		path  string
+		body  string
+		code  string
+		field string
+	}{
+		{"/api/v1/telemetry/anomalies/acknowledge", `{"operator": "  ", "ids": [1]}`, codeInvalidBody, "operator"},
+		{"/api/v1/telemetry/anomalies/acknowledge", `{"operator": "alice"}`, codeInvalidBody, "ids"},
+		{"/api/v1/telemetry/anomalies/acknowledge", `{"operator": "alice", "ids": [` + tooMany + `]}`, codeInvalidBody, "ids"},
+		{"/api/v1/telemetry/anomalies/acknowledge", `{"operator": `, codeInvalidBody, ""},
+		{"/api/v1/telemetry/anomalies/abc/acknowledge", `{"operator": "alice"}`, codeInvalidParameter, "id"},
+		{"/api/v1/telemetry/anomalies/5/acknowledge", `{"note": "looked at it"}`, codeInvalidBody, "operator"},
+		{"/api/v1/telemetry/anomalies/5/comments", `{"author": "alice"}`, codeInvalidBody, "body"},
+		{"/api/v1/telemetry/anomalies/5/comments", `{"body": "looked at it"}`, codeInvalidBody, "author"},
+	}
+	for _, tc := range cases {
+		requireAPIError(t, app, jsonRequest("POST", tc.path, tc.body), http.StatusBadRequest, tc.code, tc.field)
+	}
+}
+
+func TestUpdateAcknowledgementsAuditsChanges(t *testing.T) {
+	tx := testTx(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var ids []int
+	for i := 0; i < 2; i++ {
+		at := ts.Add(time.Duration(i) * time.Minute)
+		var id int
+		require.NoError(t, tx.QueryRow(`
+			SELECT id FROM anomaly_history WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+		`, insertTestTelemetry(t, tx, at, 36), at).Scan(&id))
+		ids = append(ids, id)
+	}
+	audit := func(id int) []string {
+		rows, err := tx.Query(`SELECT action FROM anomaly_audit WHERE anomaly_id = $1 ORDER BY id`, id)
+		require.NoError(t, err)
+		defer rows.Close()
+		var actions []string
+		for rows.Next() {
+			var action string
+			require.NoError(t, rows.Scan(&action))
+			actions = append(actions, action)
+		}
+		return actions
+	}
+
+	result, err := updateAcknowledgements(tx, ids[:1], true, "alice", "known heater cycle")
+	require.NoError(t, err)
+	assert.Equal(t, ids[:1], result.Updated)
+
+	// Only the anomaly that changed is audited.
+	result, err = updateAcknowledgements(tx, ids, true, "bob", "")
+	require.NoError(t, err)
+	assert.Equal(t, ids[1:], result.Updated)
+	assert.Equal(t, ids[:1], result.Unchanged)
+	assert.Equal(t, []string{"ACKNOWLEDGE"}, audit(ids[0]))
+	assert.Equal(t, []string{"ACKNOWLEDGE"}, audit(ids[1]))
+
+	var by, note sql.NullString
+	require.NoError(t, tx.QueryRow(`
+		SELECT acknowledged_by, acknowledgement_note FROM anomaly_history WHERE id = $1
+	`, ids[0]).Scan(&by, &note))
+	assert.Equal(t, "alice", by.String)
+	assert.Equal(t, "known heater cycle", note.String)
+
+	result, err = updateAcknowledgements(tx, ids[:1], false, "alice", "")
+	require.NoError(t, err)
+	assert.Equal(t, ids[:1], result.Updated)
+	assert.Equal(t, []string{"ACKNOWLEDGE", "UNACKNOWLEDGE"}, audit(ids[0]))
+
+	// Superseded revisions keep their state.
+	_, err = tx.Exec(`UPDATE anomaly_history SET superseded_at = NOW() WHERE id = $1`, ids[1])
+	require.NoError(t, err)
+	result, err = updateAcknowledgements(tx, ids[1:], false, "alice", "")
+	require.NoError(t, err)
+	assert.Empty(t, result.Updated)
+	assert.Equal(t, ids[1:], result.Unchanged)
+}
+
+func TestCommentsAndAuditFollowAnomalyRevisions(t *testing.T) {
+	tx := testTx(t)
+	from := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Minute)
+
+	telemetryID := insertTestTelemetry(t, tx, from, 36)
+	current := func() int {
+		var id int
+		require.NoError(t, tx.QueryRow(`
+			SELECT id FROM anomaly_history
+			WHERE telemetry_id = $1 AND telemetry_timestamp = $2 AND superseded_at IS NULL
+		`, telemetryID, from).Scan(&id))
+		return id
+	}
+	first := current()
+
+	_, err := updateAcknowledgements(tx, []int{first}, true, "alice", "")
+	require.NoError(t, err)
+	_, err = tx.Exec(`INSERT INTO anomaly_comments (anomaly_id, author, body) VALUES ($1, 'alice', 'heater cycle')`, first)
+	require.NoError(t, err)
+
+	_, err = tx.Exec(`UPDATE parameter_limits SET high_threshold = 34 WHERE parameter_name = 'temperature'`)
+	require.NoError(t, err)
+	_, _, err = reprocessRows(tx, 7, from, to)
+	require.NoError(t, err)
+	latest := current()
+	require.NotEqual(t, first, latest)
+
+	var comments int
+	require.NoError(t, tx.QueryRow(`
+		SELECT COUNT(*) FROM anomaly_comments WHERE anomaly_id IN (`+anomalyRevisionIDs+`)
+	`, latest).Scan(&comments))
+	assert.Equal(t, 1, comments, "the thread follows the new revision")
+
+	rows, err := tx.Query(`
+		SELECT action FROM anomaly_audit WHERE anomaly_id IN (`+anomalyRevisionIDs+`) ORDER BY id
+	`, first)
+	require.NoError(t, err)
+	defer rows.Close()
+	var actions []string
+	for rows.Next() {
+		var action string
+		require.NoError(t, rows.Scan(&action))
+		actions = append(actions, action)
+	}
+	assert.Equal(t, []string{"ACKNOWLEDGE", "CARRY_OVER"}, actions, "any revision returns the full trail")
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sourceRaw names the raw telemetry hypertable as an aggregation source.
+const sourceRaw = "raw"
+
+// Gap-fill modes for buckets without telemetry.
+const (
+	gapfillNull   = "null"
+	gapfillLOCF   = "locf"
+	gapfillLinear = "linear"
+)
+
+// maxRangeBuckets bounds the buckets a gap-filled query or a query over raw
+// samples may produce per subsystem and parameter.
+const maxRangeBuckets = 10000
+
+// aggregateView is a continuous aggregate of telemetry with the same columns
+// as telemetry_hourly_avg.
+type aggregateView struct {
+	Name   string
+	Bucket time.Duration
+}
+
+// aggregateViews is ordered coarsest first.
+var aggregateViews = []aggregateView{
+	{"telemetry_daily_avg", 24 * time.Hour},
+	{"telemetry_hourly_avg", time.Hour},
+	{"telemetry_minutely_avg", time.Minute},
+}
+
+// aggregateParameters are the telemetry columns summarised by the views.
+var aggregateParameters = []string{"temperature", "battery", "altitude", "signal_strength"}
+
+// chooseAggregateView returns the coarsest view whose buckets nest in the
+// requested bucket size and line up with the requested range, so reading
+// from it gives the same result as bucketing raw rows. It returns nil when
+// only raw data will do.
+func chooseAggregateView(bucket bucketSize, start, end *time.Time) *aggregateView {
+	aligned := func(t *time.Time, d time.Duration) bool {
+		return t == nil || t.Truncate(d).Equal(*t)
+	}
+	for i, v := range aggregateViews {
+		if bucket.Duration%v.Bucket == 0 && aligned(start, v.Bucket) && aligned(end, v.Bucket) {
+			return &aggregateViews[i]
+		}
+	}
+	return nil
+}
+
+// aggregationPlan says where each part of the requested range is read from:
+// materialized buckets of View before Split and raw rows from Split on.
+type aggregationPlan struct {
+	View  *aggregateView
+	Split time.Time
+}
+
+// planAggregation places the split at the end of the last materialized
+// bucket, or at end_time if the view already covers the whole range.
+// watermark is the start of the view's last materialized bucket, nil when it
+// is empty.
+func planAggregation(view *aggregateView, watermark *time.Time, start, end *time.Time) aggregationPlan {
+	if view == nil || watermark == nil {
+		return aggregationPlan{}
+	}
+	split := watermark.Add(view.Bucket)
+	if end != nil && end.Before(split) {
+		split = *end
+	}
+	if start != nil && !split.After(*start) {
+		return aggregationPlan{}
+	}
+	return aggregationPlan{View: view, Split: split}
+}
+
+// Source describes the plan for the X-Aggregation-Source header.
+func (p aggregationPlan) Source(end *time.Time) string {
+	if p.View == nil {
+		return sourceRaw
+	}
+	if end != nil && !end.After(p.Split) {
+		return p.View.Name
+	}
+	return p.View.Name + "+" + sourceRaw
+}
+
+// aggregate is one value column of an aggregation response: Fn (avg, min or
+// max) of a parameter.
+type aggregate struct {
+	Fn        string
+	Parameter string
+}
+
+func (a aggregate) alias() string {
+	return a.Fn + "_" + a.Parameter
+}
+
+// column combines the partials of the parameter.
+func (a aggregate) column() string {
+	if a.Fn == "avg" {
+		return fmt.Sprintf("SUM(sum_%s) / SUM(packet_count) AS %s", a.Parameter, a.alias())
+	}
+	return fmt.Sprintf("%s(%s) AS %s", strings.ToUpper(a.Fn), a.alias(), a.alias())
+}
+
+// parameterAggregates returns fns of every parameter, grouped by parameter.
+func parameterAggregates(fns ...string) []aggregate {
+	var aggs []aggregate
+	for _, name := range aggregateParameters {
+		for _, fn := range fns {
+			aggs = append(aggs, aggregate{Fn: fn, Parameter: name})
+		}
+	}
+	return aggs
+}
+
+// aggregationQuery bucket-aggregates the parameters over the plan's sources.
+// Both sources produce partial sums, minima, maxima and counts, which are
+// combined per bucket so buckets straddling the split are complete. Rows
+// hold the bucket, subsystem_id, aggs in order, packet_count and
+// anomaly_count.
+func aggregationQuery(p aggregationPlan, bucket bucketSize, start, end *time.Time, aggs []aggregate) (string, []interface{}) {
+	args := []interface{}{bucket.Interval}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	var parts []string
+
+	rawFrom := start
+	if p.View != nil {
+		var viewPartials []string
+		for _, name := range aggregateParameters {
+			viewPartials = append(viewPartials,
+				fmt.Sprintf("SUM(avg_%[1]s * packet_count) AS sum_%[1]s, MIN(min_%[1]s) AS min_%[1]s, MAX(max_%[1]s) AS max_%[1]s", name))
+		}
+		query := `SELECT time_bucket($1, bucket) AS bucket, subsystem_id, ` + strings.Join(viewPartials, ", ") + `,
+			SUM(packet_count) AS packet_count, SUM(anomaly_count) AS anomaly_count
+			FROM ` + p.View.Name + ` WHERE bucket < ` + arg(p.Split)
+		if start != nil {
+			query += ` AND bucket >= ` + arg(*start)
+		}
+		parts = append(parts, query+` GROUP BY 1, 2`)
+		rawFrom = &p.Split
+	}
+
+	var rawPartials []string
+	for _, name := range aggregateParameters {
+		rawPartials = append(rawPartials,
+			fmt.Sprintf("SUM(%[1]s::DOUBLE PRECISION) AS sum_%[1]s, MIN(%[1]s) AS min_%[1]s, MAX(%[1]s) AS max_%[1]s", name))
+	}
+	query := `SELECT time_bucket($1, timestamp) AS bucket, subsystem_id, ` + strings.Join(rawPartials, ", ") + `,
+		COUNT(*) AS packet_count, COUNT(*) FILTER (WHERE is_anomaly) AS anomaly_count
+		FROM telemetry WHERE 1=1`
+	if rawFrom != nil {
+		query += ` AND timestamp >= ` + arg(*rawFrom)
+	}
+	if end != nil {
+		query += ` AND timestamp <= ` + arg(*end)
+	}
+	parts = append(parts, query+` GROUP BY 1, 2`)
+
+	var columns []string
+	for _, a := range aggs {
+		columns = append(columns, a.column())
+	}
+	return `SELECT bucket, subsystem_id, ` + strings.Join(columns, ", ") + `,
+		SUM(packet_count)::BIGINT AS packet_count, SUM(anomaly_count)::BIGINT AS anomaly_count
+		FROM (` + strings.Join(parts, " UNION ALL ") + `) parts
+		GROUP BY bucket, subsystem_id
+		ORDER BY bucket DESC`, args
+}
+
+// gapfillQuery wraps an aggregation query so every bucket from start to end
+// is returned for each subsystem. Values of empty buckets are null, carried
+// forward (locf) or interpolated (linear); their counts are always null, which
+// marks them as filled. The bucket width is $1 of the wrapped query. The
+// wrapped query already bounds the samples by timestamp; its buckets are not
+// filtered again, because the first one starts before an unaligned start and
+// the last one may start at end.
+func gapfillQuery(query string, args []interface{}, aggs []aggregate, mode string, start, end time.Time) (string, []interface{}) {
+	args = append(args, start, end)
+	from, to := len(args)-1, len(args)
+
+	var columns []string
+	for _, a := range aggs {
+		value := "MAX(" + a.alias() + ")"
+		switch mode {
+		case gapfillLOCF:
+			value = "locf(" + value + ")"
+		case gapfillLinear:
+			value = "interpolate(" + value + ")"
+		}
+		columns = append(columns, value+" AS "+a.alias())
+	}
+
+	return fmt.Sprintf(`SELECT time_bucket_gapfill($1::INTERVAL, bucket, $%[1]d, $%[2]d) AS bucket, subsystem_id, %[3]s,
+		MAX(packet_count) AS packet_count, MAX(anomaly_count) AS anomaly_count
+		FROM (%[4]s) aggregated
+		GROUP BY 1, 2
+		ORDER BY 1 DESC`, from, to, strings.Join(columns, ", "), query), args
+}
+
+// queryGapfill parses the gapfill parameter. Gap filling needs a bounded
+// range that does not produce more than maxRangeBuckets buckets.
+func queryGapfill(c *fiber.Ctx, bucket bucketSize, start, end *time.Time) (string, error) {
+	mode := strings.ToLower(c.Query("gapfill"))
+	switch mode {
+	case "":
+		return "", nil
+	case gapfillNull, gapfillLOCF, gapfillLinear:
+	default:
+		return "", invalidParam("gapfill", "gapfill must be null, locf or linear")
+	}
+
+	if start == nil || end == nil {
+		return "", invalidParam("gapfill", "gapfill requires start_time and end_time")
+	}
+	if err := checkBucketCount("gapfill", "gapfill", bucket, *start, *end); err != nil {
+		return "", err
+	}
+	return mode, nil
+}
+
+// checkBucketCount rejects a range that spans more than maxRangeBuckets
+// buckets, reporting field and naming what is limited.
+func checkBucketCount(field, limited string, bucket bucketSize, start, end time.Time) error {
+	if end.Sub(start)/bucket.Duration > maxRangeBuckets {
+		return invalidParam(field, "%s is limited to %d buckets; use a larger bucket_size", limited, maxRangeBuckets)
+	}
+	return nil
+}
+
+// queryAggregations parses the range, bucket size and gap-fill mode, picks
+// the sources and runs the aggregation. It sets the X-Aggregation-Source
+// header, and X-Aggregation-Materialized-Until when a continuous aggregate
+// was used. gapfilled reports whether the rows must be read with
+// sendGapfilled.
+func queryAggregations(c *fiber.Ctx, aggs []aggregate) (rows *sql.Rows, gapfilled bool, err error) {
+	start, end, err := queryTimeRange(c)
+	if err != nil {
+		return nil, false, err
+	}
+	bucket, err := queryBucketSize(c, "1 hour")
+	if err != nil {
+		return nil, false, err
+	}
+	gapfill, err := queryGapfill(c, bucket, start, end)
+	if err != nil {
+		return nil, false, err
+	}
+
+	view := chooseAggregateView(bucket, start, end)
+	var watermark *time.Time
+	if view != nil {
+		var last sql.NullTime
+		if err := db.QueryRow(`SELECT MAX(bucket) FROM ` + view.Name).Scan(&last); err != nil {
+			return nil, false, internalError("Failed to read aggregate watermark", err)
+		}
+		if last.Valid {
+			watermark = &last.Time
+		}
+	}
+
+	plan := planAggregation(view, watermark, start, end)
+	query, args := aggregationQuery(plan, bucket, start, end, aggs)
+	if gapfill != "" {
+		query, args = gapfillQuery(query, args, aggs, gapfill, *start, *end)
+	}
+
+	rows, err = db.Query(query, args...)
+	if err != nil {
+		return nil, false, internalError("Failed to query aggregation data", err)
+	}
+
+	c.Set("X-Aggregation-Source", plan.Source(end))
+	if plan.View != nil {
+		c.Set("X-Aggregation-Materialized-Until", plan.Split.UTC().Format(time.RFC3339))
+	}
+	return rows, gapfill != "", nil
+}
+
+// sendGapfilled writes gap-filled rows. They have the fields of the regular
+// aggregation response, but values may be null, and observed is false for
+// buckets without telemetry, whose counts are 0.
+func sendGapfilled(c *fiber.Ctx, rows *sql.Rows) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return sendError(c, internalError("Failed to read aggregation data", err))
+	}
+	values := columns[2 : len(columns)-2]
+
+	result := make([]fiber.Map, 0)
+	for rows.Next() {
+		var bucket time.Time
+		var subsystemID int
+		var packetCount, anomalyCount sql.NullInt64
+		nulls := make([]sql.NullFloat64, len(values))
+
+		dest := []interface{}{&bucket, &subsystemID}
+		for i := range nulls {
+			dest = append(dest, &nulls[i])
+		}
+		dest = append(dest, &packetCount, &anomalyCount)
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Error scanning gap-filled aggregation row: %v", err)
+			continue
+		}
+
+		row := fiber.Map{
+			"bucket":        bucket,
+			"subsystem_id":  subsystemID,
+			"packet_count":  packetCount.Int64,
+			"anomaly_count": anomalyCount.Int64,
+			"observed":      packetCount.Valid,
+		}
+		for i, name := range values {
+			if nulls[i].Valid {
+				row[name] = nulls[i].Float64
+			} else {
+				row[name] = nil
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return sendError(c, internalError("Failed to read aggregation data", err))
+	}
+
+	return c.JSON(result)
+}
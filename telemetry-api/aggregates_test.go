@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestChooseAggregateView(t *testing.T) {
+	midnight := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	hour := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	minute := time.Date(2024, 3, 1, 10, 5, 0, 0, time.UTC)
+	odd := time.Date(2024, 3, 1, 10, 5, 30, 0, time.UTC)
+
+	cases := []struct {
+		bucket string
+		start  *time.Time
+		end    *time.Time
+		want   string
+	}{
+		{"1 week", nil, nil, "telemetry_daily_avg"},
+		{"1 day", timePtr(midnight), timePtr(midnight.Add(72 * time.Hour)), "telemetry_daily_avg"},
+		{"1 day", timePtr(hour), nil, "telemetry_hourly_avg"},
+		{"6 hours", timePtr(hour), nil, "telemetry_hourly_avg"},
+		{"1 hour", nil, timePtr(minute), "telemetry_minutely_avg"},
+		{"15 minutes", timePtr(minute), nil, "telemetry_minutely_avg"},
+		{"1 hour", timePtr(odd), nil, ""},
+	}
+
+	for _, tc := range cases {
+		var bucket bucketSize
+		for _, b := range bucketSizes {
+			if b.size.Interval == tc.bucket {
+				bucket = b.size
+			}
+		}
+		require.NotZero(t, bucket.Duration, tc.bucket)
+
+		view := chooseAggregateView(bucket, tc.start, tc.end)
+		if tc.want == "" {
+			assert.Nil(t, view, tc.bucket)
+			continue
+		}
+		require.NotNil(t, view, tc.bucket)
+		assert.Equal(t, tc.want, view.Name, tc.bucket)
+	}
+}
+
+func TestPlanAggregation(t *testing.T) {
+	hourly := &aggregateViews[1]
+	watermark := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	split := watermark.Add(time.Hour)
+
+	// Open-ended: materialized buckets, then raw rows.
+	p := planAggregation(hourly, &watermark, nil, nil)
+	assert.Equal(t, hourly, p.View)
+	assert.Equal(t, split, p.Split)
+	assert.Equal(t, "telemetry_hourly_avg+raw", p.Source(nil))
+
+	// A range that ends before the watermark is served from the view.
+	end := watermark.Add(-2 * time.Hour)
+	p = planAggregation(hourly, &watermark, nil, &end)
+	assert.Equal(t, end, p.Split)
+	assert.Equal(t, "telemetry_hourly_avg", p.Source(&end))
+
+	// A range that starts after the materialized data is raw only.
+	start := split.Add(time.Hour)
+	p = planAggregation(hourly, &watermark, &start, nil)
+	assert.Nil(t, p.View)
+	assert.Equal(t, sourceRaw, p.Source(nil))
+
+	// An empty view is raw only.
+	p = planAggregation(hourly, nil, nil, nil)
+	assert.Nil(t, p.View)
+}
+
+func TestAggregationQuery(t *testing.T) {
+	bucket := bucketSize{"6 hours", 6 * time.Hour}
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	split := time.Date(2024, 3, 2, 13, 0, 0, 0, time.UTC)
+	aggs := []aggregate{{Fn: "avg", Parameter: "battery"}}
+
+	query, args := aggregationQuery(aggregationPlan{View: &aggregateViews[1], Split: split}, bucket, &start, nil, aggs)
+	assert.Equal(t, []interface{}{"6 hours", split, start, split}, args)
+	assert.Contains(t, query, "FROM telemetry_hourly_avg WHERE bucket < $2 AND bucket >= $3")
+	assert.Contains(t, query, "FROM telemetry WHERE 1=1 AND timestamp >= $4")
+	assert.Contains(t, query, "SUM(sum_battery) / SUM(packet_count) AS avg_battery")
+	assert.Equal(t, 1, strings.Count(query, "UNION ALL"))
+
+	query, args = aggregationQuery(aggregationPlan{}, bucket, &start, &split, aggs)
+	assert.Equal(t, []interface{}{"6 hours", start, split}, args)
+	assert.NotContains(t, query, "UNION ALL")
+	assert.Contains(t, query, "AND timestamp >= $2 AND timestamp <= $3")
+}
+
+func TestParameterAggregates(t *testing.T) {
+	aggs := parameterAggregates("min", "max")
+	require.Len(t, aggs, 2*len(aggregateParameters))
+	assert.Equal(t, "MIN(min_temperature) AS min_temperature", aggs[0].column())
+	assert.Equal(t, "MAX(max_temperature) AS max_temperature", aggs[1].column())
+	assert.Equal(t, "min_battery", aggs[2].alias())
+}
+
+func TestGapfillQuery(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(6 * time.Hour)
+	aggs := parameterAggregates("avg")
+	inner, innerArgs := aggregationQuery(aggregationPlan{}, bucketSize{"1 hour", time.Hour}, &start, &end, aggs)
+
+	for mode, want := range map[string]string{
+		gapfillNull:   "MAX(avg_battery) AS avg_battery",
+		gapfillLOCF:   "locf(MAX(avg_battery)) AS avg_battery",
+		gapfillLinear: "interpolate(MAX(avg_battery)) AS avg_battery",
+	} {
+		query, args := gapfillQuery(inner, innerArgs, aggs, mode, start, end)
+		assert.Equal(t, append(append([]interface{}{}, innerArgs...), start, end), args, mode)
+		assert.Contains(t, query, "time_bucket_gapfill($1::INTERVAL, bucket, $4, $5)", mode)
+		assert.Contains(t, query, want, mode)
+		assert.Contains(t, query, "MAX(packet_count) AS packet_count", mode)
+	}
+}
+
+func TestGapfilledAggregationsKeepBoundaryBuckets(t *testing.T) {
+	withTestDB(t)
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/aggregations", getAggregations)
+
+	// The range starts mid-bucket and a sample sits exactly at end_time;
+	// 02:00 and 03:00 have no samples.
+	start := time.Date(2001, 1, 1, 0, 30, 0, 0, time.UTC)
+	end := time.Date(2001, 1, 1, 4, 0, 0, 0, time.UTC)
+	insertTestTelemetry(t, db, start.Add(15*time.Minute), 20)
+	insertTestTelemetry(t, db, start.Add(40*time.Minute), 30)
+	insertTestTelemetry(t, db, end, 60)
+
+	type bucket struct {
+		Bucket         time.Time `json:"bucket"`
+		Observed       bool      `json:"observed"`
+		PacketCount    int       `json:"packet_count"`
+		AvgTemperature *float64  `json:"avg_temperature"`
+	}
+	value := func(v float64) *float64 { return &v }
+
+	hour := func(h int) time.Time { return time.Date(2001, 1, 1, h, 0, 0, 0, time.UTC) }
+	for mode, want := range map[string][]bucket{
+		gapfillNull: {
+			{hour(4), true, 1, value(60)},
+			{hour(3), false, 0, nil},
+			{hour(2), false, 0, nil},
+			{hour(1), true, 1, value(30)},
+			{hour(0), true, 1, value(20)},
+		},
+		gapfillLOCF: {
+			{hour(4), true, 1, value(60)},
+			{hour(3), false, 0, value(30)},
+			{hour(2), false, 0, value(30)},
+			{hour(1), true, 1, value(30)},
+			{hour(0), true, 1, value(20)},
+		},
+		gapfillLinear: {
+			{hour(4), true, 1, value(60)},
+			{hour(3), false, 0, value(50)},
+			{hour(2), false, 0, value(40)},
+			{hour(1), true, 1, value(30)},
+			{hour(0), true, 1, value(20)},
+		},
+	} {
+		q := "gapfill=" + mode + "&bucket_size=1h&start_time=" + start.Format(time.RFC3339) + "&end_time=" + end.Format(time.RFC3339)
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/telemetry/aggregations?"+q, nil), -1)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, mode)
+
+		var got []bucket
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+		require.Len(t, got, len(want), mode)
+		for i := range want {
+			assert.True(t, want[i].Bucket.Equal(got[i].Bucket), "%s: bucket %d is %s", mode, i, got[i].Bucket)
+			assert.Equal(t, want[i].Observed, got[i].Observed, "%s %s", mode, want[i].Bucket)
+			assert.Equal(t, want[i].PacketCount, got[i].PacketCount, "%s %s", mode, want[i].Bucket)
+			if want[i].AvgTemperature == nil {
+				assert.Nil(t, got[i].AvgTemperature, "%s %s", mode, want[i].Bucket)
+			} else if assert.NotNil(t, got[i].AvgTemperature, "%s %s", mode, want[i].Bucket) {
+				assert.InDelta(t, *want[i].AvgTemperature, *got[i].AvgTemperature, 1e-6, "%s %s", mode, want[i].Bucket)
+			}
+		}
+	}
+}
+
+func TestAggregationEndpointsRejectInvalidGapfill(t *testing.T) {
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/aggregations", getAggregations)
+
+	for query, message := range map[string]string{
+		"gapfill=previous&start_time=now-1h&end_time=now":               "gapfill must be null, locf or linear",
+		"gapfill=locf&start_time=now-1h":                                "gapfill requires start_time and end_time",
+		"gapfill=linear&start_time=now-30d&end_time=now&bucket_size=1m": "gapfill is limited to 10000 buckets; use a larger bucket_size",
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/telemetry/aggregations?"+query, nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+
+		var body APIError
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "gapfill", body.Field, query)
+		assert.Equal(t, message, body.Message, query)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+const (
+	maxQueryParameters = 8
+	maxQueryFunctions  = 16
+
+	defaultHistogramBuckets = 10
+	maxHistogramBuckets     = 100
+)
+
+// AggregationQueryResult is one bucket of one parameter for one subsystem.
+// Values holds the requested functions by name; they are null where a
+// function is undefined, such as stddev of a single sample.
+type AggregationQueryResult struct {
+	Bucket      time.Time           `json:"bucket"`
+	SubsystemID int                 `json:"subsystem_id"`
+	Parameter   string              `json:"parameter"`
+	Count       int                 `json:"count"`
+	Values      map[string]*float64 `json:"values"`
+	Histogram   *Histogram          `json:"histogram,omitempty"`
+}
+
+// Histogram counts the samples of a bucket in equal-width bins. Edges has one
+// more entry than Counts; Below and Above count samples outside the edges.
+type Histogram struct {
+	Edges  []float64 `json:"edges"`
+	Counts []int64   `json:"counts"`
+	Below  int64     `json:"below"`
+	Above  int64     `json:"above"`
+}
+
+// histogramSpec is the range and bin count of the histogram function.
+type histogramSpec struct {
+	Min     float64
+	Max     float64
+	Buckets int
+}
+
+func (h histogramSpec) histogram(counts []int64) *Histogram {
+	if len(counts) != h.Buckets+2 {
+		return nil
+	}
+	edges := make([]float64, h.Buckets+1)
+	for i := range edges {
+		edges[i] = h.Min + float64(i)*(h.Max-h.Min)/float64(h.Buckets)
+	}
+	return &Histogram{
+		Edges:  edges,
+		Counts: counts[1 : h.Buckets+1],
+		Below:  counts[0],
+		Above:  counts[h.Buckets+1],
+	}
+}
+
+// aggregationFunctions maps function names to SQL over the samples' value
+// and timestamp columns. Percentiles (p1 to p99) and histogram are handled
+// by aggregationFunction.
+var aggregationFunctions = map[string]string{
+	"avg":    "AVG(value)",
+	"min":    "MIN(value)",
+	"max":    "MAX(value)",
+	"sum":    "SUM(value)",
+	"stddev": "STDDEV_SAMP(value)",
+	"first":  "first(value, timestamp)",
+	"last":   "last(value, timestamp)",
+}
+
+const histogramFunction = "histogram"
+
+// aggregationFunction returns the SQL of a function name, or false if the
+// name is unknown. The histogram expression refers to the placeholders
+// holding its range and bin count.
+func aggregationFunction(name string, histogramArgs string) (string, bool) {
+	if expr, ok := aggregationFunctions[name]; ok {
+		return expr, true
+	}
+	if name == histogramFunction {
+		return "histogram(value, " + histogramArgs + ")", true
+	}
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.Atoi(name[1:])
+		if err == nil && p >= 1 && p <= 99 && name[1] != '0' {
+			return fmt.Sprintf("percentile_cont(%.2f) WITHIN GROUP (ORDER BY value)", float64(p)/100), true
+		}
+	}
+	return "", false
+}
+
+// aggregationRequest is a parsed aggregation query. Parameters that are not
+// downlinked are taken to be derived and checked against derived_parameters.
+type aggregationRequest struct {
+	Downlinked []string
+	Derived    []string
+	Functions  []string
+	Histogram  *histogramSpec
+	Bucket     bucketSize
+	Start      *time.Time
+	End        *time.Time
+}
+
+func parseAggregationRequest(c *fiber.Ctx) (aggregationRequest, error) {
+	var req aggregationRequest
+	var err error
+
+	if req.Start, req.End, err = queryTimeRange(c); err != nil {
+		return req, err
+	}
+	if req.Bucket, err = queryBucketSize(c, "1 hour"); err != nil {
+		return req, err
+	}
+
+	if req.Downlinked, req.Derived, err = queryParameterList(c, maxQueryParameters); err != nil {
+		return req, err
+	}
+
+	req.Functions = splitList(strings.ToLower(c.Query("function")))
+	if len(req.Functions) == 0 || len(req.Functions) > maxQueryFunctions {
+		return req, invalidParam("function", "function must list 1 to %d functions", maxQueryFunctions)
+	}
+	for _, fn := range req.Functions {
+		if _, ok := aggregationFunction(fn, ""); !ok {
+			return req, invalidParam("function", "unknown function %q; use avg, min, max, sum, stddev, first, last, p1 to p99 or histogram", fn)
+		}
+		if fn == histogramFunction {
+			if req.Histogram, err = queryHistogram(c); err != nil {
+				return req, err
+			}
+		}
+	}
+
+	// Every query reads raw samples, so its range and bucket count are
+	// bounded.
+	if req.Start == nil || req.End == nil || !req.End.After(*req.Start) {
+		return req, invalidParam("start_time", "start_time and end_time are required and end_time must be after start_time")
+	}
+	if err := checkBucketCount("bucket_size", "an aggregation query", req.Bucket, *req.Start, *req.End); err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
+
+func queryHistogram(c *fiber.Ctx) (*histogramSpec, error) {
+	h := histogramSpec{Buckets: defaultHistogramBuckets}
+
+	min, err := queryFloat(c, "histogram_min")
+	if err != nil {
+		return nil, err
+	}
+	max, err := queryFloat(c, "histogram_max")
+	if err != nil {
+		return nil, err
+	}
+	if min == nil || max == nil {
+		return nil, invalidParam("histogram_min", "histogram requires histogram_min and histogram_max")
+	}
+	if *max <= *min {
+		return nil, invalidParam("histogram_max", "histogram_max must be greater than histogram_min")
+	}
+	h.Min, h.Max = *min, *max
+
+	buckets, err := queryInt(c, "histogram_buckets")
+	if err != nil {
+		return nil, err
+	}
+	if buckets != nil {
+		if *buckets < 1 || *buckets > maxHistogramBuckets {
+			return nil, invalidParam("histogram_buckets", "histogram_buckets must be between 1 and %d", maxHistogramBuckets)
+		}
+		h.Buckets = *buckets
+	}
+	return &h, nil
+}
+
+// query builds the aggregation over the samples of the requested
+// parameters: downlinked columns unpivoted from telemetry and derived values
+// with the subsystem of their telemetry row.
+func (r aggregationRequest) query() (string, []interface{}) {
+	args := []interface{}{r.Bucket.Interval}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	timeRange := func(column string) string {
+		var cond string
+		if r.Start != nil {
+			cond += " AND " + column + " >= " + arg(*r.Start)
+		}
+		if r.End != nil {
+			cond += " AND " + column + " <= " + arg(*r.End)
+		}
+		return cond
+	}
+
+	var parts []string
+	if len(r.Downlinked) > 0 {
+		var values []string
+		for _, name := range r.Downlinked {
+			values = append(values, fmt.Sprintf("('%s', t.%s::DOUBLE PRECISION)", name, downlinkedParameters[name]))
+		}
+		parts = append(parts, `SELECT t.timestamp, t.subsystem_id, v.parameter, v.value
+			FROM telemetry t CROSS JOIN LATERAL (VALUES `+strings.Join(values, ", ")+`) AS v(parameter, value)
+			WHERE 1=1`+timeRange("t.timestamp"))
+	}
+	if len(r.Derived) > 0 {
+		parts = append(parts, `SELECT d.timestamp, t.subsystem_id, d.parameter_name AS parameter, d.value::DOUBLE PRECISION AS value
+			FROM derived_values d
+			JOIN telemetry t ON t.id = d.telemetry_id AND t.timestamp = d.timestamp
+			WHERE d.parameter_name = ANY(`+arg(pq.Array(r.Derived))+`)`+timeRange("d.timestamp"))
+	}
+
+	var histogramArgs string
+	if r.Histogram != nil {
+		histogramArgs = arg(r.Histogram.Min) + "::DOUBLE PRECISION, " + arg(r.Histogram.Max) + "::DOUBLE PRECISION, " + arg(r.Histogram.Buckets) + "::INTEGER"
+	}
+	var columns []string
+	for _, fn := range r.Functions {
+		expr, _ := aggregationFunction(fn, histogramArgs)
+		columns = append(columns, expr)
+	}
+
+	return `SELECT time_bucket($1, timestamp) AS bucket, subsystem_id, parameter, COUNT(*), ` + strings.Join(columns, ", ") + `
+		FROM (` + strings.Join(parts, " UNION ALL ") + `) samples
+		GROUP BY 1, 2, 3
+		ORDER BY 1 DESC, 2, 3`, args
+}
+
+// getAggregationQuery aggregates any downlinked or derived parameters with
+// any of the aggregation functions, per bucket and subsystem. Percentiles
+// and histograms cannot be combined from the continuous aggregates, so it
+// always reads raw data, over a bounded range.
+func getAggregationQuery(c *fiber.Ctx) error {
+	req, err := parseAggregationRequest(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	if err := checkDerivedParameters(req.Derived); err != nil {
+		return sendError(c, err)
+	}
+
+	query, args := req.query()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query aggregation data", err))
+	}
+	defer rows.Close()
+
+	results := make([]AggregationQueryResult, 0)
+	for rows.Next() {
+		r := AggregationQueryResult{Values: map[string]*float64{}}
+		values := make([]sql.NullFloat64, len(req.Functions))
+		var histogram pq.Int64Array
+
+		dest := []interface{}{&r.Bucket, &r.SubsystemID, &r.Parameter, &r.Count}
+		for i, fn := range req.Functions {
+			if fn == histogramFunction {
+				dest = append(dest, &histogram)
+			} else {
+				dest = append(dest, &values[i])
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Error scanning aggregation row: %v", err)
+			continue
+		}
+
+		for i, fn := range req.Functions {
+			switch {
+			case fn == histogramFunction:
+				r.Histogram = req.Histogram.histogram(histogram)
+			case values[i].Valid:
+				v := values[i].Float64
+				r.Values[fn] = &v
+			default:
+				r.Values[fn] = nil
+			}
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return sendError(c, internalError("Failed to read aggregation data", err))
+	}
+
+	c.Set("X-Aggregation-Source", sourceRaw)
+	return c.JSON(results)
+}
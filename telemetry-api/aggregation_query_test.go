@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregationFunction(t *testing.T) {
+	for name, want := range map[string]string{
+		"stddev":    "STDDEV_SAMP(value)",
+		"last":      "last(value, timestamp)",
+		"p50":       "percentile_cont(0.50) WITHIN GROUP (ORDER BY value)",
+		"p99":       "percentile_cont(0.99) WITHIN GROUP (ORDER BY value)",
+		"p5":        "percentile_cont(0.05) WITHIN GROUP (ORDER BY value)",
+		"histogram": "histogram(value, $2, $3, $4)",
+	} {
+		expr, ok := aggregationFunction(name, "$2, $3, $4")
+		require.True(t, ok, name)
+		assert.Equal(t, want, expr, name)
+	}
+
+	for _, name := range []string{"", "p", "p0", "p05", "p100", "median", "count(*)"} {
+		_, ok := aggregationFunction(name, "")
+		assert.False(t, ok, name)
+	}
+}
+
+func TestHistogramSpec(t *testing.T) {
+	h := histogramSpec{Min: 0, Max: 100, Buckets: 4}
+
+	got := h.histogram([]int64{2, 1, 5, 7, 3, 1})
+	require.NotNil(t, got)
+	assert.Equal(t, []float64{0, 25, 50, 75, 100}, got.Edges)
+	assert.Equal(t, []int64{1, 5, 7, 3}, got.Counts)
+	assert.Equal(t, int64(2), got.Below)
+	assert.Equal(t, int64(1), got.Above)
+
+	assert.Nil(t, h.histogram(nil), "empty result")
+}
+
+func TestAggregationRequestQuery(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	req := aggregationRequest{
+		Downlinked: []string{"temperature", "battery"},
+		Derived:    []string{"battery_health"},
+		Functions:  []string{"p95", "histogram"},
+		Histogram:  &histogramSpec{Min: 0, Max: 100, Buckets: 10},
+		Bucket:     bucketSize{"1 hour", time.Hour},
+		Start:      &start,
+	}
+
+	query, args := req.query()
+	require.Len(t, args, 7)
+	assert.Equal(t, "1 hour", args[0])
+	assert.Contains(t, query, "(VALUES ('temperature', t.temperature::DOUBLE PRECISION), ('battery', t.battery::DOUBLE PRECISION))")
+	assert.Contains(t, query, "WHERE 1=1 AND t.timestamp >= $2")
+	assert.Contains(t, query, "d.parameter_name = ANY($3) AND d.timestamp >= $4")
+	assert.Contains(t, query, "percentile_cont(0.95) WITHIN GROUP (ORDER BY value), histogram(value, $5::DOUBLE PRECISION, $6::DOUBLE PRECISION, $7::INTEGER)")
+	assert.Contains(t, query, "GROUP BY 1, 2, 3")
+
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/aggregations/query", getAggregationQuery)
+
+	cases := []struct {
+		query string
+		field string
+	}{
+		{"function=avg", "parameter"},
+		{"parameter=a,b,c,d,e,f,g,h,i&function=avg", "parameter"},
+		{"parameter=temperature", "function"},
+		{"parameter=temperature&function=avg,mode", "function"},
+		{"parameter=temperature&function=p100", "function"},
+		{"parameter=temperature&function=histogram", "histogram_min"},
+		{"parameter=temperature&function=histogram&histogram_min=10&histogram_max=5", "histogram_max"},
+		{"parameter=temperature&function=histogram&histogram_min=0&histogram_max=x", "histogram_max"},
+		{"parameter=temperature&function=histogram&histogram_min=0&histogram_max=5&histogram_buckets=500", "histogram_buckets"},
+		{"parameter=temperature&function=avg&bucket_size=2h", "bucket_size"},
+		{"parameter=temperature&function=p99&bucket_size=1m", "start_time"},
+		{"parameter=temperature&function=p99&start_time=now-1h", "start_time"},
+		{"parameter=temperature&function=p99&start_time=now&end_time=now-1h", "end_time"},
+		{"parameter=temperature&function=p99&bucket_size=1m&start_time=now-30d&end_time=now", "bucket_size"},
+	}
+
+	for _, tc := range cases {
+		requireAPIError(t, app, httptest.NewRequest("GET", "/api/v1/telemetry/aggregations/query?"+tc.query, nil),
+			http.StatusBadRequest, codeInvalidParameter, tc.field)
+	}
+}
+
+func TestAggregationQueryComputesFunctions(t *testing.T) {
+	withTestDB(t)
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/aggregations/query", getAggregationQuery)
+
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, temperature := range []float32{22, 24, 26, 38, 45} {
+		insertTestTelemetry(t, db, ts.Add(time.Duration(i)*time.Minute), temperature)
+	}
+
+	q := url.Values{
+		"parameter":         {"temperature"},
+		"function":          {"p50,stddev,histogram"},
+		"histogram_min":     {"20"},
+		"histogram_max":     {"40"},
+		"histogram_buckets": {"2"},
+		"bucket_size":       {"1 hour"},
+		"start_time":        {"2001-01-01T00:00:00Z"},
+		"end_time":          {"2001-01-01T00:59:59Z"},
+	}
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/telemetry/aggregations/query?"+q.Encode(), nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var results []AggregationQueryResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&results))
+	require.Len(t, results, 1)
+	r := results[0]
+	assert.True(t, ts.Equal(r.Bucket))
+	assert.Equal(t, "temperature", r.Parameter)
+	assert.Equal(t, 5, r.Count)
+	require.NotNil(t, r.Values["p50"])
+	assert.InDelta(t, 26, *r.Values["p50"], 1e-9)
+	require.NotNil(t, r.Values["stddev"])
+	assert.InDelta(t, 10, *r.Values["stddev"], 1e-9)
+	assert.Equal(t, &Histogram{Edges: []float64{20, 30, 40}, Counts: []int64{3, 1}, Below: 0, Above: 1}, r.Histogram)
+}
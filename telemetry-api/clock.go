@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Clock correlation samples are recorded by telemetry-ingestion. The fitter
+// fits each spacecraft's samples within clockConfig.Window of its latest one
+// to an offset and a drift; fit_clock_model corrects stored telemetry with
+// the fit and raises a clock_drift anomaly when the drift is outside its
+// parameter_limits.
+
+// clockConfig is read from CLOCK_FIT_INTERVAL, CLOCK_FIT_WINDOW and
+// CLOCK_MIN_SAMPLES.
+type clockConfig struct {
+	FitInterval time.Duration
+	Window      time.Duration
+	MinSamples  int
+}
+
+var clock = clockConfig{
+	FitInterval: 5 * time.Minute,
+	Window:      24 * time.Hour,
+	MinSamples:  10,
+}
+
+func loadClockConfig() {
+	for name, d := range map[string]*time.Duration{
+		"CLOCK_FIT_INTERVAL": &clock.FitInterval,
+		"CLOCK_FIT_WINDOW":   &clock.Window,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				log.Fatalf("Invalid %s: %s", name, v)
+			}
+			*d = parsed
+		}
+	}
+	if v := os.Getenv("CLOCK_MIN_SAMPLES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 {
+			log.Fatal("Invalid CLOCK_MIN_SAMPLES:", v)
+		}
+		clock.MinSamples = n
+	}
+}
+
+// Clock status of a spacecraft.
+const (
+	clockUnfitted = "UNFITTED"
+	clockOK       = "OK"
+	clockDrift    = "DRIFT"
+)
+
+// ClockModel is one fit of a spacecraft clock. Onboard time t corresponds to
+// ground time t + OffsetSecs + DriftPPM * 1e-6 * (t - ReferenceTime).
+type ClockModel struct {
+	ID              int       `json:"id"`
+	SpacecraftID    int       `json:"spacecraft_id"`
+	ReferenceTime   time.Time `json:"reference_time"`
+	OffsetSecs      float64   `json:"offset_seconds"`
+	DriftPPM        float64   `json:"drift_ppm"`
+	SampleCount     int       `json:"sample_count"`
+	FirstSampleAt   time.Time `json:"first_sample_at"`
+	RMSResidualSecs float64   `json:"rms_residual_seconds"`
+	MaxResidualSecs float64   `json:"max_residual_seconds"`
+	DriftExceeded   bool      `json:"drift_exceeded"`
+	FittedAt        time.Time `json:"fitted_at"`
+}
+
+// ClockSample is a correlation sample. GroundTime is its earth-received time
+// less the light time and OffsetSecs how far it is ahead of the onboard time.
+// ResidualSecs is what the spacecraft's latest model leaves unexplained.
+type ClockSample struct {
+	ID              int       `json:"id"`
+	SpacecraftID    int       `json:"spacecraft_id"`
+	Station         *string   `json:"station,omitempty"`
+	OnboardTime     time.Time `json:"onboard_time"`
+	EarthReceivedAt time.Time `json:"earth_received_at"`
+	LightTimeSecs   float64   `json:"light_time_seconds"`
+	GroundTime      time.Time `json:"ground_time"`
+	OffsetSecs      float64   `json:"offset_seconds"`
+	ResidualSecs    *float64  `json:"residual_seconds"`
+	TelemetryID     int       `json:"telemetry_id"`
+}
+
+// ClockStatus is the current clock model of a spacecraft against the drift
+// tolerance, the high clock_drift limit.
+type ClockStatus struct {
+	SpacecraftID int         `json:"spacecraft_id"`
+	Status       string      `json:"status"`
+	TolerancePPM *float64    `json:"tolerance_ppm"`
+	SampleCount  int         `json:"sample_count"`
+	LastSampleAt *time.Time  `json:"last_sample_at"`
+	Model        *ClockModel `json:"model"`
+}
+
+const clockModelColumns = `id, spacecraft_id, reference_time, offset_seconds, drift_ppm, sample_count,
+		   first_sample_at, rms_residual_seconds, max_residual_seconds, drift_exceeded, fitted_at`
+
+func scanClockModel(row rowScanner) (ClockModel, error) {
+	var m ClockModel
+	err := row.Scan(&m.ID, &m.SpacecraftID, &m.ReferenceTime, &m.OffsetSecs, &m.DriftPPM, &m.SampleCount,
+		&m.FirstSampleAt, &m.RMSResidualSecs, &m.MaxResidualSecs, &m.DriftExceeded, &m.FittedAt)
+	return m, err
+}
+
+func scanClockSample(row rowScanner) (ClockSample, error) {
+	var s ClockSample
+	err := row.Scan(&s.ID, &s.SpacecraftID, &s.Station, &s.OnboardTime, &s.EarthReceivedAt,
+		&s.LightTimeSecs, &s.OffsetSecs, &s.ResidualSecs, &s.TelemetryID)
+	if err != nil {
+		return s, err
+	}
+	s.GroundTime = s.EarthReceivedAt.Add(-time.Duration(s.LightTimeSecs * float64(time.Second)))
+	return s, nil
+}
+
+// clockStatus classifies a spacecraft's latest model.
+func clockStatus(m *ClockModel) string {
+	switch {
+	case m == nil:
+		return clockUnfitted
+	case m.DriftExceeded:
+		return clockDrift
+	default:
+		return clockOK
+	}
+}
+
+func startClockFitter() {
+	for range time.Tick(clock.FitInterval) {
+		fitClockModels()
+	}
+}
+
+func fitClockModels() {
+	rows, err := db.Query(`SELECT DISTINCT spacecraft_id FROM clock_samples`)
+	if err != nil {
+		log.Printf("Error listing clock samples: %v", err)
+		return
+	}
+	var spacecraft []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			spacecraft = append(spacecraft, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range spacecraft {
+		var modelID sql.NullInt64
+		err := db.QueryRow(`SELECT fit_clock_model($1, $2::interval, $3)`,
+			id, fmt.Sprintf("%d milliseconds", clock.Window.Milliseconds()), clock.MinSamples).Scan(&modelID)
+		if err != nil {
+			log.Printf("Error fitting clock model of spacecraft %d: %v", id, err)
+			continue
+		}
+		if !modelID.Valid {
+			continue
+		}
+		m, err := scanClockModel(db.QueryRow(`SELECT `+clockModelColumns+` FROM clock_models WHERE id = $1`, modelID.Int64))
+		if err != nil {
+			log.Printf("Error reading clock model %d: %v", modelID.Int64, err)
+			continue
+		}
+		log.Printf("Spacecraft %d clock: offset %.6fs, drift %.3f ppm, RMS residual %.6fs over %d samples",
+			id, m.OffsetSecs, m.DriftPPM, m.RMSResidualSecs, m.SampleCount)
+		if m.DriftExceeded {
+			log.Printf("Spacecraft %d clock drift %.3f ppm exceeds tolerance", id, m.DriftPPM)
+		}
+	}
+}
+
+// getClockStatus returns the clock status of every spacecraft with
+// correlation samples.
+func getClockStatus(c *fiber.Ctx) error {
+	models := map[int]*ClockModel{}
+	rows, err := db.Query(`
+		SELECT DISTINCT ON (spacecraft_id) ` + clockModelColumns + `
+		FROM clock_models
+		ORDER BY spacecraft_id, fitted_at DESC, id DESC
+	`)
+	if err != nil {
+		return sendError(c, internalError("Failed to query clock models", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanClockModel(rows)
+		if err != nil {
+			log.Printf("Error scanning clock model row: %v", err)
+			continue
+		}
+		models[m.SpacecraftID] = &m
+	}
+
+	samples, err := db.Query(`
+		SELECT s.spacecraft_id, COUNT(*), MAX(s.onboard_time), MAX(l.high_threshold)
+		FROM clock_samples s
+		LEFT JOIN parameter_limits l ON l.parameter_name = 'clock_drift'
+		GROUP BY s.spacecraft_id
+		ORDER BY s.spacecraft_id
+	`)
+	if err != nil {
+		return sendError(c, internalError("Failed to query clock samples", err))
+	}
+	defer samples.Close()
+
+	statuses := make([]ClockStatus, 0)
+	for samples.Next() {
+		var s ClockStatus
+		if err := samples.Scan(&s.SpacecraftID, &s.SampleCount, &s.LastSampleAt, &s.TolerancePPM); err != nil {
+			log.Printf("Error scanning clock status row: %v", err)
+			continue
+		}
+		s.Model = models[s.SpacecraftID]
+		s.Status = clockStatus(s.Model)
+		statuses = append(statuses, s)
+	}
+
+	return c.JSON(statuses)
+}
+
+// getClockModels lists clock model fits, latest first:
+//
+//	GET /api/v1/clock/models?spacecraft_id=1&start_time=now-7d
+func getClockModels(c *fiber.Ctx) error {
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + clockModelColumns + ` FROM clock_models WHERE 1=1`
+	args := []interface{}{}
+	argCount := 0
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND spacecraft_id = $%d", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND fitted_at >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND fitted_at <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY fitted_at DESC, id DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query clock models", err))
+	}
+	defer rows.Close()
+
+	models := make([]ClockModel, 0)
+	for rows.Next() {
+		m, err := scanClockModel(rows)
+		if err != nil {
+			log.Printf("Error scanning clock model row: %v", err)
+			continue
+		}
+		models = append(models, m)
+	}
+
+	return c.JSON(models)
+}
+
+// getClockSamples lists correlation samples by onboard time, latest first,
+// with their residuals against the latest model:
+//
+//	GET /api/v1/clock/samples?spacecraft_id=1&start_time=now-24h
+func getClockSamples(c *fiber.Ctx) error {
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `
+		SELECT s.id, s.spacecraft_id, s.station, s.onboard_time, s.earth_received_at,
+			   s.light_time_seconds, s.offset_seconds,
+			   s.offset_seconds - m.offset_seconds
+			   - m.drift_ppm * 1e-6 * EXTRACT(EPOCH FROM s.onboard_time - m.reference_time)::DOUBLE PRECISION,
+			   s.telemetry_id
+		FROM clock_samples s
+		LEFT JOIN LATERAL (
+			SELECT offset_seconds, drift_ppm, reference_time
+			FROM clock_models
+			WHERE spacecraft_id = s.spacecraft_id
+			ORDER BY fitted_at DESC, id DESC
+			LIMIT 1
+		) m ON TRUE
+		WHERE 1=1`
+	args := []interface{}{}
+	argCount := 0
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND s.spacecraft_id = $%d", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND s.onboard_time >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND s.onboard_time <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY s.onboard_time DESC, s.id DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query clock samples", err))
+	}
+	defer rows.Close()
+
+	samples := make([]ClockSample, 0)
+	for rows.Next() {
+		s, err := scanClockSample(rows)
+		if err != nil {
+			log.Printf("Error scanning clock sample row: %v", err)
+			continue
+		}
+		samples = append(samples, s)
+	}
+
+	return c.JSON(samples)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanClockSampleComputesGroundTime(t *testing.T) {
+	onboard := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	received := onboard.Add(250 * time.Millisecond)
+
+	sample, err := scanClockSample(stubScanner{values: []interface{}{
+		9, 1, "GS1", onboard, received, 0.002, 0.248, 0.0005, 41,
+	}})
+
+	require.NoError(t, err)
+	require.NotNil(t, sample.Station)
+	assert.Equal(t, "GS1", *sample.Station)
+	assert.Equal(t, received.Add(-2*time.Millisecond), sample.GroundTime)
+	require.NotNil(t, sample.ResidualSecs)
+	assert.Equal(t, 0.0005, *sample.ResidualSecs)
+}
+
+func TestScanClockSampleWithoutModel(t *testing.T) {
+	onboard := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	sample, err := scanClockSample(stubScanner{values: []interface{}{
+		9, 1, nil, onboard, onboard, 0.0, 0.0, nil, 41,
+	}})
+
+	require.NoError(t, err)
+	assert.Nil(t, sample.Station)
+	assert.Nil(t, sample.ResidualSecs)
+}
+
+func TestClockStatus(t *testing.T) {
+	assert.Equal(t, clockUnfitted, clockStatus(nil))
+	assert.Equal(t, clockOK, clockStatus(&ClockModel{DriftPPM: 3}))
+	assert.Equal(t, clockDrift, clockStatus(&ClockModel{DriftPPM: 35, DriftExceeded: true}))
+}
+
+func TestFitClockModelCorrectsTelemetry(t *testing.T) {
+	tx := testTx(t)
+	latest := time.Date(2001, 1, 1, 1, 0, 0, 0, time.UTC)
+
+	// The clock is 0.5 s behind at the latest sample and drifts by 50 ppm.
+	offset := func(onboard time.Time) float64 {
+		return 0.5 + 50e-6*onboard.Sub(latest).Seconds()
+	}
+	var first, last int
+	for i := 9; i >= 0; i-- {
+		onboard := latest.Add(-time.Duration(i) * 100 * time.Second)
+		id := insertTestTelemetry(t, tx, onboard, 25)
+		_, err := tx.Exec(`UPDATE telemetry SET onboard_time = timestamp WHERE id = $1 AND timestamp = $2`, id, onboard)
+		require.NoError(t, err)
+		_, err = tx.Exec(`
+			INSERT INTO clock_samples (
+				spacecraft_id, station, onboard_time, earth_received_at, light_time_seconds, offset_seconds,
+				telemetry_id, telemetry_timestamp
+			) VALUES ($1, 'GS1', $2, $3, 0, $4, $5, $2)
+		`, testSpacecraftID, onboard, onboard.Add(time.Duration(offset(onboard)*float64(time.Second))), offset(onboard), id)
+		require.NoError(t, err)
+		if i == 9 {
+			first = id
+		}
+		last = id
+	}
+
+	corrected := func(onboard time.Time) time.Time {
+		var ts time.Time
+		require.NoError(t, tx.QueryRow(`SELECT correct_onboard_time($1, $2)`, testSpacecraftID, onboard).Scan(&ts))
+		return ts
+	}
+	fit := func(minSamples int) sql.NullInt64 {
+		var id sql.NullInt64
+		require.NoError(t, tx.QueryRow(`SELECT fit_clock_model($1, '1 day'::interval, $2)`,
+			testSpacecraftID, minSamples).Scan(&id))
+		return id
+	}
+
+	assert.True(t, latest.Equal(corrected(latest)), "uncorrected before the first fit")
+	assert.False(t, fit(11).Valid, "too few samples")
+
+	modelID := fit(10)
+	require.True(t, modelID.Valid)
+	assert.False(t, fit(10).Valid, "no new samples")
+
+	m, err := scanClockModel(tx.QueryRow(`SELECT `+clockModelColumns+` FROM clock_models WHERE id = $1`, modelID.Int64))
+	require.NoError(t, err)
+	assert.True(t, latest.Equal(m.ReferenceTime))
+	assert.InDelta(t, 0.5, m.OffsetSecs, 1e-6)
+	assert.InDelta(t, 50, m.DriftPPM, 1e-3)
+	assert.Equal(t, 10, m.SampleCount)
+	assert.InDelta(t, 0, m.MaxResidualSecs, 1e-6)
+	assert.True(t, m.DriftExceeded)
+	assert.Equal(t, clockDrift, clockStatus(&m))
+
+	next := latest.Add(1000 * time.Second)
+	assert.InDelta(t, 0.55, corrected(next).Sub(next).Seconds(), 1e-5)
+
+	// Stored telemetry is corrected from the first sample on.
+	for _, tc := range []struct {
+		id      int
+		onboard time.Time
+	}{
+		{first, latest.Add(-900 * time.Second)},
+		{last, latest},
+	} {
+		var correctedTime time.Time
+		require.NoError(t, tx.QueryRow(`
+			SELECT corrected_time FROM telemetry WHERE id = $1 AND timestamp = $2
+		`, tc.id, tc.onboard).Scan(&correctedTime))
+		assert.InDelta(t, offset(tc.onboard), correctedTime.Sub(tc.onboard).Seconds(), 1e-5)
+	}
+
+	var anomalyType string
+	var value float64
+	require.NoError(t, tx.QueryRow(`
+		SELECT anomaly_type, parameter_value FROM anomaly_history
+		WHERE telemetry_id = $1 AND telemetry_timestamp = $2 AND parameter_name = 'clock_drift'
+	`, last, latest).Scan(&anomalyType, &value))
+	assert.Equal(t, "CLOCK_DRIFT", anomalyType)
+	assert.InDelta(t, 50, value, 1e-3)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// queryRower is a database or a transaction.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// testSpacecraftID keeps rows written by database tests apart from data
+// already in the test database.
+const testSpacecraftID = 9001
+
+// testDB connects to the database at TEST_DATABASE_URL, which must have
+// db/init.sql applied. Tests of the schema's triggers and functions use it and
+// are skipped when TEST_DATABASE_URL is not set.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	conn, err := sql.Open("postgres", url)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// testTx returns a transaction on the test database that is rolled back when
+// the test ends.
+func testTx(t *testing.T) *sql.Tx {
+	t.Helper()
+	tx, err := testDB(t).Begin()
+	require.NoError(t, err)
+	t.Cleanup(func() { tx.Rollback() })
+	return tx
+}
+
+// withTestDB points db at the test database for the rest of the test, for code
+// that does not take a transaction. The rows of the test spacecraft are
+// deleted when the test ends.
+func withTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	conn := testDB(t)
+	saved := db
+	db = conn
+	t.Cleanup(func() {
+		db = saved
+		for _, query := range []string{
+			`DELETE FROM derived_values d USING telemetry t
+			 WHERE t.id = d.telemetry_id AND t.timestamp = d.timestamp AND t.spacecraft_id = $1`,
+			`DELETE FROM anomaly_history WHERE spacecraft_id = $1`,
+			`DELETE FROM events WHERE spacecraft_id = $1`,
+			`DELETE FROM incidents WHERE spacecraft_id = $1`,
+			`DELETE FROM telemetry WHERE spacecraft_id = $1`,
+		} {
+			if _, err := conn.Exec(query, testSpacecraftID); err != nil {
+				t.Errorf("deleting test rows: %v", err)
+			}
+		}
+	})
+	return conn
+}
+
+// insertTestTelemetry stores a packet of the test spacecraft that is within
+// limits except for its temperature, and returns its id.
+func insertTestTelemetry(t *testing.T, tx queryRower, ts time.Time, temperature float32) int {
+	t.Helper()
+	var id int
+	err := tx.QueryRow(`
+		INSERT INTO telemetry (
+			timestamp, spacecraft_id, packet_id, packet_seq_ctrl, subsystem_id,
+			temperature, battery, altitude, signal_strength
+		) VALUES ($1, $2, 2049, 49153, 1, $3, 80, 500, -50)
+		RETURNING id
+	`, ts, testSpacecraftID, temperature).Scan(&id)
+	require.NoError(t, err)
+	return id
+}
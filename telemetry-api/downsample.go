@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	downsampleLTTB   = "lttb"
+	downsampleMinMax = "minmax"
+
+	defaultDownsamplePoints = 1000
+	minDownsamplePoints     = 3
+	maxDownsamplePoints     = 10000
+
+	maxDownsampleParameters = 8
+)
+
+type DownsampledPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// DownsampledSeries is one parameter reduced from RawCount rows to at most
+// the requested number of points.
+type DownsampledSeries struct {
+	Parameter string             `json:"parameter"`
+	RawCount  int                `json:"raw_count"`
+	Points    []DownsampledPoint `json:"points"`
+}
+
+type DownsampleResult struct {
+	Method    string              `json:"method"`
+	MaxPoints int                 `json:"max_points"`
+	StartTime time.Time           `json:"start_time"`
+	EndTime   time.Time           `json:"end_time"`
+	Series    []DownsampledSeries `json:"series"`
+}
+
+// sampler reduces a series fed in time order. Both implementations bucket
+// the requested range by time, so they need a bucket's worth of points at
+// most rather than the whole series.
+type sampler interface {
+	add(p DownsampledPoint)
+	finish() []DownsampledPoint
+}
+
+// timeBuckets splits [start, end] into n equal buckets.
+type timeBuckets struct {
+	start time.Time
+	width float64
+	n     int
+}
+
+func newTimeBuckets(start, end time.Time, n int) timeBuckets {
+	return timeBuckets{start: start, width: float64(end.Sub(start)) / float64(n), n: n}
+}
+
+func (b timeBuckets) index(t time.Time) int {
+	i := 0
+	if b.width > 0 {
+		i = int(float64(t.Sub(b.start)) / b.width)
+	}
+	if i < 0 {
+		return 0
+	}
+	if i >= b.n {
+		return b.n - 1
+	}
+	return i
+}
+
+// x is the position of t on the time axis used for triangle areas.
+func (b timeBuckets) x(t time.Time) float64 {
+	return t.Sub(b.start).Seconds()
+}
+
+type lttbBucket struct {
+	index  int
+	points []DownsampledPoint
+}
+
+// lttbSampler implements Largest-Triangle-Three-Buckets over time buckets.
+// The first and last points are kept; every other bucket contributes the
+// point forming the largest triangle with the point chosen before it and
+// the average of the next non-empty bucket. Only the current and next
+// buckets are held, and the latest point is held back until another arrives
+// because the last point is not bucketed.
+type lttbSampler struct {
+	buckets timeBuckets
+	out     []DownsampledPoint
+	cur     lttbBucket
+	next    lttbBucket
+	latest  *DownsampledPoint
+}
+
+func newLTTBSampler(start, end time.Time, points int) *lttbSampler {
+	return &lttbSampler{buckets: newTimeBuckets(start, end, points-2)}
+}
+
+func (s *lttbSampler) add(p DownsampledPoint) {
+	if len(s.out) == 0 {
+		s.out = append(s.out, p)
+		return
+	}
+	if s.latest != nil {
+		s.place(*s.latest)
+	}
+	s.latest = &p
+}
+
+func (s *lttbSampler) place(p DownsampledPoint) {
+	i := s.buckets.index(p.Timestamp)
+	switch {
+	case len(s.cur.points) == 0:
+		s.cur = lttbBucket{index: i, points: []DownsampledPoint{p}}
+	case i == s.cur.index:
+		s.cur.points = append(s.cur.points, p)
+	case len(s.next.points) == 0 || i == s.next.index:
+		s.next.index = i
+		s.next.points = append(s.next.points, p)
+	default:
+		cx, cy := s.average(s.next)
+		s.choose(s.cur, cx, cy)
+		// Reuse the chosen bucket's storage for the new one.
+		s.cur, s.next = s.next, lttbBucket{index: i, points: append(s.cur.points[:0], p)}
+	}
+}
+
+func (s *lttbSampler) average(b lttbBucket) (float64, float64) {
+	var x, y float64
+	for _, p := range b.points {
+		x += s.buckets.x(p.Timestamp)
+		y += p.Value
+	}
+	n := float64(len(b.points))
+	return x / n, y / n
+}
+
+// choose appends the point of b forming the largest triangle with the last
+// chosen point and (cx, cy).
+func (s *lttbSampler) choose(b lttbBucket, cx, cy float64) {
+	a := s.out[len(s.out)-1]
+	ax, ay := s.buckets.x(a.Timestamp), a.Value
+
+	best, bestArea := 0, -1.0
+	for i, p := range b.points {
+		bx := s.buckets.x(p.Timestamp)
+		area := math.Abs((ax-cx)*(p.Value-ay) - (ax-bx)*(cy-ay))
+		if area > bestArea {
+			best, bestArea = i, area
+		}
+	}
+	s.out = append(s.out, b.points[best])
+}
+
+func (s *lttbSampler) finish() []DownsampledPoint {
+	if s.latest == nil {
+		return s.out
+	}
+	last := *s.latest
+	lx := s.buckets.x(last.Timestamp)
+
+	if len(s.cur.points) > 0 {
+		if len(s.next.points) > 0 {
+			cx, cy := s.average(s.next)
+			s.choose(s.cur, cx, cy)
+			s.choose(s.next, lx, last.Value)
+		} else {
+			s.choose(s.cur, lx, last.Value)
+		}
+	}
+	return append(s.out, last)
+}
+
+// minMaxSampler keeps the lowest and highest point of each time bucket, in
+// time order, so the envelope of the series survives decimation.
+type minMaxSampler struct {
+	buckets  timeBuckets
+	out      []DownsampledPoint
+	index    int
+	min, max *DownsampledPoint
+}
+
+func newMinMaxSampler(start, end time.Time, points int) *minMaxSampler {
+	return &minMaxSampler{buckets: newTimeBuckets(start, end, points/2)}
+}
+
+func (s *minMaxSampler) add(p DownsampledPoint) {
+	i := s.buckets.index(p.Timestamp)
+	if s.min != nil && i != s.index {
+		s.flush()
+	}
+	s.index = i
+	if s.min == nil || p.Value < s.min.Value {
+		q := p
+		s.min = &q
+	}
+	if s.max == nil || p.Value > s.max.Value {
+		q := p
+		s.max = &q
+	}
+}
+
+func (s *minMaxSampler) flush() {
+	first, second := *s.min, *s.max
+	if second.Timestamp.Before(first.Timestamp) {
+		first, second = second, first
+	}
+	s.out = append(s.out, first)
+	if second != first {
+		s.out = append(s.out, second)
+	}
+	s.min, s.max = nil, nil
+}
+
+func (s *minMaxSampler) finish() []DownsampledPoint {
+	if s.min != nil {
+		s.flush()
+	}
+	return s.out
+}
+
+// seriesSampler buffers up to max points and only starts sampling when a
+// series turns out to be longer, so short series are returned unchanged.
+type seriesSampler struct {
+	max     int
+	count   int
+	buf     []DownsampledPoint
+	sampler sampler
+	create  func() sampler
+}
+
+func newSeriesSampler(method string, start, end time.Time, max int) *seriesSampler {
+	create := func() sampler { return newLTTBSampler(start, end, max) }
+	if method == downsampleMinMax {
+		create = func() sampler { return newMinMaxSampler(start, end, max) }
+	}
+	return &seriesSampler{max: max, create: create}
+}
+
+func (s *seriesSampler) add(p DownsampledPoint) {
+	s.count++
+	if s.sampler != nil {
+		s.sampler.add(p)
+		return
+	}
+	s.buf = append(s.buf, p)
+	if len(s.buf) > s.max {
+		s.sampler = s.create()
+		for _, q := range s.buf {
+			s.sampler.add(q)
+		}
+		s.buf = nil
+	}
+}
+
+func (s *seriesSampler) finish() []DownsampledPoint {
+	if s.sampler != nil {
+		return s.sampler.finish()
+	}
+	if s.buf == nil {
+		return []DownsampledPoint{}
+	}
+	return s.buf
+}
+
+type downsampleRequest struct {
+	Downlinked   []string
+	Derived      []string
+	Method       string
+	Points       int
+	Start        time.Time
+	End          time.Time
+	SpacecraftID *int
+}
+
+func parseDownsampleRequest(c *fiber.Ctx) (downsampleRequest, error) {
+	var req downsampleRequest
+
+	start, end, err := queryTimeRange(c)
+	if err != nil {
+		return req, err
+	}
+	if start == nil || end == nil || !end.After(*start) {
+		return req, invalidParam("start_time", "start_time and end_time are required and end_time must be after start_time")
+	}
+	req.Start, req.End = *start, *end
+
+	if req.Downlinked, req.Derived, err = queryParameterList(c, maxDownsampleParameters); err != nil {
+		return req, err
+	}
+
+	req.Method = strings.ToLower(c.Query("method", downsampleLTTB))
+	if req.Method != downsampleLTTB && req.Method != downsampleMinMax {
+		return req, invalidParam("method", "method must be lttb or minmax")
+	}
+
+	req.Points = defaultDownsamplePoints
+	points, err := queryInt(c, "points")
+	if err != nil {
+		return req, err
+	}
+	if points != nil {
+		if *points < minDownsamplePoints || *points > maxDownsamplePoints {
+			return req, invalidParam("points", "points must be between %d and %d", minDownsamplePoints, maxDownsamplePoints)
+		}
+		req.Points = *points
+	}
+
+	if req.SpacecraftID, err = queryInt(c, "spacecraft_id"); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// streamSeries feeds the rows of query, ordered by time, to one sampler per
+// value column. Rows are processed as they are read.
+func streamSeries(query string, args []interface{}, samplers []*seriesSampler) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ts time.Time
+	values := make([]sql.NullFloat64, len(samplers))
+	dest := []interface{}{&ts}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			if v.Valid {
+				samplers[i].add(DownsampledPoint{Timestamp: ts, Value: v.Float64})
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// getDownsampledTelemetry returns at most points representative points per
+// parameter for a time range, for charting long ranges at full fidelity.
+func getDownsampledTelemetry(c *fiber.Ctx) error {
+	req, err := parseDownsampleRequest(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	if err := checkDerivedParameters(req.Derived); err != nil {
+		return sendError(c, err)
+	}
+
+	samplers := map[string]*seriesSampler{}
+	for _, name := range append(append([]string{}, req.Downlinked...), req.Derived...) {
+		samplers[name] = newSeriesSampler(req.Method, req.Start, req.End, req.Points)
+	}
+
+	spacecraft := ""
+	args := []interface{}{req.Start, req.End}
+	if req.SpacecraftID != nil {
+		args = append(args, *req.SpacecraftID)
+		spacecraft = " AND t.spacecraft_id = $3"
+	}
+
+	if len(req.Downlinked) > 0 {
+		var columns []string
+		var series []*seriesSampler
+		for _, name := range req.Downlinked {
+			columns = append(columns, "t."+downlinkedParameters[name])
+			series = append(series, samplers[name])
+		}
+		query := fmt.Sprintf(`SELECT t.timestamp, %s FROM telemetry t
+			WHERE t.timestamp >= $1 AND t.timestamp <= $2%s
+			ORDER BY t.timestamp`, strings.Join(columns, ", "), spacecraft)
+		if err := streamSeries(query, args, series); err != nil {
+			return sendError(c, internalError("Failed to query telemetry data", err))
+		}
+	}
+
+	for _, name := range req.Derived {
+		query := fmt.Sprintf(`SELECT d.timestamp, d.value FROM derived_values d
+			JOIN telemetry t ON t.id = d.telemetry_id AND t.timestamp = d.timestamp
+			WHERE d.timestamp >= $1 AND d.timestamp <= $2%s AND d.parameter_name = $%d
+			ORDER BY d.timestamp`, spacecraft, len(args)+1)
+		if err := streamSeries(query, append(args, name), []*seriesSampler{samplers[name]}); err != nil {
+			return sendError(c, internalError("Failed to query parameter values", err))
+		}
+	}
+
+	result := DownsampleResult{
+		Method:    req.Method,
+		MaxPoints: req.Points,
+		StartTime: req.Start,
+		EndTime:   req.End,
+		Series:    make([]DownsampledSeries, 0, len(samplers)),
+	}
+	for _, name := range append(append([]string{}, req.Downlinked...), req.Derived...) {
+		s := samplers[name]
+		result.Series = append(result.Series, DownsampledSeries{Parameter: name, RawCount: s.count, Points: s.finish()})
+	}
+	return c.JSON(result)
+}
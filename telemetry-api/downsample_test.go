@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sineSeries(start time.Time, n int) []DownsampledPoint {
+	points := make([]DownsampledPoint, n)
+	for i := range points {
+		points[i] = DownsampledPoint{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Value:     math.Sin(float64(i) / 50),
+		}
+	}
+	return points
+}
+
+func sample(s sampler, points []DownsampledPoint) []DownsampledPoint {
+	for _, p := range points {
+		s.add(p)
+	}
+	return s.finish()
+}
+
+func assertOrdered(t *testing.T, points []DownsampledPoint) {
+	for i := 1; i < len(points); i++ {
+		assert.True(t, points[i].Timestamp.After(points[i-1].Timestamp), "point %d out of order", i)
+	}
+}
+
+func TestLTTBSampler(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	raw := sineSeries(start, 10000)
+	end := raw[len(raw)-1].Timestamp
+
+	got := sample(newLTTBSampler(start, end, 100), raw)
+	assert.LessOrEqual(t, len(got), 100)
+	assert.GreaterOrEqual(t, len(got), 98)
+	assert.Equal(t, raw[0], got[0])
+	assert.Equal(t, raw[len(raw)-1], got[len(got)-1])
+	assertOrdered(t, got)
+
+	// The peaks of the sine wave are the largest triangles and survive.
+	var max float64
+	for _, p := range got {
+		max = math.Max(max, p.Value)
+	}
+	assert.InDelta(t, 1, max, 0.01)
+}
+
+func TestLTTBSamplerKeepsSpike(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	raw := make([]DownsampledPoint, 1000)
+	for i := range raw {
+		raw[i] = DownsampledPoint{Timestamp: start.Add(time.Duration(i) * time.Second)}
+	}
+	raw[500].Value = 100
+
+	got := sample(newLTTBSampler(start, raw[len(raw)-1].Timestamp, 10), raw)
+	assert.Contains(t, got, raw[500])
+}
+
+func TestMinMaxSampler(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	raw := sineSeries(start, 10000)
+	raw[4321].Value = -5
+
+	got := sample(newMinMaxSampler(start, raw[len(raw)-1].Timestamp, 100), raw)
+	assert.LessOrEqual(t, len(got), 100)
+	assert.Contains(t, got, raw[4321])
+	assertOrdered(t, got)
+
+	// A bucket whose min and max are one point emits it once.
+	got = sample(newMinMaxSampler(start, start.Add(time.Hour), 10), raw[:1])
+	assert.Equal(t, raw[:1], got)
+}
+
+func TestSeriesSamplerReturnsShortSeriesUnchanged(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	raw := sineSeries(start, 50)
+
+	for _, method := range []string{downsampleLTTB, downsampleMinMax} {
+		s := newSeriesSampler(method, start, start.Add(time.Hour), 50)
+		assert.Equal(t, raw, sample(s, raw), method)
+		assert.Equal(t, 50, s.count, method)
+
+		s = newSeriesSampler(method, start, start.Add(time.Hour), 10)
+		assert.LessOrEqual(t, len(sample(s, raw)), 10, method)
+		assert.Equal(t, 50, s.count, method)
+	}
+
+	assert.Equal(t, []DownsampledPoint{}, newSeriesSampler(downsampleLTTB, start, start.Add(time.Hour), 10).finish())
+}
+
+func TestDownsampledTelemetryKeepsExtremes(t *testing.T) {
+	withTestDB(t)
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/downsample", getDownsampledTelemetry)
+
+	start := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 60; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		temperature, health := float32(25), 80.0
+		if i == 30 {
+			temperature = 45
+		}
+		if i == 10 {
+			health = 10
+		}
+		id := insertTestTelemetry(t, db, ts, temperature)
+		_, err := db.Exec(`
+			INSERT INTO derived_values (telemetry_id, timestamp, parameter_name, value)
+			VALUES ($1, $2, 'battery_health', $3)
+		`, id, ts, health)
+		require.NoError(t, err)
+	}
+
+	q := url.Values{
+		"parameter":     {"temperature,battery_health"},
+		"method":        {downsampleMinMax},
+		"points":        {"10"},
+		"spacecraft_id": {fmt.Sprint(testSpacecraftID)},
+		"start_time":    {"2001-01-01T00:00:00Z"},
+		"end_time":      {"2001-01-01T01:00:00Z"},
+	}
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/telemetry/downsample?"+q.Encode(), nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result DownsampleResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result.Series, 2)
+	for _, tc := range []struct {
+		parameter string
+		extreme   DownsampledPoint
+	}{
+		{"temperature", DownsampledPoint{Timestamp: start.Add(30 * time.Minute), Value: 45}},
+		{"battery_health", DownsampledPoint{Timestamp: start.Add(10 * time.Minute), Value: 10}},
+	} {
+		var series *DownsampledSeries
+		for i := range result.Series {
+			if result.Series[i].Parameter == tc.parameter {
+				series = &result.Series[i]
+			}
+		}
+		require.NotNil(t, series, tc.parameter)
+		assert.Equal(t, 60, series.RawCount, tc.parameter)
+		assert.LessOrEqual(t, len(series.Points), 10, tc.parameter)
+		assertOrdered(t, series.Points)
+
+		found := false
+		for _, p := range series.Points {
+			found = found || p.Timestamp.Equal(tc.extreme.Timestamp) && p.Value == tc.extreme.Value
+		}
+		assert.True(t, found, "%s keeps %+v", tc.parameter, tc.extreme)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Error codes returned in the code field of every error response.
+const (
+	codeInvalidParameter = "invalid_parameter"
+	codeInvalidBody      = "invalid_body"
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeInternal         = "internal_error"
+)
+
+// APIError is the body of every error response:
+//
+//	{"error": "limit must be between 1 and 10000", "code": "invalid_parameter", "field": "limit"}
+//
+// Internal errors carry a generic message only; the cause is logged.
+type APIError struct {
+	Status  int    `json:"-"`
+	Message string `json:"error"`
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func invalidParam(field, format string, args ...interface{}) *APIError {
+	return &APIError{Status: 400, Message: fmt.Sprintf(format, args...), Code: codeInvalidParameter, Field: field}
+}
+
+func invalidBody(message string) *APIError {
+	return &APIError{Status: 400, Message: message, Code: codeInvalidBody}
+}
+
+// invalidField reports a request body field that fails validation.
+func invalidField(field, format string, args ...interface{}) *APIError {
+	return &APIError{Status: 400, Message: fmt.Sprintf(format, args...), Code: codeInvalidBody, Field: field}
+}
+
+func notFound(message string) *APIError {
+	return &APIError{Status: 404, Message: message, Code: codeNotFound}
+}
+
+func conflict(message string) *APIError {
+	return &APIError{Status: 409, Message: message, Code: codeConflict}
+}
+
+// internalError logs err and returns a 500 with message only, so database
+// errors never reach the client.
+func internalError(message string, err error) *APIError {
+	log.Printf("%s: %v", message, err)
+	return &APIError{Status: 500, Message: message, Code: codeInternal}
+}
+
+// sendError writes err in the APIError format. Errors that are not an
+// *APIError or *fiber.Error are treated as internal.
+func sendError(c *fiber.Ctx, err error) error {
+	var apiErr *APIError
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &fiberErr):
+		apiErr = &APIError{Status: fiberErr.Code, Message: fiberErr.Message, Code: codeForStatus(fiberErr.Code)}
+	default:
+		apiErr = internalError("Internal server error", err)
+	}
+	return c.Status(apiErr.Status).JSON(apiErr)
+}
+
+func codeForStatus(status int) string {
+	switch {
+	case status == 404:
+		return codeNotFound
+	case status == 409:
+		return codeConflict
+	case status >= 500:
+		return codeInternal
+	default:
+		return codeInvalidParameter
+	}
+}
+
+// errorHandler is the app's fiber ErrorHandler, so errors from middleware and
+// unknown routes use the same body as the handlers.
+func errorHandler(c *fiber.Ctx, err error) error {
+	return sendError(c, err)
+}
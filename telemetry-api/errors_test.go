@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendError(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+	app.Get("/invalid", func(c *fiber.Ctx) error {
+		return sendError(c, invalidParam("limit", "limit must be between 1 and %d", 10))
+	})
+	app.Get("/internal", func(c *fiber.Ctx) error {
+		return sendError(c, internalError("Failed to query telemetry data", errors.New(`pq: relation "telemetry" does not exist`)))
+	})
+	app.Get("/unexpected", func(c *fiber.Ctx) error {
+		return errors.New("pq: connection refused")
+	})
+
+	cases := []struct {
+		path   string
+		status int
+		body   APIError
+	}{
+		{"/invalid", 400, APIError{Message: "limit must be between 1 and 10", Code: codeInvalidParameter, Field: "limit"}},
+		{"/internal", 500, APIError{Message: "Failed to query telemetry data", Code: codeInternal}},
+		{"/unexpected", 500, APIError{Message: "Internal server error", Code: codeInternal}},
+		{"/missing", 404, APIError{Message: "Cannot GET /missing", Code: codeNotFound}},
+	}
+
+	for _, tc := range cases {
+		resp, err := app.Test(httptest.NewRequest("GET", tc.path, nil))
+		require.NoError(t, err)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.path)
+
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.NotContains(t, string(raw), "pq:", tc.path)
+
+		var body APIError
+		require.NoError(t, json.Unmarshal(raw, &body))
+		assert.Equal(t, tc.body, body, tc.path)
+	}
+}
+
+func TestEndpointsReturnErrorModel(t *testing.T) {
+	app := fiber.New()
+	app.Get("/api/v1/telemetry", getTelemetry)
+	app.Get("/api/v1/telemetry/anomalies", getAnomalies)
+	app.Get("/api/v1/telemetry/aggregations", getAggregations)
+	app.Get("/api/v1/telemetry/aggregations/min", getMinAggregations)
+	app.Get("/api/v1/telemetry/aggregations/max", getMaxAggregations)
+	app.Get("/api/v1/telemetry/anomalies/count", getAnomalyCount)
+	app.Get("/api/v1/telemetry/downsample", getDownsampledTelemetry)
+	app.Get("/api/v2/telemetry", getTelemetryPage)
+	app.Get("/api/v2/telemetry/anomalies", getAnomalyPage)
+	app.Get("/api/v1/passes", getPasses)
+	app.Get("/api/v1/passes/:id", getPassReport)
+	app.Get("/api/v1/clock/models", getClockModels)
+	app.Get("/api/v1/clock/samples", getClockSamples)
+	app.Get("/api/v1/housekeeping", getHousekeeping)
+	app.Get("/api/v1/commands", getCommands)
+	app.Get("/api/v1/commands/:id", getCommand)
+	app.Get("/api/v1/incidents", getIncidents)
+	app.Get("/api/v1/incidents/:id", getIncident)
+	app.Get("/api/v1/incidents/:id/timeline", getIncidentTimeline)
+
+	cases := []struct {
+		path  string
+		field string
+	}{
+		{"/api/v1/telemetry?limit=abc", "limit"},
+		{"/api/v1/telemetry?start_time=yesterday", "start_time"},
+		{"/api/v1/telemetry/anomalies?limit=-1", "limit"},
+		{"/api/v1/telemetry/anomalies?incident_id=x", "incident_id"},
+		{"/api/v1/telemetry/aggregations?bucket_size=7%20minutes", "bucket_size"},
+		{"/api/v1/telemetry/aggregations/min?bucket_size=banana", "bucket_size"},
+		{"/api/v1/telemetry/aggregations/max?end_time=tomorrow", "end_time"},
+		{"/api/v1/telemetry/anomalies/count?start_time=now&end_time=now-1d", "end_time"},
+		{"/api/v1/telemetry/downsample?parameter=temperature", "start_time"},
+		{"/api/v1/telemetry/downsample?parameter=temperature&start_time=now-1h", "start_time"},
+		{"/api/v1/telemetry/downsample?parameter=temperature&start_time=now&end_time=now", "start_time"},
+		{"/api/v1/telemetry/downsample?start_time=now-1h&end_time=now", "parameter"},
+		{"/api/v1/telemetry/downsample?parameter=temperature&start_time=now-1h&end_time=now&method=average", "method"},
+		{"/api/v1/telemetry/downsample?parameter=temperature&start_time=now-1h&end_time=now&points=2", "points"},
+		{"/api/v1/telemetry/downsample?parameter=temperature&start_time=now-1h&end_time=now&points=20000", "points"},
+		{"/api/v1/telemetry/downsample?parameter=temperature&start_time=now-1h&end_time=now&spacecraft_id=x", "spacecraft_id"},
+		{"/api/v2/telemetry?limit=0", "limit"},
+		{"/api/v2/telemetry?limit=5000", "limit"},
+		{"/api/v2/telemetry?order=sideways", "order"},
+		{"/api/v2/telemetry?cursor=garbage", "cursor"},
+		{"/api/v2/telemetry?start_time=yesterday", "start_time"},
+		{"/api/v2/telemetry?spacecraft_id=one", "spacecraft_id"},
+		{"/api/v2/telemetry/anomalies?acknowledged=maybe", "acknowledged"},
+		{"/api/v2/telemetry/anomalies?end_time=soon", "end_time"},
+		{"/api/v1/passes/abc", "id"},
+		{"/api/v1/passes?status=lost", "status"},
+		{"/api/v1/passes?spacecraft_id=x", "spacecraft_id"},
+		{"/api/v1/passes?start_time=yesterday", "start_time"},
+		{"/api/v1/passes?limit=0", "limit"},
+		{"/api/v1/clock/models?spacecraft_id=x", "spacecraft_id"},
+		{"/api/v1/clock/models?limit=0", "limit"},
+		{"/api/v1/clock/samples?start_time=yesterday", "start_time"},
+		{"/api/v1/clock/samples?spacecraft_id=1.5", "spacecraft_id"},
+		{"/api/v1/housekeeping?structure_id=x", "structure_id"},
+		{"/api/v1/commands?status=done", "status"},
+		{"/api/v1/commands?apid=x", "apid"},
+		{"/api/v1/commands/abc", "id"},
+		{"/api/v1/incidents?status=bogus", "status"},
+		{"/api/v1/incidents?severity=urgent", "severity"},
+		{"/api/v1/incidents/abc", "id"},
+		{"/api/v1/incidents/0/timeline", "id"},
+		{"/api/v1/incidents/1/timeline?limit=0", "limit"},
+	}
+
+	for _, tc := range cases {
+		resp, err := app.Test(httptest.NewRequest("GET", tc.path, nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, tc.path)
+
+		var body APIError
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, codeInvalidParameter, body.Code, tc.path)
+		assert.Equal(t, tc.field, body.Field, tc.path)
+	}
+}
+
+// jsonRequest builds a request with a JSON body.
+func jsonRequest(method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// requireAPIError sends req to app and checks that it fails with the status,
+// code and field of the error model.
+func requireAPIError(t *testing.T, app *fiber.App, req *http.Request, status int, code, field string) {
+	t.Helper()
+	name := req.Method + " " + req.URL.String()
+	resp, err := app.Test(req)
+	require.NoError(t, err, name)
+	require.Equal(t, status, resp.StatusCode, name)
+
+	var body APIError
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body), name)
+	assert.Equal(t, code, body.Code, name)
+	assert.Equal(t, field, body.Field, name)
+	assert.NotEmpty(t, body.Message, name)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// Onboard events come from the event APID and from ST[5] reports of PUS
+// APIDs. telemetry-ingestion formats each event's message from the event
+// dictionary as it stores it.
+
+var eventSeverities = map[string]bool{"INFO": true, "LOW": true, "MEDIUM": true, "HIGH": true}
+
+// maxEventQueryLength bounds the q search parameter.
+const maxEventQueryLength = 200
+
+// Event is an onboard event. Timestamp is the onboard time. Name is unset for
+// text events and events missing from the dictionary; Data is the auxiliary
+// data of a PUS event report, in hex.
+type Event struct {
+	ID           int       `json:"id"`
+	Timestamp    time.Time `json:"timestamp"`
+	SpacecraftID int       `json:"spacecraft_id"`
+	APID         int       `json:"apid"`
+	SeqCount     int       `json:"seq_count"`
+	SubsystemID  int       `json:"subsystem_id"`
+	Severity     string    `json:"severity"`
+	EventID      int       `json:"event_id"`
+	Name         *string   `json:"name,omitempty"`
+	Message      string    `json:"message"`
+	Arguments    []float64 `json:"arguments,omitempty"`
+	Data         string    `json:"data,omitempty"`
+	Station      string    `json:"station"`
+	ReceivedAt   time.Time `json:"received_at"`
+}
+
+// EventDefinition is an entry of the event dictionary. {0}, {1}, ... in
+// Message stand for the event's arguments.
+type EventDefinition struct {
+	EventID     int       `json:"event_id"`
+	Name        string    `json:"name"`
+	Message     string    `json:"message"`
+	Description *string   `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const eventColumns = `id, timestamp, spacecraft_id, apid, seq_count, subsystem_id, severity, event_id, name,
+		   message, arguments, data, station, received_at`
+
+func scanEvent(row rowScanner) (Event, error) {
+	var e Event
+	var data []byte
+	err := row.Scan(&e.ID, &e.Timestamp, &e.SpacecraftID, &e.APID, &e.SeqCount, &e.SubsystemID, &e.Severity,
+		&e.EventID, &e.Name, &e.Message, pq.Array(&e.Arguments), &data, &e.Station, &e.ReceivedAt)
+	e.Data = hex.EncodeToString(data)
+	return e, err
+}
+
+// getEvents lists events by onboard time, latest first. q searches the names
+// and messages of events with web search syntax:
+//
+//	GET /api/v1/events?severity=high,medium&q=heater -off&start_time=now-24h
+func getEvents(c *fiber.Ctx) error {
+	severities := splitList(strings.ToUpper(c.Query("severity")))
+	for _, s := range severities {
+		if !eventSeverities[s] {
+			return sendError(c, invalidParam("severity", "severity must be info, low, medium or high"))
+		}
+	}
+	search := strings.TrimSpace(c.Query("q"))
+	if len(search) > maxEventQueryLength {
+		return sendError(c, invalidParam("q", "q must be at most %d characters", maxEventQueryLength))
+	}
+	name := strings.ToUpper(c.Query("name"))
+	eventID, err := queryInt(c, "event_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	subsystemID, err := queryInt(c, "subsystem_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	apid, err := queryInt(c, "apid")
+	if err != nil {
+		return sendError(c, err)
+	}
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + eventColumns + ` FROM events WHERE 1=1`
+	args := []interface{}{}
+	argCount := 0
+
+	if len(severities) > 0 {
+		argCount++
+		query += fmt.Sprintf(" AND severity = ANY($%d)", argCount)
+		args = append(args, pq.Array(severities))
+	}
+
+	if search != "" {
+		argCount++
+		query += fmt.Sprintf(" AND event_search_document(name, message) @@ websearch_to_tsquery('simple', $%d)", argCount)
+		args = append(args, search)
+	}
+
+	if name != "" {
+		argCount++
+		query += fmt.Sprintf(" AND name = $%d", argCount)
+		args = append(args, name)
+	}
+
+	if eventID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND event_id = $%d", argCount)
+		args = append(args, *eventID)
+	}
+
+	if subsystemID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND subsystem_id = $%d", argCount)
+		args = append(args, *subsystemID)
+	}
+
+	if apid != nil {
+		argCount++
+		query += fmt.Sprintf(" AND apid = $%d", argCount)
+		args = append(args, *apid)
+	}
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND spacecraft_id = $%d", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY timestamp DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query events", err))
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			log.Printf("Error scanning event row: %v", err)
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return c.JSON(events)
+}
+
+// getEventDictionary lists the event definitions.
+func getEventDictionary(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT event_id, name, message, description, created_at
+		FROM event_dictionary
+		ORDER BY event_id
+	`)
+	if err != nil {
+		return sendError(c, internalError("Failed to query event dictionary", err))
+	}
+	defer rows.Close()
+
+	definitions := make([]EventDefinition, 0)
+	for rows.Next() {
+		var d EventDefinition
+		if err := rows.Scan(&d.EventID, &d.Name, &d.Message, &d.Description, &d.CreatedAt); err != nil {
+			log.Printf("Error scanning event definition row: %v", err)
+			continue
+		}
+		definitions = append(definitions, d)
+	}
+
+	return c.JSON(definitions)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanEventEncodesData(t *testing.T) {
+	onboard := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	event, err := scanEvent(stubScanner{values: []interface{}{
+		3, onboard, 1, 0x20, 77, 0x20, "HIGH", 0x1001, "SAFE_MODE_ENTERED", "Safe mode entered, battery at ?%",
+		nil, []byte{0xCA, 0xFE}, "GS1", onboard.Add(time.Second),
+	}})
+
+	require.NoError(t, err)
+	assert.Equal(t, "HIGH", event.Severity)
+	assert.Equal(t, 0x1001, event.EventID)
+	require.NotNil(t, event.Name)
+	assert.Equal(t, "SAFE_MODE_ENTERED", *event.Name)
+	assert.Equal(t, "cafe", event.Data)
+}
+
+func TestScanTextEvent(t *testing.T) {
+	onboard := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	event, err := scanEvent(stubScanner{values: []interface{}{
+		4, onboard, 1, 2, 78, 3, "INFO", 0, nil, "deployment complete", nil, nil, "GS1", onboard,
+	}})
+
+	require.NoError(t, err)
+	assert.Nil(t, event.Name)
+	assert.Equal(t, "deployment complete", event.Message)
+	assert.Empty(t, event.Data)
+}
+
+func TestGetEventsSearchesNamesAndMessages(t *testing.T) {
+	withTestDB(t)
+	app := fiber.New()
+	app.Get("/api/v1/events", getEvents)
+
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []struct {
+		severity string
+		name     sql.NullString
+		message  string
+	}{
+		{"INFO", sql.NullString{String: "HEATER_ON", Valid: true}, "Heater 2 on"},
+		{"INFO", sql.NullString{String: "HEATER_OFF", Valid: true}, "Heater 2 off"},
+		{"HIGH", sql.NullString{String: "SAFE_MODE_ENTERED", Valid: true}, "Safe mode entered, battery at 12%"},
+		{"MEDIUM", sql.NullString{String: "LOW_SIGNAL", Valid: true}, "Downlink signal degraded to 3 dB"},
+		{"INFO", sql.NullString{}, "deployment complete"},
+	} {
+		_, err := db.Exec(`
+			INSERT INTO events (
+				timestamp, spacecraft_id, apid, seq_count, subsystem_id, severity, event_id, name, message,
+				station, received_at
+			) VALUES ($1, $2, 32, $3, 1, $4, $5, $6, $7, 'GS1', $1)
+		`, ts.Add(time.Duration(i)*time.Second), testSpacecraftID, i, e.severity, i, e.name, e.message)
+		require.NoError(t, err)
+	}
+
+	search := func(params url.Values) []string {
+		params.Set("spacecraft_id", fmt.Sprint(testSpacecraftID))
+		params.Set("start_time", "2001-01-01T00:00:00Z")
+		params.Set("end_time", "2001-01-02T00:00:00Z")
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/events?"+params.Encode(), nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, params.Encode())
+
+		var events []Event
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+		messages := make([]string, len(events))
+		for i, e := range events {
+			messages[i] = e.Message
+		}
+		return messages
+	}
+
+	// Latest first.
+	assert.Equal(t, []string{"Heater 2 off", "Heater 2 on"}, search(url.Values{"q": {"heater"}}))
+	assert.Equal(t, []string{"Heater 2 on"}, search(url.Values{"q": {"heater -off"}}))
+	// Names are searched with their words split on underscores.
+	assert.Equal(t, []string{"Downlink signal degraded to 3 dB"}, search(url.Values{"q": {"low"}}))
+	assert.Equal(t, []string{"deployment complete"}, search(url.Values{"q": {"Deployment"}}))
+	assert.Equal(t, []string{"Safe mode entered, battery at 12%", "Heater 2 off"},
+		search(url.Values{"q": {"entered or off"}}))
+	assert.Equal(t, []string{"Downlink signal degraded to 3 dB", "Safe mode entered, battery at 12%"},
+		search(url.Values{"severity": {"high,medium"}}))
+	assert.Empty(t, search(url.Values{"q": {"heater"}, "severity": {"high"}}))
+}
+
+func TestEventsRejectsInvalidRequests(t *testing.T) {
+	app := fiber.New()
+	app.Get("/api/v1/events", getEvents)
+
+	cases := []struct {
+		path  string
+		field string
+	}{
+		{"/api/v1/events?severity=critical", "severity"},
+		{"/api/v1/events?severity=high,bad", "severity"},
+		{"/api/v1/events?event_id=1.5", "event_id"},
+		{"/api/v1/events?subsystem_id=x", "subsystem_id"},
+		{"/api/v1/events?q=" + url.QueryEscape(strings.Repeat("heater ", 40)), "q"},
+		{"/api/v1/events?start_time=yesterday", "start_time"},
+	}
+
+	for _, tc := range cases {
+		resp, err := app.Test(httptest.NewRequest("GET", tc.path, nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, tc.path)
+
+		var body APIError
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, tc.field, body.Field, tc.path)
+	}
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	exportCSV     = "csv"
+	exportNDJSON  = "ndjson"
+	exportParquet = "parquet"
+
+	// exportFlushRows is how often a streamed export is flushed to the
+	// client. A failed flush means the client went away.
+	exportFlushRows = 1000
+
+	// exportRowGroupRows and exportRowGroupBytes bound what a Parquet export
+	// buffers before writing a row group. The byte bound counts values before
+	// encoding and compression, so wide rows do not hold a large group in
+	// memory or keep the client waiting.
+	exportRowGroupRows  = 100000
+	exportRowGroupBytes = 8 << 20
+
+	// exportWatchInterval is how often an export checks that its client is
+	// still connected. A selective export may write nothing for a long time,
+	// so a failed flush alone does not notice a disconnect.
+	exportWatchInterval = time.Second
+)
+
+type exportKind int
+
+const (
+	exportInt exportKind = iota
+	exportReal
+	exportBool
+	exportString
+	exportTime
+)
+
+type exportColumn struct {
+	Name string
+	Kind exportKind
+}
+
+// exportTable is a table that can be exported. Where filters out rows that
+// are never exported, and Filters lists the query parameters accepted on
+// top of the time range and spacecraft.
+type exportTable struct {
+	Name    string
+	From    string
+	Where   string
+	Columns []exportColumn
+	Filters map[string]exportColumn
+}
+
+var exportTables = map[string]exportTable{
+	"telemetry": {
+		Name: "telemetry",
+		From: "telemetry",
+		Columns: []exportColumn{
+			{"id", exportInt}, {"timestamp", exportTime}, {"spacecraft_id", exportInt},
+			{"packet_id", exportInt}, {"packet_seq_ctrl", exportInt}, {"subsystem_id", exportInt},
+			{"temperature", exportReal}, {"battery", exportReal}, {"altitude", exportReal},
+			{"signal_strength", exportReal}, {"is_anomaly", exportBool}, {"anomaly_type", exportString},
+			{"station", exportString}, {"onboard_time", exportTime}, {"corrected_time", exportTime},
+			{"is_late", exportBool}, {"late_seconds", exportReal}, {"earth_received_at", exportTime}, {"rssi_dbm", exportReal}, {"snr_db", exportReal},
+			{"corrected_bits", exportInt}, {"housekeeping_structure_id", exportInt}, {"created_at", exportTime},
+		},
+		Filters: map[string]exportColumn{
+			"subsystem_id": {"subsystem_id", exportInt},
+			"is_anomaly":   {"is_anomaly", exportBool},
+			"is_late":      {"is_late", exportBool},
+			"anomaly_type": {"anomaly_type", exportString},
+			"station":      {"station", exportString},
+		},
+	},
+	"anomalies": {
+		Name:  "anomalies",
+		From:  "anomaly_history",
+		Where: "superseded_at IS NULL",
+		Columns: []exportColumn{
+			{"id", exportInt}, {"telemetry_id", exportInt}, {"timestamp", exportTime},
+			{"spacecraft_id", exportInt}, {"incident_id", exportInt}, {"anomaly_type", exportString},
+			{"parameter_name", exportString}, {"parameter_value", exportReal}, {"threshold_value", exportReal},
+			{"severity", exportString}, {"acknowledged", exportBool}, {"acknowledged_at", exportTime},
+			{"acknowledged_by", exportString}, {"acknowledgement_note", exportString}, {"is_derived", exportBool},
+			{"suppressed", exportBool}, {"silence_id", exportInt}, {"created_at", exportTime},
+		},
+		Filters: map[string]exportColumn{
+			"anomaly_type":   {"anomaly_type", exportString},
+			"parameter_name": {"parameter_name", exportString},
+			"severity":       {"severity", exportString},
+			"acknowledged":   {"acknowledged", exportBool},
+			"suppressed":     {"suppressed", exportBool},
+			"incident_id":    {"incident_id", exportInt},
+		},
+	},
+}
+
+// exportFilter is one column = value condition.
+type exportFilter struct {
+	Column string
+	Value  interface{}
+}
+
+type exportRequest struct {
+	Table        exportTable
+	Format       string
+	Gzip         bool
+	Start        *time.Time
+	End          *time.Time
+	SpacecraftID *int
+	Filters      []exportFilter
+}
+
+// parseExportRequest reads an export from named options. The API passes
+// query parameters and the export command passes its flags, so both accept
+// the same names and report the same errors.
+func parseExportRequest(table string, get func(name string) string) (exportRequest, error) {
+	var req exportRequest
+
+	t, ok := exportTables[table]
+	if !ok {
+		return req, invalidParam("table", "table must be telemetry or anomalies")
+	}
+	req.Table = t
+
+	req.Format = strings.ToLower(get("format"))
+	switch req.Format {
+	case "":
+		req.Format = exportCSV
+	case exportCSV, exportNDJSON, exportParquet:
+	default:
+		return req, invalidParam("format", "format must be csv, ndjson or parquet")
+	}
+
+	if v := get("gzip"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, invalidParam("gzip", "gzip must be true or false")
+		}
+		req.Gzip = b
+	}
+
+	now := time.Now()
+	for _, name := range []string{"start_time", "end_time"} {
+		v := get(name)
+		if v == "" {
+			continue
+		}
+		ts, ok := parseTime(v, now)
+		if !ok {
+			return req, invalidParam(name, "%s must be %s", name, timeFormat)
+		}
+		if name == "start_time" {
+			req.Start = &ts
+		} else {
+			req.End = &ts
+		}
+	}
+	if req.Start != nil && req.End != nil && req.End.Before(*req.Start) {
+		return req, invalidParam("end_time", "end_time must not be before start_time")
+	}
+
+	if v := get("spacecraft_id"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return req, invalidParam("spacecraft_id", "spacecraft_id must be an integer")
+		}
+		req.SpacecraftID = &n
+	}
+
+	names := make([]string, 0, len(t.Filters))
+	for name := range t.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := get(name)
+		if v == "" {
+			continue
+		}
+		col := t.Filters[name]
+		var value interface{} = v
+		switch col.Kind {
+		case exportInt:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return req, invalidParam(name, "%s must be an integer", name)
+			}
+			value = n
+		case exportBool:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return req, invalidParam(name, "%s must be true or false", name)
+			}
+			value = b
+		}
+		req.Filters = append(req.Filters, exportFilter{Column: col.Name, Value: value})
+	}
+
+	return req, nil
+}
+
+// query selects the table's columns in time order.
+func (r exportRequest) query() (string, []interface{}) {
+	var args []interface{}
+	conditions := []string{"1=1"}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if r.Table.Where != "" {
+		conditions = append(conditions, r.Table.Where)
+	}
+	if r.Start != nil {
+		add("timestamp >= $%d", *r.Start)
+	}
+	if r.End != nil {
+		add("timestamp <= $%d", *r.End)
+	}
+	if r.SpacecraftID != nil {
+		add("spacecraft_id = $%d", *r.SpacecraftID)
+	}
+	for _, f := range r.Filters {
+		add(f.Column+" = $%d", f.Value)
+	}
+
+	columns := make([]string, len(r.Table.Columns))
+	for i, col := range r.Table.Columns {
+		columns[i] = col.Name
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY timestamp, id",
+		strings.Join(columns, ", "), r.Table.From, strings.Join(conditions, " AND ")), args
+}
+
+// Filename is the suggested name of the exported file.
+func (r exportRequest) Filename() string {
+	name := r.Table.Name + "." + r.Format
+	if r.Gzip && r.Format != exportParquet {
+		name += ".gz"
+	}
+	return name
+}
+
+func (r exportRequest) ContentType() string {
+	switch {
+	case r.Gzip && r.Format != exportParquet:
+		return "application/gzip"
+	case r.Format == exportNDJSON:
+		return "application/x-ndjson"
+	case r.Format == exportParquet:
+		return "application/vnd.apache.parquet"
+	default:
+		return "text/csv; charset=utf-8"
+	}
+}
+
+// exportRow holds the scan destinations of one row, one per column.
+type exportRow []interface{}
+
+func newExportRow(columns []exportColumn) exportRow {
+	row := make(exportRow, len(columns))
+	for i, col := range columns {
+		switch col.Kind {
+		case exportInt:
+			row[i] = new(sql.NullInt64)
+		case exportReal:
+			row[i] = new(sql.NullFloat64)
+		case exportBool:
+			row[i] = new(sql.NullBool)
+		case exportString:
+			row[i] = new(sql.NullString)
+		case exportTime:
+			row[i] = new(sql.NullTime)
+		}
+	}
+	return row
+}
+
+// value returns column i as int64, float32, bool, string or time.Time, or
+// nil if it is NULL. REAL columns are reported as float32 so they print as
+// stored rather than with float64 noise.
+func (r exportRow) value(i int) interface{} {
+	switch v := r[i].(type) {
+	case *sql.NullInt64:
+		if v.Valid {
+			return v.Int64
+		}
+	case *sql.NullFloat64:
+		if v.Valid {
+			return float32(v.Float64)
+		}
+	case *sql.NullBool:
+		if v.Valid {
+			return v.Bool
+		}
+	case *sql.NullString:
+		if v.Valid {
+			return v.String
+		}
+	case *sql.NullTime:
+		if v.Valid {
+			return v.Time.UTC()
+		}
+	}
+	return nil
+}
+
+// exportWriter encodes rows in one format. Close writes any trailer but does
+// not close the underlying writer.
+type exportWriter interface {
+	Write(row exportRow) error
+	Close() error
+}
+
+func newExportWriter(format string, w io.Writer, columns []exportColumn, gzipped bool) (exportWriter, error) {
+	switch format {
+	case exportNDJSON:
+		return &ndjsonExportWriter{w: w, columns: columns}, nil
+	case exportParquet:
+		return newParquetExportWriter(w, columns, gzipped), nil
+	default:
+		cw := csv.NewWriter(w)
+		names := make([]string, len(columns))
+		for i, col := range columns {
+			names[i] = col.Name
+		}
+		if err := cw.Write(names); err != nil {
+			return nil, err
+		}
+		return &csvExportWriter{w: cw, record: make([]string, len(columns))}, nil
+	}
+}
+
+type csvExportWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (e *csvExportWriter) Write(row exportRow) error {
+	for i := range e.record {
+		switch v := row.value(i).(type) {
+		case nil:
+			e.record[i] = ""
+		case int64:
+			e.record[i] = strconv.FormatInt(v, 10)
+		case float32:
+			e.record[i] = strconv.FormatFloat(float64(v), 'g', -1, 32)
+		case bool:
+			e.record[i] = strconv.FormatBool(v)
+		case string:
+			e.record[i] = v
+		case time.Time:
+			e.record[i] = v.Format(time.RFC3339Nano)
+		}
+	}
+	// csv.Writer buffers; errors surface on Flush.
+	return e.w.Write(e.record)
+}
+
+func (e *csvExportWriter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonExportWriter writes one JSON object per line with the keys in
+// column order.
+type ndjsonExportWriter struct {
+	w       io.Writer
+	columns []exportColumn
+	buf     []byte
+}
+
+func (e *ndjsonExportWriter) Write(row exportRow) error {
+	e.buf = append(e.buf[:0], '{')
+	for i, col := range e.columns {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = strconv.AppendQuote(e.buf, col.Name)
+		e.buf = append(e.buf, ':')
+		data, err := json.Marshal(row.value(i))
+		if err != nil {
+			return err
+		}
+		e.buf = append(e.buf, data...)
+	}
+	e.buf = append(e.buf, '}', '\n')
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+// parquetExportWriter writes every column as optional. Gzip selects the
+// column compression codec, since a gzipped Parquet file is not readable as
+// Parquet; the default codec is Snappy.
+type parquetExportWriter struct {
+	w *parquet.Writer
+	// order maps schema column indexes, which parquet sorts by name, to
+	// export column indexes.
+	order []int
+	row   parquet.Row
+	// buffered estimates the bytes of the row group being built.
+	buffered int
+}
+
+func parquetNode(kind exportKind) parquet.Node {
+	switch kind {
+	case exportInt:
+		return parquet.Int(64)
+	case exportReal:
+		return parquet.Leaf(parquet.FloatType)
+	case exportBool:
+		return parquet.Leaf(parquet.BooleanType)
+	case exportTime:
+		return parquet.Timestamp(parquet.Microsecond)
+	default:
+		return parquet.String()
+	}
+}
+
+func newParquetExportWriter(w io.Writer, columns []exportColumn, gzipped bool) *parquetExportWriter {
+	group := parquet.Group{}
+	index := map[string]int{}
+	for i, col := range columns {
+		group[col.Name] = parquet.Optional(parquetNode(col.Kind))
+		index[col.Name] = i
+	}
+	schema := parquet.NewSchema("export", group)
+
+	var order []int
+	for _, path := range schema.Columns() {
+		order = append(order, index[path[0]])
+	}
+
+	var codec parquet.WriterOption = parquet.Compression(&parquet.Snappy)
+	if gzipped {
+		codec = parquet.Compression(&parquet.Gzip)
+	}
+	return &parquetExportWriter{
+		w:     parquet.NewWriter(w, schema, codec, parquet.MaxRowsPerRowGroup(exportRowGroupRows)),
+		order: order,
+		row:   make(parquet.Row, len(order)),
+	}
+}
+
+func (e *parquetExportWriter) Write(row exportRow) error {
+	for col, i := range e.order {
+		var v parquet.Value
+		switch x := row.value(i).(type) {
+		case nil:
+			e.row[col] = parquet.NullValue().Level(0, 0, col)
+			e.buffered++
+			continue
+		case int64:
+			v = parquet.Int64Value(x)
+			e.buffered += 8
+		case float32:
+			v = parquet.FloatValue(x)
+			e.buffered += 4
+		case bool:
+			v = parquet.BooleanValue(x)
+			e.buffered++
+		case string:
+			v = parquet.ByteArrayValue([]byte(x))
+			e.buffered += 4 + len(x)
+		case time.Time:
+			v = parquet.Int64Value(x.UnixMicro())
+			e.buffered += 8
+		}
+		e.row[col] = v.Level(0, 1, col)
+	}
+	if _, err := e.w.WriteRows([]parquet.Row{e.row}); err != nil {
+		return err
+	}
+	if e.buffered >= exportRowGroupBytes {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group.
+func (e *parquetExportWriter) flush() error {
+	e.buffered = 0
+	return e.w.Flush()
+}
+
+func (e *parquetExportWriter) Close() error {
+	return e.w.Close()
+}
+
+// flusher is satisfied by *bufio.Writer and *gzip.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// runExport streams the rows of req to w in time order and returns how many
+// it wrote. Rows are encoded as they are read, so memory does not depend on
+// the size of the export. Cancelling ctx stops the query.
+func runExport(ctx context.Context, w io.Writer, req exportRequest) (int64, error) {
+	query, args := req.query()
+
+	ctx, cancel := context.WithCancel(ctx)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return 0, err
+	}
+	// Cancel before closing, so an export that stops early does not drain
+	// the rest of the result set.
+	defer rows.Close()
+	defer cancel()
+
+	out := w
+	var zw *gzip.Writer
+	if req.Gzip && req.Format != exportParquet {
+		zw = gzip.NewWriter(w)
+		out = zw
+	}
+
+	ew, err := newExportWriter(req.Format, out, req.Table.Columns, req.Gzip)
+	if err != nil {
+		return 0, err
+	}
+
+	row := newExportRow(req.Table.Columns)
+	var count int64
+	for rows.Next() {
+		if err := rows.Scan(row...); err != nil {
+			return count, err
+		}
+		if err := ew.Write(row); err != nil {
+			return count, err
+		}
+		count++
+
+		if count%exportFlushRows == 0 {
+			if err := flushExport(ew, zw, w); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	if err := ew.Close(); err != nil {
+		return count, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return count, err
+		}
+	}
+	if f, ok := w.(flusher); ok {
+		return count, f.Flush()
+	}
+	return count, nil
+}
+
+// flushExport pushes what has been encoded so far through to w. Parquet
+// output is written a row group at a time instead, so only the row groups
+// completed so far reach w.
+func flushExport(ew exportWriter, zw *gzip.Writer, w io.Writer) error {
+	if cw, ok := ew.(*csvExportWriter); ok {
+		cw.w.Flush()
+		if err := cw.w.Error(); err != nil {
+			return err
+		}
+	}
+	if zw != nil {
+		if err := zw.Flush(); err != nil {
+			return err
+		}
+	}
+	if f, ok := w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// exportData streams a table as a file download. Validation errors are
+// returned as usual; once streaming has started, a failure ends the response
+// early, which leaves gzip and Parquet output detectably truncated. Closing
+// the connection or shutting down the server cancels the export, even while
+// the query has not returned a row.
+func exportData(c *fiber.Ctx) error {
+	req, err := parseExportRequest(c.Params("table"), func(name string) string { return c.Query(name) })
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	c.Set("Content-Type", req.ContentType())
+	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, req.Filename()))
+	c.Set("X-Accel-Buffering", "no")
+
+	conn := c.Context().Conn()
+	done := c.Context().Done()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go watchClient(ctx, cancel, conn, done)
+
+		start := time.Now()
+		count, err := runExport(ctx, w, req)
+		if err != nil {
+			log.Printf("Export of %s stopped after %d rows: %v", req.Table.Name, count, err)
+			return
+		}
+		log.Printf("Exported %d %s rows as %s in %s", count, req.Table.Name, req.Filename(), time.Since(start).Round(time.Millisecond))
+	})
+	return nil
+}
+
+// watchClient calls cancel once the client has closed conn or the server is
+// shutting down, and returns when ctx ends.
+func watchClient(ctx context.Context, cancel context.CancelFunc, conn net.Conn, shutdown <-chan struct{}) {
+	ticker := time.NewTicker(exportWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-shutdown:
+			cancel()
+			return
+		case <-ticker.C:
+			if peerClosed(conn) {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// runExportCommand implements `telemetry-api export -table telemetry
+// -format csv -start ... -end ... -o file`. Filters are given as -filter
+// name=value. Interrupting the command cancels the export and removes the
+// partial output file.
+func runExportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	table := fs.String("table", "telemetry", "table to export (telemetry or anomalies)")
+	format := fs.String("format", exportCSV, "output format (csv, ndjson or parquet)")
+	gzipped := fs.Bool("gzip", false, "gzip the output (Parquet uses gzip column compression)")
+	startTime := fs.String("start", "", "start of the range ("+timeFormat+")")
+	endTime := fs.String("end", "", "end of the range ("+timeFormat+")")
+	spacecraftID := fs.String("spacecraft", "", "spacecraft id")
+	output := fs.String("o", "-", "output file, or - for stdout")
+	filters := map[string]string{}
+	fs.Func("filter", "column filter as name=value, e.g. severity=CRITICAL (repeatable)", func(v string) error {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return errors.New("filter must be name=value")
+		}
+		filters[name] = value
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	options := map[string]string{
+		"format":        *format,
+		"gzip":          strconv.FormatBool(*gzipped),
+		"start_time":    *startTime,
+		"end_time":      *endTime,
+		"spacecraft_id": *spacecraftID,
+	}
+	for name, value := range filters {
+		if _, ok := exportTables[*table].Filters[name]; !ok {
+			return fmt.Errorf("unknown filter %q for table %q", name, *table)
+		}
+		options[name] = value
+	}
+
+	req, err := parseExportRequest(*table, func(name string) string { return options[name] })
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *output != "-" {
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+		w = file
+	}
+	bw := bufio.NewWriterSize(w, 64*1024)
+
+	start := time.Now()
+	count, err := runExport(ctx, bw, req)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*output)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("export cancelled after %d rows", count)
+		}
+		return fmt.Errorf("export failed after %d rows: %w", count, err)
+	}
+
+	log.Printf("Exported %d %s rows in %s", count, req.Table.Name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
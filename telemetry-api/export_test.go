@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var exportTestColumns = []exportColumn{
+	{"id", exportInt}, {"timestamp", exportTime}, {"temperature", exportReal},
+	{"is_anomaly", exportBool}, {"anomaly_type", exportString},
+}
+
+func exportTestRows() []exportRow {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 500000000, time.UTC)
+
+	first := newExportRow(exportTestColumns)
+	*first[0].(*sql.NullInt64) = sql.NullInt64{Int64: 1, Valid: true}
+	*first[1].(*sql.NullTime) = sql.NullTime{Time: ts, Valid: true}
+	*first[2].(*sql.NullFloat64) = sql.NullFloat64{Float64: float64(float32(24.1)), Valid: true}
+	*first[3].(*sql.NullBool) = sql.NullBool{Bool: false, Valid: true}
+
+	second := newExportRow(exportTestColumns)
+	*second[0].(*sql.NullInt64) = sql.NullInt64{Int64: 2, Valid: true}
+	*second[1].(*sql.NullTime) = sql.NullTime{Time: ts.Add(time.Second), Valid: true}
+	*second[2].(*sql.NullFloat64) = sql.NullFloat64{Float64: 40, Valid: true}
+	*second[3].(*sql.NullBool) = sql.NullBool{Bool: true, Valid: true}
+	*second[4].(*sql.NullString) = sql.NullString{String: `HIGH "TEMP", B`, Valid: true}
+
+	return []exportRow{first, second}
+}
+
+func writeExport(t *testing.T, format string, gzipped bool) []byte {
+	var buf bytes.Buffer
+	w, err := newExportWriter(format, &buf, exportTestColumns, gzipped)
+	require.NoError(t, err)
+	for _, row := range exportTestRows() {
+		require.NoError(t, w.Write(row))
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestCSVExportWriter(t *testing.T) {
+	assert.Equal(t, "id,timestamp,temperature,is_anomaly,anomaly_type\n"+
+		"1,2024-03-01T10:00:00.5Z,24.1,false,\n"+
+		"2,2024-03-01T10:00:01.5Z,40,true,\"HIGH \"\"TEMP\"\", B\"\n",
+		string(writeExport(t, exportCSV, false)))
+}
+
+func TestNDJSONExportWriter(t *testing.T) {
+	assert.Equal(t,
+		`{"id":1,"timestamp":"2024-03-01T10:00:00.5Z","temperature":24.1,"is_anomaly":false,"anomaly_type":null}`+"\n"+
+			`{"id":2,"timestamp":"2024-03-01T10:00:01.5Z","temperature":40,"is_anomaly":true,"anomaly_type":"HIGH \"TEMP\", B"}`+"\n",
+		string(writeExport(t, exportNDJSON, false)))
+}
+
+func TestParquetExportWriter(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		data := writeExport(t, exportParquet, gzipped)
+
+		f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), f.NumRows())
+
+		type record struct {
+			ID          *int64   `parquet:"id"`
+			Timestamp   *int64   `parquet:"timestamp"`
+			Temperature *float32 `parquet:"temperature"`
+			IsAnomaly   *bool    `parquet:"is_anomaly"`
+			AnomalyType *string  `parquet:"anomaly_type"`
+		}
+		rows, err := parquet.Read[record](bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		require.Len(t, rows, 2)
+
+		assert.Equal(t, int64(2), *rows[1].ID)
+		assert.Equal(t, time.Date(2024, 3, 1, 10, 0, 1, 500000000, time.UTC).UnixMicro(), *rows[1].Timestamp)
+		assert.Equal(t, float32(24.1), *rows[0].Temperature)
+		assert.True(t, *rows[1].IsAnomaly)
+		assert.Nil(t, rows[0].AnomalyType)
+		assert.Equal(t, `HIGH "TEMP", B`, *rows[1].AnomalyType)
+	}
+}
+
+func TestParquetExportWriterBoundsRowGroupBytes(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newExportWriter(exportParquet, &buf, exportTestColumns, false)
+	require.NoError(t, err)
+
+	// Each row carries a 1 MiB anomaly type, so a row group fills after
+	// eight rows.
+	row := exportTestRows()[1]
+	*row[4].(*sql.NullString) = sql.NullString{String: strings.Repeat("x", 1<<20), Valid: true}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.Write(row))
+	}
+	require.NoError(t, w.Close())
+
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), f.NumRows())
+	assert.Len(t, f.RowGroups(), 3)
+}
+
+func TestPeerClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	server, err := l.Accept()
+	require.NoError(t, err)
+	defer server.Close()
+
+	assert.False(t, peerClosed(server))
+	_, err = client.Write([]byte("GET"))
+	require.NoError(t, err)
+	assert.False(t, peerClosed(server), "pending data is not a disconnect")
+
+	client.Close()
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", string(buf), "peeking does not consume data")
+	assert.Eventually(t, func() bool { return peerClosed(server) }, time.Second, 10*time.Millisecond)
+}
+
+func TestParseExportRequest(t *testing.T) {
+	options := map[string]string{
+		"format":        "NDJSON",
+		"gzip":          "true",
+		"start_time":    "2024-03-01T00:00:00Z",
+		"spacecraft_id": "2",
+		"severity":      "CRITICAL",
+		"acknowledged":  "false",
+		"subsystem_id":  "3",
+	}
+	req, err := parseExportRequest("anomalies", func(name string) string { return options[name] })
+	require.NoError(t, err)
+	assert.Equal(t, exportNDJSON, req.Format)
+	assert.Equal(t, "anomalies.ndjson.gz", req.Filename())
+	assert.Equal(t, "application/gzip", req.ContentType())
+
+	query, args := req.query()
+	assert.Contains(t, query, "FROM anomaly_history WHERE 1=1 AND superseded_at IS NULL AND timestamp >= $1 AND spacecraft_id = $2 AND acknowledged = $3 AND severity = $4 ORDER BY timestamp, id")
+	assert.Equal(t, []interface{}{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), 2, false, "CRITICAL"}, args)
+	assert.NotContains(t, query, "subsystem_id", "not a filter of anomalies")
+
+	req, err = parseExportRequest("telemetry", func(string) string { return "" })
+	require.NoError(t, err)
+	assert.Equal(t, "telemetry.csv", req.Filename())
+	query, args = req.query()
+	assert.Contains(t, query, "FROM telemetry WHERE 1=1 ORDER BY timestamp, id")
+	assert.Empty(t, args)
+
+	req, _ = parseExportRequest("telemetry", func(name string) string { return map[string]string{"format": "parquet", "gzip": "1"}[name] })
+	assert.Equal(t, "telemetry.parquet", req.Filename(), "gzip is Parquet column compression")
+	app := fiber.New()
+	app.Get("/api/v1/export/:table", exportData)
+
+	cases := []struct {
+		path  string
+		field string
+	}{
+		{"/api/v1/export/derived_values", "table"},
+		{"/api/v1/export/telemetry?format=xlsx", "format"},
+		{"/api/v1/export/telemetry?gzip=maybe", "gzip"},
+		{"/api/v1/export/telemetry?start_time=yesterday", "start_time"},
+		{"/api/v1/export/telemetry?start_time=now&end_time=now-1h", "end_time"},
+		{"/api/v1/export/telemetry?subsystem_id=x", "subsystem_id"},
+		{"/api/v1/export/anomalies?acknowledged=x", "acknowledged"},
+	}
+
+	for _, tc := range cases {
+		requireAPIError(t, app, httptest.NewRequest("GET", tc.path, nil), http.StatusBadRequest, codeInvalidParameter, tc.field)
+	}
+}
+
+func TestRunExportScansStoredRows(t *testing.T) {
+	withTestDB(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, temperature := range []float32{25, 36, 26} {
+		insertTestTelemetry(t, db, ts.Add(time.Duration(i)*time.Second), temperature)
+	}
+
+	export := func(table string, options map[string]string) []map[string]interface{} {
+		options["format"] = exportNDJSON
+		options["gzip"] = "true"
+		options["spacecraft_id"] = fmt.Sprint(testSpacecraftID)
+		options["start_time"] = "2001-01-01T00:00:00Z"
+		options["end_time"] = "2001-01-01T01:00:00Z"
+		req, err := parseExportRequest(table, func(name string) string { return options[name] })
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		count, err := runExport(context.Background(), &buf, req)
+		require.NoError(t, err)
+
+		zr, err := gzip.NewReader(&buf)
+		require.NoError(t, err)
+		var records []map[string]interface{}
+		dec := json.NewDecoder(zr)
+		for dec.More() {
+			var record map[string]interface{}
+			require.NoError(t, dec.Decode(&record))
+			records = append(records, record)
+		}
+		assert.Equal(t, int64(len(records)), count)
+		return records
+	}
+
+	telemetry := export("telemetry", map[string]string{})
+	require.Len(t, telemetry, 3)
+	for i, record := range telemetry {
+		assert.Equal(t, ts.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano), record["timestamp"])
+	}
+	assert.Equal(t, []interface{}{false, true, false},
+		[]interface{}{telemetry[0]["is_anomaly"], telemetry[1]["is_anomaly"], telemetry[2]["is_anomaly"]})
+	assert.Equal(t, "HIGH_TEMPERATURE", telemetry[1]["anomaly_type"])
+
+	assert.Len(t, export("telemetry", map[string]string{"is_anomaly": "false"}), 2)
+
+	anomalies := export("anomalies", map[string]string{"acknowledged": "false"})
+	require.Len(t, anomalies, 1)
+	assert.Equal(t, telemetry[1]["id"], anomalies[0]["telemetry_id"])
+	assert.Equal(t, "temperature", anomalies[0]["parameter_name"])
+	assert.Equal(t, float64(36), anomalies[0]["parameter_value"])
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Liveness only reports that the server is answering. Readiness also checks
+// the database, how far the slowest stream client is behind and how old the
+// newest telemetry is. A threshold of 0 reports the value without failing the
+// check.
+
+const healthDBTimeout = 2 * time.Second
+
+// healthThresholds configure readiness and staleness. They are read from
+// HEALTH_MAX_QUEUE_DEPTH, HEALTH_MAX_DATA_AGE and STALE_DATA_THRESHOLD.
+// StaleAfter is the age at which /telemetry/current reports its data as
+// stale.
+type healthThresholds struct {
+	MaxQueueDepth int
+	MaxDataAge    time.Duration
+	StaleAfter    time.Duration
+}
+
+var thresholds = healthThresholds{StaleAfter: 2 * time.Minute}
+
+func loadHealthThresholds() {
+	if v := os.Getenv("HEALTH_MAX_QUEUE_DEPTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatal("Invalid HEALTH_MAX_QUEUE_DEPTH:", v)
+		}
+		thresholds.MaxQueueDepth = n
+	}
+	for name, d := range map[string]*time.Duration{
+		"HEALTH_MAX_DATA_AGE":  &thresholds.MaxDataAge,
+		"STALE_DATA_THRESHOLD": &thresholds.StaleAfter,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed < 0 {
+				log.Fatalf("Invalid %s: %s", name, v)
+			}
+			*d = parsed
+		}
+	}
+}
+
+// Staleness of the latest telemetry.
+const (
+	dataFresh = "FRESH"
+	dataStale = "STALE"
+)
+
+func staleness(age time.Duration) string {
+	if thresholds.StaleAfter > 0 && age > thresholds.StaleAfter {
+		return dataStale
+	}
+	return dataFresh
+}
+
+// HealthCheck is one check of a health report. Value and Threshold are set
+// for checks that measure something.
+type HealthCheck struct {
+	Name      string   `json:"name"`
+	Status    string   `json:"status"`
+	Value     *float64 `json:"value,omitempty"`
+	Threshold *float64 `json:"threshold,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Time   time.Time     `json:"time"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func passed(name string) HealthCheck {
+	return HealthCheck{Name: name, Status: "ok"}
+}
+
+func failed(name, reason string) HealthCheck {
+	return HealthCheck{Name: name, Status: "fail", Error: reason}
+}
+
+// measured checks value against threshold, ignoring a threshold of 0.
+func measured(name string, value, threshold float64) HealthCheck {
+	c := HealthCheck{Name: name, Status: "ok", Value: &value}
+	if threshold > 0 {
+		c.Threshold = &threshold
+		if value > threshold {
+			c.Status = "fail"
+		}
+	}
+	return c
+}
+
+func newHealthReport(checks ...HealthCheck) HealthReport {
+	r := HealthReport{Status: "healthy", Time: time.Now(), Checks: make([]HealthCheck, 0, len(checks))}
+	for _, c := range checks {
+		if c.Status != "ok" {
+			r.Status = "unhealthy"
+		}
+		r.Checks = append(r.Checks, c)
+	}
+	return r
+}
+
+func sendHealth(c *fiber.Ctx, report HealthReport) error {
+	if report.Status != "healthy" {
+		c.Status(fiber.StatusServiceUnavailable)
+	}
+	return c.JSON(report)
+}
+
+func getLiveness(c *fiber.Ctx) error {
+	return sendHealth(c, newHealthReport())
+}
+
+// getReadiness checks what the API needs to serve requests. Without a
+// database the data age is not checked.
+func getReadiness(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthDBTimeout)
+	defer cancel()
+
+	// Driver errors are logged rather than reported, as they can reveal
+	// connection details and SQL.
+	if err := db.PingContext(ctx); err != nil {
+		log.Printf("Readiness: database ping failed: %v", err)
+		return sendHealth(c, newHealthReport(failed("database", "database unreachable"), streamQueueCheck()))
+	}
+
+	var latest sql.NullTime
+	if err := db.QueryRowContext(ctx, `SELECT MAX(timestamp) FROM telemetry`).Scan(&latest); err != nil {
+		log.Printf("Readiness: reading latest telemetry failed: %v", err)
+		return sendHealth(c, newHealthReport(passed("database"), streamQueueCheck(),
+			failed("telemetry_age_seconds", "latest telemetry could not be read")))
+	}
+	age := failed("telemetry_age_seconds", "no telemetry stored")
+	if latest.Valid {
+		age = measured("telemetry_age_seconds", time.Since(latest.Time).Seconds(), thresholds.MaxDataAge.Seconds())
+	} else if thresholds.MaxDataAge == 0 {
+		age = passed("telemetry_age_seconds")
+	}
+
+	return sendHealth(c, newHealthReport(passed("database"), streamQueueCheck(), age))
+}
+
+func streamQueueCheck() HealthCheck {
+	return measured("stream_queue_depth", float64(streams.depth()), float64(thresholds.MaxQueueDepth))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleness(t *testing.T) {
+	defer func(saved healthThresholds) { thresholds = saved }(thresholds)
+
+	thresholds.StaleAfter = time.Minute
+	assert.Equal(t, dataFresh, staleness(30*time.Second))
+	assert.Equal(t, dataFresh, staleness(time.Minute))
+	assert.Equal(t, dataStale, staleness(72*time.Hour))
+
+	thresholds.StaleAfter = 0
+	assert.Equal(t, dataFresh, staleness(72*time.Hour))
+}
+
+func TestHealthReportFailsOnAnyCheck(t *testing.T) {
+	report := newHealthReport(passed("database"), measured("stream_queue_depth", 12, 0))
+	assert.Equal(t, "healthy", report.Status)
+	assert.Nil(t, report.Checks[1].Threshold)
+
+	report = newHealthReport(passed("database"), measured("telemetry_age_seconds", 600, 300))
+	assert.Equal(t, "unhealthy", report.Status)
+	assert.Equal(t, "fail", report.Checks[1].Status)
+	require.NotNil(t, report.Checks[1].Threshold)
+	assert.Equal(t, 300.0, *report.Checks[1].Threshold)
+}
+
+func TestStreamHubDepth(t *testing.T) {
+	hub := newStreamHub()
+	assert.Equal(t, 0, hub.depth())
+
+	slow, _ := hub.subscribe()
+	hub.subscribe()
+	hub.publish([]StreamEvent{{Type: eventTelemetry}, {Type: eventTelemetry}})
+	<-slow.events
+	assert.Equal(t, 2, hub.depth())
+}
+
+func TestLivenessEndpoint(t *testing.T) {
+	app := fiber.New()
+	app.Get("/health/live", getLiveness)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/health/live", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report HealthReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, "healthy", report.Status)
+	assert.NotZero(t, report.Time)
+}
+
+func TestReadinessHidesDatabaseErrors(t *testing.T) {
+	saved := db
+	defer func() { db = saved }()
+	unreachable, err := sql.Open("postgres", "host=127.0.0.1 port=1 user=nobody password=secret dbname=telemetry sslmode=disable connect_timeout=1")
+	require.NoError(t, err)
+	defer unreachable.Close()
+	db = unreachable
+
+	app := fiber.New()
+	app.Get("/health/ready", getReadiness)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/health/ready", nil), 5000)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "database unreachable")
+	assert.NotContains(t, string(body), "127.0.0.1")
+}
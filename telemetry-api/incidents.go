@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// incidentSweepInterval is how often open incidents without recent samples
+// are closed.
+const incidentSweepInterval = 30 * time.Second
+
+// incidentStatuses and incidentSeverities are the values the status and
+// severity filters accept.
+var (
+	incidentStatuses   = map[string]bool{"OPEN": true, "CLOSED": true, "SUPERSEDED": true}
+	incidentSeverities = map[string]bool{"INFO": true, "WARNING": true, "CRITICAL": true}
+)
+
+type Incident struct {
+	ID             int        `json:"id"`
+	SpacecraftID   int        `json:"spacecraft_id"`
+	ParameterName  string     `json:"parameter_name"`
+	AnomalyType    string     `json:"anomaly_type"`
+	Severity       string     `json:"severity"`
+	Status         string     `json:"status"`
+	OpenedAt       time.Time  `json:"opened_at"`
+	LastSeenAt     time.Time  `json:"last_seen_at"`
+	ClosedAt       *time.Time `json:"closed_at,omitempty"`
+	PeakValue      float32    `json:"peak_value"`
+	PeakAt         time.Time  `json:"peak_at"`
+	ThresholdValue float32    `json:"threshold_value"`
+	SampleCount    int        `json:"sample_count"`
+	DurationSecs   float64    `json:"duration_seconds"`
+}
+
+type IncidentTimeline struct {
+	Incident  Incident  `json:"incident"`
+	Anomalies []Anomaly `json:"anomalies"`
+}
+
+const incidentColumns = `id, spacecraft_id, parameter_name, anomaly_type, severity, status,
+		   opened_at, last_seen_at, closed_at, peak_value, peak_at, threshold_value, sample_count`
+
+func scanIncident(row rowScanner) (Incident, error) {
+	var i Incident
+	err := row.Scan(
+		&i.ID, &i.SpacecraftID, &i.ParameterName, &i.AnomalyType, &i.Severity, &i.Status,
+		&i.OpenedAt, &i.LastSeenAt, &i.ClosedAt, &i.PeakValue, &i.PeakAt, &i.ThresholdValue, &i.SampleCount,
+	)
+	if err != nil {
+		return i, err
+	}
+	i.DurationSecs = i.LastSeenAt.Sub(i.OpenedAt).Seconds()
+	return i, nil
+}
+
+func startIncidentSweeper() {
+	for range time.Tick(incidentSweepInterval) {
+		var closed int
+		if err := db.QueryRow(`SELECT close_stale_incidents()`).Scan(&closed); err != nil {
+			log.Printf("Error closing stale incidents: %v", err)
+			continue
+		}
+		if closed > 0 {
+			log.Printf("Closed %d stale incidents", closed)
+		}
+	}
+}
+
+func getIncidents(c *fiber.Ctx) error {
+	status := strings.ToUpper(c.Query("status"))
+	parameter := c.Query("parameter")
+	anomalyType := c.Query("anomaly_type")
+	severity := strings.ToUpper(c.Query("severity"))
+	if status != "" && !incidentStatuses[status] {
+		return sendError(c, invalidParam("status", "status must be open, closed or superseded"))
+	}
+	if severity != "" && !incidentSeverities[severity] {
+		return sendError(c, invalidParam("severity", "severity must be info, warning or critical"))
+	}
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + incidentColumns + ` FROM incidents WHERE 1=1`
+	args := []interface{}{}
+	argCount := 0
+
+	if status != "" {
+		argCount++
+		query += fmt.Sprintf(" AND status = $%d", argCount)
+		args = append(args, status)
+	}
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND spacecraft_id = $%d", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	if parameter != "" {
+		argCount++
+		query += fmt.Sprintf(" AND parameter_name = $%d", argCount)
+		args = append(args, parameter)
+	}
+
+	if anomalyType != "" {
+		argCount++
+		query += fmt.Sprintf(" AND anomaly_type = $%d", argCount)
+		args = append(args, anomalyType)
+	}
+
+	if severity != "" {
+		argCount++
+		query += fmt.Sprintf(" AND severity = $%d", argCount)
+		args = append(args, severity)
+	}
+
+	// Time filters select incidents that overlap the range.
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND last_seen_at >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND opened_at <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY opened_at DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query incidents", err))
+	}
+	defer rows.Close()
+
+	incidents := make([]Incident, 0)
+	for rows.Next() {
+		i, err := scanIncident(rows)
+		if err != nil {
+			log.Printf("Error scanning incident row: %v", err)
+			continue
+		}
+		incidents = append(incidents, i)
+	}
+
+	return c.JSON(incidents)
+}
+
+func getIncident(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	incident, err := scanIncident(db.QueryRow(`SELECT `+incidentColumns+` FROM incidents WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Incident not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get incident", err))
+	}
+
+	return c.JSON(incident)
+}
+
+// getIncidentTimeline returns an incident with its anomaly rows in time order,
+// so a client can replay how the incident developed.
+func getIncidentTimeline(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, 1000, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	incident, err := scanIncident(db.QueryRow(`SELECT `+incidentColumns+` FROM incidents WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Incident not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get incident", err))
+	}
+
+	rows, err := db.Query(`
+		SELECT `+anomalyColumns+`
+		FROM anomaly_history
+		WHERE incident_id = $1
+		AND superseded_at IS NULL
+		AND timestamp >= $2 AND timestamp <= $3
+		ORDER BY timestamp ASC
+		LIMIT $4
+	`, id, incident.OpenedAt, incident.LastSeenAt, limit)
+	if err != nil {
+		return sendError(c, internalError("Failed to query incident timeline", err))
+	}
+	defer rows.Close()
+
+	timeline := IncidentTimeline{Incident: incident, Anomalies: make([]Anomaly, 0)}
+	for rows.Next() {
+		a, err := scanAnomaly(rows)
+		if err != nil {
+			log.Printf("Error scanning anomaly row: %v", err)
+			continue
+		}
+		timeline.Anomalies = append(timeline.Anomalies, a)
+	}
+
+	return c.JSON(timeline)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubScanner struct {
+	values []interface{}
+}
+
+func (s stubScanner) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *int:
+			*d = s.values[i].(int)
+		case *string:
+			*d = s.values[i].(string)
+		case *float32:
+			*d = s.values[i].(float32)
+		case *float64:
+			*d = s.values[i].(float64)
+		case *bool:
+			*d = s.values[i].(bool)
+		case **string:
+			if v, ok := s.values[i].(string); ok {
+				*d = &v
+			}
+		case **float64:
+			if v, ok := s.values[i].(float64); ok {
+				*d = &v
+			}
+		case **int:
+			if v, ok := s.values[i].(int); ok {
+				*d = &v
+			}
+		case *[]byte:
+			if v, ok := s.values[i].([]byte); ok {
+				*d = v
+			}
+		case *time.Time:
+			*d = s.values[i].(time.Time)
+		case **time.Time:
+			if v, ok := s.values[i].(time.Time); ok {
+				*d = &v
+			}
+		}
+	}
+	return nil
+}
+
+func TestScanIncidentComputesDuration(t *testing.T) {
+	opened := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	lastSeen := opened.Add(90 * time.Second)
+
+	incident, err := scanIncident(stubScanner{values: []interface{}{
+		7, 1, "battery", "LOW_BATTERY", "WARNING", "CLOSED",
+		opened, lastSeen, lastSeen, float32(31.5), opened.Add(time.Minute), float32(40), 45,
+	}})
+
+	require.NoError(t, err)
+	assert.Equal(t, 7, incident.ID)
+	assert.Equal(t, "LOW_BATTERY", incident.AnomalyType)
+	require.NotNil(t, incident.ClosedAt)
+	assert.Equal(t, lastSeen, *incident.ClosedAt)
+	assert.Equal(t, 90.0, incident.DurationSecs)
+	assert.Equal(t, 45, incident.SampleCount)
+}
+
+// testIncident is the incident of the current anomaly of a telemetry row.
+func testIncident(t *testing.T, tx *sql.Tx, telemetryID int, ts time.Time) int {
+	t.Helper()
+	var id int
+	require.NoError(t, tx.QueryRow(`
+		SELECT incident_id FROM anomaly_history
+		WHERE telemetry_id = $1 AND telemetry_timestamp = $2 AND superseded_at IS NULL
+	`, telemetryID, ts).Scan(&id))
+	return id
+}
+
+func TestAssignIncidentGroupsAnomaliesWithinGap(t *testing.T) {
+	tx := testTx(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	first := testIncident(t, tx, insertTestTelemetry(t, tx, ts, 36), ts)
+	assert.Equal(t, first, testIncident(t, tx, insertTestTelemetry(t, tx, ts.Add(time.Minute), 38), ts.Add(time.Minute)))
+	assert.Equal(t, first, testIncident(t, tx, insertTestTelemetry(t, tx, ts.Add(2*time.Minute), 37), ts.Add(2*time.Minute)))
+	// A late row still joins the incident and moves its start.
+	assert.Equal(t, first, testIncident(t, tx, insertTestTelemetry(t, tx, ts.Add(-time.Minute), 36), ts.Add(-time.Minute)))
+	// Past the gap after the last sample, a new incident opens.
+	later := testIncident(t, tx, insertTestTelemetry(t, tx, ts.Add(10*time.Minute), 36), ts.Add(10*time.Minute))
+	assert.NotEqual(t, first, later)
+
+	incident, err := scanIncident(tx.QueryRow(`SELECT `+incidentColumns+` FROM incidents WHERE id = $1`, first))
+	require.NoError(t, err)
+	assert.Equal(t, testSpacecraftID, incident.SpacecraftID)
+	assert.Equal(t, "HIGH_TEMPERATURE", incident.AnomalyType)
+	assert.Equal(t, 4, incident.SampleCount)
+	assert.True(t, ts.Add(-time.Minute).Equal(incident.OpenedAt))
+	assert.Equal(t, float32(38), incident.PeakValue)
+	assert.True(t, ts.Add(time.Minute).Equal(incident.PeakAt))
+	// The samples are long past, so the incident is closed at the last one.
+	assert.Equal(t, "CLOSED", incident.Status)
+	require.NotNil(t, incident.ClosedAt)
+	assert.True(t, ts.Add(2*time.Minute).Equal(*incident.ClosedAt))
+}
+
+func TestAssignIncidentOpensCurrentIncidents(t *testing.T) {
+	tx := testTx(t)
+	ts := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+
+	id := testIncident(t, tx, insertTestTelemetry(t, tx, ts, 36), ts)
+	incident, err := scanIncident(tx.QueryRow(`SELECT `+incidentColumns+` FROM incidents WHERE id = $1`, id))
+	require.NoError(t, err)
+	assert.Equal(t, "OPEN", incident.Status)
+	assert.Nil(t, incident.ClosedAt)
+}
+
+func TestRefreshIncidentsRecountsCurrentAnomalies(t *testing.T) {
+	tx := testTx(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ids := []int{
+		insertTestTelemetry(t, tx, ts, 36),
+		insertTestTelemetry(t, tx, ts.Add(time.Minute), 38),
+		insertTestTelemetry(t, tx, ts.Add(2*time.Minute), 37),
+	}
+	incidentID := testIncident(t, tx, ids[0], ts)
+	supersede := func(id int, at time.Time) {
+		_, err := tx.Exec(`
+			UPDATE anomaly_history SET superseded_at = NOW()
+			WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+		`, id, at)
+		require.NoError(t, err)
+		_, err = tx.Exec(`SELECT refresh_incidents($1, $2)`, ts, ts.Add(time.Hour))
+		require.NoError(t, err)
+	}
+
+	// Without its peak, the incident peaks at the next furthest sample.
+	supersede(ids[1], ts.Add(time.Minute))
+	incident, err := scanIncident(tx.QueryRow(`SELECT `+incidentColumns+` FROM incidents WHERE id = $1`, incidentID))
+	require.NoError(t, err)
+	assert.Equal(t, 2, incident.SampleCount)
+	assert.Equal(t, float32(37), incident.PeakValue)
+	assert.True(t, ts.Add(2*time.Minute).Equal(incident.PeakAt))
+	assert.Equal(t, "CLOSED", incident.Status)
+
+	supersede(ids[0], ts)
+	supersede(ids[2], ts.Add(2*time.Minute))
+	incident, err = scanIncident(tx.QueryRow(`SELECT `+incidentColumns+` FROM incidents WHERE id = $1`, incidentID))
+	require.NoError(t, err)
+	assert.Equal(t, 0, incident.SampleCount)
+	assert.Equal(t, "SUPERSEDED", incident.Status)
+}
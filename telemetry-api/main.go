@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/gofiber/adaptor/v2"
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -17,24 +17,38 @@ import (
 )
 
 type Telemetry struct {
-	ID             int       `json:"id"`
-	Timestamp      time.Time `json:"timestamp"`
-	PacketID       int       `json:"packet_id"`
-	PacketSeqCtrl  int       `json:"packet_seq_ctrl"`
-	SubsystemID    int       `json:"subsystem_id"`
-	Temperature    float32   `json:"temperature"`
-	Battery        float32   `json:"battery"`
-	Altitude       float32   `json:"altitude"`
-	SignalStrength float32   `json:"signal_strength"`
-	IsAnomaly      bool      `json:"is_anomaly"`
-	AnomalyType    *string   `json:"anomaly_type,omitempty"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID              int                `json:"id"`
+	Timestamp       time.Time          `json:"timestamp"`
+	SpacecraftID    int                `json:"spacecraft_id"`
+	PacketID        int                `json:"packet_id"`
+	PacketSeqCtrl   int                `json:"packet_seq_ctrl"`
+	SubsystemID     int                `json:"subsystem_id"`
+	Temperature     float32            `json:"temperature"`
+	Battery         float32            `json:"battery"`
+	Altitude        float32            `json:"altitude"`
+	SignalStrength  float32            `json:"signal_strength"`
+	IsAnomaly       bool               `json:"is_anomaly"`
+	AnomalyType     *string            `json:"anomaly_type,omitempty"`
+	Derived         map[string]float32 `json:"derived,omitempty"`
+	Station         *string            `json:"station,omitempty"`
+	OnboardTime     *time.Time         `json:"onboard_time,omitempty"`
+	CorrectedTime   *time.Time         `json:"corrected_time,omitempty"`
+	IsLate          bool               `json:"is_late"`
+	LateSecs        *float32           `json:"late_seconds,omitempty"`
+	StructureID     *int               `json:"housekeeping_structure_id,omitempty"`
+	EarthReceivedAt *time.Time         `json:"earth_received_at,omitempty"`
+	RSSIDbm         *float32           `json:"rssi_dbm,omitempty"`
+	SNRDb           *float32           `json:"snr_db,omitempty"`
+	CorrectedBits   *int               `json:"corrected_bits,omitempty"`
+	CreatedAt       time.Time          `json:"created_at"`
 }
 
 type Anomaly struct {
 	ID             int        `json:"id"`
 	TelemetryID    int        `json:"telemetry_id"`
 	Timestamp      time.Time  `json:"timestamp"`
+	SpacecraftID   int        `json:"spacecraft_id"`
+	IncidentID     *int       `json:"incident_id,omitempty"`
 	AnomalyType    string     `json:"anomaly_type"`
 	ParameterName  string     `json:"parameter_name"`
 	ParameterValue float32    `json:"parameter_value"`
@@ -42,6 +56,10 @@ type Anomaly struct {
 	Severity       string     `json:"severity"`
 	Acknowledged   bool       `json:"acknowledged"`
 	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy *string    `json:"acknowledged_by,omitempty"`
+	AckNote        *string    `json:"acknowledgement_note,omitempty"`
+	Suppressed     bool       `json:"suppressed"`
+	SilenceID      *int       `json:"silence_id,omitempty"`
 	CreatedAt      time.Time  `json:"created_at"`
 }
 
@@ -64,10 +82,17 @@ type AggregationResult struct {
 	AnomalyCount      int       `json:"anomaly_count"`
 }
 
+// CurrentStatus is LOS when no station is in contact with the spacecraft,
+// so the latest telemetry is as old as the last pass, and STALE when a
+// station is in contact but no telemetry has been stored for longer than
+// STALE_DATA_THRESHOLD. Pass is the current or most recent pass.
 type CurrentStatus struct {
 	LatestTelemetry Telemetry `json:"latest_telemetry"`
 	AnomalyCount    int       `json:"anomaly_count"`
 	Status          string    `json:"status"`
+	Staleness       string    `json:"staleness"`
+	DataAgeSecs     float64   `json:"data_age_seconds"`
+	Pass            *Pass     `json:"pass"`
 	LastUpdate      time.Time `json:"last_update"`
 }
 
@@ -76,13 +101,25 @@ var db *sql.DB
 func main() {
 
 	initDatabase()
+	loadHealthThresholds()
+	loadClockConfig()
 
-	app := fiber.New()
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: errorHandler,
+	})
 
 	app.Use(logger.New())
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept",
+		AllowOrigins:  "*",
+		AllowHeaders:  "Origin, Content-Type, Accept, Last-Event-ID",
+		ExposeHeaders: "Link, X-Aggregation-Source, X-Aggregation-Materialized-Until",
 	}))
 
 	// Expose Prometheus metrics endpoint
@@ -100,14 +137,85 @@ func main() {
 	api.Get("/telemetry/aggregations", getAggregations)
 	api.Get("/telemetry/aggregations/min", getMinAggregations)
 	api.Get("/telemetry/aggregations/max", getMaxAggregations)
+	api.Get("/telemetry/aggregations/query", getAggregationQuery)
+	api.Get("/telemetry/downsample", getDownsampledTelemetry)
+	api.Get("/export/:table", exportData)
 	api.Get("/telemetry/anomalies/count", getAnomalyCount)
-
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status": "healthy",
-			"time":   time.Now(),
-		})
-	})
+	api.Get("/telemetry/:id/receptions", getTelemetryReceptions)
+	api.Get("/receptions/stats", getReceptionStats)
+
+	api.Get("/passes", getPasses)
+	api.Get("/passes/:id", getPassReport)
+
+	api.Get("/clock", getClockStatus)
+	api.Get("/clock/models", getClockModels)
+	api.Get("/clock/samples", getClockSamples)
+
+	api.Get("/housekeeping", getHousekeeping)
+	api.Get("/housekeeping/structures", getHousekeepingStructures)
+	api.Get("/events", getEvents)
+	api.Get("/events/dictionary", getEventDictionary)
+	api.Get("/commands", getCommands)
+	api.Get("/commands/:id", getCommand)
+
+	api.Get("/stations", getStations)
+	api.Get("/stations/:id", getStation)
+	api.Put("/stations/:id", putStation)
+
+	api.Get("/telemetry/stream", streamTelemetrySSE)
+	api.Use("/telemetry/ws", requireWebSocket)
+	api.Get("/telemetry/ws", websocket.New(streamTelemetryWS))
+
+	api.Post("/playback", createPlayback)
+	api.Get("/playback/:id", getPlayback)
+	api.Delete("/playback/:id", deletePlayback)
+	api.Post("/playback/:id/control", controlPlayback)
+	api.Get("/playback/:id/stream", streamPlaybackSSE)
+	api.Use("/playback/:id/ws", requirePlaybackWebSocket)
+	api.Get("/playback/:id/ws", websocket.New(streamPlaybackWS))
+
+	api.Post("/telemetry/anomalies/acknowledge", acknowledgeAnomalies)
+	api.Post("/telemetry/anomalies/unacknowledge", unacknowledgeAnomalies)
+	api.Post("/telemetry/anomalies/:id/acknowledge", acknowledgeAnomaly)
+	api.Post("/telemetry/anomalies/:id/unacknowledge", unacknowledgeAnomaly)
+	api.Get("/telemetry/anomalies/:id/comments", getAnomalyComments)
+	api.Post("/telemetry/anomalies/:id/comments", addAnomalyComment)
+	api.Get("/telemetry/anomalies/:id/audit", getAnomalyAudit)
+	api.Get("/audit", getAuditTrail)
+
+	api.Get("/incidents", getIncidents)
+	api.Get("/incidents/:id", getIncident)
+	api.Get("/incidents/:id/timeline", getIncidentTimeline)
+
+	api.Get("/silences", getSilences)
+	api.Post("/silences", createSilence)
+	api.Get("/silences/:id", getSilence)
+	api.Post("/silences/:id/expire", expireSilence)
+
+	api.Get("/parameters", getParameters)
+	api.Get("/parameters/:name/values", getParameterValues)
+
+	v2 := app.Group("/api/v2")
+	v2.Get("/telemetry", getTelemetryPage)
+	v2.Get("/telemetry/anomalies", getAnomalyPage)
+
+	admin := api.Group("/admin")
+	admin.Post("/reprocess", createReprocess)
+	admin.Get("/reprocess", listReprocess)
+	admin.Get("/reprocess/:id", getReprocess)
+
+	app.Get("/health", getLiveness)
+	app.Get("/health/live", getLiveness)
+	app.Get("/health/ready", getReadiness)
+
+	if _, err := failOrphanedReprocessJobs(); err != nil {
+		log.Printf("Error failing interrupted reprocess jobs: %v", err)
+	}
+
+	go startIncidentSweeper()
+	go startPassSweeper()
+	go startClockFitter()
+	go streams.run(databaseConnString())
 
 	port := os.Getenv("API_PORT")
 	if port == "" {
@@ -118,7 +226,18 @@ func main() {
 	log.Fatal(app.Listen(":" + port))
 }
 
-func initDatabase() {
+func runCommand(name string, args []string) error {
+	switch name {
+	case "reprocess":
+		return runReprocessCommand(args)
+	case "export":
+		return runExportCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func databaseConnString() string {
 	dbHost := os.Getenv("DB_HOST")
 	dbPort := os.Getenv("DB_PORT")
 	dbName := os.Getenv("DB_NAME")
@@ -141,11 +260,13 @@ func initDatabase() {
 		dbPassword = "telemetry_pass"
 	}
 
-	connStr := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
+	return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
 		dbHost, dbPort, dbName, dbUser, dbPassword)
+}
 
+func initDatabase() {
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	db, err = sql.Open("postgres", databaseConnString())
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -159,60 +280,50 @@ func initDatabase() {
 }
 
 func getTelemetry(c *fiber.Ctx) error {
-	startTime := c.Query("start_time")
-	endTime := c.Query("end_time")
-	limit := c.Query("limit", "100")
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
 
 	query := `
-		SELECT id, timestamp, packet_id, packet_seq_ctrl, subsystem_id,
-			   temperature, battery, altitude, signal_strength, is_anomaly, 
-			   anomaly_type, created_at
-		FROM telemetry
+		SELECT ` + telemetryColumns + `
+		FROM telemetry t
 		WHERE 1=1
 	`
 
 	args := []interface{}{}
 	argCount := 0
 
-	if startTime != "" {
+	if startTime != nil {
 		argCount++
 		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
-		args = append(args, startTime)
+		args = append(args, *startTime)
 	}
 
-	if endTime != "" {
+	if endTime != nil {
 		argCount++
 		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
-		args = append(args, endTime)
+		args = append(args, *endTime)
 	}
 
-	query += " ORDER BY timestamp DESC"
-
-	if limit != "" {
-		argCount++
-		query += fmt.Sprintf(" LIMIT $%d", argCount)
-		limitInt, _ := strconv.Atoi(limit)
-		args = append(args, limitInt)
-	}
+	argCount++
+	query += fmt.Sprintf(" ORDER BY timestamp DESC LIMIT $%d", argCount)
+	args = append(args, limit)
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to query telemetry data",
-			"details": err.Error(),
-		})
+		return sendError(c, internalError("Failed to query telemetry data", err))
 	}
 	defer rows.Close()
 
 	telemetry := make([]Telemetry, 0)
 
 	for rows.Next() {
-		var t Telemetry
-		err := rows.Scan(
-			&t.ID, &t.Timestamp, &t.PacketID, &t.PacketSeqCtrl, &t.SubsystemID,
-			&t.Temperature, &t.Battery, &t.Altitude, &t.SignalStrength,
-			&t.IsAnomaly, &t.AnomalyType, &t.CreatedAt,
-		)
+		t, err := scanTelemetry(rows)
 		if err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
@@ -221,11 +332,7 @@ func getTelemetry(c *fiber.Ctx) error {
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating rows: %v", err)
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to iterate telemetry data",
-			"details": err.Error(),
-		})
+		return sendError(c, internalError("Failed to iterate telemetry data", err))
 	}
 
 	return c.JSON(telemetry)
@@ -236,33 +343,37 @@ func getCurrentStatus(c *fiber.Ctx) error {
 
 	var latest Telemetry
 	query := `
-		SELECT id, timestamp, packet_id, packet_seq_ctrl, subsystem_id,
-			   temperature, battery, altitude, signal_strength, is_anomaly, 
-			   anomaly_type, created_at
-		FROM telemetry
+		SELECT t.id, t.timestamp, t.spacecraft_id, t.packet_id, t.packet_seq_ctrl, t.subsystem_id,
+			   t.temperature, t.battery, t.altitude, t.signal_strength, t.is_anomaly,
+			   t.anomaly_type, t.created_at, ` + derivedValuesColumn + `,
+			   t.is_anomaly AND telemetry_suppressed(t.id, t.timestamp)
+		FROM telemetry t
 		ORDER BY timestamp DESC
 		LIMIT 1
 	`
 
+	var derived []byte
+	var latestSuppressed bool
 	err := db.QueryRow(query).Scan(
-		&latest.ID, &latest.Timestamp, &latest.PacketID, &latest.PacketSeqCtrl, &latest.SubsystemID,
+		&latest.ID, &latest.Timestamp, &latest.SpacecraftID, &latest.PacketID, &latest.PacketSeqCtrl, &latest.SubsystemID,
 		&latest.Temperature, &latest.Battery, &latest.Altitude, &latest.SignalStrength,
-		&latest.IsAnomaly, &latest.AnomalyType, &latest.CreatedAt,
+		&latest.IsAnomaly, &latest.AnomalyType, &latest.CreatedAt, &derived, &latestSuppressed,
 	)
 
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to get current telemetry",
-			"details": err.Error(),
-		})
+		return sendError(c, internalError("Failed to get current telemetry", err))
 	}
+	latest.Derived = decodeDerived(derived)
 
+	// Anomalies covered by a silence are still stored but do not count
+	// towards the status.
 	var anomalyCount int
 	anomalyQuery := `
 		SELECT COUNT(*)
 		FROM telemetry
 		WHERE is_anomaly = true
 		AND timestamp >= NOW() - INTERVAL '24 hours'
+		AND NOT telemetry_suppressed(id, timestamp)
 	`
 
 	err = db.QueryRow(anomalyQuery).Scan(&anomalyCount)
@@ -271,77 +382,74 @@ func getCurrentStatus(c *fiber.Ctx) error {
 		anomalyCount = 0
 	}
 
-	status := "NORMAL"
-	if latest.IsAnomaly {
-		status = "ANOMALY"
-	} else if anomalyCount > 0 {
-		status = "WARNING"
+	pass, err := latestPass(latest.SpacecraftID)
+	if err != nil {
+		log.Printf("Error getting latest pass: %v", err)
 	}
 
+	now := time.Now()
+	age := now.Sub(latest.Timestamp)
+
 	currentStatus := CurrentStatus{
 		LatestTelemetry: latest,
 		AnomalyCount:    anomalyCount,
-		Status:          status,
-		LastUpdate:      time.Now(),
+		Status:          spacecraftStatus(pass, age, latest.IsAnomaly && !latestSuppressed, anomalyCount),
+		Staleness:       staleness(age),
+		DataAgeSecs:     age.Seconds(),
+		Pass:            pass,
+		LastUpdate:      now,
 	}
 
 	return c.JSON(currentStatus)
 }
 
-func getAnomalies(c *fiber.Ctx) error {
-	startTime := c.Query("start_time")
-	endTime := c.Query("end_time")
-	limit := c.Query("limit", "100")
-
-	query := `
-		SELECT id, telemetry_id, timestamp, anomaly_type, parameter_name,
-			   parameter_value, threshold_value, severity, acknowledged,
-			   acknowledged_at, created_at
-		FROM anomaly_history
-		WHERE 1=1
-	`
-
-	args := []interface{}{}
-	argCount := 0
+// spacecraftStatus is the status reported by getCurrentStatus. A closed pass
+// means LOS. Without any pass, for example before the first one or without
+// station configuration, the age of the data decides as during a pass.
+func spacecraftStatus(pass *Pass, age time.Duration, anomaly bool, anomalyCount int) string {
+	switch {
+	case pass != nil && pass.Status != "OPEN":
+		return "LOS"
+	case staleness(age) == dataStale:
+		return "STALE"
+	case anomaly:
+		return "ANOMALY"
+	case anomalyCount > 0:
+		return "WARNING"
+	}
+	return "NORMAL"
+}
 
-	if startTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
-		args = append(args, startTime)
+func getAnomalies(c *fiber.Ctx) error {
+	conditions, args, err := anomalyFilter(c)
+	if err != nil {
+		return sendError(c, err)
 	}
-
-	if endTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
-		args = append(args, endTime)
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
 	}
 
-	query += " ORDER BY timestamp DESC"
+	query := `
+		SELECT ` + anomalyColumns + `
+		FROM anomaly_history
+		WHERE superseded_at IS NULL
+	` + conditions
+	argCount := len(args)
 
-	if limit != "" {
-		argCount++
-		query += fmt.Sprintf(" LIMIT $%d", argCount)
-		limitInt, _ := strconv.Atoi(limit)
-		args = append(args, limitInt)
-	}
+	argCount++
+	query += fmt.Sprintf(" ORDER BY timestamp DESC LIMIT $%d", argCount)
+	args = append(args, limit)
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to query anomaly data",
-			"details": err.Error(),
-		})
+		return sendError(c, internalError("Failed to query anomaly data", err))
 	}
 	defer rows.Close()
 
 	var anomalies []Anomaly
 	for rows.Next() {
-		var a Anomaly
-		err := rows.Scan(
-			&a.ID, &a.TelemetryID, &a.Timestamp, &a.AnomalyType, &a.ParameterName,
-			&a.ParameterValue, &a.ThresholdValue, &a.Severity, &a.Acknowledged,
-			&a.AcknowledgedAt, &a.CreatedAt,
-		)
+		a, err := scanAnomaly(rows)
 		if err != nil {
 			log.Printf("Error scanning anomaly row: %v", err)
 			continue
@@ -352,61 +460,107 @@ func getAnomalies(c *fiber.Ctx) error {
 	return c.JSON(anomalies)
 }
 
-func getAggregations(c *fiber.Ctx) error {
-	startTime := c.Query("start_time")
-	endTime := c.Query("end_time")
-	bucketSize := c.Query("bucket_size", "1 hour")
-
-	query := `
-		SELECT time_bucket($1, timestamp) AS bucket,
-			   subsystem_id,
-			   AVG(temperature) as avg_temperature,
-			   MIN(temperature) as min_temperature,
-			   MAX(temperature) as max_temperature,
-			   AVG(battery) as avg_battery,
-			   MIN(battery) as min_battery,
-			   MAX(battery) as max_battery,
-			   AVG(altitude) as avg_altitude,
-			   MIN(altitude) as min_altitude,
-			   MAX(altitude) as max_altitude,
-			   AVG(signal_strength) as avg_signal_strength,
-			   MIN(signal_strength) as min_signal_strength,
-			   MAX(signal_strength) as max_signal_strength,
-			   COUNT(*) as packet_count,
-			   COUNT(*) FILTER (WHERE is_anomaly) as anomaly_count
-		FROM telemetry
-		WHERE 1=1
-	`
+// anomalyFilter builds the conditions shared by the anomaly listings from the
+// start_time, end_time, incident_id, acknowledged and suppressed query
+// parameters. Placeholders are numbered from $1.
+func anomalyFilter(c *fiber.Ctx) (string, []interface{}, error) {
+	var conditions string
+	args := []interface{}{}
 
-	args := []interface{}{bucketSize}
-	argCount := 1
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions += fmt.Sprintf(" AND "+condition, len(args))
+	}
 
-	if startTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
-		args = append(args, startTime)
+	start, end, err := queryTimeRange(c)
+	if err != nil {
+		return "", nil, err
+	}
+	incidentID, err := queryInt(c, "incident_id")
+	if err != nil {
+		return "", nil, err
+	}
+	acknowledged, err := queryBool(c, "acknowledged")
+	if err != nil {
+		return "", nil, err
+	}
+	suppressed, err := queryBool(c, "suppressed")
+	if err != nil {
+		return "", nil, err
 	}
 
-	if endTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
-		args = append(args, endTime)
+	if start != nil {
+		add("timestamp >= $%d", *start)
+	}
+	if end != nil {
+		add("timestamp <= $%d", *end)
+	}
+	if incidentID != nil {
+		add("incident_id = $%d", *incidentID)
+	}
+	if acknowledged != nil {
+		add("acknowledged = $%d", *acknowledged)
+	}
+	if suppressed != nil {
+		add("suppressed = $%d", *suppressed)
 	}
 
-	query += `
-		GROUP BY bucket, subsystem_id
-		ORDER BY bucket DESC
-	`
+	return conditions, args, nil
+}
 
-	rows, err := db.Query(query, args...)
+// telemetryColumns lists the telemetry columns in the order scanTelemetry
+// expects. The table must be aliased as t.
+const telemetryColumns = `t.id, t.timestamp, t.spacecraft_id, t.packet_id, t.packet_seq_ctrl, t.subsystem_id,
+		   t.temperature, t.battery, t.altitude, t.signal_strength, t.is_anomaly,
+		   t.anomaly_type, t.station, t.onboard_time, t.corrected_time,
+		   t.is_late, t.late_seconds, t.housekeeping_structure_id, t.earth_received_at, t.rssi_dbm, t.snr_db, t.corrected_bits,
+		   t.created_at, ` + derivedValuesColumn
+
+func scanTelemetry(row rowScanner) (Telemetry, error) {
+	var t Telemetry
+	var derived []byte
+	err := row.Scan(
+		&t.ID, &t.Timestamp, &t.SpacecraftID, &t.PacketID, &t.PacketSeqCtrl, &t.SubsystemID,
+		&t.Temperature, &t.Battery, &t.Altitude, &t.SignalStrength,
+		&t.IsAnomaly, &t.AnomalyType, &t.Station, &t.OnboardTime, &t.CorrectedTime,
+		&t.IsLate, &t.LateSecs, &t.StructureID, &t.EarthReceivedAt, &t.RSSIDbm, &t.SNRDb, &t.CorrectedBits,
+		&t.CreatedAt, &derived,
+	)
+	t.Derived = decodeDerived(derived)
+	return t, err
+}
+
+// anomalyColumns lists the anomaly_history columns in the order scanAnomaly expects.
+const anomalyColumns = `id, telemetry_id, timestamp, spacecraft_id, incident_id, anomaly_type,
+		   parameter_name, parameter_value, threshold_value, severity, acknowledged,
+		   acknowledged_at, acknowledged_by, acknowledgement_note, suppressed, silence_id, created_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAnomaly(row rowScanner) (Anomaly, error) {
+	var a Anomaly
+	err := row.Scan(
+		&a.ID, &a.TelemetryID, &a.Timestamp, &a.SpacecraftID, &a.IncidentID, &a.AnomalyType,
+		&a.ParameterName, &a.ParameterValue, &a.ThresholdValue, &a.Severity, &a.Acknowledged,
+		&a.AcknowledgedAt, &a.AcknowledgedBy, &a.AckNote, &a.Suppressed, &a.SilenceID, &a.CreatedAt,
+	)
+	return a, err
+}
+
+func getAggregations(c *fiber.Ctx) error {
+	rows, gapfilled, err := queryAggregations(c, parameterAggregates("avg", "min", "max"))
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to query aggregation data",
-			"details": err.Error(),
-		})
+		return sendError(c, err)
 	}
 	defer rows.Close()
 
+	if gapfilled {
+		return sendGapfilled(c, rows)
+	}
+
 	var aggregations []AggregationResult
 	for rows.Next() {
 		var a AggregationResult
@@ -429,52 +583,16 @@ func getAggregations(c *fiber.Ctx) error {
 }
 
 func getMinAggregations(c *fiber.Ctx) error {
-	startTime := c.Query("start_time")
-	endTime := c.Query("end_time")
-	bucketSize := c.Query("bucket_size", "1 hour")
-
-	query := `
-		SELECT time_bucket($1, timestamp) AS bucket,
-			   subsystem_id,
-			   MIN(temperature) as min_temperature,
-			   MIN(battery) as min_battery,
-			   MIN(altitude) as min_altitude,
-			   MIN(signal_strength) as min_signal_strength,
-			   COUNT(*) as packet_count,
-			   COUNT(*) FILTER (WHERE is_anomaly) as anomaly_count
-		FROM telemetry
-		WHERE 1=1
-	`
-
-	args := []interface{}{bucketSize}
-	argCount := 1
-
-	if startTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
-		args = append(args, startTime)
-	}
-
-	if endTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
-		args = append(args, endTime)
-	}
-
-	query += `
-		GROUP BY bucket, subsystem_id
-		ORDER BY bucket DESC
-	`
-
-	rows, err := db.Query(query, args...)
+	rows, gapfilled, err := queryAggregations(c, parameterAggregates("min"))
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to query min aggregation data",
-			"details": err.Error(),
-		})
+		return sendError(c, err)
 	}
 	defer rows.Close()
 
+	if gapfilled {
+		return sendGapfilled(c, rows)
+	}
+
 	type MinAggregationResult struct {
 		Bucket            time.Time `json:"bucket"`
 		SubsystemID       int       `json:"subsystem_id"`
@@ -505,52 +623,16 @@ func getMinAggregations(c *fiber.Ctx) error {
 }
 
 func getMaxAggregations(c *fiber.Ctx) error {
-	startTime := c.Query("start_time")
-	endTime := c.Query("end_time")
-	bucketSize := c.Query("bucket_size", "1 hour")
-
-	query := `
-		SELECT time_bucket($1, timestamp) AS bucket,
-			   subsystem_id,
-			   MAX(temperature) as max_temperature,
-			   MAX(battery) as max_battery,
-			   MAX(altitude) as max_altitude,
-			   MAX(signal_strength) as max_signal_strength,
-			   COUNT(*) as packet_count,
-			   COUNT(*) FILTER (WHERE is_anomaly) as anomaly_count
-		FROM telemetry
-		WHERE 1=1
-	`
-
-	args := []interface{}{bucketSize}
-	argCount := 1
-
-	if startTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
-		args = append(args, startTime)
-	}
-
-	if endTime != "" {
-		argCount++
-		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
-		args = append(args, endTime)
-	}
-
-	query += `
-		GROUP BY bucket, subsystem_id
-		ORDER BY bucket DESC
-	`
-
-	rows, err := db.Query(query, args...)
+	rows, gapfilled, err := queryAggregations(c, parameterAggregates("max"))
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to query max aggregation data",
-			"details": err.Error(),
-		})
+		return sendError(c, err)
 	}
 	defer rows.Close()
 
+	if gapfilled {
+		return sendGapfilled(c, rows)
+	}
+
 	type MaxAggregationResult struct {
 		Bucket            time.Time `json:"bucket"`
 		SubsystemID       int       `json:"subsystem_id"`
@@ -581,31 +663,30 @@ func getMaxAggregations(c *fiber.Ctx) error {
 }
 
 func getAnomalyCount(c *fiber.Ctx) error {
-	startTime := c.Query("start_time")
-	endTime := c.Query("end_time")
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
 
-	query := `SELECT COUNT(*) FROM anomaly_history WHERE 1=1`
+	query := `SELECT COUNT(*) FROM anomaly_history WHERE superseded_at IS NULL`
 	args := []interface{}{}
 	argCount := 0
 
-	if startTime != "" {
+	if startTime != nil {
 		argCount++
 		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
-		args = append(args, startTime)
+		args = append(args, *startTime)
 	}
-	if endTime != "" {
+	if endTime != nil {
 		argCount++
 		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
-		args = append(args, endTime)
+		args = append(args, *endTime)
 	}
 
 	var count int
-	err := db.QueryRow(query, args...).Scan(&count)
+	err = db.QueryRow(query, args...).Scan(&count)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "Failed to get anomaly count",
-			"details": err.Error(),
-		})
+		return sendError(c, internalError("Failed to get anomaly count", err))
 	}
 
 	return c.JSON(fiber.Map{"count": count})
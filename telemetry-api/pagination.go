@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Page is the v2 list envelope. Next and Prev are opaque cursors; they are
+// null when there is nothing further in that direction.
+type Page struct {
+	Data  interface{} `json:"data"`
+	Next  *string     `json:"next"`
+	Prev  *string     `json:"prev"`
+	Limit int         `json:"limit"`
+	Order string      `json:"order"`
+}
+
+// pageCursor is the (timestamp, id) key of the row a page starts after.
+// Prev cursors page back towards the start of the listing.
+type pageCursor struct {
+	Timestamp time.Time `json:"t"`
+	ID        int       `json:"i"`
+	Prev      bool      `json:"p,omitempty"`
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Timestamp.IsZero() {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+type pageRequest struct {
+	Limit  int
+	Desc   bool
+	Cursor *pageCursor
+}
+
+func parsePageRequest(c *fiber.Ctx) (pageRequest, error) {
+	p := pageRequest{Limit: defaultPageSize, Desc: true}
+
+	limit, err := queryLimit(c, defaultPageSize, maxPageSize)
+	if err != nil {
+		return p, err
+	}
+	p.Limit = limit
+
+	switch strings.ToLower(c.Query("order", "desc")) {
+	case "desc":
+	case "asc":
+		p.Desc = false
+	default:
+		return p, invalidParam("order", "order must be asc or desc")
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return p, invalidParam("cursor", "cursor is not valid")
+		}
+		p.Cursor = &cursor
+	}
+
+	return p, nil
+}
+
+// scanDesc is the direction the database is read in: the listing order, or
+// the opposite when paging back.
+func (p pageRequest) scanDesc() bool {
+	if p.Cursor != nil && p.Cursor.Prev {
+		return !p.Desc
+	}
+	return p.Desc
+}
+
+// keyset returns the condition selecting rows after the cursor and the
+// ORDER BY/LIMIT clause, with placeholders numbered after argCount. One row
+// more than the page is read to tell whether another page follows.
+func (p pageRequest) keyset(tsColumn, idColumn string, argCount int) (string, string, []interface{}) {
+	dir, cmp := "ASC", ">"
+	if p.scanDesc() {
+		dir, cmp = "DESC", "<"
+	}
+
+	var condition string
+	var args []interface{}
+	if p.Cursor != nil {
+		condition = fmt.Sprintf(" AND (%s, %s) %s ($%d, $%d)", tsColumn, idColumn, cmp, argCount+1, argCount+2)
+		args = append(args, p.Cursor.Timestamp, p.Cursor.ID)
+		argCount += 2
+	}
+
+	order := fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT $%d", tsColumn, dir, idColumn, dir, argCount+1)
+	args = append(args, p.Limit+1)
+	return condition, order, args
+}
+
+// paginate trims the extra row read by keyset, restores listing order and
+// computes the cursors of the neighbouring pages.
+func paginate[T any](p pageRequest, rows []T, key func(T) (time.Time, int)) ([]T, *string, *string) {
+	more := len(rows) > p.Limit
+	if more {
+		rows = rows[:p.Limit]
+	}
+
+	back := p.Cursor != nil && p.Cursor.Prev
+	if back {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	if len(rows) == 0 {
+		return rows, nil, nil
+	}
+
+	cursorAt := func(i int, prev bool) *string {
+		ts, id := key(rows[i])
+		s := encodeCursor(pageCursor{Timestamp: ts, ID: id, Prev: prev})
+		return &s
+	}
+
+	// Paging forward, a next page exists if the extra row was read and a
+	// previous one whenever the request started from a cursor. Paging back
+	// it is the other way round.
+	var next, prev *string
+	if more || back {
+		next = cursorAt(len(rows)-1, false)
+	}
+	if (back && more) || (!back && p.Cursor != nil) {
+		prev = cursorAt(0, true)
+	}
+	return rows, next, prev
+}
+
+// sendPage writes the envelope and a Link header with the next and prev
+// URLs, which repeat the request's query with the cursor replaced.
+func sendPage(c *fiber.Ctx, p pageRequest, data interface{}, next, prev *string) error {
+	var links []string
+	for _, l := range []struct {
+		rel    string
+		cursor *string
+	}{{"next", next}, {"prev", prev}} {
+		if l.cursor == nil {
+			continue
+		}
+		args := fiber.AcquireArgs()
+		c.Request().URI().QueryArgs().CopyTo(args)
+		args.Set("cursor", *l.cursor)
+		links = append(links, fmt.Sprintf(`<%s%s?%s>; rel="%s"`, c.BaseURL(), c.Path(), args.String(), l.rel))
+		fiber.ReleaseArgs(args)
+	}
+	if len(links) > 0 {
+		c.Set("Link", strings.Join(links, ", "))
+	}
+
+	order := "desc"
+	if !p.Desc {
+		order = "asc"
+	}
+	return c.JSON(Page{Data: data, Next: next, Prev: prev, Limit: p.Limit, Order: order})
+}
+
+func getTelemetryPage(c *fiber.Ctx) error {
+	p, err := parsePageRequest(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	start, end, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + telemetryColumns + ` FROM telemetry t WHERE 1=1`
+	args := []interface{}{}
+
+	if start != nil {
+		args = append(args, *start)
+		query += fmt.Sprintf(" AND t.timestamp >= $%d", len(args))
+	}
+	if end != nil {
+		args = append(args, *end)
+		query += fmt.Sprintf(" AND t.timestamp <= $%d", len(args))
+	}
+	if spacecraftID != nil {
+		args = append(args, *spacecraftID)
+		query += fmt.Sprintf(" AND t.spacecraft_id = $%d", len(args))
+	}
+
+	condition, order, keyArgs := p.keyset("t.timestamp", "t.id", len(args))
+	query += condition + order
+	args = append(args, keyArgs...)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query telemetry data", err))
+	}
+	defer rows.Close()
+
+	// A page missing a row, or cut short by a read error, would still carry
+	// a valid next cursor, so the client would skip the rows.
+	telemetry := make([]Telemetry, 0, p.Limit+1)
+	for rows.Next() {
+		t, err := scanTelemetry(rows)
+		if err != nil {
+			return sendError(c, internalError("Failed to read telemetry data", err))
+		}
+		telemetry = append(telemetry, t)
+	}
+	if err := rows.Err(); err != nil {
+		return sendError(c, internalError("Failed to read telemetry data", err))
+	}
+
+	telemetry, next, prev := paginate(p, telemetry, func(t Telemetry) (time.Time, int) { return t.Timestamp, t.ID })
+	return sendPage(c, p, telemetry, next, prev)
+}
+
+func getAnomalyPage(c *fiber.Ctx) error {
+	p, err := parsePageRequest(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	conditions, args, err := anomalyFilter(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + anomalyColumns + ` FROM anomaly_history WHERE superseded_at IS NULL` + conditions
+	condition, order, keyArgs := p.keyset("timestamp", "id", len(args))
+	query += condition + order
+	args = append(args, keyArgs...)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query anomaly data", err))
+	}
+	defer rows.Close()
+
+	anomalies := make([]Anomaly, 0, p.Limit+1)
+	for rows.Next() {
+		a, err := scanAnomaly(rows)
+		if err != nil {
+			return sendError(c, internalError("Failed to read anomaly data", err))
+		}
+		anomalies = append(anomalies, a)
+	}
+	if err := rows.Err(); err != nil {
+		return sendError(c, internalError("Failed to read anomaly data", err))
+	}
+
+	anomalies, next, prev := paginate(p, anomalies, func(a Anomaly) (time.Time, int) { return a.Timestamp, a.ID })
+	return sendPage(c, p, anomalies, next, prev)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pageRow struct {
+	ts time.Time
+	id int
+}
+
+// fakeKeysetQuery mimics the SQL produced by keyset over an in-memory table.
+func fakeKeysetQuery(table []pageRow, p pageRequest) []pageRow {
+	desc := p.scanDesc()
+	less := func(a, b pageRow) bool {
+		if !a.ts.Equal(b.ts) {
+			return a.ts.Before(b.ts)
+		}
+		return a.id < b.id
+	}
+
+	var rows []pageRow
+	for _, r := range table {
+		if p.Cursor != nil {
+			key := pageRow{p.Cursor.Timestamp, p.Cursor.ID}
+			if desc && !less(r, key) || !desc && !less(key, r) {
+				continue
+			}
+		}
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if desc {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+	if len(rows) > p.Limit+1 {
+		rows = rows[:p.Limit+1]
+	}
+	return rows
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	in := pageCursor{Timestamp: time.Date(2024, 3, 1, 10, 0, 0, 123456000, time.UTC), ID: 42, Prev: true}
+	out, err := decodeCursor(encodeCursor(in))
+	require.NoError(t, err)
+	assert.True(t, in.Timestamp.Equal(out.Timestamp))
+	assert.Equal(t, in.ID, out.ID)
+	assert.True(t, out.Prev)
+
+	for _, bad := range []string{"!!!", "e30", "bm90IGpzb24"} {
+		_, err := decodeCursor(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestKeysetClause(t *testing.T) {
+	cursor := pageCursor{Timestamp: time.Unix(100, 0), ID: 7}
+	p := pageRequest{Limit: 50, Desc: true, Cursor: &cursor}
+
+	condition, order, args := p.keyset("timestamp", "id", 2)
+	assert.Equal(t, " AND (timestamp, id) < ($3, $4)", condition)
+	assert.Equal(t, " ORDER BY timestamp DESC, id DESC LIMIT $5", order)
+	assert.Equal(t, []interface{}{cursor.Timestamp, 7, 51}, args)
+
+	cursor.Prev = true
+	condition, order, _ = p.keyset("timestamp", "id", 0)
+	assert.Equal(t, " AND (timestamp, id) > ($1, $2)", condition)
+	assert.Equal(t, " ORDER BY timestamp ASC, id ASC LIMIT $3", order)
+}
+
+func TestPaginateWalksForwardAndBack(t *testing.T) {
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var table []pageRow
+	for i := 1; i <= 7; i++ {
+		// Pairs of rows share a timestamp so the id tie-break matters.
+		table = append(table, pageRow{base.Add(time.Duration(i/2) * time.Second), i})
+	}
+	key := func(r pageRow) (time.Time, int) { return r.ts, r.id }
+	ids := func(rows []pageRow) []int {
+		var out []int
+		for _, r := range rows {
+			out = append(out, r.id)
+		}
+		return out
+	}
+
+	for _, desc := range []bool{true, false} {
+		p := pageRequest{Limit: 3, Desc: desc}
+		var pages [][]int
+		var cursors []*string
+
+		for {
+			rows, next, prev := paginate(p, fakeKeysetQuery(table, p), key)
+			pages = append(pages, ids(rows))
+			cursors = append(cursors, prev)
+			if next == nil {
+				break
+			}
+			c, err := decodeCursor(*next)
+			require.NoError(t, err)
+			p.Cursor = &c
+		}
+
+		if desc {
+			assert.Equal(t, [][]int{{7, 6, 5}, {4, 3, 2}, {1}}, pages)
+		} else {
+			assert.Equal(t, [][]int{{1, 2, 3}, {4, 5, 6}, {7}}, pages)
+		}
+		assert.Nil(t, cursors[0], "first page has no prev")
+
+		// Paging back from the last page returns the previous page.
+		c, err := decodeCursor(*cursors[2])
+		require.NoError(t, err)
+		p.Cursor = &c
+		rows, next, prev := paginate(p, fakeKeysetQuery(table, p), key)
+		assert.Equal(t, pages[1], ids(rows))
+		assert.NotNil(t, next)
+		assert.NotNil(t, prev)
+	}
+}
+
+func TestTelemetryPagesAreStableUnderInserts(t *testing.T) {
+	withTestDB(t)
+	app := fiber.New()
+	app.Get("/api/v2/telemetry", getTelemetryPage)
+
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	var want []int
+	for i := 0; i < 5; i++ {
+		// Pairs of rows share a timestamp so the id tie-break matters.
+		want = append(want, insertTestTelemetry(t, db, ts.Add(time.Duration(i/2)*time.Second), 25))
+	}
+
+	page := func(cursor *string) ([]int, *string) {
+		q := url.Values{"spacecraft_id": {fmt.Sprint(testSpacecraftID)}, "limit": {"2"}, "order": {"asc"}}
+		if cursor != nil {
+			q.Set("cursor", *cursor)
+		}
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/v2/telemetry?"+q.Encode(), nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var body struct {
+			Data []Telemetry `json:"data"`
+			Next *string     `json:"next"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		var ids []int
+		for _, row := range body.Data {
+			ids = append(ids, row.ID)
+		}
+		return ids, body.Next
+	}
+
+	var got []int
+	ids, next := page(nil)
+	got = append(got, ids...)
+	// A row inserted before the cursor does not shift later pages.
+	insertTestTelemetry(t, db, ts.Add(-time.Second), 25)
+	for next != nil {
+		ids, next = page(next)
+		got = append(got, ids...)
+	}
+	assert.Equal(t, want, got)
+}
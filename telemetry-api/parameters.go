@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// downlinkedParameters maps the parameter names used in parameter_limits and
+// derived expressions to their telemetry columns.
+var downlinkedParameters = map[string]string{
+	"temperature":     "temperature",
+	"battery":         "battery",
+	"altitude":        "altitude",
+	"signal_strength": "signal_strength",
+}
+
+// splitList splits a comma separated query parameter, dropping blanks and
+// repeats.
+func splitList(v string) []string {
+	var items []string
+	seen := map[string]bool{}
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" && !seen[s] {
+			seen[s] = true
+			items = append(items, s)
+		}
+	}
+	return items
+}
+
+// queryParameterList parses the comma separated parameter query parameter
+// into downlinked parameters and names taken to be derived, which
+// checkDerivedParameters verifies.
+func queryParameterList(c *fiber.Ctx, max int) (downlinked, derived []string, err error) {
+	names := splitList(c.Query("parameter"))
+	if len(names) == 0 || len(names) > max {
+		return nil, nil, invalidParam("parameter", "parameter must list 1 to %d parameters", max)
+	}
+	for _, name := range names {
+		if _, ok := downlinkedParameters[name]; ok {
+			downlinked = append(downlinked, name)
+		} else {
+			derived = append(derived, name)
+		}
+	}
+	return downlinked, derived, nil
+}
+
+// checkDerivedParameters returns an invalid_parameter error naming any of
+// names that is not a derived parameter.
+func checkDerivedParameters(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(`SELECT name FROM derived_parameters WHERE name = ANY($1)`, pq.Array(names))
+	if err != nil {
+		return internalError("Failed to look up parameters", err)
+	}
+	defer rows.Close()
+
+	known := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil {
+			known[name] = true
+		}
+	}
+
+	var unknown []string
+	for _, name := range names {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return invalidParam("parameter", "unknown parameter: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+type Parameter struct {
+	Name            string   `json:"name"`
+	Source          string   `json:"source"`
+	Expression      *string  `json:"expression,omitempty"`
+	Unit            *string  `json:"unit,omitempty"`
+	Description     *string  `json:"description,omitempty"`
+	Enabled         bool     `json:"enabled"`
+	LowThreshold    *float32 `json:"low_threshold,omitempty"`
+	LowAnomalyType  *string  `json:"low_anomaly_type,omitempty"`
+	HighThreshold   *float32 `json:"high_threshold,omitempty"`
+	HighAnomalyType *string  `json:"high_anomaly_type,omitempty"`
+	Severity        *string  `json:"severity,omitempty"`
+}
+
+type ParameterValue struct {
+	TelemetryID int       `json:"telemetry_id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Value       float32   `json:"value"`
+	IsAnomaly   bool      `json:"is_anomaly"`
+	AnomalyType *string   `json:"anomaly_type,omitempty"`
+}
+
+// derivedValuesColumn is selected alongside telemetry rows so that derived
+// parameters are returned next to the downlinked ones. It expects the
+// telemetry table to be aliased as t.
+const derivedValuesColumn = `
+	(SELECT json_object_agg(d.parameter_name, d.value)
+	 FROM derived_values d
+	 WHERE d.telemetry_id = t.id AND d.timestamp = t.timestamp) AS derived`
+
+func decodeDerived(raw []byte) map[string]float32 {
+	if raw == nil {
+		return nil
+	}
+	var derived map[string]float32
+	if err := json.Unmarshal(raw, &derived); err != nil {
+		log.Printf("Error decoding derived values: %v", err)
+		return nil
+	}
+	return derived
+}
+
+func getParameters(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT p.name, p.source, p.expression, p.unit, p.description, p.enabled,
+			   l.low_threshold, l.low_anomaly_type, l.high_threshold, l.high_anomaly_type, l.severity
+		FROM (
+			SELECT unnest($1::text[]) AS name, 'downlink' AS source, NULL::text AS expression,
+				   NULL::varchar AS unit, NULL::text AS description, TRUE AS enabled
+			UNION ALL
+			SELECT name, 'derived', expression, unit, description, enabled
+			FROM derived_parameters
+		) p
+		LEFT JOIN parameter_limits l ON l.parameter_name = p.name
+		ORDER BY p.source DESC, p.name
+	`, pq.Array(downlinkedParameterNames()))
+	if err != nil {
+		return sendError(c, internalError("Failed to query parameters", err))
+	}
+	defer rows.Close()
+
+	parameters := make([]Parameter, 0)
+	for rows.Next() {
+		var p Parameter
+		err := rows.Scan(
+			&p.Name, &p.Source, &p.Expression, &p.Unit, &p.Description, &p.Enabled,
+			&p.LowThreshold, &p.LowAnomalyType, &p.HighThreshold, &p.HighAnomalyType, &p.Severity,
+		)
+		if err != nil {
+			log.Printf("Error scanning parameter row: %v", err)
+			continue
+		}
+		parameters = append(parameters, p)
+	}
+
+	return c.JSON(parameters)
+}
+
+// getParameterValues returns the time series of a single parameter. Downlinked
+// and derived parameters are served from their own tables but share the
+// response format and query parameters.
+func getParameterValues(c *fiber.Ctx) error {
+	name := c.Params("name")
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	var query string
+	args := []interface{}{}
+	argCount := 0
+
+	if column, ok := downlinkedParameters[name]; ok {
+		query = fmt.Sprintf(`
+			SELECT id, timestamp, %s, is_anomaly, anomaly_type
+			FROM telemetry
+			WHERE 1=1
+		`, column)
+	} else {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM derived_parameters WHERE name = $1)`, name).Scan(&exists)
+		if err != nil {
+			return sendError(c, internalError("Failed to look up parameter", err))
+		}
+		if !exists {
+			return sendError(c, notFound("Unknown parameter"))
+		}
+
+		argCount++
+		query = fmt.Sprintf(`
+			SELECT telemetry_id, timestamp, value, is_anomaly, anomaly_type
+			FROM derived_values
+			WHERE parameter_name = $%d
+		`, argCount)
+		args = append(args, name)
+	}
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND timestamp >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND timestamp <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY timestamp DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query parameter values", err))
+	}
+	defer rows.Close()
+
+	values := make([]ParameterValue, 0)
+	for rows.Next() {
+		var v ParameterValue
+		var isAnomaly sql.NullBool
+		if err := rows.Scan(&v.TelemetryID, &v.Timestamp, &v.Value, &isAnomaly, &v.AnomalyType); err != nil {
+			log.Printf("Error scanning parameter value row: %v", err)
+			continue
+		}
+		v.IsAnomaly = isAnomaly.Bool
+		values = append(values, v)
+	}
+
+	return c.JSON(values)
+}
+
+func downlinkedParameterNames() []string {
+	names := make([]string, 0, len(downlinkedParameters))
+	for name := range downlinkedParameters {
+		names = append(names, name)
+	}
+	return names
+}
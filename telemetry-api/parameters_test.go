@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDerivedValuesRaiseAnomaliesOfTheirPacket(t *testing.T) {
+	tx := testTx(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := insertTestTelemetry(t, tx, ts, 25)
+
+	_, err := tx.Exec(`
+		INSERT INTO derived_values (telemetry_id, timestamp, parameter_name, value)
+		VALUES ($1, $2, 'battery_health', 25), ($1, $2, 'thermal_margin', 5)
+	`, id, ts)
+	require.NoError(t, err)
+
+	var isAnomaly bool
+	var anomalyType sql.NullString
+	require.NoError(t, tx.QueryRow(`
+		SELECT is_anomaly, anomaly_type FROM derived_values
+		WHERE telemetry_id = $1 AND timestamp = $2 AND parameter_name = 'battery_health'
+	`, id, ts).Scan(&isAnomaly, &anomalyType))
+	assert.True(t, isAnomaly)
+	assert.Equal(t, "LOW_BATTERY_HEALTH", anomalyType.String)
+
+	rows, err := tx.Query(`
+		SELECT parameter_name, spacecraft_id, parameter_value, threshold_value, is_derived
+		FROM anomaly_history
+		WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+	`, id, ts)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var anomalies int
+	for rows.Next() {
+		var name string
+		var spacecraftID int
+		var value, threshold float64
+		var derived bool
+		require.NoError(t, rows.Scan(&name, &spacecraftID, &value, &threshold, &derived))
+		assert.Equal(t, "battery_health", name)
+		assert.Equal(t, testSpacecraftID, spacecraftID)
+		assert.Equal(t, 25.0, value)
+		assert.Equal(t, 30.0, threshold)
+		assert.True(t, derived)
+		anomalies++
+	}
+	require.NoError(t, rows.Err())
+	// The packet itself is within limits and thermal_margin has none.
+	assert.Equal(t, 1, anomalies)
+}
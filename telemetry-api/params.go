@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 10000
+)
+
+// timeFormat describes the values parseTime accepts, for error messages.
+const timeFormat = "an RFC3339 timestamp or a relative time such as now-6h"
+
+// parseTime accepts RFC3339 timestamps and times relative to now: "now",
+// "now-6h", "now+30m", "now-7d". Units are s, m, h, d and w.
+func parseTime(v string, now time.Time) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, true
+	}
+
+	if !strings.HasPrefix(v, "now") {
+		return time.Time{}, false
+	}
+	rest := v[len("now"):]
+	if rest == "" {
+		return now, true
+	}
+	if len(rest) < 3 || (rest[0] != '-' && rest[0] != '+') {
+		return time.Time{}, false
+	}
+
+	// Atoi would also accept a sign, as in "now-+5h" or "now--0h".
+	amount := rest[1 : len(rest)-1]
+	if strings.TrimLeft(amount, "0123456789") != "" {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(amount)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var unit time.Duration
+	switch rest[len(rest)-1] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.Time{}, false
+	}
+	// Offsets beyond the range of a time.Duration, about 292 years, would
+	// wrap around.
+	if int64(n) > math.MaxInt64/int64(unit) {
+		return time.Time{}, false
+	}
+
+	d := time.Duration(n) * unit
+	if rest[0] == '-' {
+		d = -d
+	}
+	return now.Add(d), true
+}
+
+// queryTime parses an optional time query parameter.
+func queryTime(c *fiber.Ctx, name string, now time.Time) (*time.Time, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, ok := parseTime(v, now)
+	if !ok {
+		return nil, invalidParam(name, "%s must be %s", name, timeFormat)
+	}
+	return &t, nil
+}
+
+// queryTimeRange parses the optional start_time and end_time parameters.
+func queryTimeRange(c *fiber.Ctx) (*time.Time, *time.Time, error) {
+	now := time.Now()
+	start, err := queryTime(c, "start_time", now)
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := queryTime(c, "end_time", now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if start != nil && end != nil && end.Before(*start) {
+		return nil, nil, invalidParam("end_time", "end_time must not be before start_time")
+	}
+	return start, end, nil
+}
+
+func queryLimit(c *fiber.Ctx, def, max int) (int, error) {
+	v := c.Query("limit")
+	if v == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > max {
+		return 0, invalidParam("limit", "limit must be between 1 and %d", max)
+	}
+	return limit, nil
+}
+
+func queryInt(c *fiber.Ctx, name string) (*int, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, invalidParam(name, "%s must be an integer", name)
+	}
+	return &n, nil
+}
+
+func queryFloat(c *fiber.Ctx, name string) (*float64, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, invalidParam(name, "%s must be a number", name)
+	}
+	return &f, nil
+}
+
+func queryBool(c *fiber.Ctx, name string) (*bool, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, invalidParam(name, "%s must be true or false", name)
+	}
+	return &b, nil
+}
+
+// paramID parses a positive integer route parameter.
+func paramID(c *fiber.Ctx, name string) (int, error) {
+	id, err := strconv.Atoi(c.Params(name))
+	if err != nil || id < 1 {
+		return 0, invalidParam(name, "%s must be a positive integer", name)
+	}
+	return id, nil
+}
+
+// bucketSize is an allowed aggregation bucket. Interval is passed to
+// time_bucket.
+type bucketSize struct {
+	Interval string
+	Duration time.Duration
+}
+
+// bucketSizes is the allow-list for bucket_size; each entry also accepts a
+// short form such as 5m.
+var bucketSizes = []struct {
+	names []string
+	size  bucketSize
+}{
+	{[]string{"1 minute", "1m"}, bucketSize{"1 minute", time.Minute}},
+	{[]string{"5 minutes", "5m"}, bucketSize{"5 minutes", 5 * time.Minute}},
+	{[]string{"10 minutes", "10m"}, bucketSize{"10 minutes", 10 * time.Minute}},
+	{[]string{"15 minutes", "15m"}, bucketSize{"15 minutes", 15 * time.Minute}},
+	{[]string{"30 minutes", "30m"}, bucketSize{"30 minutes", 30 * time.Minute}},
+	{[]string{"1 hour", "1h"}, bucketSize{"1 hour", time.Hour}},
+	{[]string{"6 hours", "6h"}, bucketSize{"6 hours", 6 * time.Hour}},
+	{[]string{"12 hours", "12h"}, bucketSize{"12 hours", 12 * time.Hour}},
+	{[]string{"1 day", "1d"}, bucketSize{"1 day", 24 * time.Hour}},
+	{[]string{"1 week", "1w"}, bucketSize{"1 week", 7 * 24 * time.Hour}},
+}
+
+func queryBucketSize(c *fiber.Ctx, def string) (bucketSize, error) {
+	v := strings.ToLower(strings.TrimSpace(c.Query("bucket_size", def)))
+	var allowed []string
+	for _, b := range bucketSizes {
+		for _, name := range b.names {
+			if v == name {
+				return b.size, nil
+			}
+		}
+		allowed = append(allowed, b.names[0])
+	}
+	return bucketSize{}, invalidParam("bucket_size", "bucket_size must be one of: %s", strings.Join(allowed, ", "))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	valid := map[string]time.Time{
+		"2024-03-01T10:00:00Z":        time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		"2024-03-01T10:00:00.5+02:00": time.Date(2024, 3, 1, 8, 0, 0, 5e8, time.UTC),
+		"now":                         now,
+		"now-6h":                      now.Add(-6 * time.Hour),
+		"now+30m":                     now.Add(30 * time.Minute),
+		"now-7d":                      now.Add(-7 * 24 * time.Hour),
+		"now-1w":                      now.Add(-7 * 24 * time.Hour),
+		"now-90s":                     now.Add(-90 * time.Second),
+		"now-15250w":                  now.Add(-15250 * 7 * 24 * time.Hour),
+	}
+	for v, want := range valid {
+		got, ok := parseTime(v, now)
+		require.True(t, ok, v)
+		assert.True(t, want.Equal(got), "%s: got %s", v, got)
+	}
+
+	for _, v := range []string{"", "yesterday", "2024-03-01", "now-", "now-h", "now-6y", "now6h", "now--6h", "now-+5h", "now+-5h", "now--0h", "now- 5h", "nowish",
+		"now-99999999w", "now+15251w", "now-106752d", "now-9223372036854775807s", "now-99999999999999999999s"} {
+		_, ok := parseTime(v, now)
+		assert.False(t, ok, v)
+	}
+}
+
+func TestQueryParamValidation(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		if _, _, err := queryTimeRange(c); err != nil {
+			return sendError(c, err)
+		}
+		if _, err := queryLimit(c, defaultListLimit, maxListLimit); err != nil {
+			return sendError(c, err)
+		}
+		if _, err := queryBucketSize(c, "1 hour"); err != nil {
+			return sendError(c, err)
+		}
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		query string
+		field string
+	}{
+		{"", ""},
+		{"start_time=now-6h&end_time=now&limit=1000&bucket_size=5m", ""},
+		{"bucket_size=10%20minutes", ""},
+		{"start_time=yesterday", "start_time"},
+		{"end_time=2024-13-01T00:00:00Z", "end_time"},
+		{"start_time=now&end_time=now-1h", "end_time"},
+		{"start_time=now-99999999w", "start_time"},
+		{"limit=abc", "limit"},
+		{"limit=0", "limit"},
+		{"limit=10001", "limit"},
+		{"bucket_size=3%20minutes", "bucket_size"},
+		{"bucket_size=1%20hour;DROP%20TABLE%20telemetry", "bucket_size"},
+	}
+
+	for _, tc := range cases {
+		resp, err := app.Test(httptest.NewRequest("GET", "/?"+tc.query, nil))
+		require.NoError(t, err)
+		if tc.field == "" {
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode, tc.query)
+			continue
+		}
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, tc.query)
+		var body APIError
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, codeInvalidParameter, body.Code, tc.query)
+		assert.Equal(t, tc.field, body.Field, tc.query)
+		assert.NotEmpty(t, body.Message, tc.query)
+	}
+}
+
+func TestQueryBucketSize(t *testing.T) {
+	app := fiber.New()
+	var got bucketSize
+	app.Get("/", func(c *fiber.Ctx) error {
+		b, err := queryBucketSize(c, "1 hour")
+		if err != nil {
+			return sendError(c, err)
+		}
+		got = b
+		return nil
+	})
+
+	for query, want := range map[string]bucketSize{
+		"":                         {"1 hour", time.Hour},
+		"bucket_size=1m":           {"1 minute", time.Minute},
+		"bucket_size=1%20Day":      {"1 day", 24 * time.Hour},
+		"bucket_size=15%20minutes": {"15 minutes", 15 * time.Minute},
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/?"+query, nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, query)
+		assert.Equal(t, want, got, query)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// passSweepInterval is how often open passes without recent packets are
+// closed.
+const passSweepInterval = 10 * time.Second
+
+// Pass is a contact between a spacecraft and a ground station, from
+// acquisition (AOS) to loss of signal (LOS). LOSAt is unset while the pass is
+// open. LostPackets counts skipped sequence counts; LossRatio is their share
+// of the packets expected.
+type Pass struct {
+	ID                int        `json:"id"`
+	SpacecraftID      int        `json:"spacecraft_id"`
+	Station           string     `json:"station"`
+	Status            string     `json:"status"`
+	AOSAt             time.Time  `json:"aos_at"`
+	LastPacketAt      time.Time  `json:"last_packet_at"`
+	LOSAt             *time.Time `json:"los_at,omitempty"`
+	DurationSecs      float64    `json:"duration_seconds"`
+	PacketCount       int        `json:"packet_count"`
+	LostPackets       int        `json:"lost_packets"`
+	LossRatio         float64    `json:"loss_ratio"`
+	AnomalyCount      int        `json:"anomaly_count"`
+	MinSignalStrength *float32   `json:"min_signal_strength"`
+	MaxSignalStrength *float32   `json:"max_signal_strength"`
+}
+
+// PassAnomalies counts the anomalies of one parameter and type found in the
+// packets of a pass.
+type PassAnomalies struct {
+	ParameterName string `json:"parameter_name"`
+	AnomalyType   string `json:"anomaly_type"`
+	Severity      string `json:"severity"`
+	Count         int    `json:"count"`
+}
+
+// PassReport summarizes a pass: what the station received, how good the link
+// was and what was found in the packets. OverlappingPasses are passes of the
+// same spacecraft at other stations that overlap it.
+type PassReport struct {
+	Pass
+	Stored            int             `json:"stored"`
+	Replaced          int             `json:"replaced"`
+	Duplicate         int             `json:"duplicate"`
+	Corrupt           int             `json:"corrupt"`
+	AvgRSSIDbm        *float64        `json:"avg_rssi_dbm"`
+	AvgSNRDb          *float64        `json:"avg_snr_db"`
+	MinSNRDb          *float64        `json:"min_snr_db"`
+	CorrectedBits     int64           `json:"corrected_bits"`
+	Anomalies         []PassAnomalies `json:"anomalies"`
+	OverlappingPasses []Pass          `json:"overlapping_passes"`
+}
+
+// passColumns reports a pass whose station has been silent for
+// pass_silence() as closed even before the sweeper closes it.
+const passColumns = `id, spacecraft_id, station,
+		   CASE WHEN status = 'OPEN' AND last_packet_at < NOW() - pass_silence() THEN 'CLOSED' ELSE status END,
+		   aos_at, last_packet_at,
+		   CASE WHEN status = 'OPEN' AND last_packet_at < NOW() - pass_silence() THEN last_packet_at ELSE los_at END,
+		   packet_count, lost_packets, anomaly_count, min_signal_strength, max_signal_strength`
+
+func scanPass(row rowScanner) (Pass, error) {
+	var p Pass
+	err := row.Scan(
+		&p.ID, &p.SpacecraftID, &p.Station, &p.Status, &p.AOSAt, &p.LastPacketAt, &p.LOSAt,
+		&p.PacketCount, &p.LostPackets, &p.AnomalyCount, &p.MinSignalStrength, &p.MaxSignalStrength,
+	)
+	if err != nil {
+		return p, err
+	}
+	p.DurationSecs = p.LastPacketAt.Sub(p.AOSAt).Seconds()
+	if expected := p.PacketCount + p.LostPackets; expected > 0 {
+		p.LossRatio = float64(p.LostPackets) / float64(expected)
+	}
+	return p, nil
+}
+
+func startPassSweeper() {
+	for range time.Tick(passSweepInterval) {
+		var closed int
+		if err := db.QueryRow(`SELECT close_stale_passes()`).Scan(&closed); err != nil {
+			log.Printf("Error closing stale passes: %v", err)
+			continue
+		}
+		if closed > 0 {
+			log.Printf("Closed %d passes at loss of signal", closed)
+		}
+	}
+}
+
+// latestPass returns the current or most recent pass of a spacecraft, or nil
+// if it has never been in contact.
+func latestPass(spacecraftID int) (*Pass, error) {
+	p, err := scanPass(db.QueryRow(`
+		SELECT `+passColumns+`
+		FROM passes
+		WHERE spacecraft_id = $1
+		ORDER BY last_packet_at DESC
+		LIMIT 1
+	`, spacecraftID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// getPasses lists passes that overlap the time range, latest first:
+//
+//	GET /api/v1/passes?station=GS1&start_time=now-24h
+func getPasses(c *fiber.Ctx) error {
+	station := c.Query("station")
+	status := strings.ToUpper(c.Query("status"))
+	if status != "" && status != "OPEN" && status != "CLOSED" {
+		return sendError(c, invalidParam("status", "status must be open or closed"))
+	}
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + passColumns + ` FROM passes WHERE 1=1`
+	args := []interface{}{}
+	argCount := 0
+
+	if station != "" {
+		argCount++
+		query += fmt.Sprintf(" AND station = $%d", argCount)
+		args = append(args, station)
+	}
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND spacecraft_id = $%d", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	switch status {
+	case "OPEN":
+		query += " AND status = 'OPEN' AND last_packet_at >= NOW() - pass_silence()"
+	case "CLOSED":
+		query += " AND (status = 'CLOSED' OR last_packet_at < NOW() - pass_silence())"
+	}
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND last_packet_at >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND aos_at <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY aos_at DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query passes", err))
+	}
+	defer rows.Close()
+
+	passes := make([]Pass, 0)
+	for rows.Next() {
+		p, err := scanPass(rows)
+		if err != nil {
+			log.Printf("Error scanning pass row: %v", err)
+			continue
+		}
+		passes = append(passes, p)
+	}
+
+	return c.JSON(passes)
+}
+
+// getPassReport returns the summary report of a pass.
+func getPassReport(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	pass, err := scanPass(db.QueryRow(`SELECT `+passColumns+` FROM passes WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Pass not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get pass", err))
+	}
+
+	report := PassReport{Pass: pass, Anomalies: make([]PassAnomalies, 0), OverlappingPasses: make([]Pass, 0)}
+	err = db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE outcome = 'STORED'),
+			   COUNT(*) FILTER (WHERE outcome = 'REPLACED'),
+			   COUNT(*) FILTER (WHERE outcome = 'DUPLICATE'),
+			   COUNT(*) FILTER (WHERE quality = 0),
+			   AVG(rssi_dbm), AVG(snr_db), MIN(snr_db),
+			   COALESCE(SUM(corrected_bits), 0)
+		FROM packet_receptions
+		WHERE pass_id = $1
+	`, id).Scan(&report.Stored, &report.Replaced, &report.Duplicate, &report.Corrupt,
+		&report.AvgRSSIDbm, &report.AvgSNRDb, &report.MinSNRDb, &report.CorrectedBits)
+	if err != nil {
+		return sendError(c, internalError("Failed to query pass receptions", err))
+	}
+
+	// Anomalies belong to the stored copy of each packet, which may have
+	// come from another station.
+	rows, err := db.Query(`
+		SELECT h.parameter_name, h.anomaly_type, h.severity, COUNT(*)
+		FROM packet_receptions r
+		JOIN telemetry_packets p ON p.spacecraft_id = r.spacecraft_id AND p.apid = r.apid
+			AND p.seq_count = r.seq_count AND p.onboard_time = r.onboard_time
+		JOIN anomaly_history h ON h.telemetry_id = p.telemetry_id AND h.telemetry_timestamp = p.telemetry_timestamp
+		WHERE r.pass_id = $1 AND h.superseded_at IS NULL
+		GROUP BY h.parameter_name, h.anomaly_type, h.severity
+		ORDER BY COUNT(*) DESC, h.parameter_name
+	`, id)
+	if err != nil {
+		return sendError(c, internalError("Failed to query pass anomalies", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a PassAnomalies
+		if err := rows.Scan(&a.ParameterName, &a.AnomalyType, &a.Severity, &a.Count); err != nil {
+			log.Printf("Error scanning pass anomaly row: %v", err)
+			continue
+		}
+		report.Anomalies = append(report.Anomalies, a)
+	}
+
+	overlapping, err := db.Query(`
+		SELECT `+passColumns+`
+		FROM passes
+		WHERE spacecraft_id = $1 AND station <> $2
+		AND aos_at <= $4 AND last_packet_at >= $3
+		ORDER BY aos_at
+	`, pass.SpacecraftID, pass.Station, pass.AOSAt, pass.LastPacketAt)
+	if err != nil {
+		return sendError(c, internalError("Failed to query overlapping passes", err))
+	}
+	defer overlapping.Close()
+	for overlapping.Next() {
+		p, err := scanPass(overlapping)
+		if err != nil {
+			log.Printf("Error scanning pass row: %v", err)
+			continue
+		}
+		report.OverlappingPasses = append(report.OverlappingPasses, p)
+	}
+
+	return c.JSON(report)
+}
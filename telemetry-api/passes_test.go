@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanPassComputesDurationAndLoss(t *testing.T) {
+	aos := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	last := aos.Add(8 * time.Minute)
+
+	pass, err := scanPass(stubScanner{values: []interface{}{
+		3, 1, "GS1", "CLOSED", aos, last, last, 475, 25, 4, nil, nil,
+	}})
+
+	require.NoError(t, err)
+	assert.Equal(t, "GS1", pass.Station)
+	require.NotNil(t, pass.LOSAt)
+	assert.Equal(t, last, *pass.LOSAt)
+	assert.Equal(t, 480.0, pass.DurationSecs)
+	assert.Equal(t, 0.05, pass.LossRatio)
+	assert.Equal(t, 4, pass.AnomalyCount)
+}
+
+func TestSpacecraftStatus(t *testing.T) {
+	defer func(saved healthThresholds) { thresholds = saved }(thresholds)
+	thresholds.StaleAfter = time.Minute
+
+	open := &Pass{Status: "OPEN"}
+	closed := &Pass{Status: "CLOSED"}
+
+	assert.Equal(t, "LOS", spacecraftStatus(closed, time.Second, true, 3))
+	assert.Equal(t, "STALE", spacecraftStatus(open, time.Hour, true, 3))
+	assert.Equal(t, "ANOMALY", spacecraftStatus(open, time.Second, true, 3))
+	assert.Equal(t, "WARNING", spacecraftStatus(open, time.Second, false, 3))
+	assert.Equal(t, "NORMAL", spacecraftStatus(open, time.Second, false, 0))
+
+	// Without any pass row, fresh telemetry is not LOS.
+	assert.Equal(t, "NORMAL", spacecraftStatus(nil, time.Second, false, 0))
+	assert.Equal(t, "ANOMALY", spacecraftStatus(nil, time.Second, true, 0))
+	assert.Equal(t, "STALE", spacecraftStatus(nil, time.Hour, false, 0))
+}
+
+func TestRecordPassPacketGroupsPacketsIntoPasses(t *testing.T) {
+	tx := testTx(t)
+	aos := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	record := func(station string, at time.Time, signal float32, anomaly bool) int {
+		var id int
+		require.NoError(t, tx.QueryRow(`SELECT record_pass_packet($1, $2, $3, $4, $5)`,
+			testSpacecraftID, station, at, signal, anomaly).Scan(&id))
+		return id
+	}
+
+	first := record("GS1", aos, -60, false)
+	assert.Equal(t, first, record("GS1", aos.Add(20*time.Second), -50, true))
+	// Packets arrive out of order; this one is within the pass.
+	assert.Equal(t, first, record("GS1", aos.Add(10*time.Second), -55, false))
+	other := record("GS2", aos.Add(5*time.Second), -70, false)
+	assert.NotEqual(t, first, other)
+	// More than pass_silence() after the last packet opens a new pass.
+	next := record("GS1", aos.Add(2*time.Minute), -52, false)
+	assert.NotEqual(t, first, next)
+
+	pass, err := scanPass(tx.QueryRow(`SELECT `+passColumns+` FROM passes WHERE id = $1`, first))
+	require.NoError(t, err)
+	assert.Equal(t, "GS1", pass.Station)
+	assert.Equal(t, "CLOSED", pass.Status, "passes in the past are closed")
+	assert.True(t, aos.Equal(pass.AOSAt))
+	require.NotNil(t, pass.LOSAt)
+	assert.True(t, aos.Add(20*time.Second).Equal(*pass.LOSAt))
+	assert.Equal(t, 20.0, pass.DurationSecs)
+	assert.Equal(t, 3, pass.PacketCount)
+	assert.Equal(t, 1, pass.AnomalyCount)
+	assert.Equal(t, float32(-60), *pass.MinSignalStrength)
+	assert.Equal(t, float32(-50), *pass.MaxSignalStrength)
+
+	pass, err = scanPass(tx.QueryRow(`SELECT `+passColumns+` FROM passes WHERE id = $1`, next))
+	require.NoError(t, err)
+	assert.Equal(t, 1, pass.PacketCount)
+	assert.Equal(t, 0.0, pass.DurationSecs)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// peerClosed cannot tell without reading from conn on this platform, so a
+// disconnect is only noticed when a write fails.
+func peerClosed(conn net.Conn) bool {
+	return false
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// playbackChunk is how much data time is read from the database at once.
+	playbackChunk = time.Minute
+
+	playbackMaxSpeed = 1000.0
+
+	// playbackIdleTimeout is how long a session without a connected client
+	// is kept before it is discarded.
+	playbackIdleTimeout = 30 * time.Minute
+)
+
+const (
+	playbackPlaying = "PLAYING"
+	playbackPaused  = "PAUSED"
+	playbackEnded   = "ENDED"
+)
+
+// eventPlayback reports a change of the playback state; it is sent in
+// addition to the telemetry and anomaly events of the live stream.
+const eventPlayback = "playback"
+
+// playbackAttachedMessage is reported when a second client streams a session.
+const playbackAttachedMessage = "Playback session is already being streamed"
+
+type PlaybackState struct {
+	ID        string    `json:"id"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Position  time.Time `json:"position"`
+	Speed     float64   `json:"speed"`
+	Status    string    `json:"status"`
+}
+
+type PlaybackRequest struct {
+	StartTime string  `json:"start_time"`
+	EndTime   string  `json:"end_time"`
+	Speed     float64 `json:"speed"`
+	Paused    bool    `json:"paused"`
+}
+
+// PlaybackControl is accepted by the control endpoint and as a WebSocket
+// message. Action is pause, resume, seek (with position) or speed (with
+// speed).
+type PlaybackControl struct {
+	Action   string  `json:"action"`
+	Position string  `json:"position"`
+	Speed    float64 `json:"speed"`
+}
+
+type playbackSession struct {
+	mu       sync.Mutex
+	state    PlaybackState
+	attached bool
+	closed   bool
+	lastUsed time.Time
+
+	// changed is signalled after every control so a waiting stream
+	// re-reads the state.
+	changed chan struct{}
+}
+
+var (
+	playbackMu       sync.Mutex
+	playbackSessions = map[string]*playbackSession{}
+)
+
+func newPlaybackID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validatePlaybackRequest(req PlaybackRequest) (time.Time, time.Time, float64, error) {
+	now := time.Now()
+	start, ok := parseTime(req.StartTime, now)
+	if !ok {
+		return time.Time{}, time.Time{}, 0, invalidField("start_time", "start_time must be %s", timeFormat)
+	}
+	end, ok := parseTime(req.EndTime, now)
+	if !ok {
+		return time.Time{}, time.Time{}, 0, invalidField("end_time", "end_time must be %s", timeFormat)
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, 0, invalidField("end_time", "end_time must be after start_time")
+	}
+
+	speed := req.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	if err := validatePlaybackSpeed(speed); err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	return start, end, speed, nil
+}
+
+func validatePlaybackSpeed(speed float64) error {
+	if speed <= 0 || speed > playbackMaxSpeed {
+		return invalidField("speed", "speed must be greater than 0 and at most %g", playbackMaxSpeed)
+	}
+	return nil
+}
+
+func (s *playbackSession) snapshot() PlaybackState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// snapshotClosed also reports whether the session was deleted.
+func (s *playbackSession) snapshotClosed() (PlaybackState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.closed
+}
+
+func (s *playbackSession) signal() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// control applies one control action and returns the new state.
+func (s *playbackSession) control(ctl PlaybackControl) (PlaybackState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToLower(ctl.Action) {
+	case "pause":
+		if s.state.Status == playbackPlaying {
+			s.state.Status = playbackPaused
+		}
+	case "resume":
+		if s.state.Status == playbackPaused {
+			s.state.Status = playbackPlaying
+		}
+	case "seek":
+		pos, err := time.Parse(time.RFC3339Nano, ctl.Position)
+		if err != nil {
+			return s.state, invalidField("position", "position must be RFC3339")
+		}
+		if pos.Before(s.state.StartTime) || pos.After(s.state.EndTime) {
+			return s.state, invalidField("position", "position must be within the playback window")
+		}
+		s.state.Position = pos
+		if s.state.Status == playbackEnded {
+			s.state.Status = playbackPlaying
+		}
+	case "speed":
+		if err := validatePlaybackSpeed(ctl.Speed); err != nil {
+			return s.state, err
+		}
+		s.state.Speed = ctl.Speed
+	default:
+		return s.state, invalidField("action", "action must be pause, resume, seek or speed")
+	}
+
+	s.lastUsed = time.Now()
+	s.signal()
+	return s.state, nil
+}
+
+// advance moves the position forward unless a control changed it meanwhile.
+func (s *playbackSession) advance(from, to time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.state.Position.Equal(from) || s.state.Status != playbackPlaying {
+		return false
+	}
+	s.state.Position = to
+	if !to.Before(s.state.EndTime) {
+		s.state.Status = playbackEnded
+	}
+	return true
+}
+
+func getPlaybackSession(id string) *playbackSession {
+	playbackMu.Lock()
+	defer playbackMu.Unlock()
+	return playbackSessions[id]
+}
+
+func prunePlaybackSessions(now time.Time) {
+	playbackMu.Lock()
+	defer playbackMu.Unlock()
+
+	for id, s := range playbackSessions {
+		s.mu.Lock()
+		idle := !s.attached && now.Sub(s.lastUsed) > playbackIdleTimeout
+		s.mu.Unlock()
+		if idle {
+			delete(playbackSessions, id)
+		}
+	}
+}
+
+// fetchPlaybackEvents returns the telemetry and current anomalies with
+// timestamps in [from, to), in the order the live stream would send them.
+func fetchPlaybackEvents(from, to time.Time) ([]StreamEvent, error) {
+	var events []StreamEvent
+
+	rows, err := db.Query(`
+		SELECT `+telemetryColumns+`
+		FROM telemetry t
+		WHERE t.timestamp >= $1 AND t.timestamp < $2
+		ORDER BY t.timestamp, t.id
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		t, err := scanTelemetry(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, StreamEvent{Type: eventTelemetry, Telemetry: &t})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT `+anomalyColumns+`
+		FROM anomaly_history
+		WHERE timestamp >= $1 AND timestamp < $2
+		AND superseded_at IS NULL
+		ORDER BY timestamp, id
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		a, err := scanAnomaly(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, StreamEvent{Type: eventAnomaly, Anomaly: &a})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortStreamEvents(events)
+	return events, nil
+}
+
+// playStream sends the session's events paced by its speed until done is
+// closed or send fails. Controls take effect immediately: the current chunk
+// is abandoned and playback restarts from the session's position.
+func playStream(s *playbackSession, filter StreamFilter, done <-chan struct{},
+	send func(StreamEvent) error, keepAlive func() error) error {
+
+	keepAliveTicker := time.NewTicker(streamKeepAlive)
+	defer keepAliveTicker.Stop()
+
+	// wait blocks until d has passed. It returns false if a control arrived
+	// first.
+	wait := func(d time.Duration) (bool, error) {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				return true, nil
+			case <-s.changed:
+				return false, nil
+			case <-keepAliveTicker.C:
+				if err := keepAlive(); err != nil {
+					return false, err
+				}
+			case <-done:
+				return false, errStreamDone
+			}
+		}
+	}
+
+	// The state is announced on connect, after every control and when
+	// playback ends.
+	announce := true
+	var lastStatus string
+	for {
+		state, closed := s.snapshotClosed()
+		if announce || state.Status != lastStatus {
+			if err := send(StreamEvent{ID: state.Position.Format(time.RFC3339Nano), Type: eventPlayback, Playback: &state}); err != nil {
+				return err
+			}
+			announce = false
+			lastStatus = state.Status
+		}
+		if closed {
+			return errStreamDone
+		}
+
+		if state.Status != playbackPlaying {
+			ok, err := wait(playbackIdleTimeout)
+			if err != nil {
+				return err
+			}
+			announce = !ok
+			continue
+		}
+
+		chunkStart := state.Position
+		chunkEnd := chunkStart.Add(playbackChunk)
+		if chunkEnd.After(state.EndTime) {
+			chunkEnd = state.EndTime
+		}
+		events, err := fetchPlaybackEvents(chunkStart, chunkEnd)
+		if err != nil {
+			return err
+		}
+
+		// Scaled time since the chunk started.
+		anchor := time.Now()
+		dueAt := func(ts time.Time) time.Duration {
+			return time.Until(anchor.Add(time.Duration(float64(ts.Sub(chunkStart)) / state.Speed)))
+		}
+
+		pos := chunkStart
+		interrupted := false
+		for i, e := range events {
+			ok, err := wait(dueAt(e.timestamp()))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				interrupted = true
+				break
+			}
+
+			if e, keep := filter.apply(e); keep {
+				e.ID = e.timestamp().Format(time.RFC3339Nano)
+				if err := send(e); err != nil {
+					return err
+				}
+			}
+
+			// Move past this timestamp once every event sharing it is sent,
+			// so a pause or reconnect does not repeat events.
+			if i == len(events)-1 || events[i+1].timestamp().After(e.timestamp()) {
+				next := e.timestamp().Add(time.Microsecond)
+				if !s.advance(pos, next) {
+					interrupted = true
+					break
+				}
+				pos = next
+			}
+		}
+		if interrupted {
+			announce = true
+			continue
+		}
+
+		// Wait out the rest of the chunk so gaps in the data play in
+		// (scaled) real time.
+		ok, err := wait(dueAt(chunkEnd))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			announce = true
+		} else {
+			s.advance(pos, chunkEnd)
+		}
+	}
+}
+
+var errStreamDone = errors.New("stream closed")
+
+// attachPlayback marks the session as streaming. Only one client may stream
+// a session at a time, since controls act on the shared position.
+func attachPlayback(s *playbackSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attached {
+		return false
+	}
+	s.attached = true
+	return true
+}
+
+func detachPlayback(s *playbackSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attached = false
+	s.lastUsed = time.Now()
+}
+
+func createPlayback(c *fiber.Ctx) error {
+	var req PlaybackRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+
+	start, end, speed, err := validatePlaybackRequest(req)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	now := time.Now()
+	prunePlaybackSessions(now)
+
+	status := playbackPlaying
+	if req.Paused {
+		status = playbackPaused
+	}
+	s := &playbackSession{
+		state: PlaybackState{
+			ID:        newPlaybackID(),
+			StartTime: start,
+			EndTime:   end,
+			Position:  start,
+			Speed:     speed,
+			Status:    status,
+		},
+		lastUsed: now,
+		changed:  make(chan struct{}, 1),
+	}
+
+	playbackMu.Lock()
+	playbackSessions[s.state.ID] = s
+	playbackMu.Unlock()
+
+	return c.Status(201).JSON(s.state)
+}
+
+func getPlayback(c *fiber.Ctx) error {
+	s := getPlaybackSession(c.Params("id"))
+	if s == nil {
+		return sendError(c, notFound("Playback session not found"))
+	}
+	return c.JSON(s.snapshot())
+}
+
+func controlPlayback(c *fiber.Ctx) error {
+	s := getPlaybackSession(c.Params("id"))
+	if s == nil {
+		return sendError(c, notFound("Playback session not found"))
+	}
+
+	var ctl PlaybackControl
+	if err := c.BodyParser(&ctl); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+
+	state, err := s.control(ctl)
+	if err != nil {
+		return sendError(c, err)
+	}
+	return c.JSON(state)
+}
+
+func deletePlayback(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	playbackMu.Lock()
+	s, ok := playbackSessions[id]
+	delete(playbackSessions, id)
+	playbackMu.Unlock()
+
+	if !ok {
+		return sendError(c, notFound("Playback session not found"))
+	}
+
+	// A streaming client sees the session end.
+	s.mu.Lock()
+	s.state.Status = playbackEnded
+	s.closed = true
+	s.mu.Unlock()
+	s.signal()
+
+	return c.SendStatus(204)
+}
+
+func streamPlaybackSSE(c *fiber.Ctx) error {
+	s := getPlaybackSession(c.Params("id"))
+	if s == nil {
+		return sendError(c, notFound("Playback session not found"))
+	}
+	filter, err := parseStreamFilter(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	if !attachPlayback(s) {
+		return sendError(c, conflict(playbackAttachedMessage))
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer detachPlayback(s)
+		err := playStream(s, filter, nil,
+			func(e StreamEvent) error { return writeSSE(w, e) },
+			func() error {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				return w.Flush()
+			},
+		)
+		if err != nil && err != errStreamDone {
+			log.Printf("Playback stream closed: %v", err)
+		}
+	})
+	return nil
+}
+
+func requirePlaybackWebSocket(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	s := getPlaybackSession(c.Params("id"))
+	if s == nil {
+		return sendError(c, notFound("Playback session not found"))
+	}
+	filter, err := parseStreamFilter(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	// The session is attached by streamPlaybackWS, which only runs once the
+	// upgrade has succeeded; this check gives a plain 409 where it can.
+	s.mu.Lock()
+	attached := s.attached
+	s.mu.Unlock()
+	if attached {
+		return sendError(c, conflict(playbackAttachedMessage))
+	}
+	c.Locals("playback_session", s)
+	c.Locals("stream_filter", filter)
+	return c.Next()
+}
+
+// streamPlaybackWS streams a session and accepts PlaybackControl messages on
+// the same connection.
+func streamPlaybackWS(conn *websocket.Conn) {
+	s := conn.Locals("playback_session").(*playbackSession)
+	filter := conn.Locals("stream_filter").(StreamFilter)
+	if !attachPlayback(s) {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, playbackAttachedMessage),
+			time.Now().Add(streamKeepAlive))
+		return
+	}
+	defer detachPlayback(s)
+
+	var writeMu sync.Mutex
+	send := func(e StreamEvent) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(streamKeepAlive))
+		return conn.WriteJSON(e)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var ctl PlaybackControl
+			if err := conn.ReadJSON(&ctl); err != nil {
+				return
+			}
+			if _, err := s.control(ctl); err != nil {
+				send(StreamEvent{Type: "error", Message: err.Error()})
+			}
+		}
+	}()
+
+	err := playStream(s, filter, done, send, func() error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepAlive))
+	})
+	if err != nil && err != errStreamDone {
+		log.Printf("Playback websocket closed: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPlaybackSession(status string) *playbackSession {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	return &playbackSession{
+		state: PlaybackState{
+			ID: "test", StartTime: start, EndTime: start.Add(time.Hour),
+			Position: start, Speed: 1, Status: status,
+		},
+		lastUsed: time.Now(),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+func TestValidatePlaybackRequest(t *testing.T) {
+	start, end, speed, err := validatePlaybackRequest(PlaybackRequest{
+		StartTime: "2024-03-01T10:00:00Z", EndTime: "2024-03-01T11:00:00Z",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, end.Sub(start))
+	assert.Equal(t, 1.0, speed)
+
+	invalid := []struct {
+		req   PlaybackRequest
+		field string
+	}{
+		{PlaybackRequest{StartTime: "yesterday", EndTime: "2024-03-01T11:00:00Z"}, "start_time"},
+		{PlaybackRequest{StartTime: "2024-03-01T10:00:00Z"}, "end_time"},
+		{PlaybackRequest{StartTime: "2024-03-01T11:00:00Z", EndTime: "2024-03-01T10:00:00Z"}, "end_time"},
+		{PlaybackRequest{StartTime: "2024-03-01T10:00:00Z", EndTime: "2024-03-01T11:00:00Z", Speed: -2}, "speed"},
+		{PlaybackRequest{StartTime: "2024-03-01T10:00:00Z", EndTime: "2024-03-01T11:00:00Z", Speed: playbackMaxSpeed + 1}, "speed"},
+	}
+	app := fiber.New()
+	app.Post("/api/v1/playback", createPlayback)
+	for i, tc := range invalid {
+		_, _, _, err := validatePlaybackRequest(tc.req)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr, "case %d", i)
+		assert.Equal(t, tc.field, apiErr.Field, "case %d", i)
+
+		body, err := json.Marshal(tc.req)
+		require.NoError(t, err)
+		requireAPIError(t, app, jsonRequest("POST", "/api/v1/playback", string(body)), http.StatusBadRequest, codeInvalidBody, tc.field)
+	}
+}
+
+func TestPlaybackControl(t *testing.T) {
+	s := testPlaybackSession(playbackPlaying)
+
+	state, err := s.control(PlaybackControl{Action: "pause"})
+	require.NoError(t, err)
+	assert.Equal(t, playbackPaused, state.Status)
+
+	state, err = s.control(PlaybackControl{Action: "seek", Position: "2024-03-01T10:30:00Z"})
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, state.Position.Sub(state.StartTime))
+	assert.Equal(t, playbackPaused, state.Status, "seek keeps a paused session paused")
+
+	state, err = s.control(PlaybackControl{Action: "speed", Speed: 8})
+	require.NoError(t, err)
+	assert.Equal(t, 8.0, state.Speed)
+
+	state, err = s.control(PlaybackControl{Action: "resume"})
+	require.NoError(t, err)
+	assert.Equal(t, playbackPlaying, state.Status)
+
+	select {
+	case <-s.changed:
+	default:
+		t.Error("controls should signal the stream")
+	}
+
+	app := fiber.New()
+	app.Post("/api/v1/playback/:id/control", controlPlayback)
+	app.Get("/api/v1/playback/:id/stream", streamPlaybackSSE)
+	playbackMu.Lock()
+	playbackSessions["known"] = s
+	playbackMu.Unlock()
+	defer func() {
+		playbackMu.Lock()
+		delete(playbackSessions, "known")
+		playbackMu.Unlock()
+	}()
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+		field  string
+	}{
+		{"POST", "/api/v1/playback/known/control", `{"action": "seek", "position": "2024-03-01T12:00:00Z"}`, http.StatusBadRequest, codeInvalidBody, "position"},
+		{"POST", "/api/v1/playback/known/control", `{"action": "seek", "position": "soon"}`, http.StatusBadRequest, codeInvalidBody, "position"},
+		{"POST", "/api/v1/playback/known/control", `{"action": "speed", "speed": 0}`, http.StatusBadRequest, codeInvalidBody, "speed"},
+		{"POST", "/api/v1/playback/known/control", `{"action": "rewind"}`, http.StatusBadRequest, codeInvalidBody, "action"},
+		{"POST", "/api/v1/playback/unknown/control", `{"action": "pause"}`, http.StatusNotFound, codeNotFound, ""},
+		{"GET", "/api/v1/playback/unknown/stream", ``, http.StatusNotFound, codeNotFound, ""},
+		{"GET", "/api/v1/playback/known/stream?spacecraft_id=x", ``, http.StatusBadRequest, codeInvalidParameter, "spacecraft_id"},
+	}
+	for _, tc := range cases {
+		requireAPIError(t, app, jsonRequest(tc.method, tc.path, tc.body), tc.status, tc.code, tc.field)
+	}
+}
+
+func TestPlaybackAdvance(t *testing.T) {
+	s := testPlaybackSession(playbackPlaying)
+	start := s.state.StartTime
+
+	assert.True(t, s.advance(start, start.Add(time.Minute)))
+	assert.False(t, s.advance(start, start.Add(2*time.Minute)), "stale position must not advance")
+
+	assert.True(t, s.advance(start.Add(time.Minute), s.state.EndTime))
+	assert.Equal(t, playbackEnded, s.snapshot().Status)
+}
+
+func TestPlayStreamEndsWhenSessionIsDeleted(t *testing.T) {
+	s := testPlaybackSession(playbackPaused)
+
+	sent := make(chan StreamEvent, 10)
+	finished := make(chan error)
+	go func() {
+		finished <- playStream(s, StreamFilter{}, nil,
+			func(e StreamEvent) error { sent <- e; return nil },
+			func() error { return nil },
+		)
+	}()
+
+	e := <-sent
+	require.Equal(t, eventPlayback, e.Type)
+	assert.Equal(t, playbackPaused, e.Playback.Status)
+
+	s.mu.Lock()
+	s.state.Status = playbackEnded
+	s.closed = true
+	s.mu.Unlock()
+	s.signal()
+
+	e = <-sent
+	assert.Equal(t, playbackEnded, e.Playback.Status)
+	assert.Equal(t, errStreamDone, <-finished)
+}
+
+func TestFailedPlaybackUpgradeLeavesSessionDetached(t *testing.T) {
+	app := fiber.New()
+	app.Use("/api/v1/playback/:id/ws", requirePlaybackWebSocket)
+	app.Get("/api/v1/playback/:id/ws", websocket.New(streamPlaybackWS))
+
+	s := testPlaybackSession(playbackPaused)
+	playbackMu.Lock()
+	playbackSessions["upgrade"] = s
+	playbackMu.Unlock()
+	defer func() {
+		playbackMu.Lock()
+		delete(playbackSessions, "upgrade")
+		playbackMu.Unlock()
+	}()
+
+	// Without Sec-WebSocket-Key the upgrade fails after the middleware has
+	// accepted the request.
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/playback/upgrade/ws", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode, "attempt %d", i)
+
+		s.mu.Lock()
+		attached := s.attached
+		s.mu.Unlock()
+		assert.False(t, attached, "attempt %d", i)
+	}
+}
+
+func TestFetchPlaybackEventsInStreamOrder(t *testing.T) {
+	withTestDB(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	hot := insertTestTelemetry(t, db, ts, 36)
+	nominal := insertTestTelemetry(t, db, ts.Add(time.Second), 25)
+	superseded := insertTestTelemetry(t, db, ts.Add(2*time.Second), 36)
+	outside := insertTestTelemetry(t, db, ts.Add(time.Minute), 25)
+	_, err := db.Exec(`
+		UPDATE anomaly_history SET superseded_at = NOW() WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+	`, superseded, ts.Add(2*time.Second))
+	require.NoError(t, err)
+
+	events, err := fetchPlaybackEvents(ts, ts.Add(time.Minute))
+	require.NoError(t, err)
+
+	var got []string
+	for _, e := range events {
+		switch {
+		case e.Telemetry != nil && e.Telemetry.SpacecraftID == testSpacecraftID:
+			assert.NotEqual(t, outside, e.Telemetry.ID, "rows at the end of the range are not played")
+			got = append(got, fmt.Sprintf("telemetry %d", e.Telemetry.ID))
+		case e.Anomaly != nil && e.Anomaly.SpacecraftID == testSpacecraftID:
+			got = append(got, fmt.Sprintf("anomaly of %d", e.Anomaly.TelemetryID))
+		}
+	}
+	// Anomalies follow their telemetry; superseded revisions are left out.
+	assert.Equal(t, []string{
+		fmt.Sprintf("telemetry %d", hot),
+		fmt.Sprintf("anomaly of %d", hot),
+		fmt.Sprintf("telemetry %d", nominal),
+		fmt.Sprintf("telemetry %d", superseded),
+	}, got)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// telemetry-ingestion decodes packets of the PUS_APIDS as ECSS PUS-C
+// services. Housekeeping reports (ST[3]) become telemetry rows carrying their
+// structure, event reports (ST[5]) land in events (see events.go) and request
+// verification reports (ST[1]) in command_verifications, grouped into
+// commands.
+
+var commandStatuses = map[string]bool{
+	"ACCEPTED": true, "STARTED": true, "IN_PROGRESS": true, "COMPLETED": true, "FAILED": true,
+}
+
+// HousekeepingStructure lists the parameters of a housekeeping report in the
+// order their values appear.
+type HousekeepingStructure struct {
+	StructureID int       `json:"structure_id"`
+	Parameters  []string  `json:"parameters"`
+	Description *string   `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Command is a telecommand tracked through its verification reports.
+// FailureCode is set once a stage has failed.
+type Command struct {
+	ID              int       `json:"id"`
+	SpacecraftID    int       `json:"spacecraft_id"`
+	RequestAPID     int       `json:"request_apid"`
+	RequestSeqCount int       `json:"request_seq_count"`
+	Status          string    `json:"status"`
+	Stage           string    `json:"stage"`
+	FailureCode     *int      `json:"failure_code,omitempty"`
+	ReportCount     int       `json:"report_count"`
+	FirstReportAt   time.Time `json:"first_report_at"`
+	LastReportAt    time.Time `json:"last_report_at"`
+}
+
+// Verification is an ST[1] request verification report.
+type Verification struct {
+	Timestamp   time.Time `json:"timestamp"`
+	APID        int       `json:"apid"`
+	SeqCount    int       `json:"seq_count"`
+	Stage       string    `json:"stage"`
+	Success     bool      `json:"success"`
+	StepID      *int      `json:"step_id,omitempty"`
+	FailureCode *int      `json:"failure_code,omitempty"`
+	FailureData string    `json:"failure_data,omitempty"`
+	Station     string    `json:"station"`
+	ReceivedAt  time.Time `json:"received_at"`
+}
+
+// CommandReport is a command with its verification reports in onboard-time
+// order.
+type CommandReport struct {
+	Command
+	Verifications []Verification `json:"verifications"`
+}
+
+const commandColumns = `id, spacecraft_id, request_apid, request_seq_count, status, stage, failure_code,
+		   report_count, first_report_at, last_report_at`
+
+func scanCommand(row rowScanner) (Command, error) {
+	var cmd Command
+	err := row.Scan(&cmd.ID, &cmd.SpacecraftID, &cmd.RequestAPID, &cmd.RequestSeqCount, &cmd.Status, &cmd.Stage,
+		&cmd.FailureCode, &cmd.ReportCount, &cmd.FirstReportAt, &cmd.LastReportAt)
+	return cmd, err
+}
+
+const verificationColumns = `timestamp, apid, seq_count, stage, success, step_id, failure_code, failure_data,
+		   station, received_at`
+
+func scanVerification(row rowScanner) (Verification, error) {
+	var v Verification
+	var data []byte
+	err := row.Scan(&v.Timestamp, &v.APID, &v.SeqCount, &v.Stage, &v.Success, &v.StepID, &v.FailureCode,
+		&data, &v.Station, &v.ReceivedAt)
+	v.FailureData = hex.EncodeToString(data)
+	return v, err
+}
+
+// getHousekeepingStructures lists the housekeeping structure definitions.
+func getHousekeepingStructures(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT structure_id, parameters, description, created_at
+		FROM housekeeping_structures
+		ORDER BY structure_id
+	`)
+	if err != nil {
+		return sendError(c, internalError("Failed to query housekeeping structures", err))
+	}
+	defer rows.Close()
+
+	structures := make([]HousekeepingStructure, 0)
+	for rows.Next() {
+		var s HousekeepingStructure
+		if err := rows.Scan(&s.StructureID, pq.Array(&s.Parameters), &s.Description, &s.CreatedAt); err != nil {
+			log.Printf("Error scanning housekeeping structure row: %v", err)
+			continue
+		}
+		structures = append(structures, s)
+	}
+
+	return c.JSON(structures)
+}
+
+// getHousekeeping lists telemetry stored from housekeeping reports, latest
+// first:
+//
+//	GET /api/v1/housekeeping?structure_id=1&start_time=now-1h
+func getHousekeeping(c *fiber.Ctx) error {
+	structureID, err := queryInt(c, "structure_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `
+		SELECT ` + telemetryColumns + `
+		FROM telemetry t
+		WHERE t.housekeeping_structure_id IS NOT NULL
+	`
+	args := []interface{}{}
+	argCount := 0
+
+	if structureID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND t.housekeeping_structure_id = $%d", argCount)
+		args = append(args, *structureID)
+	}
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND t.spacecraft_id = $%d", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND t.timestamp >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND t.timestamp <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY t.timestamp DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query housekeeping telemetry", err))
+	}
+	defer rows.Close()
+
+	telemetry := make([]Telemetry, 0)
+	for rows.Next() {
+		t, err := scanTelemetry(rows)
+		if err != nil {
+			log.Printf("Error scanning row: %v", err)
+			continue
+		}
+		telemetry = append(telemetry, t)
+	}
+
+	return c.JSON(telemetry)
+}
+
+// getCommands lists tracked telecommands that had reports in the time range,
+// latest first:
+//
+//	GET /api/v1/commands?status=failed&start_time=now-24h
+func getCommands(c *fiber.Ctx) error {
+	status := strings.ToUpper(c.Query("status"))
+	if status != "" && !commandStatuses[status] {
+		return sendError(c, invalidParam("status", "status must be accepted, started, in_progress, completed or failed"))
+	}
+	apid, err := queryInt(c, "apid")
+	if err != nil {
+		return sendError(c, err)
+	}
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + commandColumns + ` FROM commands WHERE 1=1`
+	args := []interface{}{}
+	argCount := 0
+
+	if status != "" {
+		argCount++
+		query += fmt.Sprintf(" AND status = $%d", argCount)
+		args = append(args, status)
+	}
+
+	if apid != nil {
+		argCount++
+		query += fmt.Sprintf(" AND request_apid = $%d", argCount)
+		args = append(args, *apid)
+	}
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND spacecraft_id = $%d", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	if startTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND last_report_at >= $%d", argCount)
+		args = append(args, *startTime)
+	}
+
+	if endTime != nil {
+		argCount++
+		query += fmt.Sprintf(" AND first_report_at <= $%d", argCount)
+		args = append(args, *endTime)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY last_report_at DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query commands", err))
+	}
+	defer rows.Close()
+
+	commands := make([]Command, 0)
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			log.Printf("Error scanning command row: %v", err)
+			continue
+		}
+		commands = append(commands, cmd)
+	}
+
+	return c.JSON(commands)
+}
+
+// getCommand returns a telecommand with its verification reports.
+func getCommand(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	cmd, err := scanCommand(db.QueryRow(`SELECT `+commandColumns+` FROM commands WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Command not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get command", err))
+	}
+
+	rows, err := db.Query(`
+		SELECT `+verificationColumns+`
+		FROM command_verifications
+		WHERE command_id = $1
+		ORDER BY timestamp, verification_stage_rank(stage)
+	`, id)
+	if err != nil {
+		return sendError(c, internalError("Failed to query command verifications", err))
+	}
+	defer rows.Close()
+
+	report := CommandReport{Command: cmd, Verifications: make([]Verification, 0)}
+	for rows.Next() {
+		v, err := scanVerification(rows)
+		if err != nil {
+			log.Printf("Error scanning verification row: %v", err)
+			continue
+		}
+		report.Verifications = append(report.Verifications, v)
+	}
+
+	return c.JSON(report)
+}
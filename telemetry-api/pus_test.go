@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanVerificationFailure(t *testing.T) {
+	onboard := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	v, err := scanVerification(stubScanner{values: []interface{}{
+		onboard, 0x21, 12, "START", false, nil, 5, nil, "GS1", onboard,
+	}})
+
+	require.NoError(t, err)
+	assert.False(t, v.Success)
+	assert.Nil(t, v.StepID)
+	require.NotNil(t, v.FailureCode)
+	assert.Equal(t, 5, *v.FailureCode)
+	assert.Empty(t, v.FailureData)
+}
+
+func TestTrackCommandFollowsVerificationReports(t *testing.T) {
+	tx := testTx(t)
+	t0 := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	report := func(seq int, at time.Time, requestSeq int, stage string, failureCode sql.NullInt64) {
+		_, err := tx.Exec(`
+			INSERT INTO command_verifications (
+				timestamp, spacecraft_id, apid, seq_count, request_apid, request_seq_count, stage, success,
+				failure_code, station, received_at
+			) VALUES ($1, $2, 1, $3, 100, $4, $5, $6, $7, 'GS1', $1)
+			ON CONFLICT DO NOTHING
+		`, at, testSpacecraftID, seq, requestSeq, stage, !failureCode.Valid, failureCode)
+		require.NoError(t, err)
+	}
+	ok := sql.NullInt64{}
+
+	report(1, t0, 1, "ACCEPTANCE", ok)
+	// Completion is reported before the start it follows.
+	report(2, t0.Add(2*time.Second), 1, "COMPLETION", ok)
+	report(3, t0.Add(time.Second), 1, "START", ok)
+	// A copy from another station is not counted again.
+	report(3, t0.Add(time.Second), 1, "START", ok)
+
+	report(4, t0, 2, "ACCEPTANCE", ok)
+	report(5, t0.Add(time.Second), 2, "START", sql.NullInt64{Int64: 5, Valid: true})
+	report(6, t0.Add(2*time.Second), 2, "COMPLETION", ok)
+
+	// Sequence counts wrap: beyond command_gap() the request is a new command.
+	report(7, t0.Add(2*time.Hour), 1, "ACCEPTANCE", ok)
+
+	rows, err := tx.Query(`SELECT `+commandColumns+` FROM commands WHERE spacecraft_id = $1 ORDER BY id`,
+		testSpacecraftID)
+	require.NoError(t, err)
+	defer rows.Close()
+	var cmds []Command
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		require.NoError(t, err)
+		cmds = append(cmds, cmd)
+	}
+	require.Len(t, cmds, 3)
+	for i, want := range []struct {
+		requestSeq  int
+		status      string
+		stage       string
+		failureCode *int
+		reports     int
+	}{
+		{1, "COMPLETED", "COMPLETION", nil, 3},
+		// A failure is final.
+		{2, "FAILED", "START", &[]int{5}[0], 3},
+		{1, "ACCEPTED", "ACCEPTANCE", nil, 1},
+	} {
+		cmd := cmds[i]
+		assert.Equal(t, want.requestSeq, cmd.RequestSeqCount, i)
+		assert.Equal(t, want.status, cmd.Status, i)
+		assert.Equal(t, want.stage, cmd.Stage, i)
+		assert.Equal(t, want.failureCode, cmd.FailureCode, i)
+		assert.Equal(t, want.reports, cmd.ReportCount, i)
+	}
+	assert.True(t, t0.Equal(cmds[0].FirstReportAt))
+	assert.True(t, t0.Add(2*time.Second).Equal(cmds[0].LastReportAt))
+
+	var unassigned int
+	require.NoError(t, tx.QueryRow(`
+		SELECT COUNT(*) FROM command_verifications WHERE spacecraft_id = $1 AND command_id IS NULL
+	`, testSpacecraftID).Scan(&unassigned))
+	assert.Zero(t, unassigned)
+}
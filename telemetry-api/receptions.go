@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultReceptionWindow is the range of reception statistics when no
+// start_time is given.
+const defaultReceptionWindow = 24 * time.Hour
+
+// PacketReception is one copy of a packet received by a ground station.
+// Quality is 0 when packet error control failed, 1 when the packet has none
+// and 2 when it matched. The link metrics are set when the station reports
+// them.
+type PacketReception struct {
+	ID              int        `json:"id"`
+	ReceivedAt      time.Time  `json:"received_at"`
+	EarthReceivedAt *time.Time `json:"earth_received_at,omitempty"`
+	Station         string     `json:"station"`
+	SourceAddress   *string    `json:"source_address,omitempty"`
+	Quality         int        `json:"quality"`
+	Outcome         string     `json:"outcome"`
+	RSSIDbm         *float32   `json:"rssi_dbm,omitempty"`
+	SNRDb           *float32   `json:"snr_db,omitempty"`
+	CorrectedBits   *int       `json:"corrected_bits,omitempty"`
+	ImportID        *int       `json:"import_id,omitempty"`
+}
+
+// PacketReceptions lists the stations that received the packet stored as a
+// telemetry row. Station and Quality describe the stored copy.
+type PacketReceptions struct {
+	TelemetryID  int               `json:"telemetry_id"`
+	SpacecraftID int               `json:"spacecraft_id"`
+	APID         int               `json:"apid"`
+	SeqCount     int               `json:"seq_count"`
+	OnboardTime  time.Time         `json:"onboard_time"`
+	Station      string            `json:"station"`
+	Quality      int               `json:"quality"`
+	Receptions   []PacketReception `json:"receptions"`
+}
+
+// StationReceptionStats counts the copies a station received in a window by
+// outcome. Corrupt copies failed packet error control; exclusive copies are
+// packets no other station received.
+type StationReceptionStats struct {
+	Station         string    `json:"station"`
+	Received        int       `json:"received"`
+	Stored          int       `json:"stored"`
+	Replaced        int       `json:"replaced"`
+	Duplicate       int       `json:"duplicate"`
+	Corrupt         int       `json:"corrupt"`
+	Exclusive       int       `json:"exclusive"`
+	DuplicateRatio  float64   `json:"duplicate_ratio"`
+	FirstReceivedAt time.Time `json:"first_received_at"`
+	LastReceivedAt  time.Time `json:"last_received_at"`
+}
+
+type ReceptionStats struct {
+	StartTime time.Time               `json:"start_time"`
+	EndTime   time.Time               `json:"end_time"`
+	Stations  []StationReceptionStats `json:"stations"`
+}
+
+// receptionStatsQuery counts packet_receptions in [start, end) per station.
+// Copies of a packet are only compared within the window.
+func receptionStatsQuery(start, end time.Time, spacecraftID *int) (string, []interface{}) {
+	filter := "received_at >= $1 AND received_at < $2"
+	args := []interface{}{start, end}
+	if spacecraftID != nil {
+		filter += " AND spacecraft_id = $3"
+		args = append(args, *spacecraftID)
+	}
+
+	query := fmt.Sprintf(`
+		WITH r AS (
+			SELECT station, received_at, quality, outcome,
+				   COUNT(*) OVER (PARTITION BY spacecraft_id, apid, seq_count, onboard_time) AS copies
+			FROM packet_receptions
+			WHERE %s
+		)
+		SELECT station,
+			   COUNT(*),
+			   COUNT(*) FILTER (WHERE outcome = 'STORED'),
+			   COUNT(*) FILTER (WHERE outcome = 'REPLACED'),
+			   COUNT(*) FILTER (WHERE outcome = 'DUPLICATE'),
+			   COUNT(*) FILTER (WHERE quality = 0),
+			   COUNT(*) FILTER (WHERE copies = 1),
+			   MIN(received_at),
+			   MAX(received_at)
+		FROM r
+		GROUP BY station
+		ORDER BY station
+	`, filter)
+	return query, args
+}
+
+// getReceptionStats reports per-station deduplication statistics:
+//
+//	GET /api/v1/receptions/stats?start_time=now-6h&spacecraft_id=1
+func getReceptionStats(c *fiber.Ctx) error {
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	stats := ReceptionStats{EndTime: time.Now().UTC(), Stations: make([]StationReceptionStats, 0)}
+	if endTime != nil {
+		stats.EndTime = *endTime
+	}
+	stats.StartTime = stats.EndTime.Add(-defaultReceptionWindow)
+	if startTime != nil {
+		stats.StartTime = *startTime
+	}
+
+	query, args := receptionStatsQuery(stats.StartTime, stats.EndTime, spacecraftID)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query reception statistics", err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s StationReceptionStats
+		err := rows.Scan(&s.Station, &s.Received, &s.Stored, &s.Replaced, &s.Duplicate,
+			&s.Corrupt, &s.Exclusive, &s.FirstReceivedAt, &s.LastReceivedAt)
+		if err != nil {
+			log.Printf("Error scanning reception statistics row: %v", err)
+			continue
+		}
+		if s.Received > 0 {
+			s.DuplicateRatio = float64(s.Duplicate) / float64(s.Received)
+		}
+		stats.Stations = append(stats.Stations, s)
+	}
+
+	return c.JSON(stats)
+}
+
+// getTelemetryReceptions lists every copy of the packet stored as a
+// telemetry row, by station.
+func getTelemetryReceptions(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	result := PacketReceptions{TelemetryID: id, Receptions: make([]PacketReception, 0)}
+	err = db.QueryRow(`
+		SELECT spacecraft_id, apid, seq_count, onboard_time, station, quality
+		FROM telemetry_packets
+		WHERE telemetry_id = $1
+	`, id).Scan(&result.SpacecraftID, &result.APID, &result.SeqCount, &result.OnboardTime,
+		&result.Station, &result.Quality)
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Telemetry packet not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get telemetry packet", err))
+	}
+
+	rows, err := db.Query(`
+		SELECT id, received_at, earth_received_at, station, host(source_address), quality, outcome,
+			   rssi_dbm, snr_db, corrected_bits, import_id
+		FROM packet_receptions
+		WHERE spacecraft_id = $1 AND apid = $2 AND seq_count = $3 AND onboard_time = $4
+		ORDER BY received_at, id
+	`, result.SpacecraftID, result.APID, result.SeqCount, result.OnboardTime)
+	if err != nil {
+		return sendError(c, internalError("Failed to query packet receptions", err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r PacketReception
+		err := rows.Scan(&r.ID, &r.ReceivedAt, &r.EarthReceivedAt, &r.Station, &r.SourceAddress, &r.Quality,
+			&r.Outcome, &r.RSSIDbm, &r.SNRDb, &r.CorrectedBits, &r.ImportID)
+		if err != nil {
+			log.Printf("Error scanning packet reception row: %v", err)
+			continue
+		}
+		result.Receptions = append(result.Receptions, r)
+	}
+
+	return c.JSON(result)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceptionStatsQuery(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	query, args := receptionStatsQuery(start, end, nil)
+	assert.Contains(t, query, "WHERE received_at >= $1 AND received_at < $2\n")
+	assert.Contains(t, query, "PARTITION BY spacecraft_id, apid, seq_count, onboard_time")
+	assert.Contains(t, query, "GROUP BY station")
+	assert.Equal(t, []interface{}{start, end}, args)
+
+	spacecraftID := 2
+	query, args = receptionStatsQuery(start, end, &spacecraftID)
+	assert.Contains(t, query, "AND spacecraft_id = $3")
+	assert.Equal(t, []interface{}{start, end, 2}, args)
+
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/:id/receptions", getTelemetryReceptions)
+	app.Get("/api/v1/receptions/stats", getReceptionStats)
+
+	cases := []struct {
+		path  string
+		field string
+	}{
+		{"/api/v1/telemetry/abc/receptions", "id"},
+		{"/api/v1/telemetry/0/receptions", "id"},
+		{"/api/v1/receptions/stats?start_time=yesterday", "start_time"},
+		{"/api/v1/receptions/stats?start_time=now&end_time=now-1h", "end_time"},
+		{"/api/v1/receptions/stats?spacecraft_id=x", "spacecraft_id"},
+	}
+
+	for _, tc := range cases {
+		requireAPIError(t, app, httptest.NewRequest("GET", tc.path, nil), http.StatusBadRequest, codeInvalidParameter, tc.field)
+	}
+}
+
+func TestReceptionStatsCountsCopiesPerStation(t *testing.T) {
+	tx := testTx(t)
+	start := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, r := range []struct {
+		seq     int
+		station string
+		quality int
+		outcome string
+	}{
+		{1, "GS1", 0, "DISCARDED"},
+		{1, "GS2", 2, "STORED"},
+		{2, "GS1", 2, "STORED"},
+		{2, "GS2", 2, "DUPLICATE"},
+		{3, "GS2", 2, "STORED"},
+	} {
+		_, err := tx.Exec(`
+			INSERT INTO packet_receptions (
+				received_at, spacecraft_id, apid, seq_count, onboard_time, station, quality, outcome
+			) VALUES ($1, $2, 1, $3, $4, $5, $6, $7)
+		`, start.Add(time.Duration(i)*time.Second), testSpacecraftID, r.seq,
+			start.Add(time.Duration(r.seq)*time.Millisecond), r.station, r.quality, r.outcome)
+		require.NoError(t, err)
+	}
+
+	spacecraftID := testSpacecraftID
+	query, args := receptionStatsQuery(start, start.Add(time.Hour), &spacecraftID)
+	rows, err := tx.Query(query, args...)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var stats []StationReceptionStats
+	for rows.Next() {
+		var s StationReceptionStats
+		require.NoError(t, rows.Scan(&s.Station, &s.Received, &s.Stored, &s.Replaced, &s.Duplicate,
+			&s.Corrupt, &s.Exclusive, &s.FirstReceivedAt, &s.LastReceivedAt))
+		stats = append(stats, s)
+	}
+	require.NoError(t, rows.Err())
+
+	require.Len(t, stats, 2)
+	assert.Equal(t, StationReceptionStats{
+		Station: "GS1", Received: 2, Stored: 1, Corrupt: 1,
+		FirstReceivedAt: start, LastReceivedAt: start.Add(2 * time.Second),
+	}, normalizeReceptionStats(stats[0]))
+	assert.Equal(t, StationReceptionStats{
+		Station: "GS2", Received: 3, Stored: 2, Duplicate: 1, Exclusive: 1,
+		FirstReceivedAt: start.Add(time.Second), LastReceivedAt: start.Add(4 * time.Second),
+	}, normalizeReceptionStats(stats[1]))
+}
+
+// normalizeReceptionStats converts the times scanned from the database to
+// UTC for comparison.
+func normalizeReceptionStats(s StationReceptionStats) StationReceptionStats {
+	s.FirstReceivedAt = s.FirstReceivedAt.UTC()
+	s.LastReceivedAt = s.LastReceivedAt.UTC()
+	return s
+}
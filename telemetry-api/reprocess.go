@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// reprocessChunk is the width of the time window handled in a single
+// transaction. Progress is reported after every chunk.
+const reprocessChunk = time.Hour
+
+// reprocessLockClass is the advisory lock class of reprocess jobs. The process
+// running a job holds the session lock (reprocessLockClass, job id) until the
+// job finishes, so the lock of a job is free once its process has died.
+const reprocessLockClass = 0x52505243
+
+var errReprocessBusy = fmt.Errorf("another reprocess job is already pending or running")
+
+type ReprocessJob struct {
+	ID            int        `json:"id"`
+	StartTime     time.Time  `json:"start_time"`
+	EndTime       time.Time  `json:"end_time"`
+	Status        string     `json:"status"`
+	TotalRows     int        `json:"total_rows"`
+	ProcessedRows int        `json:"processed_rows"`
+	AnomalyRows   int        `json:"anomaly_rows"`
+	Error         *string    `json:"error,omitempty"`
+	RequestedBy   *string    `json:"requested_by,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+
+	// lock is the connection holding the job's advisory lock.
+	lock *sql.Conn
+}
+
+type ReprocessRequest struct {
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+	RequestedBy string `json:"requested_by"`
+}
+
+// reprocessWindows splits [start, end) into consecutive windows no wider than chunk.
+func reprocessWindows(start, end time.Time, chunk time.Duration) [][2]time.Time {
+	var windows [][2]time.Time
+	for from := start; from.Before(end); from = from.Add(chunk) {
+		to := from.Add(chunk)
+		if to.After(end) {
+			to = end
+		}
+		windows = append(windows, [2]time.Time{from, to})
+	}
+	return windows
+}
+
+func parseReprocessRange(startTime, endTime string) (time.Time, time.Time, error) {
+	if startTime == "" {
+		return time.Time{}, time.Time{}, invalidField("start_time", "start_time and end_time are required")
+	}
+	if endTime == "" {
+		return time.Time{}, time.Time{}, invalidField("end_time", "start_time and end_time are required")
+	}
+	now := time.Now()
+	start, ok := parseTime(startTime, now)
+	if !ok {
+		return time.Time{}, time.Time{}, invalidField("start_time", "start_time must be %s", timeFormat)
+	}
+	end, ok := parseTime(endTime, now)
+	if !ok {
+		return time.Time{}, time.Time{}, invalidField("end_time", "end_time must be %s", timeFormat)
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, invalidField("end_time", "end_time must be after start_time")
+	}
+	return start, end, nil
+}
+
+// createReprocessJob records a pending job and takes its advisory lock, which
+// is held until runReprocessJob finishes. idx_reprocess_jobs_active rejects
+// the job while another is pending or running, unless that one was orphaned.
+func createReprocessJob(start, end time.Time, requestedBy string) (*ReprocessJob, error) {
+	var by *string
+	if requestedBy != "" {
+		by = &requestedBy
+	}
+
+	job, err := insertReprocessJob(start, end, by)
+	if isUniqueViolation(err) {
+		orphaned, ferr := failOrphanedReprocessJobs()
+		if ferr != nil {
+			return nil, ferr
+		}
+		if orphaned == 0 {
+			return nil, errReprocessBusy
+		}
+		job, err = insertReprocessJob(start, end, by)
+	}
+	if isUniqueViolation(err) {
+		return nil, errReprocessBusy
+	}
+	return job, err
+}
+
+// insertReprocessJob inserts a job and locks it in the same transaction, so no
+// other session sees the job unlocked.
+func insertReprocessJob(start, end time.Time, by *string) (*ReprocessJob, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &ReprocessJob{StartTime: start, EndTime: end, Status: "PENDING", RequestedBy: by}
+	err = func() error {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(`
+			INSERT INTO reprocess_jobs (start_time, end_time, requested_by)
+			VALUES ($1, $2, $3)
+			RETURNING id, created_at
+		`, start, end, by).Scan(&job.ID, &job.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`SELECT pg_advisory_lock($1, $2)`, reprocessLockClass, job.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	job.lock = conn
+	return job, nil
+}
+
+// releaseReprocessJob releases the advisory lock of a finished job.
+func releaseReprocessJob(job *ReprocessJob) {
+	if job.lock == nil {
+		return
+	}
+	if _, err := job.lock.ExecContext(context.Background(),
+		`SELECT pg_advisory_unlock($1, $2)`, reprocessLockClass, job.ID); err != nil {
+		log.Printf("Error unlocking reprocess job %d: %v", job.ID, err)
+	}
+	job.lock.Close()
+	job.lock = nil
+}
+
+// failOrphanedReprocessJobs marks pending and running jobs whose process has
+// died as failed, and returns how many there were. Jobs still locked by a
+// live API or CLI process are left alone.
+func failOrphanedReprocessJobs() (int, error) {
+	rows, err := db.Query(`
+		UPDATE reprocess_jobs
+		SET status = 'FAILED', error = 'job was interrupted', finished_at = NOW()
+		WHERE status IN ('PENDING', 'RUNNING')
+		AND pg_try_advisory_xact_lock($1, id)
+		RETURNING id
+	`, reprocessLockClass)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return n, err
+		}
+		log.Printf("Reprocess job %d was interrupted, marked failed", id)
+		n++
+	}
+	return n, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// runReprocessJob re-evaluates the parameter_limits rules for every telemetry
+// and derived_values row in the job's range. is_anomaly and anomaly_type are
+// overwritten, the current anomaly_history rows are marked superseded and
+// replaced by a new revision. Acknowledgements carry over when the anomaly
+// type is unchanged.
+func runReprocessJob(job *ReprocessJob, progress func(*ReprocessJob)) (err error) {
+	defer releaseReprocessJob(job)
+	defer func() {
+		if r := recover(); r != nil {
+			err = failReprocessJob(job, fmt.Errorf("reprocess job panicked: %v", r))
+		}
+	}()
+
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM telemetry WHERE timestamp >= $1 AND timestamp < $2
+	`, job.StartTime, job.EndTime).Scan(&job.TotalRows)
+	if err != nil {
+		return failReprocessJob(job, err)
+	}
+
+	now := time.Now()
+	job.Status = "RUNNING"
+	job.StartedAt = &now
+	if _, err := db.Exec(`
+		UPDATE reprocess_jobs SET status = $2, total_rows = $3, started_at = $4 WHERE id = $1
+	`, job.ID, job.Status, job.TotalRows, now); err != nil {
+		return failReprocessJob(job, err)
+	}
+	progress(job)
+
+	for _, window := range reprocessWindows(job.StartTime, job.EndTime, reprocessChunk) {
+		processed, anomalies, err := reprocessWindow(job.ID, window[0], window[1])
+		if err != nil {
+			return failReprocessJob(job, err)
+		}
+
+		job.ProcessedRows += processed
+		job.AnomalyRows += anomalies
+		if _, err := db.Exec(`
+			UPDATE reprocess_jobs SET processed_rows = $2, anomaly_rows = $3 WHERE id = $1
+		`, job.ID, job.ProcessedRows, job.AnomalyRows); err != nil {
+			return failReprocessJob(job, err)
+		}
+		progress(job)
+	}
+
+	finished := time.Now()
+	job.Status = "COMPLETED"
+	job.FinishedAt = &finished
+	if _, err := db.Exec(`
+		UPDATE reprocess_jobs SET status = $2, finished_at = $3 WHERE id = $1
+	`, job.ID, job.Status, finished); err != nil {
+		return err
+	}
+	progress(job)
+	return nil
+}
+
+func reprocessWindow(jobID int, from, to time.Time) (int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	processed, anomalies, err := reprocessRows(tx, jobID, from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return processed, anomalies, nil
+}
+
+// reprocessRows re-evaluates the telemetry and derived values in [from, to)
+// within tx and returns the number of telemetry rows and new anomaly rows.
+func reprocessRows(tx *sql.Tx, jobID int, from, to time.Time) (int, int, error) {
+	result, err := tx.Exec(`
+		UPDATE telemetry t
+		SET is_anomaly = c.anomaly_type IS NOT NULL,
+			anomaly_type = c.anomaly_type
+		FROM telemetry s
+		LEFT JOIN LATERAL classify_telemetry(s.temperature, s.battery, s.altitude, s.signal_strength) c ON TRUE
+		WHERE s.timestamp >= $1 AND s.timestamp < $2
+		AND t.id = s.id AND t.timestamp = s.timestamp
+	`, from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	processed, _ := result.RowsAffected()
+
+	_, err = tx.Exec(`
+		UPDATE derived_values d
+		SET is_anomaly = c.anomaly_type IS NOT NULL,
+			anomaly_type = c.anomaly_type
+		FROM derived_values s
+		LEFT JOIN LATERAL classify_parameter(s.parameter_name, s.value) c ON TRUE
+		WHERE s.timestamp >= $1 AND s.timestamp < $2
+		AND d.parameter_name = s.parameter_name AND d.timestamp = s.timestamp
+		AND d.telemetry_id = s.telemetry_id
+	`, from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Clock drift anomalies come from clock model fits, not from the rows
+	// re-evaluated here, so they are left alone.
+	supersededAt := time.Now()
+	_, err = tx.Exec(`
+		UPDATE anomaly_history
+		SET superseded_at = $3
+		WHERE timestamp >= $1 AND timestamp < $2
+		AND superseded_at IS NULL
+		AND parameter_name <> 'clock_drift'
+	`, from, to, supersededAt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result, err = tx.Exec(`
+		INSERT INTO anomaly_history (
+			telemetry_id, telemetry_timestamp, timestamp, spacecraft_id, anomaly_type, parameter_name,
+			parameter_value, threshold_value, severity, acknowledged, acknowledged_at,
+			acknowledged_by, acknowledgement_note, revision, reprocess_job_id, import_id
+		)
+		SELECT t.id, t.timestamp, t.timestamp, t.spacecraft_id, c.anomaly_type, c.parameter_name,
+			   c.parameter_value, c.threshold_value, c.severity,
+			   COALESCE(prev.anomaly_type = c.anomaly_type AND prev.acknowledged, FALSE),
+			   CASE WHEN prev.anomaly_type = c.anomaly_type THEN prev.acknowledged_at END,
+			   CASE WHEN prev.anomaly_type = c.anomaly_type THEN prev.acknowledged_by END,
+			   CASE WHEN prev.anomaly_type = c.anomaly_type THEN prev.acknowledgement_note END,
+			   COALESCE(prev.revision, 0) + 1, $3, t.import_id
+		FROM telemetry t
+		CROSS JOIN LATERAL classify_telemetry(t.temperature, t.battery, t.altitude, t.signal_strength) c
+		LEFT JOIN LATERAL (
+			SELECT h.anomaly_type, h.acknowledged, h.acknowledged_at, h.acknowledged_by,
+				   h.acknowledgement_note, h.revision
+			FROM anomaly_history h
+			WHERE h.telemetry_id = t.id AND h.telemetry_timestamp = t.timestamp
+			AND NOT h.is_derived
+			ORDER BY h.revision DESC
+			LIMIT 1
+		) prev ON TRUE
+		WHERE t.timestamp >= $1 AND t.timestamp < $2
+	`, from, to, jobID)
+	if err != nil {
+		return 0, 0, err
+	}
+	anomalies, _ := result.RowsAffected()
+
+	result, err = tx.Exec(`
+		INSERT INTO anomaly_history (
+			telemetry_id, telemetry_timestamp, timestamp, spacecraft_id, anomaly_type, parameter_name,
+			parameter_value, threshold_value, severity, acknowledged, acknowledged_at,
+			acknowledged_by, acknowledgement_note, is_derived, revision, reprocess_job_id, import_id
+		)
+		SELECT d.telemetry_id, d.timestamp, d.timestamp, t.spacecraft_id, c.anomaly_type, d.parameter_name,
+			   d.value, c.threshold_value, c.severity,
+			   COALESCE(prev.anomaly_type = c.anomaly_type AND prev.acknowledged, FALSE),
+			   CASE WHEN prev.anomaly_type = c.anomaly_type THEN prev.acknowledged_at END,
+			   CASE WHEN prev.anomaly_type = c.anomaly_type THEN prev.acknowledged_by END,
+			   CASE WHEN prev.anomaly_type = c.anomaly_type THEN prev.acknowledgement_note END,
+			   TRUE, COALESCE(prev.revision, 0) + 1, $3, t.import_id
+		FROM derived_values d
+		JOIN telemetry t ON t.id = d.telemetry_id AND t.timestamp = d.timestamp
+		CROSS JOIN LATERAL classify_parameter(d.parameter_name, d.value) c
+		LEFT JOIN LATERAL (
+			SELECT h.anomaly_type, h.acknowledged, h.acknowledged_at, h.acknowledged_by,
+				   h.acknowledgement_note, h.revision
+			FROM anomaly_history h
+			WHERE h.telemetry_id = d.telemetry_id AND h.telemetry_timestamp = d.timestamp
+			AND h.is_derived AND h.parameter_name = d.parameter_name
+			ORDER BY h.revision DESC
+			LIMIT 1
+		) prev ON TRUE
+		WHERE d.timestamp >= $1 AND d.timestamp < $2
+	`, from, to, jobID)
+	if err != nil {
+		return 0, 0, err
+	}
+	derivedAnomalies, _ := result.RowsAffected()
+	anomalies += derivedAnomalies
+
+	// Acknowledgements carried over to the new revisions are audited like any
+	// other change.
+	_, err = tx.Exec(`
+		INSERT INTO anomaly_audit (anomaly_id, action, operator, note)
+		SELECT h.id, 'CARRY_OVER',
+			   COALESCE((SELECT requested_by FROM reprocess_jobs WHERE id = $3), 'reprocess'),
+			   'acknowledgement carried over by reprocess job ' || $3
+		FROM anomaly_history h
+		WHERE h.timestamp >= $1 AND h.timestamp < $2
+		AND h.reprocess_job_id = $3
+		AND h.superseded_at IS NULL
+		AND h.acknowledged
+	`, from, to, jobID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := tx.Exec(`SELECT refresh_incidents($1, $2)`, from, to); err != nil {
+		return 0, 0, err
+	}
+	return int(processed), int(anomalies), nil
+}
+
+func failReprocessJob(job *ReprocessJob, cause error) error {
+	msg := cause.Error()
+	finished := time.Now()
+	job.Status = "FAILED"
+	job.Error = &msg
+	job.FinishedAt = &finished
+	if _, err := db.Exec(`
+		UPDATE reprocess_jobs SET status = $2, error = $3, finished_at = $4 WHERE id = $1
+	`, job.ID, job.Status, msg, finished); err != nil {
+		log.Printf("Error recording reprocess job %d failure: %v", job.ID, err)
+	}
+	return cause
+}
+
+func getReprocessJob(id int) (*ReprocessJob, error) {
+	var j ReprocessJob
+	err := db.QueryRow(`
+		SELECT id, start_time, end_time, status, total_rows, processed_rows, anomaly_rows,
+			   error, requested_by, created_at, started_at, finished_at
+		FROM reprocess_jobs
+		WHERE id = $1
+	`, id).Scan(
+		&j.ID, &j.StartTime, &j.EndTime, &j.Status, &j.TotalRows, &j.ProcessedRows, &j.AnomalyRows,
+		&j.Error, &j.RequestedBy, &j.CreatedAt, &j.StartedAt, &j.FinishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func createReprocess(c *fiber.Ctx) error {
+	var req ReprocessRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+
+	start, end, err := parseReprocessRange(req.StartTime, req.EndTime)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	job, err := createReprocessJob(start, end, req.RequestedBy)
+	if err == errReprocessBusy {
+		return sendError(c, conflict(err.Error()))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to create reprocess job", err))
+	}
+
+	go func() {
+		if err := runReprocessJob(job, func(*ReprocessJob) {}); err != nil {
+			log.Printf("Reprocess job %d failed: %v", job.ID, err)
+		}
+	}()
+
+	return c.Status(202).JSON(job)
+}
+
+func getReprocess(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	job, err := getReprocessJob(id)
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Reprocess job not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get reprocess job", err))
+	}
+
+	return c.JSON(job)
+}
+
+func listReprocess(c *fiber.Ctx) error {
+	rows, err := db.Query(`
+		SELECT id, start_time, end_time, status, total_rows, processed_rows, anomaly_rows,
+			   error, requested_by, created_at, started_at, finished_at
+		FROM reprocess_jobs
+		ORDER BY created_at DESC
+		LIMIT 50
+	`)
+	if err != nil {
+		return sendError(c, internalError("Failed to query reprocess jobs", err))
+	}
+	defer rows.Close()
+
+	jobs := make([]ReprocessJob, 0)
+	for rows.Next() {
+		var j ReprocessJob
+		err := rows.Scan(
+			&j.ID, &j.StartTime, &j.EndTime, &j.Status, &j.TotalRows, &j.ProcessedRows, &j.AnomalyRows,
+			&j.Error, &j.RequestedBy, &j.CreatedAt, &j.StartedAt, &j.FinishedAt,
+		)
+		if err != nil {
+			log.Printf("Error scanning reprocess job row: %v", err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	return c.JSON(jobs)
+}
+
+// runReprocessCommand implements `telemetry-api reprocess -start ... -end ...`.
+func runReprocessCommand(args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	startTime := fs.String("start", "", "start of the range (RFC3339)")
+	endTime := fs.String("end", "", "end of the range (RFC3339)")
+	requestedBy := fs.String("by", "cli", "operator requesting the job")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	start, end, err := parseReprocessRange(*startTime, *endTime)
+	if err != nil {
+		return err
+	}
+
+	job, err := createReprocessJob(start, end, *requestedBy)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reprocess job %d: %s to %s", job.ID, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	return runReprocessJob(job, func(j *ReprocessJob) {
+		pct := 100.0
+		if j.TotalRows > 0 {
+			pct = float64(j.ProcessedRows) * 100 / float64(j.TotalRows)
+		}
+		log.Printf("Reprocess job %d %s: %d/%d rows (%.1f%%), %d anomalies",
+			j.ID, j.Status, j.ProcessedRows, j.TotalRows, pct, j.AnomalyRows)
+	})
+}
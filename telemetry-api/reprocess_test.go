@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReprocessWindows(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(150 * time.Minute)
+
+	windows := reprocessWindows(start, end, time.Hour)
+
+	require.Len(t, windows, 3)
+	assert.Equal(t, start, windows[0][0])
+	assert.Equal(t, start.Add(time.Hour), windows[0][1])
+	assert.Equal(t, start.Add(2*time.Hour), windows[2][0])
+	assert.Equal(t, end, windows[2][1])
+}
+
+func TestParseReprocessRange(t *testing.T) {
+	start, end, err := parseReprocessRange("2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, end.Sub(start))
+
+	app := fiber.New()
+	app.Post("/api/v1/admin/reprocess", createReprocess)
+
+	cases := []struct {
+		body  string
+		field string
+	}{
+		{`{"end_time": "2024-01-02T00:00:00Z"}`, "start_time"},
+		{`{"start_time": "2024-01-01T00:00:00Z"}`, "end_time"},
+		{`{"start_time": "yesterday", "end_time": "2024-01-02T00:00:00Z"}`, "start_time"},
+		{`{"start_time": "2024-01-02T00:00:00Z", "end_time": "2024-01-01T00:00:00Z"}`, "end_time"},
+		{`{"start_time": `, ""},
+	}
+	for _, tc := range cases {
+		requireAPIError(t, app, jsonRequest("POST", "/api/v1/admin/reprocess", tc.body), http.StatusBadRequest, codeInvalidBody, tc.field)
+	}
+}
+
+func TestDetectAnomalyReportsHighestPriorityRule(t *testing.T) {
+	tx := testTx(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	hot := insertTestTelemetry(t, tx, ts, 36)
+	nominal := insertTestTelemetry(t, tx, ts.Add(time.Second), 25)
+	var both int
+	require.NoError(t, tx.QueryRow(`
+		INSERT INTO telemetry (
+			timestamp, spacecraft_id, packet_id, packet_seq_ctrl, subsystem_id,
+			temperature, battery, altitude, signal_strength
+		) VALUES ($1, $2, 2049, 49155, 1, 36, 30, 500, -50)
+		RETURNING id
+	`, ts.Add(2*time.Second), testSpacecraftID).Scan(&both))
+
+	for _, tc := range []struct {
+		id          int
+		ts          time.Time
+		anomalyType string
+		parameter   string
+		threshold   float64
+	}{
+		{hot, ts, "HIGH_TEMPERATURE", "temperature", 35},
+		{nominal, ts.Add(time.Second), "", "", 0},
+		// Battery rules outrank temperature rules.
+		{both, ts.Add(2 * time.Second), "LOW_BATTERY", "battery", 40},
+	} {
+		var isAnomaly bool
+		var anomalyType sql.NullString
+		require.NoError(t, tx.QueryRow(`
+			SELECT is_anomaly, anomaly_type FROM telemetry WHERE id = $1 AND timestamp = $2
+		`, tc.id, tc.ts).Scan(&isAnomaly, &anomalyType))
+		assert.Equal(t, tc.anomalyType != "", isAnomaly, tc.anomalyType)
+		assert.Equal(t, tc.anomalyType, anomalyType.String)
+
+		var parameter string
+		var threshold float64
+		var revision int
+		err := tx.QueryRow(`
+			SELECT parameter_name, threshold_value, revision
+			FROM anomaly_history
+			WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+		`, tc.id, tc.ts).Scan(&parameter, &threshold, &revision)
+		if tc.anomalyType == "" {
+			assert.Equal(t, sql.ErrNoRows, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tc.parameter, parameter)
+		assert.Equal(t, tc.threshold, threshold)
+		assert.Equal(t, 1, revision)
+	}
+}
+
+func TestReprocessRowsSupersedesAnomalies(t *testing.T) {
+	tx := testTx(t)
+	from := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Minute)
+
+	id := insertTestTelemetry(t, tx, from, 36)
+	_, err := tx.Exec(`
+		UPDATE anomaly_history SET acknowledged = TRUE, acknowledged_by = 'ops'
+		WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+	`, id, from)
+	require.NoError(t, err)
+	// As if the row had been imported.
+	_, err = tx.Exec(`UPDATE telemetry SET import_id = 3 WHERE id = $1 AND timestamp = $2`, id, from)
+	require.NoError(t, err)
+
+	type revision struct {
+		Revision     int
+		Threshold    float64
+		Acknowledged bool
+		By           sql.NullString
+		Superseded   bool
+		JobID        sql.NullInt64
+		ImportID     sql.NullInt64
+	}
+	revisions := func() []revision {
+		rows, err := tx.Query(`
+			SELECT revision, threshold_value, acknowledged, acknowledged_by, superseded_at IS NOT NULL,
+				   reprocess_job_id, import_id
+			FROM anomaly_history
+			WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+			ORDER BY revision
+		`, id, from)
+		require.NoError(t, err)
+		defer rows.Close()
+		var revs []revision
+		for rows.Next() {
+			var r revision
+			require.NoError(t, rows.Scan(&r.Revision, &r.Threshold, &r.Acknowledged, &r.By, &r.Superseded, &r.JobID, &r.ImportID))
+			revs = append(revs, r)
+		}
+		return revs
+	}
+
+	// The anomaly type is unchanged, so the acknowledgement carries over.
+	_, err = tx.Exec(`UPDATE parameter_limits SET high_threshold = 34 WHERE parameter_name = 'temperature'`)
+	require.NoError(t, err)
+	processed, anomalies, err := reprocessRows(tx, 7, from, to)
+	require.NoError(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Equal(t, 1, anomalies)
+
+	revs := revisions()
+	require.Len(t, revs, 2)
+	assert.True(t, revs[0].Superseded)
+	assert.Equal(t, revision{
+		Revision: 2, Threshold: 34, Acknowledged: true, By: sql.NullString{String: "ops", Valid: true},
+		JobID: sql.NullInt64{Int64: 7, Valid: true}, ImportID: sql.NullInt64{Int64: 3, Valid: true},
+	}, revs[1])
+
+	_, err = tx.Exec(`UPDATE parameter_limits SET high_threshold = 40 WHERE parameter_name = 'temperature'`)
+	require.NoError(t, err)
+	processed, anomalies, err = reprocessRows(tx, 8, from, to)
+	require.NoError(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Equal(t, 0, anomalies)
+
+	revs = revisions()
+	require.Len(t, revs, 2)
+	assert.True(t, revs[1].Superseded)
+	var isAnomaly bool
+	require.NoError(t, tx.QueryRow(`
+		SELECT is_anomaly FROM telemetry WHERE id = $1 AND timestamp = $2
+	`, id, from).Scan(&isAnomaly))
+	assert.False(t, isAnomaly)
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	assert.True(t, isUniqueViolation(&pq.Error{Code: "23505"}))
+	assert.False(t, isUniqueViolation(&pq.Error{Code: "23503"}))
+	assert.False(t, isUniqueViolation(sql.ErrNoRows))
+	assert.False(t, isUniqueViolation(nil))
+}
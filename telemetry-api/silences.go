@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxSilenceDuration bounds how long a single silence may suppress anomalies,
+// so a forgotten silence cannot hide a real fault indefinitely.
+const maxSilenceDuration = 30 * 24 * time.Hour
+
+type Silence struct {
+	ID            int       `json:"id"`
+	SpacecraftID  *int      `json:"spacecraft_id"`
+	ParameterName *string   `json:"parameter_name"`
+	AnomalyType   *string   `json:"anomaly_type"`
+	StartsAt      time.Time `json:"starts_at"`
+	EndsAt        time.Time `json:"ends_at"`
+	Reason        string    `json:"reason"`
+	CreatedBy     string    `json:"created_by"`
+	ExpiredBy     *string   `json:"expired_by,omitempty"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// SilenceRequest creates a silence. Omitted scope fields match any value.
+// starts_at defaults to now; the window ends at ends_at or after
+// duration_minutes.
+type SilenceRequest struct {
+	SpacecraftID    *int   `json:"spacecraft_id"`
+	ParameterName   string `json:"parameter_name"`
+	AnomalyType     string `json:"anomaly_type"`
+	StartsAt        string `json:"starts_at"`
+	EndsAt          string `json:"ends_at"`
+	DurationMinutes int    `json:"duration_minutes"`
+	Reason          string `json:"reason"`
+	CreatedBy       string `json:"created_by"`
+}
+
+type ExpireSilenceRequest struct {
+	Operator string `json:"operator"`
+}
+
+// silenceColumns lists the silences columns in the order scanSilence expects.
+const silenceColumns = `id, spacecraft_id, parameter_name, anomaly_type, starts_at, ends_at,
+		   reason, created_by, expired_by,
+		   CASE WHEN NOW() < starts_at THEN 'PENDING'
+				WHEN NOW() < ends_at THEN 'ACTIVE'
+				ELSE 'EXPIRED' END,
+		   created_at`
+
+func scanSilence(row rowScanner) (Silence, error) {
+	var s Silence
+	err := row.Scan(
+		&s.ID, &s.SpacecraftID, &s.ParameterName, &s.AnomalyType, &s.StartsAt, &s.EndsAt,
+		&s.Reason, &s.CreatedBy, &s.ExpiredBy, &s.Status, &s.CreatedAt,
+	)
+	return s, err
+}
+
+// silenceWindow validates a request and resolves its time window relative to now.
+func silenceWindow(req SilenceRequest, now time.Time) (time.Time, time.Time, error) {
+	if strings.TrimSpace(req.CreatedBy) == "" {
+		return time.Time{}, time.Time{}, invalidField("created_by", "created_by is required")
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return time.Time{}, time.Time{}, invalidField("reason", "reason is required")
+	}
+	if req.SpacecraftID == nil && req.ParameterName == "" && req.AnomalyType == "" {
+		return time.Time{}, time.Time{}, invalidField("spacecraft_id", "at least one of spacecraft_id, parameter_name or anomaly_type is required")
+	}
+
+	start := now
+	if req.StartsAt != "" {
+		t, ok := parseTime(req.StartsAt, now)
+		if !ok {
+			return time.Time{}, time.Time{}, invalidField("starts_at", "starts_at must be %s", timeFormat)
+		}
+		start = t
+	}
+
+	var end time.Time
+	switch {
+	case req.EndsAt != "" && req.DurationMinutes != 0:
+		return time.Time{}, time.Time{}, invalidField("duration_minutes", "specify either ends_at or duration_minutes, not both")
+	case req.EndsAt != "":
+		t, ok := parseTime(req.EndsAt, now)
+		if !ok {
+			return time.Time{}, time.Time{}, invalidField("ends_at", "ends_at must be %s", timeFormat)
+		}
+		end = t
+	case req.DurationMinutes > 0:
+		end = start.Add(time.Duration(req.DurationMinutes) * time.Minute)
+	default:
+		return time.Time{}, time.Time{}, invalidField("duration_minutes", "ends_at or a positive duration_minutes is required")
+	}
+
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, invalidField("ends_at", "silence must end after it starts")
+	}
+	if !end.After(now) {
+		return time.Time{}, time.Time{}, invalidField("ends_at", "silence must end in the future")
+	}
+	if end.Sub(start) > maxSilenceDuration {
+		return time.Time{}, time.Time{}, invalidField("ends_at", "silence may not be longer than %s", maxSilenceDuration)
+	}
+	return start, end, nil
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func createSilence(c *fiber.Ctx) error {
+	var req SilenceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+	req.AnomalyType = strings.ToUpper(strings.TrimSpace(req.AnomalyType))
+	req.ParameterName = strings.TrimSpace(req.ParameterName)
+
+	start, end, err := silenceWindow(req, time.Now())
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return sendError(c, internalError("Failed to create silence", err))
+	}
+	defer tx.Rollback()
+
+	silence, err := scanSilence(tx.QueryRow(`
+		INSERT INTO silences (spacecraft_id, parameter_name, anomaly_type, starts_at, ends_at, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+silenceColumns,
+		req.SpacecraftID, nullIfEmpty(req.ParameterName), nullIfEmpty(req.AnomalyType),
+		start, end, req.Reason, req.CreatedBy,
+	))
+	if err != nil {
+		return sendError(c, internalError("Failed to create silence", err))
+	}
+
+	// Anomalies already recorded inside the window are suppressed as well, so
+	// a silence created after a test started also clears the status and stops
+	// pending escalations.
+	res, err := tx.Exec(`
+		UPDATE anomaly_history
+		SET suppressed = TRUE, silence_id = $1
+		WHERE superseded_at IS NULL
+		AND NOT suppressed
+		AND timestamp >= $2 AND timestamp < $3
+		AND ($4::INTEGER IS NULL OR spacecraft_id = $4)
+		AND ($5::VARCHAR IS NULL OR parameter_name = $5)
+		AND ($6::VARCHAR IS NULL OR anomaly_type = $6)
+	`, silence.ID, start, end, req.SpacecraftID, nullIfEmpty(req.ParameterName), nullIfEmpty(req.AnomalyType))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to create silence", err))
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Silence %d suppressed %d existing anomalies", silence.ID, n)
+	}
+
+	return c.Status(201).JSON(silence)
+}
+
+func getSilences(c *fiber.Ctx) error {
+	status := strings.ToUpper(c.Query("status"))
+	createdBy := c.Query("created_by")
+	spacecraftID, err := queryInt(c, "spacecraft_id")
+	if err != nil {
+		return sendError(c, err)
+	}
+	limit, err := queryLimit(c, defaultListLimit, maxListLimit)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query := `SELECT ` + silenceColumns + ` FROM silences WHERE 1=1`
+	args := []interface{}{}
+	argCount := 0
+
+	switch status {
+	case "":
+	case "PENDING":
+		query += " AND NOW() < starts_at"
+	case "ACTIVE":
+		query += " AND NOW() >= starts_at AND NOW() < ends_at"
+	case "EXPIRED":
+		query += " AND NOW() >= ends_at"
+	default:
+		return sendError(c, invalidParam("status", "status must be pending, active or expired"))
+	}
+
+	if spacecraftID != nil {
+		argCount++
+		query += fmt.Sprintf(" AND (spacecraft_id IS NULL OR spacecraft_id = $%d)", argCount)
+		args = append(args, *spacecraftID)
+	}
+
+	if createdBy != "" {
+		argCount++
+		query += fmt.Sprintf(" AND created_by = $%d", argCount)
+		args = append(args, createdBy)
+	}
+
+	argCount++
+	query += fmt.Sprintf(" ORDER BY starts_at DESC LIMIT $%d", argCount)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query silences", err))
+	}
+	defer rows.Close()
+
+	silences := make([]Silence, 0)
+	for rows.Next() {
+		s, err := scanSilence(rows)
+		if err != nil {
+			log.Printf("Error scanning silence row: %v", err)
+			continue
+		}
+		silences = append(silences, s)
+	}
+
+	return c.JSON(silences)
+}
+
+func getSilence(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	silence, err := scanSilence(db.QueryRow(`SELECT `+silenceColumns+` FROM silences WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Silence not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get silence", err))
+	}
+
+	return c.JSON(silence)
+}
+
+// expireSilence ends a silence early. Anomalies it already suppressed stay
+// suppressed; anomalies from now on are no longer covered.
+func expireSilence(c *fiber.Ctx) error {
+	id, err := paramID(c, "id")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	var req ExpireSilenceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+	if strings.TrimSpace(req.Operator) == "" {
+		return sendError(c, invalidField("operator", "operator is required"))
+	}
+
+	silence, err := scanSilence(db.QueryRow(`
+		UPDATE silences
+		SET starts_at = LEAST(starts_at, NOW()),
+			ends_at = NOW(),
+			expired_by = $2
+		WHERE id = $1 AND ends_at > NOW()
+		RETURNING `+silenceColumns,
+		id, req.Operator,
+	))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Silence not found or already expired"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to expire silence", err))
+	}
+
+	return c.JSON(silence)
+}
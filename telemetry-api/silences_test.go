@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSilenceWindow(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sc := 1
+
+	start, end, err := silenceWindow(SilenceRequest{
+		SpacecraftID: &sc, AnomalyType: "LOW_BATTERY", DurationMinutes: 90,
+		Reason: "battery discharge test", CreatedBy: "alice",
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now, start)
+	assert.Equal(t, now.Add(90*time.Minute), end)
+
+	start, end, err = silenceWindow(SilenceRequest{
+		ParameterName: "battery", StartsAt: "2024-03-01T11:00:00Z", EndsAt: "2024-03-01T14:00:00Z",
+		Reason: "battery discharge test", CreatedBy: "alice",
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC), end)
+
+	invalid := []struct {
+		req   SilenceRequest
+		field string
+	}{
+		{SilenceRequest{SpacecraftID: &sc, DurationMinutes: 10, Reason: "test"}, "created_by"},
+		{SilenceRequest{SpacecraftID: &sc, DurationMinutes: 10, CreatedBy: "alice"}, "reason"},
+		{SilenceRequest{DurationMinutes: 10, Reason: "test", CreatedBy: "alice"}, "spacecraft_id"},
+		{SilenceRequest{SpacecraftID: &sc, Reason: "test", CreatedBy: "alice"}, "duration_minutes"},
+		{SilenceRequest{SpacecraftID: &sc, EndsAt: "2024-03-01T14:00:00Z", DurationMinutes: 10, Reason: "test", CreatedBy: "alice"}, "duration_minutes"},
+		{SilenceRequest{SpacecraftID: &sc, EndsAt: "2024-03-01T11:00:00Z", Reason: "test", CreatedBy: "alice"}, "ends_at"},
+		{SilenceRequest{SpacecraftID: &sc, StartsAt: "yesterday", DurationMinutes: 10, Reason: "test", CreatedBy: "alice"}, "starts_at"},
+		{SilenceRequest{SpacecraftID: &sc, DurationMinutes: 60 * 24 * 31, Reason: "test", CreatedBy: "alice"}, "ends_at"},
+	}
+	for i, tc := range invalid {
+		_, _, err := silenceWindow(tc.req, now)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr, "case %d", i)
+		assert.Equal(t, codeInvalidBody, apiErr.Code, "case %d", i)
+		assert.Equal(t, tc.field, apiErr.Field, "case %d", i)
+	}
+
+	app := fiber.New()
+	app.Get("/api/v1/silences", getSilences)
+	app.Post("/api/v1/silences", createSilence)
+	app.Get("/api/v1/silences/:id", getSilence)
+	app.Post("/api/v1/silences/:id/expire", expireSilence)
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+		code   string
+		field  string
+	}{
+		{"POST", "/api/v1/silences", `{"anomaly_type": "LOW_BATTERY", "duration_minutes": 60, "reason": "test"}`, codeInvalidBody, "created_by"},
+		{"POST", "/api/v1/silences", `{"created_by": "alice", "reason": "test", "duration_minutes": 60}`, codeInvalidBody, "spacecraft_id"},
+		{"GET", "/api/v1/silences?status=forgotten", ``, codeInvalidParameter, "status"},
+		{"GET", "/api/v1/silences/abc", ``, codeInvalidParameter, "id"},
+		{"POST", "/api/v1/silences/abc/expire", `{"operator": "alice"}`, codeInvalidParameter, "id"},
+		{"POST", "/api/v1/silences/3/expire", `{}`, codeInvalidBody, "operator"},
+	}
+	for _, tc := range requests {
+		requireAPIError(t, app, jsonRequest(tc.method, tc.path, tc.body), http.StatusBadRequest, tc.code, tc.field)
+	}
+}
+
+func TestApplySilenceSuppressesMatchingAnomalies(t *testing.T) {
+	tx := testTx(t)
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var silenceID int
+	require.NoError(t, tx.QueryRow(`
+		INSERT INTO silences (spacecraft_id, parameter_name, starts_at, ends_at, reason, created_by)
+		VALUES ($1, 'temperature', $2, $3, 'heater test', 'alice')
+		RETURNING id
+	`, testSpacecraftID, ts, ts.Add(10*time.Minute)).Scan(&silenceID))
+	_, err := tx.Exec(`
+		INSERT INTO silences (spacecraft_id, starts_at, ends_at, reason, created_by)
+		VALUES ($1, $2, $3, 'another spacecraft', 'alice')
+	`, testSpacecraftID+1, ts, ts.Add(time.Hour))
+	require.NoError(t, err)
+
+	tests := []struct {
+		at         time.Time
+		suppressed bool
+	}{
+		{ts, true},
+		{ts.Add(9 * time.Minute), true},
+		// Silences end before ends_at.
+		{ts.Add(10 * time.Minute), false},
+		{ts.Add(-time.Second), false},
+	}
+	for _, tt := range tests {
+		id := insertTestTelemetry(t, tx, tt.at, 36)
+
+		var suppressed bool
+		var silence sql.NullInt64
+		require.NoError(t, tx.QueryRow(`
+			SELECT suppressed, silence_id FROM anomaly_history
+			WHERE telemetry_id = $1 AND telemetry_timestamp = $2
+		`, id, tt.at).Scan(&suppressed, &silence))
+		assert.Equal(t, tt.suppressed, suppressed, tt.at)
+		if tt.suppressed {
+			assert.Equal(t, int64(silenceID), silence.Int64, tt.at)
+		} else {
+			assert.False(t, silence.Valid, tt.at)
+		}
+
+		var telemetrySuppressed bool
+		require.NoError(t, tx.QueryRow(`SELECT telemetry_suppressed($1, $2)`, id, tt.at).Scan(&telemetrySuppressed))
+		assert.Equal(t, tt.suppressed, telemetrySuppressed, tt.at)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GroundStation is a registry entry with its reception statistics over a
+// window. Errors are copies that failed packet error control plus datagrams
+// that could not be decoded; ErrorRate is their share of everything the
+// station delivered. LastContactAt is the latest datagram ever received from
+// the station.
+type GroundStation struct {
+	ID            string     `json:"id"`
+	Name          *string    `json:"name"`
+	Address       *string    `json:"address"`
+	Description   *string    `json:"description"`
+	Origin        string     `json:"origin"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	LastContactAt *time.Time `json:"last_contact_at"`
+	Received      int        `json:"received"`
+	Duplicate     int        `json:"duplicate"`
+	Corrupt       int        `json:"corrupt"`
+	Rejected      int        `json:"rejected"`
+	ErrorRate     float64    `json:"error_rate"`
+	AvgRSSIDbm    *float64   `json:"avg_rssi_dbm"`
+	AvgSNRDb      *float64   `json:"avg_snr_db"`
+	MinSNRDb      *float64   `json:"min_snr_db"`
+}
+
+type GroundStationList struct {
+	StartTime time.Time       `json:"start_time"`
+	EndTime   time.Time       `json:"end_time"`
+	Stations  []GroundStation `json:"stations"`
+}
+
+// StationBucket is one bucket of a station's link history.
+type StationBucket struct {
+	Bucket    time.Time `json:"bucket"`
+	Received  int       `json:"received"`
+	Corrupt   int       `json:"corrupt"`
+	Rejected  int       `json:"rejected"`
+	ErrorRate float64   `json:"error_rate"`
+	AvgRSSI   *float64  `json:"avg_rssi_dbm"`
+	AvgSNR    *float64  `json:"avg_snr_db"`
+}
+
+type GroundStationDetail struct {
+	GroundStation
+	StartTime  time.Time       `json:"start_time"`
+	EndTime    time.Time       `json:"end_time"`
+	BucketSize string          `json:"bucket_size"`
+	History    []StationBucket `json:"history"`
+}
+
+// StationRequest configures a station. address is an IP address or CIDR
+// range; datagrams from it are attributed to the station.
+type StationRequest struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Description string `json:"description"`
+}
+
+func errorRate(corrupt, rejected, received int) float64 {
+	if received+rejected == 0 {
+		return 0
+	}
+	return float64(corrupt+rejected) / float64(received+rejected)
+}
+
+// stationsQuery returns the registry with statistics over [start, end),
+// optionally for one station.
+func stationsQuery(start, end time.Time, id string) (string, []interface{}) {
+	args := []interface{}{start, end}
+	where := ""
+	if id != "" {
+		where = "WHERE s.id = $3"
+		args = append(args, id)
+	}
+
+	query := fmt.Sprintf(`
+		WITH r AS (
+			SELECT station,
+				   COUNT(*) AS received,
+				   COUNT(*) FILTER (WHERE outcome = 'DUPLICATE') AS duplicate,
+				   COUNT(*) FILTER (WHERE quality = 0) AS corrupt,
+				   AVG(rssi_dbm) AS avg_rssi,
+				   AVG(snr_db) AS avg_snr,
+				   MIN(snr_db) AS min_snr
+			FROM packet_receptions
+			WHERE received_at >= $1 AND received_at < $2
+			GROUP BY station
+		), x AS (
+			SELECT station, COUNT(*) AS rejected
+			FROM rejected_packets
+			WHERE received_at >= $1 AND received_at < $2
+			GROUP BY station
+		)
+		SELECT s.id, s.name, s.address::TEXT, s.description, s.origin, s.created_at, s.updated_at,
+			   GREATEST(
+				   (SELECT MAX(received_at) FROM packet_receptions p WHERE p.station = s.id),
+				   (SELECT MAX(received_at) FROM rejected_packets j WHERE j.station = s.id)
+			   ),
+			   COALESCE(r.received, 0), COALESCE(r.duplicate, 0), COALESCE(r.corrupt, 0),
+			   COALESCE(x.rejected, 0), r.avg_rssi, r.avg_snr, r.min_snr
+		FROM ground_stations s
+		LEFT JOIN r ON r.station = s.id
+		LEFT JOIN x ON x.station = s.id
+		%s
+		ORDER BY s.id
+	`, where)
+	return query, args
+}
+
+func scanGroundStation(row rowScanner) (GroundStation, error) {
+	var s GroundStation
+	err := row.Scan(
+		&s.ID, &s.Name, &s.Address, &s.Description, &s.Origin, &s.CreatedAt, &s.UpdatedAt,
+		&s.LastContactAt, &s.Received, &s.Duplicate, &s.Corrupt, &s.Rejected,
+		&s.AvgRSSIDbm, &s.AvgSNRDb, &s.MinSNRDb,
+	)
+	s.ErrorRate = errorRate(s.Corrupt, s.Rejected, s.Received)
+	return s, err
+}
+
+// stationWindow resolves start_time and end_time, defaulting to the last
+// defaultReceptionWindow.
+func stationWindow(c *fiber.Ctx) (time.Time, time.Time, error) {
+	startTime, endTime, err := queryTimeRange(c)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end := time.Now().UTC()
+	if endTime != nil {
+		end = *endTime
+	}
+	start := end.Add(-defaultReceptionWindow)
+	if startTime != nil {
+		start = *startTime
+	}
+	return start, end, nil
+}
+
+// getStations lists the ground station registry with reception statistics:
+//
+//	GET /api/v1/stations?start_time=now-6h
+func getStations(c *fiber.Ctx) error {
+	start, end, err := stationWindow(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query, args := stationsQuery(start, end, "")
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return sendError(c, internalError("Failed to query ground stations", err))
+	}
+	defer rows.Close()
+
+	list := GroundStationList{StartTime: start, EndTime: end, Stations: make([]GroundStation, 0)}
+	for rows.Next() {
+		s, err := scanGroundStation(rows)
+		if err != nil {
+			log.Printf("Error scanning ground station row: %v", err)
+			continue
+		}
+		list.Stations = append(list.Stations, s)
+	}
+
+	return c.JSON(list)
+}
+
+// getStation returns one station with its statistics and their history per
+// bucket, which shows a link degrading over time.
+func getStation(c *fiber.Ctx) error {
+	id := c.Params("id")
+	start, end, err := stationWindow(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	bucket, err := queryBucketSize(c, "1 hour")
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	query, args := stationsQuery(start, end, id)
+	station, err := scanGroundStation(db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return sendError(c, notFound("Ground station not found"))
+	}
+	if err != nil {
+		return sendError(c, internalError("Failed to get ground station", err))
+	}
+
+	rows, err := db.Query(`
+		WITH r AS (
+			SELECT time_bucket($4::INTERVAL, received_at) AS bucket,
+				   COUNT(*) AS received,
+				   COUNT(*) FILTER (WHERE quality = 0) AS corrupt,
+				   AVG(rssi_dbm) AS avg_rssi,
+				   AVG(snr_db) AS avg_snr
+			FROM packet_receptions
+			WHERE station = $1 AND received_at >= $2 AND received_at < $3
+			GROUP BY 1
+		), x AS (
+			SELECT time_bucket($4::INTERVAL, received_at) AS bucket, COUNT(*) AS rejected
+			FROM rejected_packets
+			WHERE station = $1 AND received_at >= $2 AND received_at < $3
+			GROUP BY 1
+		)
+		SELECT COALESCE(r.bucket, x.bucket), COALESCE(r.received, 0), COALESCE(r.corrupt, 0),
+			   COALESCE(x.rejected, 0), r.avg_rssi, r.avg_snr
+		FROM r FULL JOIN x ON x.bucket = r.bucket
+		ORDER BY 1
+	`, id, start, end, bucket.Interval)
+	if err != nil {
+		return sendError(c, internalError("Failed to query ground station history", err))
+	}
+	defer rows.Close()
+
+	detail := GroundStationDetail{
+		GroundStation: station,
+		StartTime:     start,
+		EndTime:       end,
+		BucketSize:    bucket.Interval,
+		History:       make([]StationBucket, 0),
+	}
+	for rows.Next() {
+		var b StationBucket
+		if err := rows.Scan(&b.Bucket, &b.Received, &b.Corrupt, &b.Rejected, &b.AvgRSSI, &b.AvgSNR); err != nil {
+			log.Printf("Error scanning ground station history row: %v", err)
+			continue
+		}
+		b.ErrorRate = errorRate(b.Corrupt, b.Rejected, b.Received)
+		detail.History = append(detail.History, b)
+	}
+
+	return c.JSON(detail)
+}
+
+// stationAddress normalizes an IP address or CIDR range to CIDR form.
+func stationAddress(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(v); ip != nil {
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), nil
+	}
+	_, network, err := net.ParseCIDR(v)
+	if err != nil {
+		return "", fmt.Errorf("address must be an IP address or CIDR range")
+	}
+	return network.String(), nil
+}
+
+// putStation configures a station, creating it if needed. A station that was
+// learned becomes configured.
+func putStation(c *fiber.Ctx) error {
+	id := strings.TrimSpace(c.Params("id"))
+	if len(id) > 50 {
+		return sendError(c, invalidParam("id", "id must be at most 50 characters"))
+	}
+
+	var req StationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return sendError(c, invalidBody("Invalid request body"))
+	}
+	address, err := stationAddress(strings.TrimSpace(req.Address))
+	if err != nil {
+		return sendError(c, invalidField("address", "%v", err))
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO ground_stations (id, name, address, description, origin)
+		VALUES ($1, $2, $3::CIDR, $4, 'configured')
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name,
+			address = EXCLUDED.address,
+			description = EXCLUDED.description,
+			origin = 'configured',
+			updated_at = NOW()
+	`, id, nullIfEmpty(strings.TrimSpace(req.Name)), nullIfEmpty(address), nullIfEmpty(strings.TrimSpace(req.Description)))
+	if err != nil {
+		return sendError(c, internalError("Failed to save ground station", err))
+	}
+
+	return getStation(c)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStationsQuery(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	query, args := stationsQuery(start, end, "")
+	assert.Contains(t, query, "FROM ground_stations s")
+	assert.Contains(t, query, "LEFT JOIN x ON x.station = s.id")
+	assert.NotContains(t, query, "$3")
+	assert.Equal(t, []interface{}{start, end}, args)
+
+	query, args = stationsQuery(start, end, "GS2")
+	assert.Contains(t, query, "WHERE s.id = $3")
+	assert.Equal(t, []interface{}{start, end, "GS2"}, args)
+	app := fiber.New()
+	app.Get("/api/v1/stations", getStations)
+	app.Get("/api/v1/stations/:id", getStation)
+	for path, field := range map[string]string{
+		"/api/v1/stations?start_time=yesterday":           "start_time",
+		"/api/v1/stations?start_time=now&end_time=now-1h": "end_time",
+		"/api/v1/stations/GS1?bucket_size=7m":             "bucket_size",
+	} {
+		requireAPIError(t, app, httptest.NewRequest("GET", path, nil), http.StatusBadRequest, codeInvalidParameter, field)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	assert.Equal(t, 0.0, errorRate(0, 0, 0))
+	assert.Equal(t, 0.25, errorRate(1, 1, 7))
+	assert.Equal(t, 1.0, errorRate(0, 3, 0))
+}
+
+func TestStationAddress(t *testing.T) {
+	cases := map[string]string{
+		"":              "",
+		"10.0.0.7":      "10.0.0.7/32",
+		"10.0.1.0/24":   "10.0.1.0/24",
+		"10.0.1.9/24":   "10.0.1.0/24",
+		"2001:db8::1":   "2001:db8::1/128",
+		"2001:db8::/32": "2001:db8::/32",
+	}
+	for in, want := range cases {
+		got, err := stationAddress(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	_, err := stationAddress("gs1.example.com")
+	assert.Error(t, err)
+	app := fiber.New()
+	app.Put("/api/v1/stations/:id", putStation)
+	requireAPIError(t, app, jsonRequest("PUT", "/api/v1/stations/"+strings.Repeat("x", 51), `{}`),
+		http.StatusBadRequest, codeInvalidParameter, "id")
+	requireAPIError(t, app, jsonRequest("PUT", "/api/v1/stations/GS1", `{"address": "gs1.example.com"}`),
+		http.StatusBadRequest, codeInvalidBody, "address")
+	requireAPIError(t, app, jsonRequest("PUT", "/api/v1/stations/GS1", `{`),
+		http.StatusBadRequest, codeInvalidBody, "")
+}
+
+func TestStationsQueryReportsLinkStatistics(t *testing.T) {
+	tx := testTx(t)
+	start := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	_, err := tx.Exec(`
+		INSERT INTO ground_stations (id, name, address, origin)
+		VALUES ('TEST-GS', 'Test station', '10.0.0.0/24', 'configured'), ('TEST-IDLE', NULL, NULL, 'learned')
+	`)
+	require.NoError(t, err)
+
+	for i, r := range []struct {
+		at      time.Time
+		quality int
+		outcome string
+		rssi    sql.NullFloat64
+		snr     sql.NullFloat64
+	}{
+		{start, 0, "DISCARDED", sql.NullFloat64{Float64: -100, Valid: true}, sql.NullFloat64{Float64: 2, Valid: true}},
+		{start.Add(time.Minute), 2, "DUPLICATE", sql.NullFloat64{Float64: -90, Valid: true}, sql.NullFloat64{Float64: 6, Valid: true}},
+		{start.Add(2 * time.Minute), 2, "STORED", sql.NullFloat64{}, sql.NullFloat64{}},
+		// Outside the window, but the latest contact.
+		{end.Add(time.Hour), 2, "STORED", sql.NullFloat64{}, sql.NullFloat64{}},
+	} {
+		_, err := tx.Exec(`
+			INSERT INTO packet_receptions (
+				received_at, spacecraft_id, apid, seq_count, onboard_time, station, quality, outcome, rssi_dbm, snr_db
+			) VALUES ($1, $2, 1, $3, $1, 'TEST-GS', $4, $5, $6, $7)
+		`, r.at, testSpacecraftID, i, r.quality, r.outcome, r.rssi, r.snr)
+		require.NoError(t, err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO rejected_packets (received_at, station, length, error)
+		VALUES ($1, 'TEST-GS', 3, 'truncated packet')
+	`, start.Add(3*time.Minute))
+	require.NoError(t, err)
+
+	query, args := stationsQuery(start, end, "TEST-GS")
+	s, err := scanGroundStation(tx.QueryRow(query, args...))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/24", *s.Address)
+	require.NotNil(t, s.LastContactAt)
+	assert.True(t, end.Add(time.Hour).Equal(*s.LastContactAt))
+	assert.Equal(t, []int{3, 1, 1, 1}, []int{s.Received, s.Duplicate, s.Corrupt, s.Rejected})
+	assert.Equal(t, 0.5, s.ErrorRate)
+	assert.Equal(t, []float64{-95, 4, 2}, []float64{*s.AvgRSSIDbm, *s.AvgSNRDb, *s.MinSNRDb})
+
+	query, args = stationsQuery(start, end, "TEST-IDLE")
+	s, err = scanGroundStation(tx.QueryRow(query, args...))
+	require.NoError(t, err)
+	assert.Equal(t, "learned", s.Origin)
+	assert.Nil(t, s.LastContactAt)
+	assert.Equal(t, []int{0, 0, 0, 0}, []int{s.Received, s.Duplicate, s.Corrupt, s.Rejected})
+	assert.Nil(t, s.AvgSNRDb)
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// streamBuffer is how many events may queue for one client. A client that
+	// falls further behind is disconnected with an overflow event and is
+	// expected to reconnect with its last event ID.
+	streamBuffer = 256
+
+	// streamReplayLimit caps how many rows of each kind are replayed on
+	// resume. Clients that missed more receive a reset event and should
+	// reload through the REST endpoints.
+	streamReplayLimit = 1000
+
+	// streamCoalesce delays each fetch after a notification so that bursts
+	// are read in one query and derived values stored right after their
+	// telemetry row are included.
+	streamCoalesce = 100 * time.Millisecond
+
+	// streamPollInterval bounds latency when notifications are lost, for
+	// example while the listener reconnects.
+	streamPollInterval = 5 * time.Second
+
+	streamKeepAlive = 15 * time.Second
+)
+
+// Stream event types. Telemetry and anomaly events carry a row; the others
+// tell the client how to recover.
+const (
+	eventTelemetry = "telemetry"
+	eventAnomaly   = "anomaly"
+	eventReset     = "reset"
+	eventOverflow  = "overflow"
+)
+
+var (
+	streamClientsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "telemetry_stream_clients",
+		Help: "Number of connected telemetry stream clients",
+	})
+	streamOverflowCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "telemetry_stream_overflows_total",
+		Help: "Total number of stream clients disconnected for falling behind",
+	})
+)
+
+type StreamEvent struct {
+	ID        string         `json:"id,omitempty"`
+	Type      string         `json:"type"`
+	Telemetry *Telemetry     `json:"telemetry,omitempty"`
+	Anomaly   *Anomaly       `json:"anomaly,omitempty"`
+	Playback  *PlaybackState `json:"playback,omitempty"`
+	Message   string         `json:"message,omitempty"`
+
+	// key is the stream position of the row.
+	key streamKey
+}
+
+// streamKey is the position of a row in the stream. Rows are streamed in the
+// order of stream_xid, the transaction that inserted them, then id. Ids are
+// not enough: a transaction can commit a lower id after a higher one has been
+// streamed. A row is only read once every transaction older than its own has
+// ended, so no row can appear behind a key already sent.
+type streamKey struct {
+	XID int64
+	ID  int
+}
+
+func (k streamKey) after(o streamKey) bool {
+	return k.XID > o.XID || (k.XID == o.XID && k.ID > o.ID)
+}
+
+func (k streamKey) String() string {
+	return fmt.Sprintf("%d.%d", k.XID, k.ID)
+}
+
+func parseStreamKey(s string) (streamKey, bool) {
+	xid, id, ok := strings.Cut(s, ".")
+	if !ok {
+		return streamKey{}, false
+	}
+	x, err1 := strconv.ParseInt(xid, 10, 64)
+	i, err2 := strconv.Atoi(id)
+	if err1 != nil || err2 != nil || x < 0 || i < 0 {
+		return streamKey{}, false
+	}
+	return streamKey{XID: x, ID: i}, true
+}
+
+// streamCursor is the position of a client in the stream: the key of the last
+// telemetry row and anomaly it has been sent. Its string form
+// "<telemetry key>-<anomaly key>" is used as the event ID, so a reconnecting
+// client can resume from Last-Event-ID even after an API restart.
+type streamCursor struct {
+	Telemetry streamKey
+	Anomaly   streamKey
+}
+
+func (c streamCursor) String() string {
+	return c.Telemetry.String() + "-" + c.Anomaly.String()
+}
+
+func parseStreamCursor(s string) (streamCursor, error) {
+	invalid := errors.New("event id must have the form <xid>.<telemetry id>-<xid>.<anomaly id>")
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return streamCursor{}, invalid
+	}
+	t, ok1 := parseStreamKey(parts[0])
+	a, ok2 := parseStreamKey(parts[1])
+	if !ok1 || !ok2 {
+		return streamCursor{}, invalid
+	}
+	return streamCursor{Telemetry: t, Anomaly: a}, nil
+}
+
+// covers reports whether the event has already been sent at this position.
+func (c streamCursor) covers(e StreamEvent) bool {
+	switch {
+	case e.Telemetry != nil:
+		return !e.key.after(c.Telemetry)
+	case e.Anomaly != nil:
+		return !e.key.after(c.Anomaly)
+	}
+	return false
+}
+
+func (c *streamCursor) advance(e StreamEvent) {
+	if e.Telemetry != nil && e.key.after(c.Telemetry) {
+		c.Telemetry = e.key
+	}
+	if e.Anomaly != nil && e.key.after(c.Anomaly) {
+		c.Anomaly = e.key
+	}
+}
+
+// StreamFilter selects the events sent to one client. Parameters filter
+// anomaly events and the derived values of telemetry events; downlinked
+// values are always part of a telemetry row.
+type StreamFilter struct {
+	SpacecraftIDs map[int]bool
+	Parameters    map[string]bool
+	AnomaliesOnly bool
+}
+
+func parseStreamFilter(c *fiber.Ctx) (StreamFilter, error) {
+	var f StreamFilter
+
+	if v := c.Query("spacecraft_id"); v != "" {
+		f.SpacecraftIDs = map[int]bool{}
+		for _, s := range strings.Split(v, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return f, invalidParam("spacecraft_id", "spacecraft_id must be a comma separated list of integers")
+			}
+			f.SpacecraftIDs[id] = true
+		}
+	}
+
+	if v := c.Query("parameter"); v != "" {
+		f.Parameters = map[string]bool{}
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				f.Parameters[s] = true
+			}
+		}
+	}
+
+	if v := c.Query("anomalies_only"); v != "" {
+		only, err := queryBool(c, "anomalies_only")
+		if err != nil {
+			return f, err
+		}
+		f.AnomaliesOnly = *only
+	}
+
+	return f, nil
+}
+
+// apply returns the event as this client should see it, or false if the
+// client is not interested in it.
+func (f StreamFilter) apply(e StreamEvent) (StreamEvent, bool) {
+	switch {
+	case e.Telemetry != nil:
+		if f.AnomaliesOnly || (f.SpacecraftIDs != nil && !f.SpacecraftIDs[e.Telemetry.SpacecraftID]) {
+			return e, false
+		}
+		if f.Parameters != nil && len(e.Telemetry.Derived) > 0 {
+			t := *e.Telemetry
+			t.Derived = map[string]float32{}
+			for name, v := range e.Telemetry.Derived {
+				if f.Parameters[name] {
+					t.Derived[name] = v
+				}
+			}
+			e.Telemetry = &t
+		}
+	case e.Anomaly != nil:
+		if f.SpacecraftIDs != nil && !f.SpacecraftIDs[e.Anomaly.SpacecraftID] {
+			return e, false
+		}
+		if f.Parameters != nil && !f.Parameters[e.Anomaly.ParameterName] {
+			return e, false
+		}
+	}
+	return e, true
+}
+
+type streamSubscriber struct {
+	events chan StreamEvent
+}
+
+// streamHub fans new telemetry and anomaly rows out to connected clients.
+// One goroutine (run) reads the database and publishes; publish never blocks
+// on a client.
+type streamHub struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+	cursor      streamCursor
+}
+
+var streams = newStreamHub()
+
+func newStreamHub() *streamHub {
+	return &streamHub{subscribers: map[*streamSubscriber]struct{}{}}
+}
+
+// subscribe registers a client and returns the position of the last event
+// published before it joined.
+func (h *streamHub) subscribe() (*streamSubscriber, streamCursor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &streamSubscriber{events: make(chan StreamEvent, streamBuffer)}
+	h.subscribers[sub] = struct{}{}
+	streamClientsGauge.Inc()
+	return sub, h.cursor
+}
+
+func (h *streamHub) unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.events)
+		streamClientsGauge.Dec()
+	}
+}
+
+// publish queues the events for every client. A client whose buffer is full
+// is dropped; its channel is closed, which the client reports as overflow.
+func (h *streamHub) publish(events []StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, e := range events {
+		h.cursor.advance(e)
+	}
+
+	for sub := range h.subscribers {
+		for _, e := range events {
+			select {
+			case sub.events <- e:
+				continue
+			default:
+			}
+			delete(h.subscribers, sub)
+			close(sub.events)
+			streamClientsGauge.Dec()
+			streamOverflowCounter.Inc()
+			break
+		}
+	}
+}
+
+// depth returns how many events the furthest behind client has queued.
+func (h *streamHub) depth() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	depth := 0
+	for sub := range h.subscribers {
+		if n := len(sub.events); n > depth {
+			depth = n
+		}
+	}
+	return depth
+}
+
+func (h *streamHub) position() streamCursor {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cursor
+}
+
+// run publishes rows inserted after startup. It wakes on the telemetry_stream
+// notification and on a timer.
+func (h *streamHub) run(connStr string) {
+	var start streamCursor
+	err := db.QueryRow(`SELECT pg_snapshot_xmin(pg_current_snapshot())`).Scan(&start.Telemetry.XID)
+	if err != nil {
+		log.Printf("Stream hub failed to read start position: %v", err)
+	}
+	start.Anomaly.XID = start.Telemetry.XID
+	h.mu.Lock()
+	h.cursor = start
+	h.mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Stream listener: %v", err)
+		}
+	})
+	if err := listener.Listen("telemetry_stream"); err != nil {
+		log.Printf("Stream hub failed to listen, falling back to polling: %v", err)
+	} else {
+		go func() {
+			for range listener.Notify {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wake:
+			time.Sleep(streamCoalesce)
+		case <-ticker.C:
+		}
+
+		for {
+			events, truncated, err := fetchStreamEvents(h.position(), streamReplayLimit)
+			if err != nil {
+				log.Printf("Stream hub failed to fetch events: %v", err)
+				break
+			}
+			if len(events) > 0 {
+				h.publish(events)
+			}
+			if !truncated {
+				break
+			}
+		}
+	}
+}
+
+// fetchStreamEvents returns up to limit telemetry rows and limit anomalies
+// after the cursor, in stream order. Rows of transactions that started
+// after the oldest one still running are left for a later fetch, as that
+// transaction may yet commit rows before them. truncated is set when either
+// kind hit the limit.
+func fetchStreamEvents(after streamCursor, limit int) ([]StreamEvent, bool, error) {
+	var telemetry, anomalies []StreamEvent
+	truncated := false
+
+	rows, err := db.Query(`
+		SELECT t.stream_xid, `+telemetryColumns+`
+		FROM telemetry t
+		WHERE (t.stream_xid, t.id) > ($1::xid8, $2)
+		AND t.stream_xid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY t.stream_xid, t.id
+		LIMIT $3
+	`, after.Telemetry.XID, after.Telemetry.ID, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	n := 0
+	for rows.Next() {
+		var xid int64
+		t, err := scanTelemetry(keyedScanner{rows, &xid})
+		if err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		telemetry = append(telemetry, StreamEvent{Type: eventTelemetry, Telemetry: &t, key: streamKey{xid, t.ID}})
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	truncated = n == limit
+
+	// Reprocessed revisions describe historical data and are not streamed.
+	rows, err = db.Query(`
+		SELECT stream_xid, `+anomalyColumns+`
+		FROM anomaly_history
+		WHERE (stream_xid, id) > ($1::xid8, $2)
+		AND stream_xid < pg_snapshot_xmin(pg_current_snapshot())
+		AND superseded_at IS NULL
+		AND reprocess_job_id IS NULL
+		ORDER BY stream_xid, id
+		LIMIT $3
+	`, after.Anomaly.XID, after.Anomaly.ID, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	n = 0
+	for rows.Next() {
+		var xid int64
+		a, err := scanAnomaly(keyedScanner{rows, &xid})
+		if err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		anomalies = append(anomalies, StreamEvent{Type: eventAnomaly, Anomaly: &a, key: streamKey{xid, a.ID}})
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	truncated = truncated || n == limit
+
+	return mergeStreamEvents(telemetry, anomalies), truncated, nil
+}
+
+// mergeStreamEvents interleaves telemetry rows and anomalies, each already in
+// key order, by stream_xid, telemetry first within a transaction. Every kind
+// stays in key order: the cursor treats a row as sent once a higher key of its
+// kind has been sent, so a row sorted by sample time behind a newer one, such
+// as a late or imported packet, would be lost.
+func mergeStreamEvents(telemetry, anomalies []StreamEvent) []StreamEvent {
+	events := make([]StreamEvent, 0, len(telemetry)+len(anomalies))
+	for len(telemetry) > 0 && len(anomalies) > 0 {
+		if anomalies[0].key.XID < telemetry[0].key.XID {
+			events = append(events, anomalies[0])
+			anomalies = anomalies[1:]
+		} else {
+			events = append(events, telemetry[0])
+			telemetry = telemetry[1:]
+		}
+	}
+	events = append(events, telemetry...)
+	return append(events, anomalies...)
+}
+
+// keyedScanner reads the stream_xid column ahead of the columns of a row.
+type keyedScanner struct {
+	rows *sql.Rows
+	xid  *int64
+}
+
+func (s keyedScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append([]interface{}{s.xid}, dest...)...)
+}
+
+// sortStreamEvents orders events by sample time, telemetry before the
+// anomalies it caused. Only playback uses it; the live stream is sent in key
+// order.
+func sortStreamEvents(events []StreamEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		ti, tj := events[i].timestamp(), events[j].timestamp()
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return events[i].Telemetry != nil && events[j].Telemetry == nil
+	})
+}
+
+func (e StreamEvent) timestamp() time.Time {
+	switch {
+	case e.Telemetry != nil:
+		return e.Telemetry.Timestamp
+	case e.Anomaly != nil:
+		return e.Anomaly.Timestamp
+	}
+	return time.Time{}
+}
+
+// serveStream sends events to one client until send fails or done is closed.
+// If resume is set, rows after it are replayed from the database first.
+func serveStream(filter StreamFilter, resume *streamCursor, done <-chan struct{},
+	send func(StreamEvent) error, keepAlive func() error) error {
+
+	sub, cursor := streams.subscribe()
+	defer streams.unsubscribe(sub)
+
+	emit := func(e StreamEvent) error {
+		if cursor.covers(e) {
+			return nil
+		}
+		cursor.advance(e)
+		e, ok := filter.apply(e)
+		if !ok {
+			return nil
+		}
+		e.ID = cursor.String()
+		return send(e)
+	}
+
+	if resume != nil {
+		live := cursor
+		cursor = *resume
+		replay, truncated, err := fetchStreamEvents(cursor, streamReplayLimit)
+		if err != nil {
+			return err
+		}
+		if truncated {
+			cursor = live
+			if err := send(StreamEvent{ID: cursor.String(), Type: eventReset,
+				Message: "too many events missed; reload through the REST API"}); err != nil {
+				return err
+			}
+		} else {
+			for _, e := range replay {
+				if err := emit(e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return send(StreamEvent{ID: cursor.String(), Type: eventOverflow,
+					Message: "client too slow; reconnect with the last event id"})
+			}
+			if err := emit(e); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := keepAlive(); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// streamResume reads the resume position from the Last-Event-ID header or the
+// last_event_id query parameter.
+func streamResume(c *fiber.Ctx) (*streamCursor, error) {
+	id := c.Get("Last-Event-ID")
+	if id == "" {
+		id = c.Query("last_event_id")
+	}
+	if id == "" {
+		return nil, nil
+	}
+	cursor, err := parseStreamCursor(id)
+	if err != nil {
+		return nil, invalidParam("last_event_id", "%v", err)
+	}
+	return &cursor, nil
+}
+
+func writeSSE(w *bufio.Writer, e StreamEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.ID != "" {
+		fmt.Fprintf(w, "id: %s\n", e.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return w.Flush()
+}
+
+func streamTelemetrySSE(c *fiber.Ctx) error {
+	filter, err := parseStreamFilter(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	resume, err := streamResume(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// A failed flush means the client went away.
+		err := serveStream(filter, resume, nil,
+			func(e StreamEvent) error { return writeSSE(w, e) },
+			func() error {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				return w.Flush()
+			},
+		)
+		if err != nil {
+			log.Printf("Telemetry stream closed: %v", err)
+		}
+	})
+	return nil
+}
+
+func requireWebSocket(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	filter, err := parseStreamFilter(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	resume, err := streamResume(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	c.Locals("stream_filter", filter)
+	c.Locals("stream_resume", resume)
+	return c.Next()
+}
+
+func streamTelemetryWS(conn *websocket.Conn) {
+	filter := conn.Locals("stream_filter").(StreamFilter)
+	resume := conn.Locals("stream_resume").(*streamCursor)
+
+	// The read loop only detects the client closing the connection.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := serveStream(filter, resume, done,
+		func(e StreamEvent) error {
+			conn.SetWriteDeadline(time.Now().Add(streamKeepAlive))
+			return conn.WriteJSON(e)
+		},
+		func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepAlive))
+		},
+	)
+	if err != nil {
+		log.Printf("Telemetry websocket closed: %v", err)
+	}
+}
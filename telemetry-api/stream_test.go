@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func telemetryEvent(id, spacecraft int) StreamEvent {
+	return StreamEvent{Type: eventTelemetry, Telemetry: &Telemetry{
+		ID: id, SpacecraftID: spacecraft, Timestamp: time.Unix(int64(id), 0),
+		Derived: map[string]float32{"battery_health": 80, "thermal_margin": 3},
+	}, key: streamKey{XID: int64(id), ID: id}}
+}
+
+func anomalyEvent(id, spacecraft int, parameter string) StreamEvent {
+	return StreamEvent{Type: eventAnomaly, Anomaly: &Anomaly{
+		ID: id, SpacecraftID: spacecraft, ParameterName: parameter, Timestamp: time.Unix(int64(id), 0),
+	}, key: streamKey{XID: int64(id), ID: id}}
+}
+
+func TestParseStreamCursor(t *testing.T) {
+	c, err := parseStreamCursor("900.120-880.7")
+	require.NoError(t, err)
+	assert.Equal(t, streamCursor{Telemetry: streamKey{900, 120}, Anomaly: streamKey{880, 7}}, c)
+	assert.Equal(t, "900.120-880.7", c.String())
+
+	for _, bad := range []string{"", "12", "120-7", "a.1-1.1", "1.2-3", "1.2-3.4-5.6", "-1.2-3.4", "1.2.3-4.5"} {
+		_, err := parseStreamCursor(bad)
+		assert.Error(t, err, bad)
+	}
+
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/stream", streamTelemetrySSE)
+	requireAPIError(t, app, httptest.NewRequest("GET", "/api/v1/telemetry/stream?last_event_id=12", nil),
+		http.StatusBadRequest, codeInvalidParameter, "last_event_id")
+	req := httptest.NewRequest("GET", "/api/v1/telemetry/stream", nil)
+	req.Header.Set("Last-Event-ID", "120-7")
+	requireAPIError(t, app, req, http.StatusBadRequest, codeInvalidParameter, "last_event_id")
+}
+
+func TestStreamCursorAdvance(t *testing.T) {
+	c := streamCursor{Telemetry: streamKey{10, 10}, Anomaly: streamKey{2, 2}}
+	assert.True(t, c.covers(telemetryEvent(10, 1)))
+	assert.False(t, c.covers(telemetryEvent(11, 1)))
+
+	c.advance(telemetryEvent(11, 1))
+	c.advance(anomalyEvent(1, 1, "battery"))
+	assert.Equal(t, streamCursor{Telemetry: streamKey{11, 11}, Anomaly: streamKey{2, 2}}, c)
+}
+
+func TestStreamCursorKeepsRowsCommittedOutOfIDOrder(t *testing.T) {
+	// Transaction 101 inserted row 6 and committed while transaction 102,
+	// which had already drawn id 5, was still running.
+	c := streamCursor{}
+	c.advance(StreamEvent{Telemetry: &Telemetry{ID: 6}, key: streamKey{101, 6}})
+
+	late := StreamEvent{Telemetry: &Telemetry{ID: 5}, key: streamKey{102, 5}}
+	assert.False(t, c.covers(late), "a lower id from a later transaction must still be sent")
+	c.advance(late)
+	assert.Equal(t, streamKey{102, 5}, c.Telemetry)
+	assert.True(t, c.covers(StreamEvent{Telemetry: &Telemetry{ID: 6}, key: streamKey{101, 6}}))
+}
+
+func TestStreamFilterApply(t *testing.T) {
+	f := StreamFilter{SpacecraftIDs: map[int]bool{2: true}, Parameters: map[string]bool{"battery": true, "battery_health": true}}
+
+	_, ok := f.apply(telemetryEvent(1, 1))
+	assert.False(t, ok)
+
+	e, ok := f.apply(telemetryEvent(1, 2))
+	require.True(t, ok)
+	assert.Equal(t, map[string]float32{"battery_health": 80}, e.Telemetry.Derived)
+
+	_, ok = f.apply(anomalyEvent(1, 2, "temperature"))
+	assert.False(t, ok)
+	_, ok = f.apply(anomalyEvent(1, 2, "battery"))
+	assert.True(t, ok)
+
+	f = StreamFilter{AnomaliesOnly: true}
+	_, ok = f.apply(telemetryEvent(1, 1))
+	assert.False(t, ok)
+	_, ok = f.apply(anomalyEvent(1, 1, "battery"))
+	assert.True(t, ok)
+	app := fiber.New()
+	app.Get("/api/v1/telemetry/stream", streamTelemetrySSE)
+	app.Use("/api/v1/telemetry/ws", requireWebSocket)
+	for query, field := range map[string]string{
+		"spacecraft_id=abc":    "spacecraft_id",
+		"spacecraft_id=1,,2":   "spacecraft_id",
+		"anomalies_only=maybe": "anomalies_only",
+	} {
+		requireAPIError(t, app, httptest.NewRequest("GET", "/api/v1/telemetry/stream?"+query, nil),
+			http.StatusBadRequest, codeInvalidParameter, field)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/telemetry/ws", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+}
+
+func TestStreamHubDropsSlowSubscribers(t *testing.T) {
+	hub := newStreamHub()
+	slow, _ := hub.subscribe()
+	fast, _ := hub.subscribe()
+
+	for i := 1; i <= streamBuffer+1; i++ {
+		hub.publish([]StreamEvent{telemetryEvent(i, 1)})
+		if i <= streamBuffer {
+			<-fast.events
+		}
+	}
+	<-fast.events
+
+	drained := 0
+	for range slow.events {
+		drained++
+	}
+	assert.Equal(t, streamBuffer, drained, "slow subscriber channel should be closed after its buffer")
+	assert.Equal(t, streamCursor{Telemetry: streamKey{streamBuffer + 1, streamBuffer + 1}}, hub.position())
+
+	hub.publish([]StreamEvent{telemetryEvent(streamBuffer+2, 1)})
+	assert.Equal(t, streamBuffer+2, (<-fast.events).Telemetry.ID)
+}
+
+func TestServeStreamSendsLiveEvents(t *testing.T) {
+	saved := streams
+	streams = newStreamHub()
+	defer func() { streams = saved }()
+
+	sent := make(chan StreamEvent, 10)
+	done := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- serveStream(StreamFilter{AnomaliesOnly: true}, nil, done,
+			func(e StreamEvent) error { sent <- e; return nil },
+			func() error { return nil },
+		)
+	}()
+
+	require.Eventually(t, func() bool {
+		streams.mu.Lock()
+		defer streams.mu.Unlock()
+		return len(streams.subscribers) == 1
+	}, time.Second, time.Millisecond)
+
+	streams.publish([]StreamEvent{telemetryEvent(5, 1), anomalyEvent(3, 1, "battery")})
+
+	e := <-sent
+	assert.Equal(t, eventAnomaly, e.Type)
+	assert.Equal(t, "5.5-3.3", e.ID, "event id covers the skipped telemetry row")
+
+	close(done)
+	assert.NoError(t, <-finished)
+}
+
+func TestFetchStreamEventsWaitsForEarlierTransactions(t *testing.T) {
+	withTestDB(t)
+
+	var start streamCursor
+	require.NoError(t, db.QueryRow(`SELECT pg_snapshot_xmin(pg_current_snapshot())`).Scan(&start.Telemetry.XID))
+	streamed := func() []int {
+		events, _, err := fetchStreamEvents(start, streamReplayLimit)
+		require.NoError(t, err)
+		ids := []int{}
+		for _, e := range events {
+			if e.Telemetry != nil && e.Telemetry.SpacecraftID == testSpacecraftID {
+				ids = append(ids, e.Telemetry.ID)
+			}
+		}
+		return ids
+	}
+
+	ts := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	early, err := db.Begin()
+	require.NoError(t, err)
+	defer early.Rollback()
+	earlyID := insertTestTelemetry(t, early, ts, 25)
+
+	later, err := db.Begin()
+	require.NoError(t, err)
+	laterID := insertTestTelemetry(t, later, ts.Add(time.Second), 25)
+	require.NoError(t, later.Commit())
+
+	assert.Empty(t, streamed(), "rows committed while an earlier transaction is open are held back")
+
+	require.NoError(t, early.Commit())
+	assert.Equal(t, []int{earlyID, laterID}, streamed())
+}
+
+func TestServeStreamSendsLateRowsInTheSameBatch(t *testing.T) {
+	saved := streams
+	streams = newStreamHub()
+	defer func() { streams = saved }()
+
+	sent := make(chan StreamEvent, 10)
+	done := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- serveStream(StreamFilter{}, nil, done,
+			func(e StreamEvent) error { sent <- e; return nil },
+			func() error { return nil },
+		)
+	}()
+
+	require.Eventually(t, func() bool {
+		streams.mu.Lock()
+		defer streams.mu.Unlock()
+		return len(streams.subscribers) == 1
+	}, time.Second, time.Millisecond)
+
+	// Row 12 is a late packet: stored after rows 10 and 11 but sampled an
+	// hour before them.
+	newer := telemetryEvent(10, 1)
+	late := telemetryEvent(12, 1)
+	late.Telemetry.Timestamp = newer.Telemetry.Timestamp.Add(-time.Hour)
+	streams.publish(mergeStreamEvents(
+		[]StreamEvent{newer, telemetryEvent(11, 1), late},
+		[]StreamEvent{anomalyEvent(11, 1, "battery")},
+	))
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, (<-sent).ID)
+	}
+	assert.Equal(t, []string{"10.10-0.0", "11.11-0.0", "11.11-11.11", "12.12-11.11"}, ids)
+
+	close(done)
+	assert.NoError(t, <-finished)
+}
+
+func TestFetchStreamEventsKeepsLateRowsInKeyOrder(t *testing.T) {
+	withTestDB(t)
+
+	var start streamCursor
+	require.NoError(t, db.QueryRow(`SELECT pg_snapshot_xmin(pg_current_snapshot())`).Scan(&start.Telemetry.XID))
+	start.Anomaly.XID = start.Telemetry.XID
+
+	ts := time.Date(2001, 1, 1, 12, 0, 0, 0, time.UTC)
+	newerID := insertTestTelemetry(t, db, ts, 25)
+	lateID := insertTestTelemetry(t, db, ts.Add(-time.Hour), 25)
+
+	var sent []int
+	err := serveStream(StreamFilter{SpacecraftIDs: map[int]bool{testSpacecraftID: true}}, &start, closedChan(),
+		func(e StreamEvent) error {
+			if e.Telemetry != nil {
+				sent = append(sent, e.Telemetry.ID)
+			}
+			return nil
+		},
+		func() error { return nil },
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []int{newerID, lateID}, sent, "a late row is resumed after the rows stored before it")
+}
+
+func closedChan() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
@@ -98,7 +98,7 @@ const useRealTimeData = (fetchFn, interval = 5000) => {
 
 
 const getStatusClass = (s) =>
-  ({ NORMAL: "status-normal", WARNING: "status-warning", ANOMALY: "status-anomaly" }[s] || "");
+  ({ NORMAL: "status-normal", WARNING: "status-warning", ANOMALY: "status-anomaly", LOS: "status-los", STALE: "status-warning" }[s] || "");
 
 const getMetricClass = (v, min, max) =>
   v < min || v > max
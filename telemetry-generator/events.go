@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The generator reports onboard events on EVENT_APID alongside telemetry:
+// heaters switching every heaterPeriod packets, and limits crossed by the
+// generated telemetry. Event IDs are those of the event dictionary in
+// db/init.sql. EVENTS=false turns them off.
+
+const (
+	EVENT_HEATER_ON         = 1
+	EVENT_HEATER_OFF        = 2
+	EVENT_SAFE_MODE_ENTERED = 3
+	EVENT_SAFE_MODE_EXITED  = 4
+	EVENT_OVERTEMPERATURE   = 5
+	EVENT_LOW_SIGNAL        = 6
+)
+
+// Event severities as sent.
+const (
+	SEVERITY_INFO   = 1
+	SEVERITY_LOW    = 2
+	SEVERITY_MEDIUM = 3
+	SEVERITY_HIGH   = 4
+)
+
+// Subsystems events are reported by.
+const (
+	SUBSYSTEM_THERMAL = 0x0002
+	SUBSYSTEM_POWER   = 0x0003
+	SUBSYSTEM_COMMS   = 0x0004
+)
+
+const (
+	heaterPeriod        = 30
+	temperatureLimit    = 35
+	safeModeBattery     = 25
+	safeModeExitBattery = 50
+	lowSignalLimit      = -80
+)
+
+var (
+	eventAPID     uint16 = 0x02
+	eventsEnabled        = true
+)
+
+func loadEventConfig() error {
+	if v := os.Getenv("EVENT_APID"); v != "" {
+		apid, err := strconv.ParseUint(v, 0, 11)
+		if err != nil || apid == APID {
+			return fmt.Errorf("invalid EVENT_APID: %q", v)
+		}
+		eventAPID = uint16(apid)
+	}
+	if v := os.Getenv("EVENTS"); v != "" {
+		eventsEnabled = v != "false"
+	}
+	return nil
+}
+
+// generatedEvent is an event to send. Arguments fill the {n} placeholders of
+// the dictionary message.
+type generatedEvent struct {
+	Subsystem uint16
+	EventID   uint16
+	Severity  uint8
+	Arguments []float32
+}
+
+// eventSource tracks the onboard state that events report changes of.
+type eventSource struct {
+	seqCount uint16
+	heaterOn [2]bool
+	safeMode bool
+}
+
+// eventsFor returns the events that accompany the telemetry packet with the
+// sequence count.
+func (s *eventSource) eventsFor(count uint16, p TelemetryPayload) []generatedEvent {
+	var events []generatedEvent
+
+	if count%heaterPeriod == 0 {
+		heater := (count / heaterPeriod) % 2
+		s.heaterOn[heater] = !s.heaterOn[heater]
+		id := uint16(EVENT_HEATER_OFF)
+		if s.heaterOn[heater] {
+			id = EVENT_HEATER_ON
+		}
+		events = append(events, generatedEvent{SUBSYSTEM_THERMAL, id, SEVERITY_INFO, []float32{float32(heater + 1)}})
+	}
+
+	if p.Temperature > temperatureLimit {
+		events = append(events, generatedEvent{SUBSYSTEM_THERMAL, EVENT_OVERTEMPERATURE, SEVERITY_MEDIUM,
+			[]float32{p.Temperature, temperatureLimit}})
+	}
+
+	if !s.safeMode && p.Battery < safeModeBattery {
+		s.safeMode = true
+		events = append(events, generatedEvent{SUBSYSTEM_POWER, EVENT_SAFE_MODE_ENTERED, SEVERITY_HIGH,
+			[]float32{p.Battery}})
+	} else if s.safeMode && p.Battery >= safeModeExitBattery {
+		s.safeMode = false
+		events = append(events, generatedEvent{SUBSYSTEM_POWER, EVENT_SAFE_MODE_EXITED, SEVERITY_INFO, nil})
+	}
+
+	if p.Signal < lowSignalLimit {
+		events = append(events, generatedEvent{SUBSYSTEM_COMMS, EVENT_LOW_SIGNAL, SEVERITY_LOW,
+			[]float32{p.Signal}})
+	}
+
+	return events
+}
+
+// createEventPacket builds an event packet: the secondary header, event ID,
+// severity, argument count and float32 arguments, and packet error control.
+func (s *eventSource) createEventPacket(e generatedEvent, t time.Time) []byte {
+	buf := new(bytes.Buffer)
+
+	timeField, _ := timeCode.encode(t)
+	dataLength := len(timeField) + 2 + 2 + 1 + 1 + 4*len(e.Arguments) + PEC_SIZE
+
+	binary.Write(buf, binary.BigEndian, CCSDSPrimaryHeader{
+		PacketID: uint16(PACKET_VERSION)<<13 |
+			uint16(PACKET_TYPE)<<12 |
+			uint16(SEC_HDR_FLAG)<<11 |
+			eventAPID,
+		PacketSeqCtrl: uint16(SEQ_FLAGS)<<14 | (s.seqCount & 0x3FFF),
+		PacketLength:  uint16(dataLength - 1),
+	})
+	s.seqCount++
+
+	buf.Write(timeField)
+	binary.Write(buf, binary.BigEndian, e.Subsystem)
+	binary.Write(buf, binary.BigEndian, e.EventID)
+	buf.WriteByte(e.Severity)
+	buf.WriteByte(uint8(len(e.Arguments)))
+	binary.Write(buf, binary.BigEndian, e.Arguments)
+	binary.Write(buf, binary.BigEndian, crc16(buf.Bytes()))
+
+	return buf.Bytes()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestEventsFor(t *testing.T) {
+	s := &eventSource{}
+	normal := TelemetryPayload{Temperature: 25, Battery: 80, Altitude: 520, Signal: -50}
+
+	events := s.eventsFor(0, normal)
+	if len(events) != 1 || events[0].EventID != EVENT_HEATER_ON || events[0].Arguments[0] != 1 {
+		t.Fatalf("packet 0: %+v", events)
+	}
+	if events := s.eventsFor(heaterPeriod, normal); len(events) != 1 || events[0].Arguments[0] != 2 {
+		t.Fatalf("packet %d: %+v", heaterPeriod, events)
+	}
+	if events := s.eventsFor(2*heaterPeriod, normal); len(events) != 1 || events[0].EventID != EVENT_HEATER_OFF {
+		t.Fatalf("packet %d: %+v", 2*heaterPeriod, events)
+	}
+	if events := s.eventsFor(1, normal); len(events) != 0 {
+		t.Errorf("nominal packet: %+v", events)
+	}
+
+	low := normal
+	low.Battery = 22
+	events = s.eventsFor(1, low)
+	if len(events) != 1 || events[0].EventID != EVENT_SAFE_MODE_ENTERED || events[0].Severity != SEVERITY_HIGH {
+		t.Fatalf("low battery: %+v", events)
+	}
+	if events := s.eventsFor(2, low); len(events) != 0 {
+		t.Errorf("safe mode reported again: %+v", events)
+	}
+	if events := s.eventsFor(3, normal); len(events) != 1 || events[0].EventID != EVENT_SAFE_MODE_EXITED {
+		t.Errorf("battery recovered: %+v", events)
+	}
+
+	hot := normal
+	hot.Temperature = 37
+	hot.Signal = -85
+	events = s.eventsFor(4, hot)
+	if len(events) != 2 || events[0].EventID != EVENT_OVERTEMPERATURE || events[1].EventID != EVENT_LOW_SIGNAL {
+		t.Errorf("hot and faint: %+v", events)
+	}
+}
+
+func TestCreateEventPacket(t *testing.T) {
+	s := &eventSource{seqCount: 7}
+	packet := s.createEventPacket(generatedEvent{SUBSYSTEM_THERMAL, EVENT_OVERTEMPERATURE, SEVERITY_MEDIUM,
+		[]float32{37, 35}}, time.Now())
+
+	buf := bytes.NewReader(packet)
+	var primary CCSDSPrimaryHeader
+	var body struct {
+		PField      uint8
+		Coarse      uint32
+		Fine        [3]byte
+		SubsystemID uint16
+		EventID     uint16
+		Severity    uint8
+		Count       uint8
+		Arguments   [2]float32
+	}
+	if err := binary.Read(buf, binary.BigEndian, &primary); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Read(buf, binary.BigEndian, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if primary.PacketID&0x7FF != eventAPID || primary.PacketSeqCtrl&0x3FFF != 7 || s.seqCount != 8 {
+		t.Errorf("primary header %+v", primary)
+	}
+	if body.SubsystemID != SUBSYSTEM_THERMAL || body.EventID != EVENT_OVERTEMPERATURE ||
+		body.Severity != SEVERITY_MEDIUM || body.Count != 2 || body.Arguments != [2]float32{37, 35} {
+		t.Errorf("event %+v", body)
+	}
+	if int(primary.PacketLength)+7 != len(packet) {
+		t.Errorf("PacketLength %d does not match packet of %d bytes", primary.PacketLength, len(packet))
+	}
+	if crc16(packet[:len(packet)-2]) != binary.BigEndian.Uint16(packet[len(packet)-2:]) {
+		t.Error("Packet error control does not match")
+	}
+}
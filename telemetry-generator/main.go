@@ -17,6 +17,8 @@ type CCSDSPrimaryHeader struct {
 }
 
 
+// CCSDSSecondaryHeader is the original secondary header layout, sent with
+// TIME_CODE=unix. Otherwise the time code replaces Timestamp.
 type CCSDSSecondaryHeader struct {
 	Timestamp    uint64 
 	SubsystemID  uint16 
@@ -37,12 +39,20 @@ const (
 	SEC_HDR_FLAG   = 0x1 
 	SEQ_FLAGS      = 0x3 
 	SUBSYSTEM_ID   = 0x0001 
+	PEC_SIZE       = 2
 )
 
 func main() {
 
 	rand.Seed(time.Now().UnixNano())
 
+	if err := loadTimeCodeConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadEventConfig(); err != nil {
+		log.Fatal(err)
+	}
+
 
 	conn, err := net.Dial("udp", "telemetry-ingestion:8090")
 	if err != nil {
@@ -53,8 +63,10 @@ func main() {
 	log.Println("Telemetry generator started. Sending packets to telemetry-ingestion:8090")
 
 	packetCount := uint16(0)
+	events := &eventSource{}
 	for {
-		data := createTelemetryPacket(&packetCount)
+		payload := generateTelemetryPayload(packetCount%5 == 0)
+		data := createTelemetryPacket(&packetCount, payload)
 		_, err := conn.Write(data)
 		if err != nil {
 			log.Printf("Error sending telemetry: %v", err)
@@ -68,12 +80,22 @@ func main() {
 			log.Printf("Sent normal telemetry packet #%d", packetCount)
 		}
 
+		if eventsEnabled {
+			for _, e := range events.eventsFor(packetCount, payload) {
+				if _, err := conn.Write(events.createEventPacket(e, time.Now())); err != nil {
+					log.Printf("Error sending event: %v", err)
+					continue
+				}
+				log.Printf("Sent event %d from subsystem %d", e.EventID, e.Subsystem)
+			}
+		}
+
 		time.Sleep(1 * time.Second)
 		packetCount++
 	}
 }
 
-func createTelemetryPacket(seqCount *uint16) []byte {
+func createTelemetryPacket(seqCount *uint16, payload TelemetryPayload) []byte {
 	buf := new(bytes.Buffer)
 
 
@@ -86,11 +108,10 @@ func createTelemetryPacket(seqCount *uint16) []byte {
 	packetSeqCtrl := uint16(SEQ_FLAGS)<<14 | (*seqCount & 0x3FFF)
 
 
-	payload := generateTelemetryPayload(*seqCount%5 == 0)
+	timeField, _ := timeCode.encode(time.Now())
 
-
-	packetDataLength := uint16(binary.Size(CCSDSSecondaryHeader{}) +
-		binary.Size(TelemetryPayload{}) - 1)
+	packetDataLength := uint16(len(timeField) + binary.Size(uint16(SUBSYSTEM_ID)) +
+		binary.Size(TelemetryPayload{}) + PEC_SIZE - 1)
 
 	primaryHeader := CCSDSPrimaryHeader{
 		PacketID:      packetID,
@@ -99,19 +120,33 @@ func createTelemetryPacket(seqCount *uint16) []byte {
 	}
 
 
-	secondaryHeader := CCSDSSecondaryHeader{
-		Timestamp:   uint64(time.Now().Unix()),
-		SubsystemID: SUBSYSTEM_ID,
-	}
-
-
 	binary.Write(buf, binary.BigEndian, primaryHeader) 
-	binary.Write(buf, binary.BigEndian, secondaryHeader)
+	buf.Write(timeField)
+	binary.Write(buf, binary.BigEndian, uint16(SUBSYSTEM_ID))
 	binary.Write(buf, binary.BigEndian, payload)
 
+	// Packet error control lets ingestion tell a corrupted copy from a good one.
+	binary.Write(buf, binary.BigEndian, crc16(buf.Bytes()))
+
 	return buf.Bytes()
 }
 
+// crc16 is the CRC-16-CCITT used for CCSDS packet error control.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
 func generateTelemetryPayload(generateAnomaly bool) TelemetryPayload {
 	if generateAnomaly {
 
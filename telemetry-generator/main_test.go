@@ -47,7 +47,7 @@ func TestGenerateTelemetryPayload_Anomaly(t *testing.T) {
 
 func TestCreateTelemetryPacket(t *testing.T) {
 	seq := uint16(42)
-	packet := createTelemetryPacket(&seq)
+	packet := createTelemetryPacket(&seq, generateTelemetryPayload(false))
 	if len(packet) == 0 {
 		t.Fatal("Packet is empty")
 	}
@@ -55,7 +55,12 @@ func TestCreateTelemetryPacket(t *testing.T) {
 
 	buf := bytes.NewReader(packet)
 	var primary CCSDSPrimaryHeader
-	var secondary CCSDSSecondaryHeader
+	var secondary struct {
+		PField      uint8
+		Coarse      uint32
+		Fine        [3]byte
+		SubsystemID uint16
+	}
 	var payload TelemetryPayload
 	if err := binary.Read(buf, binary.BigEndian, &primary); err != nil {
 		t.Fatalf("Failed to decode primary header: %v", err)
@@ -70,7 +75,18 @@ func TestCreateTelemetryPacket(t *testing.T) {
 	if primary.PacketID == 0 {
 		t.Error("PacketID should not be zero")
 	}
+	if secondary.PField != 0x1F {
+		t.Errorf("P-field %#02x, want the default CUC 0x1f", secondary.PField)
+	}
 	if secondary.SubsystemID == 0 {
 		t.Error("SubsystemID should not be zero")
 	}
+
+	if int(primary.PacketLength)+7 != len(packet) {
+		t.Errorf("PacketLength %d does not match packet of %d bytes", primary.PacketLength, len(packet))
+	}
+	pec := binary.BigEndian.Uint16(packet[len(packet)-2:])
+	if crc16(packet[:len(packet)-2]) != pec {
+		t.Error("Packet error control does not match")
+	}
 }
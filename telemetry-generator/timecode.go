@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Packets carry their onboard time as a CCSDS time code (CCSDS 301.0-B-4) at
+// the start of the secondary header. TIME_CODE is the P-field describing it,
+// in hex, or "unix" for the original 64-bit Unix seconds. The default, 1F, is
+// CUC level 1: four octets of TAI seconds since 1958 and three of fraction.
+// With TIME_CODE_EXPLICIT=false the P-field is left out and ingestion must be
+// configured with the same TIME_CODE. TIME_CODE_EPOCH is the agency epoch of
+// CUC level 2 and CDS codes.
+
+// timeCodeFormat is how packet times are encoded.
+type timeCodeFormat struct {
+	pField   []byte
+	explicit bool
+	legacy   bool
+	epoch    time.Time
+}
+
+var timeCode = timeCodeFormat{
+	pField:   []byte{0x1F},
+	explicit: true,
+	epoch:    time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// ccsdsEpoch is the CCSDS recommended epoch, 1958-01-01 TAI.
+var ccsdsEpoch = time.Date(1958, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func loadTimeCodeConfig() error {
+	if v := os.Getenv("TIME_CODE"); strings.EqualFold(v, "unix") {
+		timeCode.legacy = true
+	} else if v != "" {
+		p, err := hex.DecodeString(v)
+		if err != nil || len(p) == 0 {
+			return fmt.Errorf("invalid TIME_CODE: %q", v)
+		}
+		timeCode.pField = p
+	}
+	if v := os.Getenv("TIME_CODE_EXPLICIT"); v != "" {
+		timeCode.explicit = v != "false"
+	}
+	if v := os.Getenv("TIME_CODE_EPOCH"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("invalid TIME_CODE_EPOCH: %v", err)
+		}
+		timeCode.epoch = t.UTC()
+	}
+	if _, err := timeCode.encode(time.Now()); err != nil {
+		return fmt.Errorf("invalid TIME_CODE: %v", err)
+	}
+	return nil
+}
+
+// encode returns the time code for t, with its P-field if explicit.
+func (f timeCodeFormat) encode(t time.Time) ([]byte, error) {
+	if f.legacy {
+		return binary.BigEndian.AppendUint64(nil, uint64(t.Unix())), nil
+	}
+	var out []byte
+	if f.explicit {
+		out = append(out, f.pField...)
+	}
+
+	p := f.pField[0]
+	switch id := p >> 4 & 0x7; id {
+	case 0x1, 0x2:
+		coarse, fine := int(p>>2&0x3)+1, int(p&0x3)
+		if p&0x80 != 0 && len(f.pField) > 1 {
+			coarse += int(f.pField[1] >> 5 & 0x3)
+			fine += int(f.pField[1] >> 2 & 0x7)
+		}
+		var since time.Duration
+		if id == 0x1 {
+			since = t.Sub(ccsdsEpoch) + taiOffset(t)
+		} else {
+			since = t.Sub(f.epoch)
+		}
+		seconds := uint64(since / time.Second)
+		frac := uint64(since % time.Second)
+		out = appendUintN(out, seconds, coarse)
+		for i := 0; i < fine; i++ {
+			frac *= 256
+			out = append(out, byte(frac/uint64(time.Second)))
+			frac %= uint64(time.Second)
+		}
+		return out, nil
+	case 0x4:
+		epoch := ccsdsEpoch
+		if p&0x08 != 0 {
+			epoch = f.epoch
+		}
+		days := 2
+		if p&0x04 != 0 {
+			days = 3
+		}
+		since := t.Sub(epoch)
+		ofDay := since % (24 * time.Hour)
+		out = appendUintN(out, uint64(since/(24*time.Hour)), days)
+		out = binary.BigEndian.AppendUint32(out, uint32(ofDay/time.Millisecond))
+		switch p & 0x3 {
+		case 1:
+			out = binary.BigEndian.AppendUint16(out, uint16(ofDay%time.Millisecond/time.Microsecond))
+		case 2:
+			out = binary.BigEndian.AppendUint32(out, uint32(ofDay%time.Millisecond)*1000)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported time code ID %03b", id)
+	}
+}
+
+// appendUintN appends the low n octets of v, big-endian.
+func appendUintN(b []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+// leapSeconds lists when TAI-UTC changed, from 10 s at the start of 1972.
+var leapSeconds = []struct {
+	utc    time.Time
+	offset time.Duration
+}{
+	{time.Date(1972, 7, 1, 0, 0, 0, 0, time.UTC), 11 * time.Second},
+	{time.Date(1973, 1, 1, 0, 0, 0, 0, time.UTC), 12 * time.Second},
+	{time.Date(1974, 1, 1, 0, 0, 0, 0, time.UTC), 13 * time.Second},
+	{time.Date(1975, 1, 1, 0, 0, 0, 0, time.UTC), 14 * time.Second},
+	{time.Date(1976, 1, 1, 0, 0, 0, 0, time.UTC), 15 * time.Second},
+	{time.Date(1977, 1, 1, 0, 0, 0, 0, time.UTC), 16 * time.Second},
+	{time.Date(1978, 1, 1, 0, 0, 0, 0, time.UTC), 17 * time.Second},
+	{time.Date(1979, 1, 1, 0, 0, 0, 0, time.UTC), 18 * time.Second},
+	{time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), 19 * time.Second},
+	{time.Date(1981, 7, 1, 0, 0, 0, 0, time.UTC), 20 * time.Second},
+	{time.Date(1982, 7, 1, 0, 0, 0, 0, time.UTC), 21 * time.Second},
+	{time.Date(1983, 7, 1, 0, 0, 0, 0, time.UTC), 22 * time.Second},
+	{time.Date(1985, 7, 1, 0, 0, 0, 0, time.UTC), 23 * time.Second},
+	{time.Date(1988, 1, 1, 0, 0, 0, 0, time.UTC), 24 * time.Second},
+	{time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC), 25 * time.Second},
+	{time.Date(1991, 1, 1, 0, 0, 0, 0, time.UTC), 26 * time.Second},
+	{time.Date(1992, 7, 1, 0, 0, 0, 0, time.UTC), 27 * time.Second},
+	{time.Date(1993, 7, 1, 0, 0, 0, 0, time.UTC), 28 * time.Second},
+	{time.Date(1994, 7, 1, 0, 0, 0, 0, time.UTC), 29 * time.Second},
+	{time.Date(1996, 1, 1, 0, 0, 0, 0, time.UTC), 30 * time.Second},
+	{time.Date(1997, 7, 1, 0, 0, 0, 0, time.UTC), 31 * time.Second},
+	{time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC), 32 * time.Second},
+	{time.Date(2006, 1, 1, 0, 0, 0, 0, time.UTC), 33 * time.Second},
+	{time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC), 34 * time.Second},
+	{time.Date(2012, 7, 1, 0, 0, 0, 0, time.UTC), 35 * time.Second},
+	{time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC), 36 * time.Second},
+	{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), 37 * time.Second},
+}
+
+// taiOffset is TAI-UTC at t.
+func taiOffset(t time.Time) time.Duration {
+	offset := 10 * time.Second
+	for _, l := range leapSeconds {
+		if t.Before(l.utc) {
+			break
+		}
+		offset = l.offset
+	}
+	return offset
+}
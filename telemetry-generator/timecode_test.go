@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEncodeTimeCode(t *testing.T) {
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	newYear := time.Date(2020, 1, 1, 0, 0, 0, 500000000, time.UTC)
+	tests := []struct {
+		name   string
+		format timeCodeFormat
+		at     time.Time
+		want   []byte
+	}{
+		// 2020-01-01 is 1956528000 s after 1958-01-01 and TAI-UTC was 37 s.
+		{"CUC level 1", timeCodeFormat{pField: []byte{0x1E}, explicit: true}, newYear,
+			[]byte{0x1E, 0x74, 0x9E, 0x3F, 0xA5, 0x80, 0x00}},
+		{"CUC implicit", timeCodeFormat{pField: []byte{0x1E}}, newYear,
+			[]byte{0x74, 0x9E, 0x3F, 0xA5, 0x80, 0x00}},
+		{"CUC before leap second", timeCodeFormat{pField: []byte{0x1C}},
+			time.Date(2016, 12, 31, 23, 59, 59, 0, time.UTC), []byte{0x6E, 0xFA, 0xA5, 0x23}},
+		{"CUC level 2", timeCodeFormat{pField: []byte{0x2D}, explicit: true, epoch: epoch},
+			time.Date(2000, 1, 1, 1, 0, 0, 750000000, time.UTC), []byte{0x2D, 0x00, 0x00, 0x0E, 0x10, 0xC0}},
+		{"CDS microseconds", timeCodeFormat{pField: []byte{0x41}, explicit: true},
+			time.Date(2020, 1, 1, 1, 2, 3, 4005000, time.UTC),
+			[]byte{0x41, 0x58, 0x75, 0x00, 0x38, 0xCE, 0xFC, 0x00, 0x05}},
+		{"CDS agency epoch", timeCodeFormat{pField: []byte{0x48}, explicit: true, epoch: epoch},
+			time.Date(2000, 1, 2, 0, 0, 1, 0, time.UTC), []byte{0x48, 0x00, 0x01, 0x00, 0x00, 0x03, 0xE8}},
+		{"Unix seconds", timeCodeFormat{legacy: true}, newYear,
+			[]byte{0, 0, 0, 0, 0x5E, 0x0B, 0xE1, 0x00}},
+	}
+	for _, tt := range tests {
+		got, err := tt.format.encode(tt.at)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := (timeCodeFormat{pField: []byte{0x50}}).encode(newYear); err == nil {
+		t.Error("unsupported time code encoded without error")
+	}
+}
+
+func TestLoadTimeCodeConfig(t *testing.T) {
+	defer func(saved timeCodeFormat) { timeCode = saved }(timeCode)
+
+	t.Setenv("TIME_CODE", "41")
+	t.Setenv("TIME_CODE_EXPLICIT", "false")
+	if err := loadTimeCodeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := timeCode.encode(time.Now()); len(got) != 8 {
+		t.Errorf("implicit CDS time code of %d octets, want 8", len(got))
+	}
+
+	t.Setenv("TIME_CODE", "50")
+	if err := loadTimeCodeConfig(); err == nil {
+		t.Error("unsupported TIME_CODE accepted")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Clock correlation samples pair the onboard time of a stored packet with the
+// ground time it was sent at, its earth-received time less the one-way light
+// time. telemetry-api fits them to the spacecraft clock's offset and drift.
+// Corrupt copies are not sampled, and a spacecraft is sampled at most once per
+// clockSampleInterval of onboard time.
+
+// speedOfLight is in km/s.
+const speedOfLight = 299792.458
+
+var clockSampleInterval = 10 * time.Second
+
+func loadClockSampleInterval() {
+	if v := os.Getenv("CLOCK_SAMPLE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatal("Invalid CLOCK_SAMPLE_INTERVAL:", v)
+		}
+		clockSampleInterval = d
+	}
+}
+
+// lightTime is the one-way light time to a spacecraft at the altitude, in
+// km. The slant range is not known, so this is the time from directly
+// overhead, the least it can be.
+func lightTime(altitude float32) time.Duration {
+	if altitude <= 0 {
+		return 0
+	}
+	return time.Duration(float64(altitude) / speedOfLight * float64(time.Second))
+}
+
+// clockSamples holds the onboard time each spacecraft was last sampled at.
+var clockSamples = struct {
+	sync.Mutex
+	last map[int]time.Time
+}{last: map[int]time.Time{}}
+
+// sampleDue reports whether a packet with the onboard time is due to be
+// sampled, and if so records it. Onboard times earlier than the last sample,
+// as after an onboard clock reset, restart sampling.
+func sampleDue(spacecraftID int, onboard time.Time) bool {
+	clockSamples.Lock()
+	defer clockSamples.Unlock()
+
+	last, ok := clockSamples.last[spacecraftID]
+	if ok && !onboard.Before(last) && onboard.Sub(last) < clockSampleInterval {
+		return false
+	}
+	clockSamples.last[spacecraftID] = onboard
+	return true
+}
+
+// recordClockSample records a correlation sample for a stored copy with an
+// earth-received time, if one is due.
+func recordClockSample(ctx context.Context, tx *sql.Tx, r *Reception, telemetryID int) error {
+	p := r.Packet
+	if r.EarthReceivedAt.IsZero() || p.Time.IsZero() || p.Quality == qualityCorrupt {
+		return nil
+	}
+	if !sampleDue(r.SpacecraftID, p.Time) {
+		return nil
+	}
+
+	light := lightTime(p.Payload.Altitude)
+	offset := r.EarthReceivedAt.Add(-light).Sub(p.Time)
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO clock_samples (
+			spacecraft_id, station, onboard_time, earth_received_at, light_time_seconds, offset_seconds,
+			telemetry_id, telemetry_timestamp, import_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, 0))
+	`, r.SpacecraftID, r.Station, p.Time, r.EarthReceivedAt, light.Seconds(), offset.Seconds(),
+		telemetryID, p.Time, r.ImportID)
+	return err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLightTime(t *testing.T) {
+	if got := lightTime(299.792458); got.Round(time.Microsecond) != time.Millisecond {
+		t.Errorf("lightTime(299.79 km) = %v, want 1ms", got)
+	}
+	if got := lightTime(-5); got != 0 {
+		t.Errorf("lightTime(-5) = %v, want 0", got)
+	}
+}
+
+func TestSampleDue(t *testing.T) {
+	defer func(saved time.Duration) { clockSampleInterval = saved }(clockSampleInterval)
+	clockSampleInterval = 10 * time.Second
+	delete(clockSamples.last, 7)
+	defer delete(clockSamples.last, 7)
+
+	t0 := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	steps := []struct {
+		at   time.Time
+		want bool
+	}{
+		{t0, true},
+		{t0.Add(5 * time.Second), false},
+		{t0.Add(10 * time.Second), true},
+		{t0.Add(12 * time.Second), false},
+		// The onboard clock was reset.
+		{t0.Add(-time.Hour), true},
+		{t0.Add(-time.Hour + time.Second), false},
+	}
+	for i, s := range steps {
+		if got := sampleDue(7, s.at); got != s.want {
+			t.Errorf("step %d: sampleDue = %v, want %v", i, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Redundant ground stations receive the same passes, so a packet can arrive
+// more than once. Packets are identified by their natural key, the
+// spacecraft, APID, sequence count and onboard time, in telemetry_packets.
+// The first copy is stored; a later copy replaces it only if its quality is
+// better, and every copy is recorded in packet_receptions with the station
+// that received it. Copies that fail packet error control are recorded but
+// never stored, as their natural key and values cannot be trusted.
+
+// Copy quality, worst first.
+const (
+	// qualityCorrupt is a copy whose packet error control does not match.
+	// It is discarded.
+	qualityCorrupt = iota
+	// qualityUnchecked is a copy without packet error control.
+	qualityUnchecked
+	// qualityVerified is a copy whose packet error control matches.
+	qualityVerified
+)
+
+const (
+	receptionStored    = "STORED"
+	receptionReplaced  = "REPLACED"
+	receptionDuplicate = "DUPLICATE"
+	receptionDiscarded = "DISCARDED"
+)
+
+// groundStation, if set, names the station of datagrams that neither a
+// station header nor a registered address attributes to another station.
+var groundStation string
+
+var receptionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "satellite_packet_reception_count",
+	Help: "Total number of packet copies received by station and outcome",
+}, []string{"station", "outcome"})
+
+// Reception is one copy of a packet received by a ground station. Live and
+// imported copies alike are stored at the packet's onboard time; ImportID is
+// 0 for live packets. EarthReceivedAt and Link are what the station reported,
+// if anything; SourceIP is the sender of a live datagram. Late is set when
+// the reorder buffer had already passed on a later packet of the APID, by
+// LateBy of onboard time.
+type Reception struct {
+	SpacecraftID    int
+	Station         string
+	ReceivedAt      time.Time
+	EarthReceivedAt time.Time
+	Link            *LinkMetrics
+	SourceIP        net.IP
+	ImportID        int
+	Late            bool
+	LateBy          time.Duration
+	Packet          *Packet
+}
+
+// metadata returns the earth-received time and link metrics for a query, with
+// nil for what is unknown.
+func (r *Reception) metadata() []interface{} {
+	values := []interface{}{nil, nil, nil, nil}
+	if !r.EarthReceivedAt.IsZero() {
+		values[0] = r.EarthReceivedAt
+	}
+	if r.Link != nil {
+		values[1] = r.Link.RSSI
+		values[2] = r.Link.SNR
+		values[3] = int64(r.Link.CorrectedBits)
+	}
+	return values
+}
+
+// storeReception stores a copy of a packet unless a copy of at least the same
+// quality is already stored, or the copy is corrupt. It returns the outcome
+// and, if the copy was stored, the id of the new telemetry row. Derived values
+// are left to the caller. Copies with an earth-received time are also
+// assigned to their station's pass, and stored ones sampled for clock
+// correlation.
+func storeReception(ctx context.Context, r *Reception) (string, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	outcome, id, anomalous := receptionDiscarded, 0, false
+	if r.Packet.Quality != qualityCorrupt {
+		if outcome, id, anomalous, err = storeTelemetry(ctx, tx, r); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := recordReception(ctx, tx, r, outcome, anomalous); err != nil {
+		return "", 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", 0, err
+	}
+	receptionCounter.WithLabelValues(r.Station, strings.ToLower(outcome)).Inc()
+	return outcome, id, nil
+}
+
+// storeTelemetry stores a copy of a packet as telemetry within tx unless a
+// copy of at least the same quality is already stored. It returns the
+// outcome, the id of the new telemetry row and whether the stored copy is
+// anomalous.
+func storeTelemetry(ctx context.Context, tx *sql.Tx, r *Reception) (string, int, bool, error) {
+	p := r.Packet
+	apid, seqCount := p.APID(), p.SeqCount()
+
+	// The insert waits for a concurrent transaction holding the same key,
+	// so only one copy of a packet is handled at a time.
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO telemetry_packets (spacecraft_id, apid, seq_count, onboard_time, station, quality)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT DO NOTHING
+	`, r.SpacecraftID, apid, seqCount, p.Time, r.Station, p.Quality)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	outcome := receptionStored
+	var anomalous bool
+	if n, _ := result.RowsAffected(); n == 0 {
+		var storedID int
+		var storedAt time.Time
+		var storedQuality int
+		err := tx.QueryRowContext(ctx, `
+			SELECT p.telemetry_id, p.telemetry_timestamp, p.quality, COALESCE(t.is_anomaly, FALSE)
+			FROM telemetry_packets p
+			LEFT JOIN telemetry t ON t.id = p.telemetry_id AND t.timestamp = p.telemetry_timestamp
+			WHERE p.spacecraft_id = $1 AND p.apid = $2 AND p.seq_count = $3 AND p.onboard_time = $4
+			FOR UPDATE OF p
+		`, r.SpacecraftID, apid, seqCount, p.Time).Scan(&storedID, &storedAt, &storedQuality, &anomalous)
+		if err != nil {
+			return "", 0, false, err
+		}
+
+		outcome = receptionDuplicate
+		if p.Quality > storedQuality {
+			outcome = receptionReplaced
+			if err := discardTelemetry(ctx, tx, storedID, storedAt); err != nil {
+				return "", 0, false, err
+			}
+		}
+	}
+	if outcome == receptionDuplicate {
+		return outcome, 0, anomalous, nil
+	}
+
+	id, anomalous, err := insertTelemetry(ctx, tx, r)
+	if err != nil {
+		return "", 0, false, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE telemetry_packets
+		SET telemetry_id = $5, telemetry_timestamp = $6, station = $7, quality = $8, updated_at = NOW()
+		WHERE spacecraft_id = $1 AND apid = $2 AND seq_count = $3 AND onboard_time = $4
+	`, r.SpacecraftID, apid, seqCount, p.Time, id, p.Time, r.Station, p.Quality)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if err := recordClockSample(ctx, tx, r, id); err != nil {
+		return "", 0, false, err
+	}
+	return outcome, id, anomalous, nil
+}
+
+// recordReception assigns a copy to its station's pass and records it in
+// packet_receptions within tx.
+func recordReception(ctx context.Context, tx *sql.Tx, r *Reception, outcome string, anomalous bool) error {
+	passID, err := recordPass(ctx, tx, r, anomalous)
+	if err != nil {
+		return err
+	}
+
+	p := r.Packet
+	var source interface{}
+	if r.SourceIP != nil {
+		source = r.SourceIP.String()
+	}
+	args := []interface{}{r.ReceivedAt, r.SpacecraftID, p.APID(), p.SeqCount(), p.Time, r.Station, p.Quality, outcome,
+		r.ImportID, source, passID}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO packet_receptions (
+			received_at, spacecraft_id, apid, seq_count, onboard_time, station, quality, outcome, import_id,
+			source_address, pass_id, earth_received_at, rssi_dbm, snr_db, corrected_bits
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, 0), $10, NULLIF($11, 0), $12, $13, $14, $15)
+	`, append(args, r.metadata()...)...)
+	return err
+}
+
+// insertTelemetry stores a copy of a packet at its onboard time and returns
+// its id and whether it is anomalous. Its onboard time is corrected by the
+// spacecraft's current clock model. Housekeeping reports record their
+// structure.
+func insertTelemetry(ctx context.Context, tx *sql.Tx, r *Reception) (int, bool, error) {
+	p := r.Packet
+	args := []interface{}{p.Time, r.SpacecraftID, p.PacketID, p.PacketSeqCtrl, p.SubsystemID,
+		p.Payload.Temperature, p.Payload.Battery, p.Payload.Altitude, p.Payload.Signal, r.ImportID, r.Station, p.Time,
+		r.Late, nil, nil}
+	if r.Late {
+		args[13] = r.LateBy.Seconds()
+	}
+	if p.PUS != nil {
+		args[14] = int(p.PUS.StructureID)
+	}
+	var id int
+	var anomalous bool
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO telemetry (
+			timestamp, spacecraft_id, packet_id, packet_seq_ctrl, subsystem_id,
+			temperature, battery, altitude, signal_strength, import_id, station, onboard_time,
+			corrected_time, is_late, late_seconds, housekeeping_structure_id,
+			earth_received_at, rssi_dbm, snr_db, corrected_bits
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, 0), $11, $12,
+			correct_onboard_time($2, $12), $13, $14, $15, $16, $17, $18, $19
+		)
+		RETURNING id, is_anomaly
+	`, append(args, r.metadata()...)...).Scan(&id, &anomalous)
+	return id, anomalous, err
+}
+
+// discardTelemetry removes a copy that is being replaced. Its anomalies are
+// marked superseded rather than deleted, as reprocessing does, so
+// acknowledgements and incident history stay visible.
+func discardTelemetry(ctx context.Context, tx *sql.Tx, id int, timestamp time.Time) error {
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE anomaly_history SET superseded_at = NOW()
+		WHERE telemetry_id = $1 AND telemetry_timestamp = $2 AND superseded_at IS NULL
+	`, id, timestamp); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT refresh_incidents($1, $1)`, timestamp); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM derived_values WHERE telemetry_id = $1 AND timestamp = $2
+	`, id, timestamp); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM telemetry WHERE id = $1 AND timestamp = $2`, id, timestamp)
+	return err
+}
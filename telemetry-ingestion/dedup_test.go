@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	// CRC-16/CCITT-FALSE check value.
+	if got := crc16([]byte("123456789")); got != 0x29B1 {
+		t.Errorf("crc16 = %#04x, want 0x29b1", got)
+	}
+}
+
+// withPEC appends packet error control to a packet built by testPacket.
+func withPEC(packet []byte) []byte {
+	out := append([]byte(nil), packet...)
+	binary.BigEndian.PutUint16(out[4:], binary.BigEndian.Uint16(out[4:])+pecSize)
+	return binary.BigEndian.AppendUint16(out, crc16(out))
+}
+
+func TestPacketQuality(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	plain := testPacket(5, ts, 25)
+	verified := withPEC(plain)
+	corrupt := append([]byte(nil), verified...)
+	corrupt[20] ^= 0x01
+
+	cases := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no PEC", plain, qualityUnchecked},
+		{"matching PEC", verified, qualityVerified},
+		{"bit error", corrupt, qualityCorrupt},
+		{"PEC cut off", verified[:len(verified)-1], qualityUnchecked},
+	}
+	for _, tc := range cases {
+		p, err := parseCCSDSPacket(tc.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if p.Quality != tc.want {
+			t.Errorf("%s: quality = %d, want %d", tc.name, p.Quality, tc.want)
+		}
+	}
+
+	p, _ := parseCCSDSPacket(verified)
+	if p.APID() != 0x01 || p.SeqCount() != 5 {
+		t.Errorf("natural key: APID %d, seq %d", p.APID(), p.SeqCount())
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Derived parameters are defined in the derived_parameters table as arithmetic
+// expressions over downlinked parameters and other derived parameters. The
+// expression language is deliberately small: numbers, identifiers, + - * / % ^,
+// parentheses and a fixed set of math functions. Nothing else can be called.
+
+const (
+	maxExpressionLength = 1024
+	maxExpressionDepth  = 32
+)
+
+type DerivedParameter struct {
+	Name       string
+	Expression string
+	expr       exprNode
+	inputs     []string
+}
+
+var (
+	derivedMu     sync.RWMutex
+	derivedParams []*DerivedParameter
+
+	derivedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "satellite_derived_parameter",
+		Help: "Latest value of each derived telemetry parameter",
+	}, []string{"parameter"})
+)
+
+// payloadParameters maps a decoded payload to the parameter names used in
+// expressions and in parameter_limits.
+func payloadParameters(p *TelemetryPayload) map[string]float64 {
+	return map[string]float64{
+		"temperature":     float64(p.Temperature),
+		"battery":         float64(p.Battery),
+		"altitude":        float64(p.Altitude),
+		"signal_strength": float64(p.Signal),
+	}
+}
+
+func startDerivedParameterRefresh() {
+	interval := 60 * time.Second
+	if v := os.Getenv("DERIVED_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	loadDerivedParameters()
+	for range time.Tick(interval) {
+		loadDerivedParameters()
+	}
+}
+
+func loadDerivedParameters() {
+	rows, err := db.Query(`SELECT name, expression FROM derived_parameters WHERE enabled ORDER BY name`)
+	if err != nil {
+		log.Printf("Error loading derived parameters: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	definitions := map[string]string{}
+	for rows.Next() {
+		var name, expression string
+		if err := rows.Scan(&name, &expression); err != nil {
+			log.Printf("Error scanning derived parameter: %v", err)
+			continue
+		}
+		definitions[name] = expression
+	}
+
+	params, errs := compileDerivedParameters(definitions)
+	for _, err := range errs {
+		log.Printf("Skipping derived parameter: %v", err)
+	}
+
+	derivedMu.Lock()
+	derivedParams = params
+	derivedMu.Unlock()
+}
+
+// compileDerivedParameters parses every definition and returns the valid ones
+// in dependency order, so each parameter is evaluated after its inputs.
+// Definitions that fail to parse, shadow a downlinked parameter, reference an
+// unknown name or take part in a cycle are reported and left out.
+func compileDerivedParameters(definitions map[string]string) ([]*DerivedParameter, []error) {
+	var errs []error
+	downlinked := payloadParameters(&TelemetryPayload{})
+
+	pending := map[string]*DerivedParameter{}
+	for name, expression := range definitions {
+		if _, ok := downlinked[name]; ok {
+			errs = append(errs, fmt.Errorf("%s: name is already a downlinked parameter", name))
+			continue
+		}
+		expr, err := parseExpression(expression)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		pending[name] = &DerivedParameter{Name: name, Expression: expression, expr: expr, inputs: exprInputs(expr)}
+	}
+
+	var ordered []*DerivedParameter
+	resolved := map[string]bool{}
+	for name := range downlinked {
+		resolved[name] = true
+	}
+
+	for len(pending) > 0 {
+		names := make([]string, 0, len(pending))
+		for name := range pending {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		progress := false
+		for _, name := range names {
+			p := pending[name]
+			ready := true
+			for _, input := range p.inputs {
+				if !resolved[input] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				ordered = append(ordered, p)
+				resolved[name] = true
+				delete(pending, name)
+				progress = true
+			}
+		}
+
+		if !progress {
+			for _, name := range names {
+				errs = append(errs, fmt.Errorf("%s: unknown input or dependency cycle", name))
+			}
+			break
+		}
+	}
+
+	return ordered, errs
+}
+
+// evaluateDerivedParameters computes every derived parameter from the given
+// inputs. Parameters whose expression fails (division by zero, non-finite
+// result) are skipped, and anything depending on them is skipped too.
+func evaluateDerivedParameters(params []*DerivedParameter, inputs map[string]float64) map[string]float64 {
+	vars := make(map[string]float64, len(inputs)+len(params))
+	for k, v := range inputs {
+		vars[k] = v
+	}
+
+	results := make(map[string]float64, len(params))
+	for _, p := range params {
+		value, err := p.expr.eval(vars)
+		if err != nil {
+			log.Printf("Error evaluating derived parameter %s: %v", p.Name, err)
+			continue
+		}
+		vars[p.Name] = value
+		results[p.Name] = value
+	}
+	return results
+}
+
+// storeDerivedValues evaluates the derived parameters of a packet and stores
+// them, returning the stored values by name.
+func storeDerivedValues(telemetryID int, timestamp time.Time, payload *TelemetryPayload) (map[string]float64, error) {
+	derivedMu.RLock()
+	params := derivedParams
+	derivedMu.RUnlock()
+
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	values := evaluateDerivedParameters(params, payloadParameters(payload))
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	query := `INSERT INTO derived_values (telemetry_id, timestamp, parameter_name, value) VALUES `
+	args := []interface{}{}
+	for _, p := range params {
+		value, ok := values[p.Name]
+		if !ok {
+			continue
+		}
+		if len(args) > 0 {
+			query += ", "
+		}
+		n := len(args)
+		query += fmt.Sprintf("($%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4)
+		args = append(args, telemetryID, timestamp, p.Name, value)
+	}
+
+	if _, err := db.Exec(query, args...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+type exprNode interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type numberNode float64
+
+type identNode string
+
+type unaryNode struct {
+	op      byte
+	operand exprNode
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+type exprFunc struct {
+	minArgs, maxArgs int
+	fn               func(args []float64) float64
+}
+
+// exprFuncs is the complete set of functions available to expressions.
+// maxArgs of -1 means variadic.
+var exprFuncs = map[string]exprFunc{
+	"abs":   {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt":  {1, 1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"exp":   {1, 1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"ln":    {1, 1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, 1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"pow":   {2, 2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"clamp": {3, 3, func(a []float64) float64 { return math.Max(a[1], math.Min(a[2], a[0])) }},
+	"min": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	}},
+	"max": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}},
+	"avg": {1, -1, func(a []float64) float64 {
+		sum := 0.0
+		for _, v := range a {
+			sum += v
+		}
+		return sum / float64(len(a))
+	}},
+}
+
+func (n numberNode) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (n identNode) eval(vars map[string]float64) (float64, error) {
+	v, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("no value for %s", string(n))
+	}
+	return v, nil
+}
+
+func (n unaryNode) eval(vars map[string]float64) (float64, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	return -v, nil
+}
+
+func (n binaryNode) eval(vars map[string]float64) (float64, error) {
+	l, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	var v float64
+	switch n.op {
+	case '+':
+		v = l + r
+	case '-':
+		v = l - r
+	case '*':
+		v = l * r
+	case '/':
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		v = l / r
+	case '%':
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		v = math.Mod(l, r)
+	case '^':
+		v = math.Pow(l, r)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("non-finite result")
+	}
+	return v, nil
+}
+
+func (n callNode) eval(vars map[string]float64) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	v := exprFuncs[n.name].fn(args)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("non-finite result from %s", n.name)
+	}
+	return v, nil
+}
+
+// exprInputs returns the distinct identifiers referenced by an expression.
+func exprInputs(n exprNode) []string {
+	seen := map[string]bool{}
+	var walk func(exprNode)
+	walk = func(n exprNode) {
+		switch n := n.(type) {
+		case identNode:
+			seen[string(n)] = true
+		case unaryNode:
+			walk(n.operand)
+		case binaryNode:
+			walk(n.left)
+			walk(n.right)
+		case callNode:
+			for _, a := range n.args {
+				walk(a)
+			}
+		}
+	}
+	walk(n)
+
+	inputs := make([]string, 0, len(seen))
+	for name := range seen {
+		inputs = append(inputs, name)
+	}
+	sort.Strings(inputs)
+	return inputs
+}
+
+type exprToken struct {
+	kind  byte // 'n' number, 'i' identifier, otherwise the operator itself
+	text  string
+	value float64
+	pos   int
+}
+
+func tokenizeExpression(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i < len(s) && (unicode.IsDigit(rune(s[i])) || s[i] == '.') {
+				i++
+			}
+			if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+				i++
+				if i < len(s) && (s[i] == '+' || s[i] == '-') {
+					i++
+				}
+				for i < len(s) && unicode.IsDigit(rune(s[i])) {
+					i++
+				}
+			}
+			v, err := strconv.ParseFloat(s[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", s[start:i], start)
+			}
+			tokens = append(tokens, exprToken{kind: 'n', text: s[start:i], value: v, pos: start})
+		case isIdentStart(s[i]):
+			start := i
+			for i < len(s) && (isIdentStart(s[i]) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: 'i', text: s[start:i], pos: start})
+		case strings.ContainsRune("+-*/%^(),", c):
+			tokens = append(tokens, exprToken{kind: s[i], text: s[i : i+1], pos: i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+}
+
+// parseExpression compiles an expression into an evaluable tree.
+//
+//	expr   := term (('+' | '-') term)*
+//	term   := unary (('*' | '/' | '%') unary)*
+//	unary  := '-' unary | power
+//	power  := primary ('^' unary)?
+//	primary:= number | ident | ident '(' expr (',' expr)* ')' | '(' expr ')'
+func parseExpression(s string) (exprNode, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+	if len(s) > maxExpressionLength {
+		return nil, fmt.Errorf("expression longer than %d characters", maxExpressionLength)
+	}
+
+	tokens, err := tokenizeExpression(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() byte {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return 0
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression nested deeper than %d levels", maxExpressionDepth)
+	}
+
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == '+' || p.peek() == '-' {
+		op := p.tokens[p.pos].kind
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == '*' || p.peek() == '/' || p.peek() == '%' {
+		op := p.tokens[p.pos].kind
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxExpressionDepth {
+			return nil, fmt.Errorf("expression nested deeper than %d levels", maxExpressionDepth)
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op: '-', operand: operand}, nil
+	}
+	return p.parsePower()
+}
+
+func (p *exprParser) parsePower() (exprNode, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		exponent, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryNode{op: '^', left: base, right: exponent}, nil
+	}
+	return base, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case 'n':
+		return numberNode(t.value), nil
+	case 'i':
+		if p.peek() != '(' {
+			return identNode(t.text), nil
+		}
+		p.pos++
+		f, ok := exprFuncs[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q at %d", t.text, t.pos)
+		}
+		var args []exprNode
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() == ',' {
+				p.pos++
+				continue
+			}
+			break
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) after arguments to %s", t.text)
+		}
+		p.pos++
+		if len(args) < f.minArgs || (f.maxArgs >= 0 && len(args) > f.maxArgs) {
+			return nil, fmt.Errorf("wrong number of arguments to %s: %d", t.text, len(args))
+		}
+		return callNode{name: t.text, args: args}, nil
+	case '(':
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) for ( at %d", t.pos)
+		}
+		p.pos++
+		return node, nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+}
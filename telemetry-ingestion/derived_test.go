@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseExpressionEvaluates(t *testing.T) {
+	vars := map[string]float64{"temperature": 30, "battery": 80, "bus_voltage": 28, "current": 1.5}
+
+	cases := []struct {
+		expr string
+		want float64
+	}{
+		{"bus_voltage * current", 42},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-2 ^ 2", -4},
+		{"2 ^ 3 ^ 2", 512},
+		{"10 % 4", 2},
+		{"abs(temperature - 35)", 5},
+		{"min(temperature, battery, 50)", 30},
+		{"max(temperature, battery)", 80},
+		{"clamp(battery, 0, 50)", 50},
+		{"avg(1, 2, 3)", 2},
+		{"1.5e2", 150},
+		{"battery * (1 - abs(temperature - 25) / 50)", 72},
+	}
+
+	for _, tc := range cases {
+		node, err := parseExpression(tc.expr)
+		if err != nil {
+			t.Fatalf("parseExpression(%q): %v", tc.expr, err)
+		}
+		got, err := node.eval(vars)
+		if err != nil {
+			t.Fatalf("eval(%q): %v", tc.expr, err)
+		}
+		if math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("eval(%q) = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseExpressionRejectsInvalidInput(t *testing.T) {
+	cases := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"temperature)",
+		"system(\"rm\")",
+		"abs(1, 2)",
+		"clamp(1)",
+		"battery; drop table",
+		"1 $ 2",
+		strings.Repeat("(", 40) + "1" + strings.Repeat(")", 40),
+		strings.Repeat("1+", 600) + "1",
+	}
+
+	for _, expr := range cases {
+		if _, err := parseExpression(expr); err == nil {
+			t.Errorf("parseExpression(%q) should fail", expr)
+		}
+	}
+}
+
+func TestEvalRejectsNonFiniteResults(t *testing.T) {
+	for _, expr := range []string{"1 / (battery - battery)", "sqrt(-battery)", "ln(0)"} {
+		node, err := parseExpression(expr)
+		if err != nil {
+			t.Fatalf("parseExpression(%q): %v", expr, err)
+		}
+		if _, err := node.eval(map[string]float64{"battery": 50}); err == nil {
+			t.Errorf("eval(%q) should fail", expr)
+		}
+	}
+}
+
+func TestCompileDerivedParametersOrdersDependencies(t *testing.T) {
+	params, errs := compileDerivedParameters(map[string]string{
+		"health_index":   "battery_health / 100",
+		"battery_health": "battery * 0.9",
+		"loop_a":         "loop_b + 1",
+		"loop_b":         "loop_a + 1",
+		"temperature":    "1",
+		"unknown_ref":    "no_such_parameter * 2",
+		"broken":         "1 +",
+	})
+
+	if len(params) != 2 {
+		t.Fatalf("expected 2 valid parameters, got %d", len(params))
+	}
+	if params[0].Name != "battery_health" || params[1].Name != "health_index" {
+		t.Errorf("unexpected order: %s, %s", params[0].Name, params[1].Name)
+	}
+	if len(errs) != 5 {
+		t.Errorf("expected 5 errors, got %d: %v", len(errs), errs)
+	}
+
+	values := evaluateDerivedParameters(params, payloadParameters(&TelemetryPayload{Battery: 50}))
+	if math.Abs(values["health_index"]-0.45) > 1e-9 {
+		t.Errorf("health_index = %v, want 0.45", values["health_index"])
+	}
+}
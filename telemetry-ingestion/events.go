@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Onboard event messages, such as "heater 2 on" or "safe mode entered", are
+// sent on their own APID, EVENT_APID. After the native secondary header, an
+// event packet carries:
+//
+//	event ID   uint16
+//	severity   uint8, 1 INFO, 2 LOW, 3 MEDIUM or 4 HIGH
+//	coded events (ID other than 0):
+//	  count    uint8
+//	  args     count IEEE 754 float32 arguments
+//	text events (ID 0): the message in UTF-8
+//
+// and ends in a packet error control field. Coded events are formatted from
+// the message template of their ID in event_dictionary, where {0}, {1}, ...
+// stand for the arguments. ST[5] event reports of PUS APIDs are formatted the
+// same way, without arguments. Events are stored in events with their
+// formatted message, so later changes to the dictionary do not rewrite
+// history.
+//
+// Event and verification reports are kept once per packet. Copies that fail
+// packet error control are discarded rather than stored, as a better copy
+// cannot replace them later. Every copy is recorded in packet_receptions and
+// assigned to its station's pass, as telemetry is.
+
+// defaultEventAPID is the event APID unless EVENT_APID says otherwise.
+const defaultEventAPID = 0x02
+
+var eventAPID uint16 = defaultEventAPID
+
+func loadEventAPID() error {
+	if v := os.Getenv("EVENT_APID"); v != "" {
+		apid, err := strconv.ParseUint(v, 0, 11)
+		if err != nil {
+			return fmt.Errorf("invalid EVENT_APID: %q", v)
+		}
+		eventAPID = uint16(apid)
+	}
+	if pusAPIDs[eventAPID] {
+		return fmt.Errorf("EVENT_APID %d is also in PUS_APIDS", eventAPID)
+	}
+	return nil
+}
+
+// Event severities by code, which is also the ST[5] subtype.
+var eventSeverities = map[uint8]string{
+	1: "INFO",
+	2: "LOW",
+	3: "MEDIUM",
+	4: "HIGH",
+}
+
+// Event is an onboard event. Coded events have Arguments; text events have
+// EventID 0 and Text. Data is the auxiliary data of a PUS event report.
+type Event struct {
+	Severity  string
+	EventID   uint16
+	Arguments []float32
+	Text      string
+	Data      []byte
+}
+
+// decodeEvent decodes the application data of a packet of the event APID.
+func decodeEvent(data []byte) (*Event, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("event packet too short: %d bytes", len(data))
+	}
+	e := &Event{EventID: binary.BigEndian.Uint16(data)}
+	severity, ok := eventSeverities[data[2]]
+	if !ok {
+		return nil, fmt.Errorf("invalid event severity %d", data[2])
+	}
+	e.Severity = severity
+	data = data[3:]
+
+	if e.EventID == 0 {
+		if !utf8.Valid(data) {
+			return nil, fmt.Errorf("event text is not UTF-8")
+		}
+		e.Text = string(data)
+		return e, nil
+	}
+
+	if len(data) < 1 || len(data) != 1+4*int(data[0]) {
+		return nil, fmt.Errorf("event %d arguments do not match the packet length", e.EventID)
+	}
+	for i := 0; i < int(data[0]); i++ {
+		e.Arguments = append(e.Arguments, math.Float32frombits(binary.BigEndian.Uint32(data[1+4*i:])))
+	}
+	return e, nil
+}
+
+// EventDefinition is an entry of the event dictionary.
+type EventDefinition struct {
+	Name    string
+	Message string
+}
+
+// eventDictionary holds the dictionary as last loaded. loaded is false until
+// a load succeeds, so events described before then can be told apart from
+// events the dictionary does not define.
+var eventDictionary = struct {
+	sync.RWMutex
+	defs   map[uint16]EventDefinition
+	loaded bool
+}{defs: map[uint16]EventDefinition{}}
+
+var undescribedEventCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "satellite_event_undescribed_count",
+	Help: "Total number of coded events stored without a dictionary message by reason",
+}, []string{"reason"})
+
+func startEventDictionaryRefresh() {
+	interval := 60 * time.Second
+	if v := os.Getenv("EVENT_DICTIONARY_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	loadEventDictionary()
+	for range time.Tick(interval) {
+		loadEventDictionary()
+	}
+}
+
+func loadEventDictionary() {
+	rows, err := db.Query(`SELECT event_id, name, message FROM event_dictionary`)
+	if err != nil {
+		log.Printf("Error loading event dictionary: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	defs := map[uint16]EventDefinition{}
+	for rows.Next() {
+		var id int
+		var def EventDefinition
+		if err := rows.Scan(&id, &def.Name, &def.Message); err != nil {
+			log.Printf("Error scanning event definition: %v", err)
+			continue
+		}
+		defs[uint16(id)] = def
+	}
+
+	eventDictionary.Lock()
+	eventDictionary.defs = defs
+	eventDictionary.loaded = true
+	eventDictionary.Unlock()
+}
+
+// describeEvent returns the dictionary name of an event, if it has one, and
+// its formatted message. Events missing from the dictionary are described by
+// their ID and arguments, and counted; so are all coded events while the
+// dictionary has not been loaded, which is also logged, as their stored
+// messages will never be formatted.
+func describeEvent(e *Event) (string, string) {
+	if e.EventID == 0 {
+		return "", e.Text
+	}
+
+	eventDictionary.RLock()
+	def, ok := eventDictionary.defs[e.EventID]
+	loaded := eventDictionary.loaded
+	eventDictionary.RUnlock()
+	if !ok {
+		if loaded {
+			undescribedEventCounter.WithLabelValues("unknown_event").Inc()
+		} else {
+			undescribedEventCounter.WithLabelValues("dictionary_unavailable").Inc()
+			log.Printf("Event dictionary not loaded; storing event %d without its message", e.EventID)
+		}
+		message := fmt.Sprintf("event %d", e.EventID)
+		for _, arg := range e.Arguments {
+			message += " " + formatEventArgument(arg)
+		}
+		return "", message
+	}
+	return def.Name, formatEventMessage(def.Message, e.Arguments)
+}
+
+// formatEventMessage replaces {n} in a template with the nth argument, or ?
+// if there are not that many.
+func formatEventMessage(template string, args []float32) string {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			break
+		}
+		n, err := strconv.Atoi(template[open+1 : open+end])
+		if err != nil || n < 0 {
+			b.WriteString(template[:open+end+1])
+			template = template[open+end+1:]
+			continue
+		}
+		b.WriteString(template[:open])
+		if n < len(args) {
+			b.WriteString(formatEventArgument(args[n]))
+		} else {
+			b.WriteString("?")
+		}
+		template = template[open+end+1:]
+	}
+	b.WriteString(template)
+	return b.String()
+}
+
+func formatEventArgument(v float32) string {
+	return strconv.FormatFloat(float64(v), 'g', -1, 32)
+}
+
+// isReport reports whether a packet is an event or verification report,
+// which is stored outside telemetry.
+func (p *Packet) isReport() bool {
+	return p.Event != nil || p.Verification != nil
+}
+
+// storeReport stores an event or verification report unless a copy is
+// already stored or the copy is corrupt, and returns the outcome. Every copy
+// is recorded like a copy of telemetry.
+func storeReport(ctx context.Context, r *Reception) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	outcome := receptionDiscarded
+	if r.Packet.Quality != qualityCorrupt {
+		var stored bool
+		if r.Packet.Event != nil {
+			stored, err = insertEvent(ctx, tx, r)
+		} else {
+			stored, err = insertVerification(ctx, tx, r)
+		}
+		if err != nil {
+			return "", err
+		}
+		outcome = receptionStored
+		if !stored {
+			outcome = receptionDuplicate
+		}
+	}
+	if err := recordReception(ctx, tx, r, outcome, false); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	receptionCounter.WithLabelValues(r.Station, strings.ToLower(outcome)).Inc()
+	return outcome, nil
+}
+
+func insertEvent(ctx context.Context, tx *sql.Tx, r *Reception) (bool, error) {
+	p, e := r.Packet, r.Packet.Event
+	name, message := describeEvent(e)
+	var args interface{}
+	if e.Arguments != nil {
+		args = pq.Array(e.Arguments)
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO events (
+			timestamp, spacecraft_id, apid, seq_count, subsystem_id, severity, event_id, name, message,
+			arguments, data, station, received_at, import_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10, $11, $12, $13, NULLIF($14, 0))
+		ON CONFLICT DO NOTHING
+	`, p.Time, r.SpacecraftID, p.APID(), p.SeqCount(), p.SubsystemID, e.Severity, e.EventID, name, message,
+		args, e.Data, r.Station, r.ReceivedAt, r.ImportID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
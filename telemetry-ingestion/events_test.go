@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testEventPacket builds a packet of the event APID with packet error control.
+func testEventPacket(ts time.Time, appData []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, CCSDSPrimaryHeader{
+		PacketID:      1<<11 | defaultEventAPID,
+		PacketSeqCtrl: 3<<14 | 4,
+		PacketLength:  uint16(binary.Size(CCSDSSecondaryHeader{}) + len(appData) - 1),
+	})
+	binary.Write(&buf, binary.BigEndian, CCSDSSecondaryHeader{Timestamp: uint64(ts.Unix()), SubsystemID: 3})
+	buf.Write(appData)
+	return withPEC(buf.Bytes())
+}
+
+func codedEvent(id uint16, severity uint8, args ...float32) []byte {
+	data := binary.BigEndian.AppendUint16(nil, id)
+	data = append(data, severity, uint8(len(args)))
+	for _, arg := range args {
+		data = binary.BigEndian.AppendUint32(data, math.Float32bits(arg))
+	}
+	return data
+}
+
+func TestParseEventPacket(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	p, err := parseCCSDSPacket(testEventPacket(ts, codedEvent(1, 1, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.isReport() || p.Event == nil || p.Quality != qualityVerified {
+		t.Fatalf("event packet decoded as %+v", p)
+	}
+	e := p.Event
+	if e.EventID != 1 || e.Severity != "INFO" || len(e.Arguments) != 1 || e.Arguments[0] != 2 {
+		t.Errorf("event decoded as %+v", e)
+	}
+	if p.SubsystemID != 3 || !p.Time.Equal(ts) {
+		t.Errorf("subsystem %d, time %v", p.SubsystemID, p.Time)
+	}
+
+	p, err = parseCCSDSPacket(testEventPacket(ts, append([]byte{0, 0, 4}, "safe mode entered"...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Event.Text != "safe mode entered" || p.Event.Severity != "HIGH" {
+		t.Errorf("text event decoded as %+v", p.Event)
+	}
+
+	if p, _ := parseCCSDSPacket(testPacket(1, ts, 25)); p.isReport() {
+		t.Error("telemetry packet decoded as a report")
+	}
+}
+
+func TestDecodeEventRejectsMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		"too short":         {0, 1},
+		"invalid severity":  codedEvent(1, 5),
+		"missing argument":  codedEvent(1, 1, 2)[:7],
+		"extra bytes":       append(codedEvent(1, 1), 0),
+		"no argument count": {0, 1, 1},
+		"text not UTF-8":    {0, 0, 1, 0xFF},
+	}
+	for name, data := range cases {
+		if _, err := decodeEvent(data); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// withEventDictionary sets the event dictionary for the rest of the test.
+func withEventDictionary(t *testing.T, defs map[uint16]EventDefinition, loaded bool) {
+	t.Helper()
+	eventDictionary.Lock()
+	savedDefs, savedLoaded := eventDictionary.defs, eventDictionary.loaded
+	eventDictionary.defs, eventDictionary.loaded = defs, loaded
+	eventDictionary.Unlock()
+	t.Cleanup(func() {
+		eventDictionary.Lock()
+		eventDictionary.defs, eventDictionary.loaded = savedDefs, savedLoaded
+		eventDictionary.Unlock()
+	})
+}
+
+func TestDescribeEvent(t *testing.T) {
+	withEventDictionary(t, map[uint16]EventDefinition{
+		1: {Name: "HEATER_ON", Message: "Heater {0} on"},
+		5: {Name: "OVERTEMPERATURE", Message: "Temperature {0} C above limit {1} C"},
+	}, true)
+
+	tests := []struct {
+		event   Event
+		name    string
+		message string
+	}{
+		{Event{EventID: 1, Arguments: []float32{2}}, "HEATER_ON", "Heater 2 on"},
+		{Event{EventID: 5, Arguments: []float32{37.5, 35}}, "OVERTEMPERATURE", "Temperature 37.5 C above limit 35 C"},
+		{Event{EventID: 5}, "OVERTEMPERATURE", "Temperature ? C above limit ? C"},
+		{Event{EventID: 9, Arguments: []float32{1, 0.25}}, "", "event 9 1 0.25"},
+		{Event{Text: "safe mode entered"}, "", "safe mode entered"},
+	}
+	for _, tt := range tests {
+		name, message := describeEvent(&tt.event)
+		if name != tt.name || message != tt.message {
+			t.Errorf("%+v: got %q %q, want %q %q", tt.event, name, message, tt.name, tt.message)
+		}
+	}
+}
+
+func TestDescribeEventCountsMissingDictionary(t *testing.T) {
+	withEventDictionary(t, map[uint16]EventDefinition{}, false)
+	unknown := undescribedEventCounter.WithLabelValues("unknown_event")
+	unavailable := undescribedEventCounter.WithLabelValues("dictionary_unavailable")
+	before := testutil.ToFloat64(unavailable)
+
+	f := withFakeDB(t)
+	f.fail("event_dictionary", errors.New("connection refused"))
+	loadEventDictionary()
+	event := &Event{EventID: 1, Arguments: []float32{2}}
+	if _, message := describeEvent(event); message != "event 1 2" {
+		t.Errorf("message without dictionary = %q", message)
+	}
+	if got := testutil.ToFloat64(unavailable) - before; got != 1 {
+		t.Errorf("dictionary_unavailable counted %v times, want 1", got)
+	}
+
+	f.table("event_dictionary", []string{"event_id", "name", "message"},
+		[]driver.Value{int64(1), "HEATER_ON", "Heater {0} on"})
+	loadEventDictionary()
+	if name, message := describeEvent(event); name != "HEATER_ON" || message != "Heater 2 on" {
+		t.Errorf("loaded dictionary: got %q %q", name, message)
+	}
+
+	before = testutil.ToFloat64(unknown)
+	describeEvent(&Event{EventID: 9})
+	if got := testutil.ToFloat64(unknown) - before; got != 1 {
+		t.Errorf("unknown_event counted %v times, want 1", got)
+	}
+}
+
+func TestFormatEventMessage(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"no arguments", "no arguments"},
+		{"{1} before {0}", "2 before 1"},
+		{"braces {x} and {0", "braces {x} and {0"},
+		{"{2}", "?"},
+	}
+	for _, tt := range tests {
+		if got := formatEventMessage(tt.template, []float32{1, 2}); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB answers queries from canned results, for testing code that loads
+// configuration tables without a database. A query gets the result of the
+// first registered table it mentions; queries mentioning none fail.
+type fakeDB struct {
+	mu      sync.Mutex
+	results map[string]fakeResult
+	queries []string
+}
+
+type fakeResult struct {
+	columns []string
+	rows    [][]driver.Value
+	err     error
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	n   int
+	dbs map[string]*fakeDB
+}{dbs: map[string]*fakeDB{}}
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+// withFakeDB points db at a fake database for the rest of the test.
+func withFakeDB(t *testing.T) *fakeDB {
+	t.Helper()
+	f := &fakeDB{results: map[string]fakeResult{}}
+
+	fakeDBs.Lock()
+	fakeDBs.n++
+	name := fmt.Sprintf("fake%d", fakeDBs.n)
+	fakeDBs.dbs[name] = f
+	fakeDBs.Unlock()
+
+	conn, err := sql.Open("fake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = conn
+	t.Cleanup(func() {
+		db = saved
+		conn.Close()
+	})
+	return f
+}
+
+// table registers the rows returned by queries of a table.
+func (f *fakeDB) table(name string, columns []string, rows ...[]driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[name] = fakeResult{columns: columns, rows: rows}
+}
+
+// fail makes queries of a table fail.
+func (f *fakeDB) fail(name string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[name] = fakeResult{err: err}
+}
+
+func (f *fakeDB) query(q string) (fakeResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, q)
+	for name, r := range f.results {
+		if strings.Contains(q, name) {
+			return r, r.err
+		}
+	}
+	return fakeResult{}, fmt.Errorf("fake database: unexpected query %q", q)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	f, ok := fakeDBs.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("fake database %q not registered", name)
+	}
+	return &fakeConn{f}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("fake database: no transactions")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := c.db.query(query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: r}, nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.db.query(s.query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	r, err := s.db.query(s.query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: r}, nil
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Liveness reports whether the process should be restarted: the UDP listener
+// is open. Readiness also checks the database, how many received datagrams
+// are waiting to be stored and how long ago the last packet arrived. A
+// threshold of 0 reports the value without failing the check.
+
+const healthDBTimeout = 2 * time.Second
+
+var (
+	// listening is set while the UDP listener is open.
+	listening atomic.Bool
+	// queueDepth counts datagrams received but not yet processed.
+	queueDepth atomic.Int64
+	// lastPacketAt is when the last packet was decoded, in Unix nanoseconds.
+	lastPacketAt atomic.Int64
+
+	startedAt = time.Now()
+)
+
+// healthThresholds configure readiness. They are read from
+// HEALTH_MAX_QUEUE_DEPTH and HEALTH_MAX_PACKET_AGE.
+type healthThresholds struct {
+	MaxQueueDepth int
+	MaxPacketAge  time.Duration
+}
+
+var thresholds = healthThresholds{MaxQueueDepth: 1000}
+
+func loadHealthThresholds() {
+	if v := os.Getenv("HEALTH_MAX_QUEUE_DEPTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatal("Invalid HEALTH_MAX_QUEUE_DEPTH:", v)
+		}
+		thresholds.MaxQueueDepth = n
+	}
+	if v := os.Getenv("HEALTH_MAX_PACKET_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatal("Invalid HEALTH_MAX_PACKET_AGE:", v)
+		}
+		thresholds.MaxPacketAge = d
+	}
+}
+
+// HealthCheck is one check of a health report. Value and Threshold are set
+// for checks that measure something.
+type HealthCheck struct {
+	Name      string   `json:"name"`
+	Status    string   `json:"status"`
+	Value     *float64 `json:"value,omitempty"`
+	Threshold *float64 `json:"threshold,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Time   time.Time     `json:"time"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func passed(name string) HealthCheck {
+	return HealthCheck{Name: name, Status: "ok"}
+}
+
+func failed(name, reason string) HealthCheck {
+	return HealthCheck{Name: name, Status: "fail", Error: reason}
+}
+
+// measured checks value against threshold, ignoring a threshold of 0.
+func measured(name string, value, threshold float64) HealthCheck {
+	c := HealthCheck{Name: name, Status: "ok", Value: &value}
+	if threshold > 0 {
+		c.Threshold = &threshold
+		if value > threshold {
+			c.Status = "fail"
+		}
+	}
+	return c
+}
+
+func newHealthReport(checks ...HealthCheck) HealthReport {
+	r := HealthReport{Status: "healthy", Time: time.Now(), Checks: checks}
+	for _, c := range checks {
+		if c.Status != "ok" {
+			r.Status = "unhealthy"
+		}
+	}
+	return r
+}
+
+func listenerCheck() HealthCheck {
+	if !listening.Load() {
+		return failed("udp_listener", "UDP listener is not open")
+	}
+	return passed("udp_listener")
+}
+
+func databaseCheck(ctx context.Context) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthDBTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		log.Printf("Readiness: database ping failed: %v", err)
+		return failed("database", "database unreachable")
+	}
+	return passed("database")
+}
+
+// packetAgeCheck measures seconds since the last packet, or since startup if
+// none has arrived.
+func packetAgeCheck(now time.Time) HealthCheck {
+	last := startedAt
+	if ns := lastPacketAt.Load(); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	return measured("last_packet_age_seconds", now.Sub(last).Seconds(), thresholds.MaxPacketAge.Seconds())
+}
+
+func livenessReport() HealthReport {
+	return newHealthReport(listenerCheck())
+}
+
+func readinessReport(ctx context.Context) HealthReport {
+	return newHealthReport(
+		databaseCheck(ctx),
+		listenerCheck(),
+		measured("queue_depth", float64(queueDepth.Load()), float64(thresholds.MaxQueueDepth)),
+		packetAgeCheck(time.Now()),
+	)
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "healthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, livenessReport())
+}
+
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, readinessReport(r.Context()))
+}
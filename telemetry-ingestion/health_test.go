@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMeasuredThreshold(t *testing.T) {
+	cases := []struct {
+		value, threshold float64
+		want             string
+	}{
+		{5, 10, "ok"},
+		{10, 10, "ok"},
+		{11, 10, "fail"},
+		{1e9, 0, "ok"},
+	}
+	for _, tc := range cases {
+		c := measured("queue_depth", tc.value, tc.threshold)
+		if c.Status != tc.want {
+			t.Errorf("measured(%v, %v) = %s, want %s", tc.value, tc.threshold, c.Status, tc.want)
+		}
+		if (c.Threshold == nil) != (tc.threshold == 0) {
+			t.Errorf("measured(%v, %v): threshold reported = %v", tc.value, tc.threshold, c.Threshold != nil)
+		}
+	}
+}
+
+func TestPacketAgeCheck(t *testing.T) {
+	defer func(saved healthThresholds) { thresholds = saved }(thresholds)
+	defer lastPacketAt.Store(lastPacketAt.Load())
+
+	now := time.Now()
+	thresholds.MaxPacketAge = time.Minute
+
+	lastPacketAt.Store(now.Add(-30 * time.Second).UnixNano())
+	if c := packetAgeCheck(now); c.Status != "ok" || *c.Value != 30 {
+		t.Errorf("recent packet: %s, %v", c.Status, *c.Value)
+	}
+
+	lastPacketAt.Store(now.Add(-2 * time.Minute).UnixNano())
+	if c := packetAgeCheck(now); c.Status != "fail" {
+		t.Errorf("stale packet: %s", c.Status)
+	}
+}
+
+func TestLivenessFollowsListener(t *testing.T) {
+	defer listening.Store(listening.Load())
+
+	for _, open := range []bool{false, true} {
+		listening.Store(open)
+		rec := httptest.NewRecorder()
+		handleLiveness(rec, httptest.NewRequest("GET", "/health/live", nil))
+
+		want := http.StatusServiceUnavailable
+		if open {
+			want = http.StatusOK
+		}
+		if rec.Code != want {
+			t.Errorf("listening %v: status %d, want %d", open, rec.Code, want)
+		}
+		var report HealthReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Checks) != 1 || report.Checks[0].Name != "udp_listener" {
+			t.Errorf("checks = %+v", report.Checks)
+		}
+	}
+}
@@ -0,0 +1,913 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Recorded packets are imported through the same decoding, deduplication,
+// derived parameter and anomaly logic as live UDP packets, but are stored at
+// their onboard time. Packets already received live or imported before are
+// duplicates, so re-importing a file only adds what is missing.
+
+const (
+	importAuto  = "auto"
+	importCCSDS = "ccsds"
+	importPcap  = "pcap"
+	importCSV   = "csv"
+
+	// maxImportErrors is how many rejected records an import report lists.
+	maxImportErrors = 20
+
+	// maxClockSkew is how far ahead of the ground clock an onboard time may be.
+	maxClockSkew = time.Hour
+
+	defaultMaxImportBytes = 1 << 30
+)
+
+var errInvalidImport = errors.New("invalid import")
+
+var importPacketCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "satellite_import_packet_count",
+	Help: "Total number of imported packets by result",
+}, []string{"result"})
+
+// importRecord is one packet or CSV row read from an import file. Skip marks
+// pcap frames that are not telemetry, such as other UDP traffic. Station,
+// EarthReceivedAt and Link are set when the file records them.
+type importRecord struct {
+	Packet          *Packet
+	SpacecraftID    int
+	Station         string
+	EarthReceivedAt time.Time
+	Link            *LinkMetrics
+	Position        string
+	Err             error
+	Skip            bool
+}
+
+// recordReader returns the records of a file in order and io.EOF at the end.
+// Other errors mean the rest of the file cannot be read.
+type recordReader interface {
+	Next() (importRecord, error)
+}
+
+// ccsdsFileReader splits a stream of concatenated space packets using the
+// packet data length of each primary header.
+type ccsdsFileReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (c *ccsdsFileReader) Next() (importRecord, error) {
+	header, err := c.r.Peek(6)
+	if err != nil && err != io.EOF {
+		return importRecord{}, err
+	}
+	if len(header) == 0 {
+		return importRecord{}, io.EOF
+	}
+	pos := fmt.Sprintf("byte %d", c.offset)
+	if len(header) < 6 {
+		n, _ := c.r.Discard(len(header))
+		c.offset += int64(n)
+		return importRecord{Position: pos, Err: fmt.Errorf("truncated packet header: %d bytes", n)}, nil
+	}
+
+	length := int(binary.BigEndian.Uint16(header[4:6])) + 7
+	data := make([]byte, length)
+	n, err := io.ReadFull(c.r, data)
+	c.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		return importRecord{Position: pos, Err: fmt.Errorf("truncated packet: %d of %d bytes", n, length)}, nil
+	}
+	if err != nil {
+		return importRecord{}, err
+	}
+
+	if version := binary.BigEndian.Uint16(data[0:2]) >> 13; version != 0 {
+		return importRecord{Position: pos, Err: fmt.Errorf("unsupported packet version %d", version)}, nil
+	}
+	packet, err := parseCCSDSPacket(data)
+	return importRecord{Packet: packet, Position: pos, Err: err}, nil
+}
+
+// pcapReader reads UDP datagrams from a classic libpcap capture. Each
+// datagram to port (any port if 0) is decoded as one packet, as live
+// ingestion does.
+type pcapReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	port     int
+	frame    int
+}
+
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+
+	maxPcapFrame = 256 * 1024
+)
+
+func newPcapReader(r *bufio.Reader, port int) (*pcapReader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: reading pcap header: %v", errInvalidImport, err)
+	}
+
+	p := &pcapReader{r: r, port: port}
+	magic := binary.LittleEndian.Uint32(header[0:4])
+	switch magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		p.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		p.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: not a pcap capture", errInvalidImport)
+	}
+	p.nanos = magic == 0xa1b23c4d || magic == 0x4d3cb2a1
+
+	p.linkType = p.order.Uint32(header[20:24]) & 0x0fffffff
+	switch p.linkType {
+	case linkNull, linkEthernet, linkRaw, linkLinuxSLL, linkIPv4, linkIPv6, linkSLL2:
+	default:
+		return nil, fmt.Errorf("%w: unsupported pcap link type %d", errInvalidImport, p.linkType)
+	}
+	return p, nil
+}
+
+func (p *pcapReader) Next() (importRecord, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return p.readError(err)
+	}
+	p.frame++
+
+	length := p.order.Uint32(header[8:12])
+	if length > maxPcapFrame {
+		return importRecord{}, fmt.Errorf("frame %d: implausible length %d", p.frame, length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(p.r, frame); err != nil {
+		return p.readError(err)
+	}
+
+	pos := fmt.Sprintf("frame %d", p.frame)
+	payload, port, err := udpPayload(p.linkType, frame)
+	if err != nil {
+		return importRecord{Position: pos, Err: err}, nil
+	}
+	if payload == nil || (p.port != 0 && port != p.port) {
+		return importRecord{Position: pos, Skip: true}, nil
+	}
+
+	// The capture time stands in for the earth-received time unless the
+	// datagram has a station header.
+	rec := importRecord{Position: pos, EarthReceivedAt: p.frameTime(header)}
+	stationHeader, payload, err := splitStationHeader(payload)
+	if err != nil {
+		rec.Err = err
+		return rec, nil
+	}
+	if stationHeader != nil {
+		rec.Station = stationHeader.StationID()
+		rec.EarthReceivedAt = stationHeader.Time()
+		rec.Link = stationHeader.Link()
+	}
+	rec.Packet, rec.Err = parseCCSDSPacket(payload)
+	return rec, nil
+}
+
+func (p *pcapReader) frameTime(header []byte) time.Time {
+	sec := int64(p.order.Uint32(header[0:4]))
+	frac := int64(p.order.Uint32(header[4:8]))
+	if !p.nanos {
+		frac *= 1000
+	}
+	return time.Unix(sec, frac).UTC()
+}
+
+// readError ends the capture. A capture cut off mid-frame, as when tcpdump
+// is killed, rejects the partial frame rather than failing the import.
+func (p *pcapReader) readError(err error) (importRecord, error) {
+	switch err {
+	case io.EOF:
+		return importRecord{}, io.EOF
+	case io.ErrUnexpectedEOF:
+		return importRecord{Position: fmt.Sprintf("frame %d", p.frame+1), Err: errors.New("truncated frame")}, nil
+	default:
+		return importRecord{}, err
+	}
+}
+
+// udpPayload returns the payload and destination port of a UDP datagram in a
+// captured frame, or a nil payload if the frame is not UDP over IP.
+func udpPayload(linkType uint32, frame []byte) ([]byte, int, error) {
+	var packet []byte
+	switch linkType {
+	case linkEthernet:
+		offset := 12
+		for offset+2 <= len(frame) {
+			etherType := binary.BigEndian.Uint16(frame[offset:])
+			// Skip 802.1Q and 802.1ad VLAN tags.
+			if etherType == 0x8100 || etherType == 0x88a8 {
+				offset += 4
+				continue
+			}
+			if etherType != 0x0800 && etherType != 0x86dd {
+				return nil, 0, nil
+			}
+			packet = frame[offset+2:]
+			break
+		}
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return nil, 0, errors.New("truncated Linux cooked header")
+		}
+		packet = frame[16:]
+	case linkSLL2:
+		if len(frame) < 20 {
+			return nil, 0, errors.New("truncated Linux cooked header")
+		}
+		packet = frame[20:]
+	case linkNull:
+		if len(frame) < 4 {
+			return nil, 0, errors.New("truncated loopback header")
+		}
+		packet = frame[4:]
+	default:
+		packet = frame
+	}
+	if len(packet) == 0 {
+		return nil, 0, nil
+	}
+
+	var udp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, 0, errors.New("truncated IPv4 header")
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if headerLen < 20 || total < headerLen || total > len(packet) {
+			return nil, 0, errors.New("malformed IPv4 header")
+		}
+		if packet[9] != 17 {
+			return nil, 0, nil
+		}
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+			return nil, 0, errors.New("fragmented IPv4 datagram")
+		}
+		udp = packet[headerLen:total]
+	case 6:
+		if len(packet) < 40 {
+			return nil, 0, errors.New("truncated IPv6 header")
+		}
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if total > len(packet) {
+			return nil, 0, errors.New("malformed IPv6 header")
+		}
+		// Extension headers are not followed.
+		if packet[6] != 17 {
+			return nil, 0, nil
+		}
+		udp = packet[40:total]
+	default:
+		return nil, 0, nil
+	}
+
+	if len(udp) < 8 {
+		return nil, 0, errors.New("truncated UDP header")
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		return nil, 0, errors.New("malformed UDP header")
+	}
+	return udp[8:length], int(binary.BigEndian.Uint16(udp[2:4])), nil
+}
+
+// csvRecordReader reads telemetry rows with a header line. timestamp and the
+// four payload parameters are required; spacecraft_id, packet_id,
+// packet_seq_ctrl and subsystem_id are optional, and other columns (such as
+// those of an API export) are ignored.
+type csvRecordReader struct {
+	r            *csv.Reader
+	columns      map[string]int
+	spacecraftID int
+}
+
+var csvRequiredColumns = []string{"timestamp", "temperature", "battery", "altitude", "signal_strength"}
+
+func newCSVRecordReader(r io.Reader, spacecraftID int) (*csvRecordReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading CSV header: %v", errInvalidImport, err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	var missing []string
+	for _, name := range csvRequiredColumns {
+		if _, ok := columns[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: CSV header is missing %s", errInvalidImport, strings.Join(missing, ", "))
+	}
+	return &csvRecordReader{r: cr, columns: columns, spacecraftID: spacecraftID}, nil
+}
+
+func (c *csvRecordReader) Next() (importRecord, error) {
+	row, err := c.r.Read()
+	if err == io.EOF {
+		return importRecord{}, io.EOF
+	}
+	line, _ := c.r.FieldPos(0)
+	rec := importRecord{Position: fmt.Sprintf("line %d", line), SpacecraftID: c.spacecraftID}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rec.Position = fmt.Sprintf("line %d", parseErr.Line)
+			rec.Err = parseErr.Err
+			return rec, nil
+		}
+		return importRecord{}, err
+	}
+
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	float := func(name string) float32 {
+		if rec.Err != nil {
+			return 0
+		}
+		v, err := strconv.ParseFloat(field(name), 32)
+		if err != nil {
+			rec.Err = fmt.Errorf("%s: invalid number %q", name, field(name))
+		}
+		return float32(v)
+	}
+	uint16Field := func(name string, def uint16) uint16 {
+		v := field(name)
+		if rec.Err != nil || v == "" {
+			return def
+		}
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			rec.Err = fmt.Errorf("%s: invalid value %q", name, v)
+		}
+		return uint16(n)
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, field("timestamp"))
+	if err != nil {
+		rec.Err = fmt.Errorf("timestamp: invalid RFC3339 time %q", field("timestamp"))
+		return rec, nil
+	}
+	if v := field("spacecraft_id"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			rec.Err = fmt.Errorf("spacecraft_id: invalid value %q", v)
+			return rec, nil
+		}
+		rec.SpacecraftID = n
+	}
+
+	packet := &Packet{
+		PacketID:      uint16Field("packet_id", 0),
+		PacketSeqCtrl: uint16Field("packet_seq_ctrl", 0),
+		SubsystemID:   uint16Field("subsystem_id", 1),
+		Time:          ts.UTC(),
+		Quality:       qualityUnchecked,
+		Payload: TelemetryPayload{
+			Temperature: float("temperature"),
+			Battery:     float("battery"),
+			Altitude:    float("altitude"),
+			Signal:      float("signal_strength"),
+		},
+	}
+	if rec.Err == nil {
+		rec.Packet = packet
+	}
+	return rec, nil
+}
+
+// detectImportFormat recognises pcap captures by their magic number and CSV
+// by a text header line; anything else is taken to be raw packets.
+func detectImportFormat(r *bufio.Reader) (string, error) {
+	head, _ := r.Peek(4)
+	if len(head) < 4 {
+		return importCCSDS, nil
+	}
+	switch binary.LittleEndian.Uint32(head) {
+	case 0xa1b2c3d4, 0xa1b23c4d, 0xd4c3b2a1, 0x4d3cb2a1:
+		return importPcap, nil
+	case 0x0a0d0d0a:
+		return "", fmt.Errorf("%w: pcapng captures are not supported; save the capture as pcap (e.g. editcap -F pcap)", errInvalidImport)
+	}
+
+	line, _ := r.Peek(256)
+	if i := strings.IndexByte(string(line), '\n'); i > 0 {
+		header := strings.ToLower(string(line[:i]))
+		if strings.Contains(header, "timestamp") && strings.Contains(header, ",") {
+			return importCSV, nil
+		}
+	}
+	return importCCSDS, nil
+}
+
+// ImportOptions describe one file to import. Port filters pcap captures to
+// datagrams sent to the ingestion port; 0 imports every UDP datagram.
+// Station is the ground station that recorded the file, for packets without
+// a station header.
+type ImportOptions struct {
+	Format       string
+	SpacecraftID int
+	Station      string
+	Port         int
+	FileName     string
+	ImportedBy   string
+}
+
+type ImportError struct {
+	Position string `json:"position"`
+	Error    string `json:"error"`
+}
+
+// ImportReport summarizes an import. Accepted includes packets that replaced
+// a worse copy. Errors lists the first rejected records; PreviousImports lists
+// earlier imports of the same file.
+type ImportReport struct {
+	ID              int           `json:"id"`
+	FileName        string        `json:"file_name"`
+	Format          string        `json:"format"`
+	SHA256          string        `json:"sha256,omitempty"`
+	SpacecraftID    int           `json:"spacecraft_id"`
+	Station         string        `json:"station"`
+	Status          string        `json:"status"`
+	Accepted        int           `json:"accepted"`
+	Duplicate       int           `json:"duplicate"`
+	Rejected        int           `json:"rejected"`
+	Skipped         int           `json:"skipped"`
+	FirstTimestamp  *time.Time    `json:"first_timestamp,omitempty"`
+	LastTimestamp   *time.Time    `json:"last_timestamp,omitempty"`
+	Errors          []ImportError `json:"errors,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	PreviousImports []int         `json:"previous_imports,omitempty"`
+}
+
+func (r *ImportReport) reject(pos string, err error) {
+	r.Rejected++
+	importPacketCounter.WithLabelValues("rejected").Inc()
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, ImportError{Position: pos, Error: err.Error()})
+	}
+}
+
+func (r *ImportReport) accept(t time.Time) {
+	r.Accepted++
+	importPacketCounter.WithLabelValues("accepted").Inc()
+	if r.FirstTimestamp == nil || t.Before(*r.FirstTimestamp) {
+		r.FirstTimestamp = &t
+	}
+	if r.LastTimestamp == nil || t.After(*r.LastTimestamp) {
+		r.LastTimestamp = &t
+	}
+}
+
+// checkOnboardTime rejects packets whose onboard clock is unset or ahead of
+// the ground clock, as telemetry is stored at its onboard time.
+func checkOnboardTime(t, now time.Time) error {
+	if t.Unix() <= 0 {
+		return errors.New("onboard time is not set")
+	}
+	if t.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("onboard time %s is in the future", t.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func newRecordReader(format string, r *bufio.Reader, opts ImportOptions) (recordReader, error) {
+	switch format {
+	case importCCSDS:
+		return &ccsdsFileReader{r: r}, nil
+	case importPcap:
+		return newPcapReader(r, opts.Port)
+	case importCSV:
+		return newCSVRecordReader(r, opts.SpacecraftID)
+	default:
+		return nil, fmt.Errorf("%w: format must be auto, ccsds, pcap or csv", errInvalidImport)
+	}
+}
+
+// runImport stores every packet of r and records the import in
+// telemetry_imports. Each packet is committed on its own, so an import that
+// fails or is cancelled keeps what it stored and can simply be run again.
+func runImport(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	hash := sha256.New()
+	br := bufio.NewReaderSize(io.TeeReader(r, hash), 64*1024)
+
+	format := opts.Format
+	if format == "" || format == importAuto {
+		var err error
+		if format, err = detectImportFormat(br); err != nil {
+			return nil, err
+		}
+	}
+	records, err := newRecordReader(format, br, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Station == "" {
+		opts.Station = groundStation
+	}
+	if opts.Station == "" {
+		opts.Station = "unknown"
+	}
+
+	report := &ImportReport{
+		FileName:     opts.FileName,
+		Format:       format,
+		SpacecraftID: opts.SpacecraftID,
+		Station:      opts.Station,
+		Status:       "RUNNING",
+	}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO telemetry_imports (file_name, format, spacecraft_id, station, imported_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, opts.FileName, format, opts.SpacecraftID, opts.Station, opts.ImportedBy).Scan(&report.ID)
+	if err != nil {
+		return nil, fmt.Errorf("recording import: %v", err)
+	}
+
+	err = importRecords(ctx, records, report)
+	if err == nil {
+		// Hash whatever follows the last record too.
+		_, err = io.Copy(io.Discard, br)
+	}
+
+	report.Status = "COMPLETED"
+	if err != nil {
+		report.Status = "FAILED"
+		report.Error = err.Error()
+	} else {
+		report.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	}
+	finishImport(report)
+
+	if report.Accepted > 0 {
+		refreshAggregates(*report.FirstTimestamp, *report.LastTimestamp)
+	}
+	return report, err
+}
+
+func importRecords(ctx context.Context, records recordReader, report *ImportReport) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec, err := records.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if rec.Skip {
+			report.Skipped++
+			continue
+		}
+		if rec.Err == nil {
+			rec.Err = checkOnboardTime(rec.Packet.Time, time.Now())
+		}
+		if rec.Err != nil {
+			report.reject(rec.Position, rec.Err)
+			continue
+		}
+		if rec.SpacecraftID == 0 {
+			rec.SpacecraftID = report.SpacecraftID
+		}
+
+		outcome, err := storeImportedPacket(ctx, rec, report)
+		if err != nil {
+			return fmt.Errorf("%s: %v", rec.Position, err)
+		}
+		switch outcome {
+		case receptionStored, receptionReplaced:
+			report.accept(rec.Packet.Time)
+		case receptionDiscarded:
+			report.reject(rec.Position, errors.New("packet error control failed"))
+		default:
+			report.Duplicate++
+			importPacketCounter.WithLabelValues("duplicate").Inc()
+		}
+	}
+}
+
+// storeImportedPacket stores a packet at its onboard time unless a copy at
+// least as good is already stored or it is corrupt, and returns the outcome.
+func storeImportedPacket(ctx context.Context, rec importRecord, report *ImportReport) (string, error) {
+	p := rec.Packet
+	station, origin := rec.Station, originHeader
+	if station == "" {
+		station, origin = report.Station, originConfigured
+	}
+	stations.ensure(station, "", origin)
+
+	reception := &Reception{
+		SpacecraftID:    rec.SpacecraftID,
+		Station:         station,
+		ReceivedAt:      time.Now(),
+		EarthReceivedAt: rec.EarthReceivedAt,
+		Link:            rec.Link,
+		ImportID:        report.ID,
+		Packet:          p,
+	}
+	if p.isReport() {
+		return storeReport(ctx, reception)
+	}
+
+	outcome, id, err := storeReception(ctx, reception)
+	if err != nil || id == 0 {
+		return outcome, err
+	}
+
+	if _, err := storeDerivedValues(id, p.Time, &p.Payload); err != nil {
+		log.Printf("Error storing derived values for imported packet %s: %v", rec.Position, err)
+	}
+	return outcome, nil
+}
+
+func finishImport(report *ImportReport) {
+	_, err := db.Exec(`
+		UPDATE telemetry_imports
+		SET status = $2, accepted = $3, duplicate = $4, rejected = $5, skipped = $6,
+			first_timestamp = $7, last_timestamp = $8, file_sha256 = NULLIF($9, ''),
+			error = NULLIF($10, ''), finished_at = NOW()
+		WHERE id = $1
+	`, report.ID, report.Status, report.Accepted, report.Duplicate, report.Rejected, report.Skipped,
+		report.FirstTimestamp, report.LastTimestamp, report.SHA256, report.Error)
+	if err != nil {
+		log.Printf("Error recording import %d: %v", report.ID, err)
+	}
+
+	if report.SHA256 == "" {
+		return
+	}
+	rows, err := db.Query(`
+		SELECT id FROM telemetry_imports WHERE file_sha256 = $1 AND id <> $2 ORDER BY id
+	`, report.SHA256, report.ID)
+	if err != nil {
+		log.Printf("Error looking up previous imports: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			report.PreviousImports = append(report.PreviousImports, id)
+		}
+	}
+}
+
+// refreshAggregates brings the continuous aggregates up to date over an
+// imported range instead of waiting for the refresh policies.
+func refreshAggregates(first, last time.Time) {
+	start := first.UTC().Truncate(24 * time.Hour)
+	end := last.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	for _, view := range []string{"telemetry_minutely_avg", "telemetry_hourly_avg", "telemetry_daily_avg"} {
+		if _, err := db.Exec(`CALL refresh_continuous_aggregate('`+view+`', $1::TIMESTAMPTZ, $2::TIMESTAMPTZ)`, start, end); err != nil {
+			log.Printf("Error refreshing %s after import: %v", view, err)
+		}
+	}
+}
+
+// bearerToken returns the credentials of an Authorization header using the
+// Bearer scheme, or false for any other header.
+func bearerToken(header string) (string, bool) {
+	const scheme = "Bearer "
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return "", false
+	}
+	return header[len(scheme):], true
+}
+
+// handleImport accepts a file as the request body:
+//
+//	POST /import?format=auto&spacecraft_id=1&station=GS1&name=pass.pcap
+//
+// Uploads must carry the IMPORT_TOKEN as a bearer token; without the
+// variable the endpoint is disabled.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("IMPORT_TOKEN")
+	if token == "" {
+		writeImportError(w, http.StatusForbidden, "imports are disabled; set IMPORT_TOKEN to enable them")
+		return
+	}
+	given, ok := bearerToken(r.Header.Get("Authorization"))
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeImportError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeImportError(w, http.StatusMethodNotAllowed, "use POST with the file as the request body")
+		return
+	}
+
+	opts, err := importOptionsFromQuery(r)
+	if err != nil {
+		writeImportError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	maxBytes := int64(defaultMaxImportBytes)
+	if v, err := strconv.ParseInt(os.Getenv("IMPORT_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		maxBytes = v
+	}
+	body := http.MaxBytesReader(w, r.Body, maxBytes)
+
+	report, err := runImport(r.Context(), body, opts)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errInvalidImport):
+		writeImportError(w, http.StatusBadRequest, err.Error())
+		return
+	case report == nil:
+		log.Printf("Import of %s failed: %v", opts.FileName, err)
+		writeImportError(w, http.StatusInternalServerError, "import failed")
+		return
+	}
+	log.Printf("Import %d of %s: %s, %d accepted, %d duplicate, %d rejected",
+		report.ID, report.FileName, report.Status, report.Accepted, report.Duplicate, report.Rejected)
+
+	status := http.StatusOK
+	if errors.As(err, &tooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	} else if err != nil {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+func importOptionsFromQuery(r *http.Request) (ImportOptions, error) {
+	q := r.URL.Query()
+	opts := ImportOptions{
+		Format:       strings.ToLower(q.Get("format")),
+		SpacecraftID: spacecraftID,
+		Station:      q.Get("station"),
+		FileName:     q.Get("name"),
+		ImportedBy:   q.Get("by"),
+	}
+	if opts.ImportedBy == "" {
+		opts.ImportedBy = "upload"
+	}
+
+	port, err := strconv.Atoi(listenPort())
+	if err != nil {
+		port = 0
+	}
+	opts.Port = port
+
+	if v := q.Get("spacecraft_id"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, errors.New("spacecraft_id must be a positive integer")
+		}
+		opts.SpacecraftID = n
+	}
+	if v := q.Get("port"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 65535 {
+			return opts, errors.New("port must be between 0 and 65535")
+		}
+		opts.Port = n
+	}
+	return opts, nil
+}
+
+func writeImportError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// loadImportDefinitions loads the definitions packets are decoded and
+// stored with. The service loads them in its refresh loops, which do not run
+// for a command.
+func loadImportDefinitions() {
+	loadDerivedParameters()
+	loadHousekeepingStructures()
+	loadEventDictionary()
+}
+
+// runImportCommand implements `telemetry-ingestion import [flags] file...`,
+// printing a JSON report per file. "-" reads standard input. Interrupting the
+// command stops the current import.
+func runImportCommand(args []string) error {
+	port, _ := strconv.Atoi(listenPort())
+
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", importAuto, "file format (auto, ccsds, pcap or csv)")
+	spacecraft := fs.Int("spacecraft", spacecraftID, "spacecraft the packets belong to")
+	station := fs.String("station", "", "ground station that recorded the files (default GROUND_STATION)")
+	pcapPort := fs.Int("port", port, "UDP port to import from pcap captures (0 for any)")
+	importedBy := fs.String("by", "cli", "operator running the import")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: telemetry-ingestion import [flags] file...")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	loadImportDefinitions()
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	var failed int
+	for _, name := range fs.Args() {
+		opts := ImportOptions{
+			Format:       strings.ToLower(*format),
+			SpacecraftID: *spacecraft,
+			Station:      *station,
+			Port:         *pcapPort,
+			FileName:     name,
+			ImportedBy:   *importedBy,
+		}
+
+		report, err := importFile(ctx, name, opts)
+		if report != nil {
+			out.Encode(report)
+		}
+		if err != nil {
+			log.Printf("Import of %s failed: %v", name, err)
+			failed++
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d imports failed", failed, fs.NArg())
+	}
+	return nil
+}
+
+func importFile(ctx context.Context, name string, opts ImportOptions) (*ImportReport, error) {
+	if name == "-" {
+		opts.FileName = "stdin"
+		return runImport(ctx, os.Stdin, opts)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return runImport(ctx, f, opts)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPacket(seq uint16, ts time.Time, temperature float32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, CCSDSPrimaryHeader{
+		PacketID:      1<<11 | 0x01,
+		PacketSeqCtrl: 3<<14 | seq,
+		PacketLength:  uint16(binary.Size(CCSDSSecondaryHeader{}) + binary.Size(TelemetryPayload{}) - 1),
+	})
+	binary.Write(&buf, binary.BigEndian, CCSDSSecondaryHeader{Timestamp: uint64(ts.Unix()), SubsystemID: 2})
+	binary.Write(&buf, binary.BigEndian, TelemetryPayload{Temperature: temperature, Battery: 80, Altitude: 500, Signal: -50})
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, r recordReader) []importRecord {
+	t.Helper()
+	var records []importRecord
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestCCSDSFileReader(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	var file []byte
+	file = append(file, testPacket(1, ts, 25)...)
+	file = append(file, testPacket(2, ts.Add(time.Second), 26)...)
+	file = append(file, testPacket(3, ts.Add(2*time.Second), 27)[:20]...)
+
+	records := readAll(t, &ccsdsFileReader{r: bufio.NewReader(bytes.NewReader(file))})
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+
+	p := records[1].Packet
+	if records[1].Err != nil || p == nil {
+		t.Fatalf("second packet: %v", records[1].Err)
+	}
+	if p.PacketSeqCtrl&0x3fff != 2 || p.SubsystemID != 2 || !p.Time.Equal(ts.Add(time.Second)) || p.Payload.Temperature != 26 {
+		t.Errorf("second packet decoded as %+v", p)
+	}
+	if records[1].Position != "byte 32" {
+		t.Errorf("position = %q, want byte 32", records[1].Position)
+	}
+	if records[2].Err == nil || !strings.Contains(records[2].Err.Error(), "truncated packet: 20 of 32 bytes") {
+		t.Errorf("truncated packet error = %v", records[2].Err)
+	}
+}
+
+// testPcap builds a little-endian Ethernet capture of UDP datagrams.
+func testPcap(datagrams map[int][]byte, order []int) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{0xa1b2c3d4, 0x00040002, 0, 0, 65535, linkEthernet})
+
+	for _, port := range order {
+		payload := datagrams[port]
+		udp := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(udp[0:], 40000)
+		binary.BigEndian.PutUint16(udp[2:], uint16(port))
+		binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+		udp = append(udp, payload...)
+
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		ip = append(ip, udp...)
+
+		frame := make([]byte, 14, 14+len(ip))
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		frame = append(frame, ip...)
+		// Ethernet pads short frames; the IP length must be used.
+		frame = append(frame, 0, 0, 0, 0)
+
+		binary.Write(&buf, binary.LittleEndian, []uint32{1709287200, 0, uint32(len(frame)), uint32(len(frame))})
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func TestPcapReader(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	capture := testPcap(map[int][]byte{
+		8090: testPacket(7, ts, 31),
+		53:   []byte("not telemetry"),
+	}, []int{53, 8090})
+	// Cut off mid-frame, as when tcpdump is killed.
+	capture = append(capture, 0x10, 0, 0, 0)
+
+	r, err := newPcapReader(bufio.NewReader(bytes.NewReader(capture)), 8090)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAll(t, r)
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	if !records[0].Skip {
+		t.Errorf("datagram to port 53 was not skipped")
+	}
+	if records[1].Err != nil || records[1].Packet.Payload.Temperature != 31 || records[1].Position != "frame 2" {
+		t.Errorf("telemetry frame: %+v", records[1])
+	}
+	if records[2].Err == nil {
+		t.Errorf("truncated frame was not rejected")
+	}
+
+	if _, err := newPcapReader(bufio.NewReader(strings.NewReader(strings.Repeat("x", 24))), 0); !errors.Is(err, errInvalidImport) {
+		t.Errorf("non-pcap input: %v", err)
+	}
+}
+
+func TestCSVRecordReader(t *testing.T) {
+	// The column layout of an API export, which has extra columns.
+	input := "id,timestamp,spacecraft_id,packet_id,packet_seq_ctrl,subsystem_id,temperature,battery,altitude,signal_strength,is_anomaly\n" +
+		"1,2024-03-01T10:00:00.5Z,2,2049,49153,1,24.1,80,500,-50,false\n" +
+		"2,yesterday,2,2049,49154,1,24.1,80,500,-50,false\n" +
+		"3,2024-03-01T10:00:02Z,,2049,49155,1,hot,80,500,-50,false\n" +
+		"4,2024-03-01T10:00:03Z,,,,,25,80,500,-50\n"
+
+	r, err := newCSVRecordReader(strings.NewReader(input), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAll(t, r)
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want 4", len(records))
+	}
+
+	first := records[0]
+	if first.Err != nil || first.SpacecraftID != 2 || first.Packet.PacketID != 2049 ||
+		first.Packet.Payload.Temperature != 24.1 || !first.Packet.Time.Equal(time.Date(2024, 3, 1, 10, 0, 0, 5e8, time.UTC)) {
+		t.Errorf("first row: %+v %+v", first, first.Packet)
+	}
+	if records[1].Err == nil || records[1].Position != "line 3" {
+		t.Errorf("invalid timestamp: %+v", records[1])
+	}
+	if records[2].Err == nil || !strings.Contains(records[2].Err.Error(), "temperature") {
+		t.Errorf("invalid number: %+v", records[2])
+	}
+	last := records[3]
+	if last.Err != nil || last.SpacecraftID != 1 || last.Packet.SubsystemID != 1 || last.Packet.PacketID != 0 {
+		t.Errorf("defaults: %+v %+v", last, last.Packet)
+	}
+
+	if _, err := newCSVRecordReader(strings.NewReader("timestamp,temperature\n"), 1); err == nil ||
+		!strings.Contains(err.Error(), "battery, altitude, signal_strength") {
+		t.Errorf("missing columns: %v", err)
+	}
+}
+
+func TestDetectImportFormat(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	cases := map[string][]byte{
+		importPcap:  testPcap(nil, nil),
+		importCSV:   []byte("timestamp,temperature,battery,altitude,signal_strength\n"),
+		importCCSDS: testPacket(1, ts, 25),
+	}
+	for want, input := range cases {
+		got, err := detectImportFormat(bufio.NewReader(bytes.NewReader(input)))
+		if err != nil || got != want {
+			t.Errorf("detectImportFormat = %q, %v; want %q", got, err, want)
+		}
+	}
+
+	pcapng := []byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0}
+	if _, err := detectImportFormat(bufio.NewReader(bytes.NewReader(pcapng))); !errors.Is(err, errInvalidImport) {
+		t.Errorf("pcapng: %v", err)
+	}
+}
+
+func TestCheckOnboardTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	if err := checkOnboardTime(now.Add(-72*time.Hour), now); err != nil {
+		t.Errorf("past time rejected: %v", err)
+	}
+	if err := checkOnboardTime(time.Unix(0, 0), now); err == nil {
+		t.Errorf("unset time accepted")
+	}
+	if err := checkOnboardTime(now.Add(2*time.Hour), now); err == nil {
+		t.Errorf("future time accepted")
+	}
+}
+
+func TestHandleImportRequiresBearerToken(t *testing.T) {
+	t.Setenv("IMPORT_TOKEN", "secret")
+
+	for _, header := range []string{"", "secret", "Bearer", "Bearer ", "Basic secret", "Bearer wrong", "Bearersecret"} {
+		req := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(""))
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handleImport(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", header, rec.Code)
+		}
+	}
+
+	// A valid token gets past authentication to method checks.
+	req := httptest.NewRequest(http.MethodGet, "/import", nil)
+	req.Header.Set("Authorization", "bearer secret")
+	rec := httptest.NewRecorder()
+	handleImport(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("valid token: status %d, want 405", rec.Code)
+	}
+}
+
+func TestImportLoadsDefinitions(t *testing.T) {
+	withPUSAPID(t)
+	housekeepingStructures.Lock()
+	saved := housekeepingStructures.params
+	housekeepingStructures.params = map[uint16][]string{}
+	housekeepingStructures.Unlock()
+	defer func() { housekeepingStructures.params = saved }()
+	withEventDictionary(t, map[uint16]EventDefinition{}, false)
+
+	f := withFakeDB(t)
+	f.table("derived_parameters", []string{"name", "expression"})
+	f.table("housekeeping_structures", []string{"structure_id", "parameters"},
+		[]driver.Value{int64(7), "{battery,temperature,signal_strength,altitude}"})
+	f.table("event_dictionary", []string{"event_id", "name", "message"},
+		[]driver.Value{int64(1), "HEATER_ON", "Heater {0} on"})
+
+	appData := binary.BigEndian.AppendUint16(nil, 7)
+	for _, v := range []float32{80, 21.5, -50, 500} {
+		appData = binary.BigEndian.AppendUint32(appData, math.Float32bits(v))
+	}
+	file := testPUSPacket(3, 25, appData)
+
+	loadImportDefinitions()
+	records := readAll(t, &ccsdsFileReader{r: bufio.NewReader(bytes.NewReader(file))})
+	if len(records) != 1 || records[0].Err != nil {
+		t.Fatalf("records = %+v", records)
+	}
+	p := records[0].Packet
+	want := TelemetryPayload{Temperature: 21.5, Battery: 80, Altitude: 500, Signal: -50}
+	if p.PUS == nil || p.PUS.StructureID != 7 || p.Payload != want {
+		t.Errorf("ST[3,25] imported as %+v, payload %+v", p.PUS, p.Payload)
+	}
+	if _, message := describeEvent(&Event{EventID: 1, Arguments: []float32{2}}); message != "Heater 2 on" {
+		t.Errorf("event dictionary not loaded: %q", message)
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -23,6 +27,9 @@ type CCSDSPrimaryHeader struct {
 	PacketLength  uint16
 }
 
+// CCSDSSecondaryHeader is the original secondary header, with the onboard
+// time in Unix seconds. The secondary header now starts with a CCSDS time
+// code (see timecode.go), of which this layout is still accepted.
 type CCSDSSecondaryHeader struct {
 	Timestamp   uint64
 	SubsystemID uint16
@@ -35,7 +42,43 @@ type TelemetryPayload struct {
 	Signal      float32
 }
 
+// Packet is a decoded telemetry packet. Time is the onboard time from the
+// secondary header and Quality ranks copies of the packet received by
+// different ground stations. PUS is set for packets with a PUS secondary
+// header (see pus.go). Event and verification reports carry Event or
+// Verification instead of a payload.
+type Packet struct {
+	PacketID      uint16
+	PacketSeqCtrl uint16
+	SubsystemID   uint16
+	Time          time.Time
+	Quality       int
+	Payload       TelemetryPayload
+	PUS           *PUSMessage
+	Event         *Event
+	Verification  *Verification
+}
+
+// APID is the application process identifier of the packet.
+func (p *Packet) APID() uint16 {
+	return p.PacketID & 0x7FF
+}
+
+// SeqCount is the packet sequence count, which wraps at 16384.
+func (p *Packet) SeqCount() uint16 {
+	return p.PacketSeqCtrl & 0x3FFF
+}
+
+// pecSize is the length of the optional packet error control field, a
+// CRC-16 over the rest of the packet.
+const pecSize = 2
+
 var db *sql.DB
+
+// spacecraftID identifies the spacecraft this ingestion instance receives
+// telemetry from. CCSDS space packets do not carry it themselves.
+var spacecraftID = 1
+
 var (
 	temperatureGauge = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "satellite_temperature_celsius",
@@ -67,14 +110,51 @@ func main() {
 
 	initDatabase()
 
-	udpPort := os.Getenv("UDP_PORT")
-	if udpPort == "" {
-		udpPort = "8090"
+	if v := os.Getenv("SPACECRAFT_ID"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatal("Invalid SPACECRAFT_ID:", err)
+		}
+		spacecraftID = id
+	}
+	if v := os.Getenv("GROUND_STATION"); v != "" {
+		groundStation = v
+	}
+	if err := loadTimeCodeConfig(); err != nil {
+		log.Fatal(err)
 	}
+	if err := loadPUSAPIDs(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadEventAPID(); err != nil {
+		log.Fatal(err)
+	}
+	loadClockSampleInterval()
+	reorder = newReorderBuffer(loadReorderWindow(), storePacket)
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	udpPort := listenPort()
+	loadHealthThresholds()
 
 	
 	go startHealthServer()
 
+	go startDerivedParameterRefresh()
+
+	go startHousekeepingStructureRefresh()
+
+	go startEventDictionaryRefresh()
+
+	go startStationRefresh()
+
+	go reorder.run()
+
 	
 	addr := fmt.Sprintf(":%s", udpPort)
 	conn, err := net.ListenPacket("udp", addr)
@@ -82,6 +162,8 @@ func main() {
 		log.Fatal("Failed to create UDP server:", err)
 	}
 	defer conn.Close()
+	listening.Store(true)
+	defer listening.Store(false)
 
 	log.Printf("Telemetry ingestion service started on port %s", udpPort)
 
@@ -98,10 +180,30 @@ func main() {
 
 		log.Printf("Received %d bytes from %s", n, addr)
 
-		go processPacket(buffer[:n])
+		// The buffer is reused for the next datagram.
+		data := append([]byte(nil), buffer[:n]...)
+		queueDepth.Add(1)
+		go processPacket(data, addr)
+	}
+}
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "import":
+		return runImportCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
 	}
 }
 
+// listenPort is the UDP port live telemetry arrives on.
+func listenPort() string {
+	if port := os.Getenv("UDP_PORT"); port != "" {
+		return port
+	}
+	return "8090"
+}
+
 func initDatabase() {
 
 	dbHost := os.Getenv("DB_HOST")
@@ -143,19 +245,100 @@ func initDatabase() {
 	log.Println("Successfully connected to database")
 }
 
-func processPacket(data []byte) {
+// reorder orders live packets by onboard time before they are stored.
+var reorder *reorderBuffer
 
-	telemetry, err := parseCCSDSPacket(data)
+// processPacket decodes a datagram and hands it to the reorder buffer, which
+// stores it with storePacket.
+func processPacket(data []byte, addr net.Addr) {
+	now := time.Now()
+	ip := sourceIP(addr)
+
+	header, body, err := splitStationHeader(data)
+	station := resolveStation(header, ip)
+	if err != nil {
+		queueDepth.Add(-1)
+		log.Printf("Error parsing station header from %s: %v", station, err)
+		recordRejectedPacket(station, ip, len(data), err)
+		return
+	}
+
+	packet, err := parseCCSDSPacket(body)
+	if err == nil {
+		err = checkOnboardTime(packet.Time, now)
+	}
 	if err != nil {
-		log.Printf("Error parsing CCSDS packet: %v", err)
+		queueDepth.Add(-1)
+		log.Printf("Error parsing CCSDS packet from %s: %v", station, err)
+		recordRejectedPacket(station, ip, len(data), err)
+		return
+	}
+	lastPacketAt.Store(now.UnixNano())
+
+	reception := &Reception{
+		SpacecraftID:    spacecraftID,
+		Station:         station,
+		ReceivedAt:      now,
+		EarthReceivedAt: now,
+		SourceIP:        ip,
+		Packet:          packet,
+	}
+	if header != nil {
+		reception.EarthReceivedAt = header.Time()
+		reception.Link = header.Link()
+		stationSNRGauge.WithLabelValues(station).Set(float64(header.SNR))
+		stationRSSIGauge.WithLabelValues(station).Set(float64(header.RSSI))
+	}
+
+	reorder.add(reception, now)
+}
+
+// storeLiveReception stores the copies storePacket is handed.
+var storeLiveReception = storeReception
+
+// storePacket stores a live packet released by the reorder buffer.
+func storePacket(reception *Reception) {
+	defer queueDepth.Add(-1)
+	packet, station := reception.Packet, reception.Station
+	telemetry := &packet.Payload
+
+	if packet.isReport() {
+		outcome, err := storeReport(context.Background(), reception)
+		if err != nil {
+			log.Printf("Error storing report: %v", err)
+			return
+		}
+		log.Printf("Report APID %d seq %d from %s: %s", packet.APID(), packet.SeqCount(), station,
+			strings.ToLower(outcome))
 		return
 	}
 
-	err = storeTelemetry(telemetry)
+	outcome, telemetryID, err := storeLiveReception(context.Background(), reception)
 	if err != nil {
 		log.Printf("Error storing telemetry: %v", err)
 		return
 	}
+	switch outcome {
+	case receptionDuplicate:
+		log.Printf("Duplicate packet APID %d seq %d from %s", packet.APID(), packet.SeqCount(), station)
+		return
+	case receptionDiscarded:
+		log.Printf("Discarded corrupt packet APID %d seq %d from %s", packet.APID(), packet.SeqCount(), station)
+		return
+	}
+	if reception.Late {
+		log.Printf("Late packet APID %d seq %d from %s, %v behind", packet.APID(), packet.SeqCount(), station, reception.LateBy)
+		recordLateness(reception)
+	}
+	timestamp := packet.Time
+
+	derived, err := storeDerivedValues(telemetryID, timestamp, telemetry)
+	if err != nil {
+		log.Printf("Error storing derived values: %v", err)
+	}
+	for name, value := range derived {
+		derivedGauge.WithLabelValues(name).Set(value)
+	}
 
 	temperatureGauge.Set(float64(telemetry.Temperature))
 	batteryGauge.Set(float64(telemetry.Battery))
@@ -175,7 +358,7 @@ func processPacket(data []byte) {
 		telemetry.Temperature, telemetry.Battery, telemetry.Altitude, telemetry.Signal)
 }
 
-func parseCCSDSPacket(data []byte) (*TelemetryPayload, error) {
+func parseCCSDSPacket(data []byte) (*Packet, error) {
 	if len(data) < 16 {
 		return nil, fmt.Errorf("packet too short: %d bytes", len(data))
 	}
@@ -187,51 +370,89 @@ func parseCCSDSPacket(data []byte) (*TelemetryPayload, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading primary header: %v", err)
 	}
+	if pusAPIDs[primaryHeader.PacketID&0x7FF] {
+		return parsePUSPacket(data, primaryHeader)
+	}
 
-	var secondaryHeader CCSDSSecondaryHeader
-	err = binary.Read(buf, binary.BigEndian, &secondaryHeader)
+	onboardTime, timeCodeSize, err := decodeTimeCode(data[binary.Size(primaryHeader):])
 	if err != nil {
 		return nil, fmt.Errorf("error reading secondary header: %v", err)
 	}
+	buf.Seek(int64(timeCodeSize), io.SeekCurrent)
 
-	var payload TelemetryPayload
-	err = binary.Read(buf, binary.BigEndian, &payload)
+	var subsystemID uint16
+	err = binary.Read(buf, binary.BigEndian, &subsystemID)
 	if err != nil {
-		return nil, fmt.Errorf("error reading payload: %v", err)
+		return nil, fmt.Errorf("error reading secondary header: %v", err)
 	}
 
-	return &payload, nil
-}
+	packet := &Packet{
+		PacketID:      primaryHeader.PacketID,
+		PacketSeqCtrl: primaryHeader.PacketSeqCtrl,
+		SubsystemID:   subsystemID,
+		Time:          onboardTime,
+	}
 
-func storeTelemetry(payload *TelemetryPayload) error {
-	query := `
-		INSERT INTO telemetry (
-			timestamp, packet_id, packet_seq_ctrl, subsystem_id,
-			temperature, battery, altitude, signal_strength
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8
-		)
-	`
+	if packet.APID() == eventAPID {
+		// Event packets vary in length and always end in packet error
+		// control.
+		size := len(data) - buf.Len()
+		end := binary.Size(primaryHeader) + int(primaryHeader.PacketLength) + 1
+		if len(data) < end || end < size+pecSize {
+			return nil, fmt.Errorf("event packet truncated")
+		}
+		packet.Event, err = decodeEvent(data[size : end-pecSize])
+		if err != nil {
+			return nil, err
+		}
+		packet.Quality = packetQuality(data, primaryHeader.PacketLength, end-pecSize)
+		return packet, nil
+	}
 
-	_, err := db.Exec(query,
-		time.Now(),
-		1,
-		1,
-		1,
-		payload.Temperature,
-		payload.Battery,
-		payload.Altitude,
-		payload.Signal,
-	)
+	err = binary.Read(buf, binary.BigEndian, &packet.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("error reading payload: %v", err)
+	}
+	packet.Quality = packetQuality(data, primaryHeader.PacketLength, len(data)-buf.Len())
+	return packet, nil
+}
 
-	return err
+// packetQuality checks the packet error control field, which is present when
+// the packet data length covers two bytes beyond the payload. size is the
+// length of the packet without it.
+func packetQuality(data []byte, packetLength uint16, size int) int {
+	end := binary.Size(CCSDSPrimaryHeader{}) + int(packetLength) + 1
+	if end != size+pecSize || len(data) < end {
+		return qualityUnchecked
+	}
+	if crc16(data[:end-pecSize]) != binary.BigEndian.Uint16(data[end-pecSize:end]) {
+		return qualityCorrupt
+	}
+	return qualityVerified
+}
+
+// crc16 is the CRC-16-CCITT used for CCSDS packet error control
+// (polynomial 0x1021, initial value 0xFFFF).
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
 }
 
 func startHealthServer() {
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("healthy"))
-	})
+	http.HandleFunc("/health", handleLiveness)
+	http.HandleFunc("/health/live", handleLiveness)
+	http.HandleFunc("/health/ready", handleReadiness)
+	http.HandleFunc("/import", handleImport)
 
 	log.Println("Health server started on :8091")
 	if err := http.ListenAndServe(":8091", nil); err != nil {
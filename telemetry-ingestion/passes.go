@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+)
+
+// Passes are inferred per station by record_pass_packet from the
+// earth-received time of every copy the station receives. Sequence counts
+// skipped within a pass are counted here, per APID, as lost packets.
+
+// maxSequenceGap is the largest jump in sequence count counted as loss; a
+// count further ahead is taken to be behind, after wrapping.
+const maxSequenceGap = 0x2000
+
+// sequenceGap returns how many packets were lost between the last and next
+// sequence counts of an APID, and whether next is ahead of last. Counts wrap
+// after 14 bits.
+func sequenceGap(last, next uint16) (int, bool) {
+	d := int(next-last) & 0x3FFF
+	if d == 0 || d >= maxSequenceGap {
+		return 0, false
+	}
+	return d - 1, true
+}
+
+type passKey struct {
+	spacecraftID int
+	station      string
+	importID     int
+}
+
+type passSequence struct {
+	passID int
+	last   map[uint16]uint16
+}
+
+// passSequences holds the last sequence count per APID of the pass each
+// station, live or in an import, is in.
+var passSequences = struct {
+	sync.Mutex
+	m map[passKey]*passSequence
+}{m: map[passKey]*passSequence{}}
+
+// lostPackets records the copy's sequence count in its pass and returns how
+// many packets of its APID were skipped since the last copy. Copies that
+// arrive out of order are not counted as recovered.
+func lostPackets(r *Reception, passID int) int {
+	key := passKey{spacecraftID: r.SpacecraftID, station: r.Station, importID: r.ImportID}
+	apid, seq := r.Packet.APID(), r.Packet.SeqCount()
+
+	passSequences.Lock()
+	defer passSequences.Unlock()
+
+	s := passSequences.m[key]
+	if s == nil || s.passID != passID {
+		if r.ImportID == 0 {
+			log.Printf("AOS: %s pass %d", r.Station, passID)
+		}
+		s = &passSequence{passID: passID, last: map[uint16]uint16{}}
+		passSequences.m[key] = s
+	}
+
+	last, seen := s.last[apid]
+	if !seen {
+		s.last[apid] = seq
+		return 0
+	}
+	lost, ahead := sequenceGap(last, seq)
+	if ahead {
+		s.last[apid] = seq
+	}
+	return lost
+}
+
+// recordPass assigns a copy to its station's pass and returns the pass id, or
+// 0 when the copy has no earth-received time.
+func recordPass(ctx context.Context, tx *sql.Tx, r *Reception, anomalous bool) (int, error) {
+	if r.EarthReceivedAt.IsZero() {
+		return 0, nil
+	}
+
+	// The header and payload of a corrupt copy cannot be trusted, so it
+	// counts towards its pass but not its signal strength or lost packets.
+	// Reports carry no signal strength.
+	corrupt := r.Packet.Quality == qualityCorrupt
+	var signal interface{}
+	if !corrupt && !r.Packet.isReport() {
+		signal = r.Packet.Payload.Signal
+	}
+	var passID int
+	err := tx.QueryRowContext(ctx, `SELECT record_pass_packet($1, $2, $3, $4, $5)`,
+		r.SpacecraftID, r.Station, r.EarthReceivedAt, signal, anomalous).Scan(&passID)
+	if err != nil || corrupt {
+		return passID, err
+	}
+
+	if lost := lostPackets(r, passID); lost > 0 {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE passes SET lost_packets = lost_packets + $2, updated_at = NOW() WHERE id = $1
+		`, passID, lost)
+	}
+	return passID, err
+}
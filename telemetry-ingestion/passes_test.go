@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSequenceGap(t *testing.T) {
+	cases := []struct {
+		last, next uint16
+		lost       int
+		ahead      bool
+	}{
+		{5, 6, 0, true},
+		{5, 9, 3, true},
+		{5, 5, 0, false},
+		{5, 4, 0, false},
+		{0x3FFF, 0, 0, true},
+		{0x3FFE, 2, 3, true},
+		{100, 100 + maxSequenceGap, 0, false},
+	}
+	for _, tc := range cases {
+		lost, ahead := sequenceGap(tc.last, tc.next)
+		if lost != tc.lost || ahead != tc.ahead {
+			t.Errorf("sequenceGap(%d, %d) = %d, %v, want %d, %v", tc.last, tc.next, lost, ahead, tc.lost, tc.ahead)
+		}
+	}
+}
+
+func TestLostPackets(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	reception := func(seq uint16) *Reception {
+		p, err := parseCCSDSPacket(testPacket(seq, ts, 25))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Reception{SpacecraftID: 1, Station: "GS-lost", Packet: p}
+	}
+
+	steps := []struct {
+		passID int
+		seq    uint16
+		want   int
+	}{
+		{1, 10, 0},
+		{1, 11, 0},
+		{1, 15, 3},
+		{1, 13, 0}, // late, not recovered
+		{1, 16, 0},
+		{2, 40, 0}, // new pass, no baseline
+		{2, 42, 1},
+	}
+	for _, s := range steps {
+		if got := lostPackets(reception(s.seq), s.passID); got != s.want {
+			t.Errorf("pass %d seq %d: lost = %d, want %d", s.passID, s.seq, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Packets of the APIDs listed in PUS_APIDS follow the ECSS Packet Utilization
+// Standard (ECSS-E-ST-70-41C, PUS-C) rather than the native layout. Their
+// secondary header names the service and message subtype of the packet, and
+// the application data is laid out by the service:
+//
+//   - ST[3,25] and ST[3,26] housekeeping reports carry a structure ID and the
+//     values of the parameters defined for it in housekeeping_structures. They
+//     are stored as telemetry, like native packets.
+//   - ST[5,1] to ST[5,4] event reports carry an event definition ID and
+//     auxiliary data, and are stored in events (see events.go).
+//   - ST[1] request verification reports carry the packet ID and sequence
+//     control of the telecommand they verify, and are stored in
+//     command_verifications, which tracks each telecommand in commands.
+//
+// PUS packets end in a packet error control field.
+
+// pusVersion is the TM packet PUS version number of PUS-C.
+const pusVersion = 2
+
+// PUS service types.
+const (
+	pusVerification = 1
+	pusHousekeeping = 3
+	pusEvent        = 5
+)
+
+// pusHeaderSize is the length of the PUS-C secondary header before the time.
+const pusHeaderSize = 7
+
+// PUSMessage is the PUS-C secondary header of a packet.
+type PUSMessage struct {
+	Version        uint8
+	TimeStatus     uint8
+	Service        uint8
+	Subtype        uint8
+	MessageCounter uint16
+	DestinationID  uint16
+	// StructureID is the housekeeping structure of an ST[3] report, whose
+	// parameters are decoded into the packet's payload.
+	StructureID uint16
+}
+
+func (m *PUSMessage) String() string {
+	return fmt.Sprintf("ST[%d,%d]", m.Service, m.Subtype)
+}
+
+// pusAPIDs holds the APIDs whose packets carry a PUS-C secondary header.
+var pusAPIDs = map[uint16]bool{}
+
+func loadPUSAPIDs() error {
+	v := os.Getenv("PUS_APIDS")
+	if v == "" {
+		return nil
+	}
+	for _, s := range strings.Split(v, ",") {
+		apid, err := strconv.ParseUint(strings.TrimSpace(s), 0, 11)
+		if err != nil {
+			return fmt.Errorf("invalid PUS_APIDS: %q", s)
+		}
+		pusAPIDs[uint16(apid)] = true
+	}
+	return nil
+}
+
+// housekeepingStructures maps structure IDs to their parameter names, in the
+// order their values appear in a report.
+var housekeepingStructures = struct {
+	sync.RWMutex
+	params map[uint16][]string
+}{params: map[uint16][]string{}}
+
+func startHousekeepingStructureRefresh() {
+	interval := 60 * time.Second
+	if v := os.Getenv("HOUSEKEEPING_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	loadHousekeepingStructures()
+	for range time.Tick(interval) {
+		loadHousekeepingStructures()
+	}
+}
+
+func loadHousekeepingStructures() {
+	rows, err := db.Query(`SELECT structure_id, parameters FROM housekeeping_structures`)
+	if err != nil {
+		log.Printf("Error loading housekeeping structures: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	structures := map[uint16][]string{}
+	for rows.Next() {
+		var id int
+		var params []string
+		if err := rows.Scan(&id, pq.Array(&params)); err != nil {
+			log.Printf("Error scanning housekeeping structure: %v", err)
+			continue
+		}
+		if err := checkHousekeepingStructure(params); err != nil {
+			log.Printf("Housekeeping structure %d disabled: %v", id, err)
+			continue
+		}
+		structures[uint16(id)] = params
+	}
+
+	housekeepingStructures.Lock()
+	housekeepingStructures.params = structures
+	housekeepingStructures.Unlock()
+}
+
+// checkHousekeepingStructure verifies that a structure defines each
+// downlinked parameter exactly once, and nothing else.
+func checkHousekeepingStructure(params []string) error {
+	downlinked := payloadParameters(&TelemetryPayload{})
+	seen := map[string]bool{}
+	for _, name := range params {
+		if _, ok := downlinked[name]; !ok {
+			return fmt.Errorf("unknown parameter %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("parameter %q repeated", name)
+		}
+		seen[name] = true
+	}
+	if len(seen) != len(downlinked) {
+		return fmt.Errorf("not all downlinked parameters defined")
+	}
+	return nil
+}
+
+// parsePUSPacket decodes a packet with a PUS-C secondary header. PUS packets
+// have no subsystem ID; their APID stands in for it.
+func parsePUSPacket(data []byte, header CCSDSPrimaryHeader) (*Packet, error) {
+	if header.PacketID&0x0800 == 0 {
+		return nil, fmt.Errorf("PUS packet without secondary header")
+	}
+	primarySize := binary.Size(header)
+	end := primarySize + int(header.PacketLength) + 1
+	if len(data) < end {
+		return nil, fmt.Errorf("packet truncated: %d of %d bytes", len(data), end)
+	}
+	if end < primarySize+pusHeaderSize+pecSize {
+		return nil, fmt.Errorf("packet too short for a PUS secondary header")
+	}
+
+	h := data[primarySize:]
+	m := &PUSMessage{
+		Version:        h[0] >> 4,
+		TimeStatus:     h[0] & 0x0F,
+		Service:        h[1],
+		Subtype:        h[2],
+		MessageCounter: binary.BigEndian.Uint16(h[3:]),
+		DestinationID:  binary.BigEndian.Uint16(h[5:]),
+	}
+	if m.Version != pusVersion {
+		return nil, fmt.Errorf("unsupported PUS version %d", m.Version)
+	}
+
+	onboardTime, timeCodeSize, err := decodeTimeCode(data[primarySize+pusHeaderSize : end-pecSize])
+	if err != nil {
+		return nil, fmt.Errorf("error reading secondary header: %v", err)
+	}
+	size := primarySize + pusHeaderSize + timeCodeSize
+
+	p := &Packet{
+		PacketID:      header.PacketID,
+		PacketSeqCtrl: header.PacketSeqCtrl,
+		SubsystemID:   header.PacketID & 0x7FF,
+		Time:          onboardTime,
+		Quality:       packetQuality(data, header.PacketLength, end-pecSize),
+		PUS:           m,
+	}
+	appData := data[size : end-pecSize]
+
+	switch {
+	case m.Service == pusHousekeeping && (m.Subtype == 25 || m.Subtype == 26):
+		err = decodeHousekeeping(m, appData, &p.Payload)
+	case m.Service == pusEvent && m.Subtype >= 1 && m.Subtype <= 4:
+		p.Event, err = decodeEventReport(m, appData)
+	case m.Service == pusVerification:
+		p.Verification, err = decodeVerification(m, appData)
+	default:
+		err = fmt.Errorf("unsupported PUS service %s", m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// decodeHousekeeping decodes the parameters of a housekeeping report into a
+// payload. Parameter values are IEEE 754 single precision (PTC 5, PFC 1).
+func decodeHousekeeping(m *PUSMessage, data []byte, payload *TelemetryPayload) error {
+	if len(data) < 2 {
+		return fmt.Errorf("%s report without structure ID", m)
+	}
+	m.StructureID = binary.BigEndian.Uint16(data)
+	data = data[2:]
+
+	housekeepingStructures.RLock()
+	params, ok := housekeepingStructures.params[m.StructureID]
+	housekeepingStructures.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown housekeeping structure %d", m.StructureID)
+	}
+	if len(data) != 4*len(params) {
+		return fmt.Errorf("housekeeping structure %d has %d parameters, report has %d bytes",
+			m.StructureID, len(params), len(data))
+	}
+
+	for i, name := range params {
+		value := math.Float32frombits(binary.BigEndian.Uint32(data[4*i:]))
+		switch name {
+		case "temperature":
+			payload.Temperature = value
+		case "battery":
+			payload.Battery = value
+		case "altitude":
+			payload.Altitude = value
+		case "signal_strength":
+			payload.Signal = value
+		}
+	}
+	return nil
+}
+
+// decodeEventReport decodes an ST[5] event report, whose subtype is its
+// severity. The auxiliary data is kept as it is.
+func decodeEventReport(m *PUSMessage, data []byte) (*Event, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%s report without event ID", m)
+	}
+	return &Event{
+		Severity: eventSeverities[m.Subtype],
+		EventID:  binary.BigEndian.Uint16(data),
+		Data:     append([]byte(nil), data[2:]...),
+	}, nil
+}
+
+// Verification stages by ST[1] subtype. Odd subtypes report success and even
+// ones failure; ST[1,10] reports a routing failure.
+var verificationStages = map[uint8]string{
+	1: "ACCEPTANCE", 2: "ACCEPTANCE",
+	3: "START", 4: "START",
+	5: "PROGRESS", 6: "PROGRESS",
+	7: "COMPLETION", 8: "COMPLETION",
+	10: "ROUTING",
+}
+
+// Verification is an ST[1] request verification report. RequestAPID and
+// RequestSeqCount identify the telecommand. Progress reports carry a step ID
+// and failure reports a failure code with optional data.
+type Verification struct {
+	Stage           string
+	Success         bool
+	RequestAPID     uint16
+	RequestSeqCount uint16
+	StepID          *uint16
+	FailureCode     *uint16
+	FailureData     []byte
+}
+
+func decodeVerification(m *PUSMessage, data []byte) (*Verification, error) {
+	stage, ok := verificationStages[m.Subtype]
+	if !ok {
+		return nil, fmt.Errorf("unsupported PUS service %s", m)
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%s report without request ID", m)
+	}
+	v := &Verification{
+		Stage:           stage,
+		Success:         m.Subtype%2 == 1,
+		RequestAPID:     binary.BigEndian.Uint16(data) & 0x7FF,
+		RequestSeqCount: binary.BigEndian.Uint16(data[2:]) & 0x3FFF,
+	}
+	data = data[4:]
+
+	if stage == "PROGRESS" {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%s report without step ID", m)
+		}
+		step := binary.BigEndian.Uint16(data)
+		v.StepID = &step
+		data = data[2:]
+	}
+	if !v.Success {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%s report without failure code", m)
+		}
+		code := binary.BigEndian.Uint16(data)
+		v.FailureCode = &code
+		v.FailureData = append([]byte(nil), data[2:]...)
+	} else if len(data) > 0 {
+		return nil, fmt.Errorf("%s report has %d unexpected bytes", m, len(data))
+	}
+	return v, nil
+}
+
+func insertVerification(ctx context.Context, tx *sql.Tx, r *Reception) (bool, error) {
+	p, v := r.Packet, r.Packet.Verification
+	var stepID, failureCode interface{}
+	if v.StepID != nil {
+		stepID = int(*v.StepID)
+	}
+	if v.FailureCode != nil {
+		failureCode = int(*v.FailureCode)
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO command_verifications (
+			timestamp, spacecraft_id, apid, seq_count, request_apid, request_seq_count, stage, success,
+			step_id, failure_code, failure_data, station, received_at, import_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14, 0))
+		ON CONFLICT DO NOTHING
+	`, p.Time, r.SpacecraftID, p.APID(), p.SeqCount(), v.RequestAPID, v.RequestSeqCount, v.Stage, v.Success,
+		stepID, failureCode, v.FailureData, r.Station, r.ReceivedAt, r.ImportID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
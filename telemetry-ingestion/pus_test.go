@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// pusTimeCode is CUC 4+3 with its P-field: 2020-01-01T00:00:00.5Z.
+var pusTimeCode = []byte{0x1F, 0x74, 0x9E, 0x3F, 0xA5, 0x80, 0x00, 0x00}
+
+// testPUSPacket builds a PUS-C packet of APID 0x20 with packet error control.
+func testPUSPacket(service, subtype uint8, appData []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, CCSDSPrimaryHeader{
+		PacketID:      1<<11 | 0x20,
+		PacketSeqCtrl: 3<<14 | 7,
+		PacketLength:  uint16(pusHeaderSize + len(pusTimeCode) + len(appData) - 1),
+	})
+	buf.Write([]byte{pusVersion<<4 | 1, service, subtype, 0, 42, 0, 3})
+	buf.Write(pusTimeCode)
+	buf.Write(appData)
+	return withPEC(buf.Bytes())
+}
+
+func withPUSAPID(t *testing.T) {
+	pusAPIDs[0x20] = true
+	t.Cleanup(func() { delete(pusAPIDs, 0x20) })
+}
+
+func TestParsePUSHousekeeping(t *testing.T) {
+	withPUSAPID(t)
+	housekeepingStructures.Lock()
+	saved := housekeepingStructures.params
+	housekeepingStructures.params = map[uint16][]string{
+		7: {"battery", "temperature", "signal_strength", "altitude"},
+	}
+	housekeepingStructures.Unlock()
+	defer func() { housekeepingStructures.params = saved }()
+
+	appData := binary.BigEndian.AppendUint16(nil, 7)
+	for _, v := range []float32{80, 21.5, -50, 500} {
+		appData = binary.BigEndian.AppendUint32(appData, math.Float32bits(v))
+	}
+	p, err := parseCCSDSPacket(testPUSPacket(3, 25, appData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PUS == nil || p.PUS.StructureID != 7 || p.PUS.MessageCounter != 42 || p.PUS.DestinationID != 3 {
+		t.Fatalf("PUS header decoded as %+v", p.PUS)
+	}
+	want := TelemetryPayload{Temperature: 21.5, Battery: 80, Altitude: 500, Signal: -50}
+	if p.Payload != want || p.SubsystemID != 0x20 || p.Quality != qualityVerified || p.isReport() {
+		t.Errorf("packet decoded as %+v", p)
+	}
+	if want := time.Date(2020, 1, 1, 0, 0, 0, 500000000, time.UTC); !p.Time.Equal(want) {
+		t.Errorf("time = %v, want %v", p.Time, want)
+	}
+
+	if _, err := parseCCSDSPacket(testPUSPacket(3, 25, appData[:10])); err == nil {
+		t.Error("short housekeeping report accepted")
+	}
+	if _, err := parseCCSDSPacket(testPUSPacket(3, 25, append([]byte{0, 8}, appData[2:]...))); err == nil {
+		t.Error("unknown housekeeping structure accepted")
+	}
+}
+
+func TestParsePUSEvent(t *testing.T) {
+	withPUSAPID(t)
+
+	p, err := parseCCSDSPacket(testPUSPacket(5, 4, []byte{0x10, 0x01, 0xCA, 0xFE}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := p.Event
+	if !p.isReport() || e == nil {
+		t.Fatal("event report not decoded as an event")
+	}
+	if e.Severity != "HIGH" || e.EventID != 0x1001 || !bytes.Equal(e.Data, []byte{0xCA, 0xFE}) {
+		t.Errorf("event decoded as %+v", e)
+	}
+
+	if _, err := parseCCSDSPacket(testPUSPacket(5, 5, []byte{0x10, 0x01})); err == nil {
+		t.Error("ST[5,5] accepted")
+	}
+}
+
+func TestDecodeVerification(t *testing.T) {
+	request := []byte{0x18, 0x30, 0xC0, 0x0C}
+	tests := []struct {
+		name    string
+		subtype uint8
+		data    []byte
+		stage   string
+		success bool
+		step    int
+		code    int
+	}{
+		{"acceptance success", 1, request, "ACCEPTANCE", true, -1, -1},
+		{"progress success", 5, append(request[:4:4], 0, 2), "PROGRESS", true, 2, -1},
+		{"progress failure", 6, append(request[:4:4], 0, 2, 0, 9, 0xFF), "PROGRESS", false, 2, 9},
+		{"completion failure", 8, append(request[:4:4], 0, 9), "COMPLETION", false, -1, 9},
+		{"routing failure", 10, append(request[:4:4], 0, 1), "ROUTING", false, -1, 1},
+	}
+	for _, tt := range tests {
+		v, err := decodeVerification(&PUSMessage{Service: 1, Subtype: tt.subtype}, tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if v.Stage != tt.stage || v.Success != tt.success || v.RequestAPID != 0x30 || v.RequestSeqCount != 12 {
+			t.Errorf("%s: decoded as %+v", tt.name, v)
+		}
+		if (v.StepID == nil) != (tt.step < 0) || v.StepID != nil && int(*v.StepID) != tt.step {
+			t.Errorf("%s: step ID %v, want %d", tt.name, v.StepID, tt.step)
+		}
+		if (v.FailureCode == nil) != (tt.code < 0) || v.FailureCode != nil && int(*v.FailureCode) != tt.code {
+			t.Errorf("%s: failure code %v, want %d", tt.name, v.FailureCode, tt.code)
+		}
+	}
+
+	for _, tc := range []struct {
+		subtype uint8
+		data    []byte
+	}{
+		{9, request},
+		{2, request},
+		{5, request},
+		{1, append(request[:4:4], 0)},
+		{1, request[:3]},
+	} {
+		if _, err := decodeVerification(&PUSMessage{Service: 1, Subtype: tc.subtype}, tc.data); err == nil {
+			t.Errorf("ST[1,%d] with % x accepted", tc.subtype, tc.data)
+		}
+	}
+}
+
+func TestParsePUSRejectsOtherVersions(t *testing.T) {
+	withPUSAPID(t)
+	packet := testPUSPacket(5, 1, []byte{0, 1})
+	packet[6] = 1 << 4
+	if _, err := parseCCSDSPacket(packet); err == nil {
+		t.Error("PUS-A header accepted")
+	}
+}
+
+func TestCheckHousekeepingStructure(t *testing.T) {
+	valid := []string{"temperature", "battery", "altitude", "signal_strength"}
+	if err := checkHousekeepingStructure(valid); err != nil {
+		t.Errorf("valid structure: %v", err)
+	}
+	for _, params := range [][]string{
+		valid[:3],
+		append(valid[:3:3], "temperature"),
+		append(valid[:4:4], "voltage"),
+	} {
+		if err := checkHousekeepingStructure(params); err == nil {
+			t.Errorf("%v accepted", params)
+		}
+	}
+}
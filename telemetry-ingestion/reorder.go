@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Live packets are parsed concurrently and may be relayed by several
+// stations, so they arrive out of onboard-time order. Each APID has a reorder
+// buffer that holds packets for REORDER_WINDOW after they arrive and hands
+// them to storage in onboard-time order, one at a time. A packet older than
+// one already handed on is late: it is stored at once, flagged, and how far
+// it was behind is recorded.
+
+var (
+	reorderHeldGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "satellite_reorder_buffer_packets",
+		Help: "Packets held in the reorder buffers",
+	})
+	latenessHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "satellite_packet_lateness_seconds",
+		Help:    "Onboard time by which late packets were behind the last packet released for their APID",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 8),
+	}, []string{"apid"})
+)
+
+func loadReorderWindow() time.Duration {
+	window := 2 * time.Second
+	if v := os.Getenv("REORDER_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatal("Invalid REORDER_WINDOW:", v)
+		}
+		window = d
+	}
+	return window
+}
+
+type heldReception struct {
+	r   *Reception
+	due time.Time
+}
+
+// reorderQueue is the buffer of one APID. Its worker stores the ready
+// packets, so a slow APID never holds up the others or intake.
+type reorderQueue struct {
+	mu sync.Mutex
+	// held is sorted by onboard time.
+	held []heldReception
+	// released is the latest onboard time handed on.
+	released time.Time
+	// ready is the packets handed on and waiting for the worker, in order.
+	ready []*Reception
+	wake  chan struct{}
+}
+
+// signal wakes the queue's worker.
+func (q *reorderQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+type reorderBuffer struct {
+	// mu guards queues; each queue has its own lock.
+	mu     sync.Mutex
+	window time.Duration
+	queues map[uint16]*reorderQueue
+	held   atomic.Int64
+	store  func(*Reception)
+}
+
+// newReorderBuffer returns a buffer that calls store for each packet, in
+// order per APID.
+func newReorderBuffer(window time.Duration, store func(*Reception)) *reorderBuffer {
+	return &reorderBuffer{window: window, queues: map[uint16]*reorderQueue{}, store: store}
+}
+
+// queue returns the queue of an APID, starting its storage worker.
+func (b *reorderBuffer) queue(apid uint16) *reorderQueue {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.queues[apid]
+	if q == nil {
+		q = &reorderQueue{wake: make(chan struct{}, 1)}
+		b.queues[apid] = q
+		go b.work(q)
+	}
+	return q
+}
+
+// work stores the ready packets of a queue one at a time, in order.
+func (b *reorderBuffer) work(q *reorderQueue) {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			ready := q.ready
+			q.ready = nil
+			q.mu.Unlock()
+			if len(ready) == 0 {
+				break
+			}
+			for _, r := range ready {
+				b.store(r)
+			}
+		}
+	}
+}
+
+// add holds a packet that arrived at now until its window closes, or hands
+// it on at once if it is late.
+func (b *reorderBuffer) add(r *Reception, now time.Time) {
+	q := b.queue(r.Packet.APID())
+	defer q.signal()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t := r.Packet.Time
+	if t.Before(q.released) {
+		r.Late = true
+		r.LateBy = q.released.Sub(t)
+		q.ready = append(q.ready, r)
+		return
+	}
+
+	i, _ := slices.BinarySearchFunc(q.held, t, func(h heldReception, t time.Time) int {
+		if h.r.Packet.Time.After(t) {
+			return 1
+		}
+		return -1
+	})
+	q.held = slices.Insert(q.held, i, heldReception{r: r, due: now.Add(b.window)})
+	b.held.Add(1)
+	if b.window == 0 {
+		b.release(q, now)
+	}
+	reorderHeldGauge.Set(float64(b.held.Load()))
+}
+
+// flush hands on every packet whose window has closed at now, with every
+// packet of its APID before it.
+func (b *reorderBuffer) flush(now time.Time) {
+	b.mu.Lock()
+	queues := make([]*reorderQueue, 0, len(b.queues))
+	for _, q := range b.queues {
+		queues = append(queues, q)
+	}
+	b.mu.Unlock()
+
+	for _, q := range queues {
+		q.mu.Lock()
+		released := b.release(q, now)
+		q.mu.Unlock()
+		if released {
+			q.signal()
+		}
+	}
+	reorderHeldGauge.Set(float64(b.held.Load()))
+}
+
+// release moves the due packets of a queue to its ready list and reports
+// whether there were any. The caller holds q.mu.
+func (b *reorderBuffer) release(q *reorderQueue, now time.Time) bool {
+	n := 0
+	for i, h := range q.held {
+		if !h.due.After(now) {
+			n = i + 1
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	for _, h := range q.held[:n] {
+		q.ready = append(q.ready, h.r)
+	}
+	q.released = q.held[n-1].r.Packet.Time
+	q.held = slices.Delete(q.held, 0, n)
+	b.held.Add(int64(-n))
+	return true
+}
+
+// run flushes the buffer as windows close.
+func (b *reorderBuffer) run() {
+	if b.window == 0 {
+		return
+	}
+	interval := b.window / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	for now := range time.Tick(interval) {
+		b.flush(now)
+	}
+}
+
+// recordLateness records how late a stored late packet was.
+func recordLateness(r *Reception) {
+	latenessHistogram.WithLabelValues(strconv.Itoa(int(r.Packet.APID()))).Observe(r.LateBy.Seconds())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func reorderReception(apid uint16, seq uint16, onboard time.Time) *Reception {
+	return &Reception{Packet: &Packet{PacketID: 1<<11 | apid, PacketSeqCtrl: 3<<14 | seq, Time: onboard}}
+}
+
+// collect returns a buffer whose stored packets are sent on the channel.
+func collect(window time.Duration) (*reorderBuffer, chan *Reception) {
+	stored := make(chan *Reception, 16)
+	return newReorderBuffer(window, func(r *Reception) { stored <- r }), stored
+}
+
+func receive(t *testing.T, stored chan *Reception, n int) []*Reception {
+	t.Helper()
+	var got []*Reception
+	for i := 0; i < n; i++ {
+		select {
+		case r := <-stored:
+			got = append(got, r)
+		case <-time.After(time.Second):
+			t.Fatalf("stored %d of %d packets", len(got), n)
+		}
+	}
+	select {
+	case r := <-stored:
+		t.Fatalf("unexpected packet seq %d", r.Packet.SeqCount())
+	case <-time.After(20 * time.Millisecond):
+	}
+	return got
+}
+
+func TestReorderBufferOrdersWithinWindow(t *testing.T) {
+	b, stored := collect(2 * time.Second)
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	onboard := now.Add(-time.Minute)
+
+	b.add(reorderReception(1, 3, onboard.Add(3*time.Second)), now)
+	b.add(reorderReception(1, 1, onboard.Add(time.Second)), now.Add(500*time.Millisecond))
+	b.add(reorderReception(1, 2, onboard.Add(2*time.Second)), now.Add(time.Second))
+
+	b.flush(now.Add(time.Second))
+	receive(t, stored, 0)
+
+	// The first packet to arrive is due, and the packets before it go with it.
+	b.flush(now.Add(2 * time.Second))
+	got := receive(t, stored, 3)
+	for i, r := range got {
+		if r.Packet.SeqCount() != uint16(i+1) || r.Late {
+			t.Errorf("packet %d: seq %d, late %v", i, r.Packet.SeqCount(), r.Late)
+		}
+	}
+	if n := b.held.Load(); n != 0 {
+		t.Errorf("%d packets still held", n)
+	}
+}
+
+func TestReorderBufferFlagsLatePackets(t *testing.T) {
+	b, stored := collect(time.Second)
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	onboard := now.Add(-time.Minute)
+
+	b.add(reorderReception(1, 5, onboard.Add(5*time.Second)), now)
+	b.flush(now.Add(time.Second))
+	receive(t, stored, 1)
+
+	// Stored at once, without waiting for a flush.
+	b.add(reorderReception(1, 4, onboard.Add(1500*time.Millisecond)), now.Add(2*time.Second))
+	got := receive(t, stored, 1)
+	if !got[0].Late || got[0].LateBy != 3500*time.Millisecond {
+		t.Errorf("late %v by %v, want late by 3.5s", got[0].Late, got[0].LateBy)
+	}
+
+	// Another APID has its own order.
+	b.add(reorderReception(2, 1, onboard), now.Add(2*time.Second))
+	b.flush(now.Add(3 * time.Second))
+	if got := receive(t, stored, 1); got[0].Late {
+		t.Error("first packet of another APID flagged late")
+	}
+}
+
+func TestReorderBufferWithoutWindow(t *testing.T) {
+	b, stored := collect(0)
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	b.add(reorderReception(1, 2, now.Add(2*time.Second)), now)
+	b.add(reorderReception(1, 1, now.Add(time.Second)), now)
+	got := receive(t, stored, 2)
+	if got[0].Late || !got[1].Late || got[1].LateBy != time.Second {
+		t.Errorf("late flags %v, %v (by %v)", got[0].Late, got[1].Late, got[1].LateBy)
+	}
+}
+
+func TestReorderBufferStoresInOnboardOrder(t *testing.T) {
+	defer func(saved func(context.Context, *Reception) (string, int, error)) {
+		storeLiveReception = saved
+	}(storeLiveReception)
+	stored := make(chan *Reception, 16)
+	storeLiveReception = func(ctx context.Context, r *Reception) (string, int, error) {
+		stored <- r
+		return receptionDuplicate, 0, nil
+	}
+
+	b := newReorderBuffer(time.Second, storePacket)
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	onboard := now.Add(-time.Minute)
+	for _, seq := range []uint16{3, 1, 4, 2} {
+		queueDepth.Add(1)
+		b.add(reorderReception(1, seq, onboard.Add(time.Duration(seq)*time.Second)), now)
+	}
+	b.flush(now.Add(time.Second))
+
+	got := receive(t, stored, 4)
+	for i, r := range got {
+		if r.Packet.SeqCount() != uint16(i+1) {
+			t.Fatalf("storeReception called with seq %d at position %d", r.Packet.SeqCount(), i)
+		}
+	}
+}
+
+func TestReorderBufferSlowAPIDDoesNotBlockOthers(t *testing.T) {
+	blocked := make(chan struct{})
+	stored := make(chan *Reception, 16)
+	b := newReorderBuffer(0, func(r *Reception) {
+		if r.Packet.APID() == 1 {
+			<-blocked
+		}
+		stored <- r
+	})
+	defer close(blocked)
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// APID 1's worker is stuck storing its first packet, and the rest pile up.
+	for i := 0; i < 2000; i++ {
+		b.add(reorderReception(1, uint16(i), now.Add(time.Duration(i)*time.Millisecond)), now)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.add(reorderReception(2, 1, now), now)
+		b.flush(now)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("add and flush blocked behind another APID")
+	}
+	if got := receive(t, stored, 1); got[0].Packet.APID() != 2 {
+		t.Errorf("stored APID %d, want 2", got[0].Packet.APID())
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Ground stations are registered in ground_stations. A datagram is attributed
+// to the station named in its station header, else to the registered station
+// whose address range contains the sender, else to GROUND_STATION, and
+// otherwise to a station learned from the sender's address. Stations seen
+// for the first time are added to the registry.
+
+// stationHeaderMagic starts a station header. No CCSDS packet can start with
+// it, since the packet version number would be 2.
+const stationHeaderMagic = "GSH1"
+
+// StationHeader may precede a packet in a datagram. The station reports who
+// received the packet, when, and over what link. Station is ASCII, padded
+// with NULs.
+type StationHeader struct {
+	Magic           [4]byte
+	Station         [16]byte
+	EarthReceivedAt int64 // Unix nanoseconds
+	RSSI            float32
+	SNR             float32
+	CorrectedBits   uint32
+}
+
+var stationHeaderSize = binary.Size(StationHeader{})
+
+// LinkMetrics describe the downlink a copy of a packet arrived over. RSSI is
+// in dBm, SNR in dB and CorrectedBits counts bits fixed by the decoder.
+type LinkMetrics struct {
+	RSSI          float32
+	SNR           float32
+	CorrectedBits uint32
+}
+
+// Origins of a ground_stations row.
+const (
+	originConfigured = "configured"
+	originHeader     = "header"
+	originAddress    = "address"
+)
+
+var (
+	stationSNRGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "satellite_station_snr_db",
+		Help: "Signal to noise ratio of the latest packet from each ground station",
+	}, []string{"station"})
+	stationRSSIGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "satellite_station_rssi_dbm",
+		Help: "Received signal strength of the latest packet from each ground station",
+	}, []string{"station"})
+)
+
+// splitStationHeader removes the station header from a datagram. It returns
+// a nil header if there is none.
+func splitStationHeader(data []byte) (*StationHeader, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(stationHeaderMagic)) {
+		return nil, data, nil
+	}
+	if len(data) < stationHeaderSize {
+		return nil, nil, errors.New("truncated station header")
+	}
+	var h StationHeader
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &h); err != nil {
+		return nil, nil, err
+	}
+	if h.StationID() == "" {
+		return nil, nil, errors.New("station header without a station ID")
+	}
+	return &h, data[stationHeaderSize:], nil
+}
+
+func (h *StationHeader) StationID() string {
+	return strings.TrimRight(string(h.Station[:]), "\x00 ")
+}
+
+func (h *StationHeader) Time() time.Time {
+	return time.Unix(0, h.EarthReceivedAt).UTC()
+}
+
+func (h *StationHeader) Link() *LinkMetrics {
+	return &LinkMetrics{RSSI: h.RSSI, SNR: h.SNR, CorrectedBits: h.CorrectedBits}
+}
+
+type stationNetwork struct {
+	id      string
+	network *net.IPNet
+}
+
+// stationRegistry caches ground_stations so datagrams can be attributed
+// without a query.
+type stationRegistry struct {
+	mu       sync.RWMutex
+	known    map[string]bool
+	networks []stationNetwork
+}
+
+var stations = &stationRegistry{known: map[string]bool{}}
+
+// set replaces the registry, ordering networks most specific first.
+func (r *stationRegistry) set(known map[string]bool, networks []stationNetwork) {
+	sort.SliceStable(networks, func(i, j int) bool {
+		a, _ := networks[i].network.Mask.Size()
+		b, _ := networks[j].network.Mask.Size()
+		return a > b
+	})
+	r.mu.Lock()
+	r.known = known
+	r.networks = networks
+	r.mu.Unlock()
+}
+
+// lookup returns the station whose address range contains ip.
+func (r *stationRegistry) lookup(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, n := range r.networks {
+		if n.network.Contains(ip) {
+			return n.id
+		}
+	}
+	return ""
+}
+
+// ensure registers a station the first time it is seen. address, if set, is
+// a CIDR range.
+func (r *stationRegistry) ensure(id, address, origin string) {
+	r.mu.RLock()
+	known := r.known[id]
+	r.mu.RUnlock()
+	if known {
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO ground_stations (id, address, origin)
+		VALUES ($1, NULLIF($2, '')::CIDR, $3)
+		ON CONFLICT (id) DO NOTHING
+	`, id, address, origin)
+	if err != nil {
+		log.Printf("Error registering ground station %s: %v", id, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Registered ground station %s (%s)", id, origin)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.known[id] = true
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		r.networks = append(r.networks, stationNetwork{id: id, network: network})
+	}
+}
+
+// resolveStation attributes a datagram sent from ip to a ground station.
+func resolveStation(header *StationHeader, ip net.IP) string {
+	if header != nil {
+		id := header.StationID()
+		stations.ensure(id, "", originHeader)
+		return id
+	}
+	if id := stations.lookup(ip); id != "" {
+		return id
+	}
+	if groundStation != "" {
+		stations.ensure(groundStation, "", originConfigured)
+		return groundStation
+	}
+	if ip == nil {
+		return "unknown"
+	}
+	id := ip.String()
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	stations.ensure(id, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), originAddress)
+	return id
+}
+
+// sourceIP returns the IP address of a datagram's sender, or nil.
+func sourceIP(addr net.Addr) net.IP {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP
+	}
+	return nil
+}
+
+func startStationRefresh() {
+	interval := 60 * time.Second
+	if v := os.Getenv("STATION_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	loadStations()
+	for range time.Tick(interval) {
+		loadStations()
+	}
+}
+
+func loadStations() {
+	rows, err := db.Query(`SELECT id, COALESCE(address::TEXT, '') FROM ground_stations`)
+	if err != nil {
+		log.Printf("Error loading ground stations: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	known := map[string]bool{}
+	var networks []stationNetwork
+	for rows.Next() {
+		var id, address string
+		if err := rows.Scan(&id, &address); err != nil {
+			log.Printf("Error scanning ground station: %v", err)
+			continue
+		}
+		known[id] = true
+		if _, network, err := net.ParseCIDR(address); err == nil {
+			networks = append(networks, stationNetwork{id: id, network: network})
+		}
+	}
+	stations.set(known, networks)
+}
+
+// recordRejectedPacket keeps a datagram that could not be decoded, so error
+// rates can be reported per station.
+func recordRejectedPacket(station string, ip net.IP, length int, reason error) {
+	receptionCounter.WithLabelValues(station, "rejected").Inc()
+
+	var address string
+	if ip != nil {
+		address = ip.String()
+	}
+	_, err := db.Exec(`
+		INSERT INTO rejected_packets (received_at, station, source_address, length, error)
+		VALUES (NOW(), $1, NULLIF($2, '')::INET, $3, $4)
+	`, station, address, length, reason.Error())
+	if err != nil {
+		log.Printf("Error recording rejected packet: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func testStationHeader(station string, ert time.Time, snr float32) []byte {
+	h := StationHeader{EarthReceivedAt: ert.UnixNano(), RSSI: -112.5, SNR: snr, CorrectedBits: 3}
+	copy(h.Magic[:], stationHeaderMagic)
+	copy(h.Station[:], station)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h)
+	return buf.Bytes()
+}
+
+func TestSplitStationHeader(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	packet := testPacket(1, ts, 25)
+
+	h, body, err := splitStationHeader(packet)
+	if h != nil || err != nil || !bytes.Equal(body, packet) {
+		t.Errorf("packet without header: %v, %v", h, err)
+	}
+
+	ert := ts.Add(1500 * time.Millisecond)
+	h, body, err = splitStationHeader(append(testStationHeader("GS2", ert, 9.5), packet...))
+	if err != nil || h == nil {
+		t.Fatalf("header: %v", err)
+	}
+	if h.StationID() != "GS2" || !h.Time().Equal(ert) || *h.Link() != (LinkMetrics{RSSI: -112.5, SNR: 9.5, CorrectedBits: 3}) {
+		t.Errorf("header decoded as %+v", h)
+	}
+	if !bytes.Equal(body, packet) {
+		t.Errorf("packet after header was not returned")
+	}
+
+	if _, _, err := splitStationHeader([]byte(stationHeaderMagic + "GS")); err == nil {
+		t.Errorf("truncated header accepted")
+	}
+	if _, _, err := splitStationHeader(testStationHeader("", ert, 0)); err == nil {
+		t.Errorf("header without station accepted")
+	}
+}
+
+func TestStationRegistryLookup(t *testing.T) {
+	parse := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+	r := &stationRegistry{}
+	r.set(map[string]bool{"SITE": true, "GS1": true}, []stationNetwork{
+		{"SITE", parse("10.1.0.0/16")},
+		{"GS1", parse("10.1.2.3/32")},
+	})
+
+	cases := map[string]string{"10.1.2.3": "GS1", "10.1.9.9": "SITE", "192.168.0.1": ""}
+	for ip, want := range cases {
+		if got := r.lookup(net.ParseIP(ip)); got != want {
+			t.Errorf("lookup(%s) = %q, want %q", ip, got, want)
+		}
+	}
+	if got := r.lookup(nil); got != "" {
+		t.Errorf("lookup(nil) = %q", got)
+	}
+}
+
+func TestPcapReaderStationHeader(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	ert := ts.Add(250 * time.Millisecond)
+	capture := testPcap(map[int][]byte{
+		8090: append(testStationHeader("GS3", ert, 4), testPacket(9, ts, 22)...),
+		8091: testPacket(10, ts, 23),
+	}, []int{8090, 8091})
+
+	r, err := newPcapReader(bufio.NewReader(bytes.NewReader(capture)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAll(t, r)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if rec := records[0]; rec.Err != nil || rec.Station != "GS3" || !rec.EarthReceivedAt.Equal(ert) || rec.Link.SNR != 4 {
+		t.Errorf("datagram with station header: %+v", rec)
+	}
+	capturedAt := time.Unix(1709287200, 0).UTC()
+	if rec := records[1]; rec.Err != nil || rec.Station != "" || !rec.EarthReceivedAt.Equal(capturedAt) || rec.Link != nil {
+		t.Errorf("datagram without station header: %+v", rec)
+	}
+}
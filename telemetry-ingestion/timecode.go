@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// The secondary header starts with the packet's onboard time as a CCSDS time
+// code (CCSDS 301.0-B-4): Unsegmented (CUC) or Day Segmented (CDS). Each code
+// is a P-field describing its layout followed by the T-field holding the
+// time. Packets carry the P-field unless TIME_CODE preconfigures it, in hex.
+// The original secondary header's 64-bit Unix seconds are still accepted:
+// they start with a zero octet, which no P-field does.
+
+// Time code IDs, bits 1-3 of the first P-field octet.
+const (
+	timeCodeCUCLevel1 = 0x1 // CUC from the CCSDS epoch, in TAI seconds
+	timeCodeCUCLevel2 = 0x2 // CUC from the agency-defined epoch
+	timeCodeCDS       = 0x4
+)
+
+// ccsdsEpoch is the CCSDS recommended epoch, 1958-01-01 TAI.
+var ccsdsEpoch = time.Date(1958, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// agencyEpoch is the agency-defined epoch of CUC level 2 and CDS codes, set
+// by TIME_CODE_EPOCH. Times from it are counted without leap seconds.
+var agencyEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// timeCode is a decoded P-field.
+type timeCode struct {
+	id int
+	// CUC: octets of whole seconds and of binary fractions of a second.
+	coarse, fine int
+	// CDS: octets of days, octets below the millisecond (0, 2 for
+	// microseconds, 4 for picoseconds) and whether days count from
+	// agencyEpoch.
+	days, subMillis int
+	agency          bool
+}
+
+// timeCodeLayout, if set, is the P-field of packets that do not carry one.
+var timeCodeLayout *timeCode
+
+func loadTimeCodeConfig() error {
+	if v := os.Getenv("TIME_CODE_EPOCH"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("invalid TIME_CODE_EPOCH: %v", err)
+		}
+		agencyEpoch = t.UTC()
+	}
+	if v := os.Getenv("TIME_CODE"); v != "" && !strings.EqualFold(v, "explicit") {
+		p, err := hex.DecodeString(v)
+		if err != nil {
+			return fmt.Errorf("invalid TIME_CODE: %v", err)
+		}
+		tc, n, err := parsePField(p)
+		if err != nil {
+			return fmt.Errorf("invalid TIME_CODE: %v", err)
+		}
+		if n != len(p) {
+			return fmt.Errorf("invalid TIME_CODE: %d trailing octets", len(p)-n)
+		}
+		timeCodeLayout = &tc
+	}
+	return nil
+}
+
+// parsePField decodes the P-field at the start of data and returns its
+// length.
+func parsePField(data []byte) (timeCode, int, error) {
+	if len(data) == 0 {
+		return timeCode{}, 0, errors.New("missing time code P-field")
+	}
+	p := data[0]
+	tc := timeCode{id: int(p>>4) & 0x7}
+	extended := p&0x80 != 0
+
+	switch tc.id {
+	case timeCodeCUCLevel1, timeCodeCUCLevel2:
+		tc.coarse = int(p>>2&0x3) + 1
+		tc.fine = int(p & 0x3)
+		if !extended {
+			return tc, 1, nil
+		}
+		if len(data) < 2 {
+			return timeCode{}, 0, errors.New("truncated time code P-field")
+		}
+		tc.coarse += int(data[1] >> 5 & 0x3)
+		tc.fine += int(data[1] >> 2 & 0x7)
+		if data[1]&0x80 != 0 {
+			return timeCode{}, 0, errors.New("unsupported third P-field octet")
+		}
+		return tc, 2, nil
+	case timeCodeCDS:
+		if extended {
+			return timeCode{}, 0, errors.New("unsupported CDS P-field extension")
+		}
+		tc.agency = p&0x08 != 0
+		tc.days = 2
+		if p&0x04 != 0 {
+			tc.days = 3
+		}
+		switch p & 0x3 {
+		case 1:
+			tc.subMillis = 2
+		case 2:
+			tc.subMillis = 4
+		case 3:
+			return timeCode{}, 0, errors.New("reserved CDS sub-millisecond resolution")
+		}
+		return tc, 1, nil
+	default:
+		return timeCode{}, 0, fmt.Errorf("unsupported time code ID %03b", tc.id)
+	}
+}
+
+// size is the length of the T-field.
+func (tc timeCode) size() int {
+	if tc.id == timeCodeCDS {
+		return tc.days + 4 + tc.subMillis
+	}
+	return tc.coarse + tc.fine
+}
+
+// maxTimeCodeSeconds is the largest CUC second count that fits a
+// time.Duration, about 292 years. Extended P-fields allow up to 7 octets of
+// seconds, which would overflow it.
+const maxTimeCodeSeconds = uint64(math.MaxInt64 / int64(time.Second))
+
+// decode converts a T-field to UTC.
+func (tc timeCode) decode(t []byte) (time.Time, error) {
+	if tc.id == timeCodeCDS {
+		epoch := ccsdsEpoch
+		if tc.agency {
+			epoch = agencyEpoch
+		}
+		days := uintN(t[:tc.days])
+		ms := binary.BigEndian.Uint32(t[tc.days:])
+		var sub time.Duration
+		switch tc.subMillis {
+		case 2:
+			sub = time.Duration(binary.BigEndian.Uint16(t[tc.days+4:])) * time.Microsecond
+		case 4:
+			sub = time.Duration(binary.BigEndian.Uint32(t[tc.days+4:]) / 1000)
+		}
+		day := epoch.AddDate(0, 0, int(days))
+		if ms >= 86400000 {
+			// The millisecond count of a day with a leap second runs to
+			// 86400999; Go times have no 23:59:60.
+			return day.Add(24*time.Hour - time.Nanosecond), nil
+		}
+		return day.Add(time.Duration(ms)*time.Millisecond + sub), nil
+	}
+
+	seconds := uintN(t[:tc.coarse])
+	if seconds > maxTimeCodeSeconds {
+		return time.Time{}, fmt.Errorf("time code of %d seconds out of range", seconds)
+	}
+	frac := fractionNanos(t[tc.coarse : tc.coarse+tc.fine])
+	if tc.id == timeCodeCUCLevel2 {
+		return agencyEpoch.Add(time.Duration(seconds)*time.Second + frac), nil
+	}
+	return taiToUTC(seconds, frac), nil
+}
+
+// uintN reads a big-endian unsigned integer of up to 8 octets.
+func uintN(b []byte) uint64 {
+	var v uint64
+	for _, o := range b {
+		v = v<<8 | uint64(o)
+	}
+	return v
+}
+
+// fractionNanos converts a binary fraction of a second, rounded to the
+// nearest nanosecond.
+func fractionNanos(b []byte) time.Duration {
+	if len(b) == 0 {
+		return 0
+	}
+	num := new(big.Int).SetBytes(b)
+	num.Mul(num, big.NewInt(int64(time.Second)))
+	num.Add(num, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b)-1)))
+	num.Rsh(num, uint(8*len(b)))
+	return time.Duration(num.Int64())
+}
+
+// decodeTimeCode decodes the time code at the start of data and returns its
+// length. Without a preconfigured layout the P-field is read from data.
+func decodeTimeCode(data []byte) (time.Time, int, error) {
+	tc, n := timeCode{}, 0
+	if timeCodeLayout != nil {
+		tc = *timeCodeLayout
+	} else {
+		if len(data) > 0 && data[0] == 0 {
+			if len(data) < 8 {
+				return time.Time{}, 0, errors.New("truncated timestamp")
+			}
+			return time.Unix(int64(binary.BigEndian.Uint64(data)), 0).UTC(), 8, nil
+		}
+		var err error
+		if tc, n, err = parsePField(data); err != nil {
+			return time.Time{}, 0, err
+		}
+	}
+	if len(data) < n+tc.size() {
+		return time.Time{}, 0, errors.New("truncated time code T-field")
+	}
+	t, err := tc.decode(data[n:])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return t, n + tc.size(), nil
+}
+
+// leapSeconds lists when TAI-UTC changed, from 10 s at the start of 1972.
+// Before 1972 the offset is taken to be 10 s.
+var leapSeconds = []struct {
+	utc    time.Time
+	offset int64
+}{
+	{time.Date(1972, 7, 1, 0, 0, 0, 0, time.UTC), 11},
+	{time.Date(1973, 1, 1, 0, 0, 0, 0, time.UTC), 12},
+	{time.Date(1974, 1, 1, 0, 0, 0, 0, time.UTC), 13},
+	{time.Date(1975, 1, 1, 0, 0, 0, 0, time.UTC), 14},
+	{time.Date(1976, 1, 1, 0, 0, 0, 0, time.UTC), 15},
+	{time.Date(1977, 1, 1, 0, 0, 0, 0, time.UTC), 16},
+	{time.Date(1978, 1, 1, 0, 0, 0, 0, time.UTC), 17},
+	{time.Date(1979, 1, 1, 0, 0, 0, 0, time.UTC), 18},
+	{time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), 19},
+	{time.Date(1981, 7, 1, 0, 0, 0, 0, time.UTC), 20},
+	{time.Date(1982, 7, 1, 0, 0, 0, 0, time.UTC), 21},
+	{time.Date(1983, 7, 1, 0, 0, 0, 0, time.UTC), 22},
+	{time.Date(1985, 7, 1, 0, 0, 0, 0, time.UTC), 23},
+	{time.Date(1988, 1, 1, 0, 0, 0, 0, time.UTC), 24},
+	{time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC), 25},
+	{time.Date(1991, 1, 1, 0, 0, 0, 0, time.UTC), 26},
+	{time.Date(1992, 7, 1, 0, 0, 0, 0, time.UTC), 27},
+	{time.Date(1993, 7, 1, 0, 0, 0, 0, time.UTC), 28},
+	{time.Date(1994, 7, 1, 0, 0, 0, 0, time.UTC), 29},
+	{time.Date(1996, 1, 1, 0, 0, 0, 0, time.UTC), 30},
+	{time.Date(1997, 7, 1, 0, 0, 0, 0, time.UTC), 31},
+	{time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC), 32},
+	{time.Date(2006, 1, 1, 0, 0, 0, 0, time.UTC), 33},
+	{time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC), 34},
+	{time.Date(2012, 7, 1, 0, 0, 0, 0, time.UTC), 35},
+	{time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC), 36},
+	{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), 37},
+}
+
+// taiToUTC converts TAI seconds since the CCSDS epoch, at most
+// maxTimeCodeSeconds, to UTC. A time within an inserted leap second is
+// reported as the last instant before it.
+func taiToUTC(seconds uint64, frac time.Duration) time.Time {
+	// Seconds since the epoch as if every day had 86400 of them.
+	naive := ccsdsEpoch.Add(time.Duration(seconds) * time.Second)
+	offset := int64(10)
+	for _, l := range leapSeconds {
+		start := l.utc.Add(time.Duration(l.offset) * time.Second)
+		if naive.Before(start.Add(-time.Second)) {
+			break
+		}
+		if naive.Before(start) {
+			return l.utc.Add(-time.Nanosecond)
+		}
+		offset = l.offset
+	}
+	return naive.Add(frac - time.Duration(offset)*time.Second)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestDecodeTimeCode(t *testing.T) {
+	defer func(saved time.Time) { agencyEpoch = saved }(agencyEpoch)
+	agencyEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		data []byte
+		want time.Time
+		size int
+	}{
+		// 2020-01-01 is 1956528000 s after 1958-01-01 and TAI-UTC was 37 s.
+		{"CUC level 1", []byte{0x1E, 0x74, 0x9E, 0x3F, 0xA5, 0x80, 0x00},
+			time.Date(2020, 1, 1, 0, 0, 0, 500000000, time.UTC), 7},
+		{"CUC level 1 without fine time", []byte{0x1C, 0x74, 0x9E, 0x3F, 0xA5},
+			time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 5},
+		{"CUC extended", []byte{0x9F, 0x10, 0x74, 0x9E, 0x3F, 0xA5, 0x40, 0, 0, 0, 0, 0, 0},
+			time.Date(2020, 1, 1, 0, 0, 0, 250000000, time.UTC), 13},
+		{"CUC level 2", []byte{0x2D, 0x00, 0x00, 0x0E, 0x10, 0xC0},
+			time.Date(2000, 1, 1, 1, 0, 0, 750000000, time.UTC), 6},
+		{"CDS microseconds", []byte{0x41, 0x58, 0x75, 0x00, 0x38, 0xCE, 0xFC, 0x00, 0x05},
+			time.Date(2020, 1, 1, 1, 2, 3, 4005000, time.UTC), 9},
+		{"CDS picoseconds", []byte{0x42, 0x58, 0x75, 0x00, 0x00, 0x00, 0x01, 0x00, 0x0F, 0x42, 0x40},
+			time.Date(2020, 1, 1, 0, 0, 0, 1001000, time.UTC), 11},
+		{"CDS agency epoch", []byte{0x48, 0x00, 0x01, 0x00, 0x00, 0x03, 0xE8},
+			time.Date(2000, 1, 2, 0, 0, 1, 0, time.UTC), 7},
+		{"CDS leap second", []byte{0x40, 0x54, 0x2D, 0x05, 0x26, 0x5D, 0xF4},
+			time.Date(2016, 12, 31, 23, 59, 59, 999999999, time.UTC), 7},
+		{"legacy Unix seconds", []byte{0, 0, 0, 0, 0x5E, 0x0B, 0xE1, 0x00},
+			time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 8},
+	}
+	for _, tt := range tests {
+		got, size, err := decodeTimeCode(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !got.Equal(tt.want) || size != tt.size {
+			t.Errorf("%s: got %v (%d octets), want %v (%d octets)", tt.name, got, size, tt.want, tt.size)
+		}
+	}
+}
+
+func TestTAIToUTCLeapSecond(t *testing.T) {
+	// TAI-UTC went from 36 to 37 s at the start of 2017, 1861920000 s after
+	// the CCSDS epoch.
+	const midnight = 1861920000
+	tests := []struct {
+		tai  uint64
+		want time.Time
+	}{
+		{midnight + 35, time.Date(2016, 12, 31, 23, 59, 59, 0, time.UTC)},
+		{midnight + 36, time.Date(2016, 12, 31, 23, 59, 59, 999999999, time.UTC)},
+		{midnight + 37, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := taiToUTC(tt.tai, 0); !got.Equal(tt.want) {
+			t.Errorf("taiToUTC(%d) = %v, want %v", tt.tai, got, tt.want)
+		}
+	}
+}
+
+func TestPreconfiguredTimeCode(t *testing.T) {
+	defer func() { timeCodeLayout = nil }()
+	t.Setenv("TIME_CODE", "1E")
+	if err := loadTimeCodeConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, size, err := decodeTimeCode([]byte{0x74, 0x9E, 0x3F, 0xA5, 0x80, 0x00})
+	if err != nil || size != 6 || !got.Equal(time.Date(2020, 1, 1, 0, 0, 0, 500000000, time.UTC)) {
+		t.Errorf("implicit P-field: %v, %d, %v", got, size, err)
+	}
+}
+
+func TestTimeCodeErrors(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":             {},
+		"unknown code":      {0x50, 0, 0, 0, 0},
+		"truncated T-field": {0x1E, 0x74, 0x9E},
+		"truncated legacy":  {0, 0, 0},
+		"reserved CDS":      {0x43, 0, 0, 0, 0, 0, 0},
+		// 7 and 5 octets of seconds, beyond the range of a time.Duration.
+		"CUC level 1 overflow": {0x9C, 0x60, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+		"CUC level 2 overflow": {0xAC, 0x20, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	} {
+		if _, _, err := decodeTimeCode(data); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+
+	t.Setenv("TIME_CODE", "zz")
+	if err := loadTimeCodeConfig(); err == nil {
+		t.Error("invalid TIME_CODE accepted")
+	}
+}
+
+func TestParsePacketWithTimeCode(t *testing.T) {
+	// CDS with microseconds: 2020-01-01T01:02:03.004005Z.
+	timeCode := []byte{0x41, 0x58, 0x75, 0x00, 0x38, 0xCE, 0xFC, 0x00, 0x05}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, CCSDSPrimaryHeader{
+		PacketID:      1<<11 | 0x01,
+		PacketSeqCtrl: 3<<14 | 9,
+		PacketLength:  uint16(len(timeCode) + 2 + binary.Size(TelemetryPayload{}) - 1),
+	})
+	buf.Write(timeCode)
+	binary.Write(&buf, binary.BigEndian, uint16(4))
+	binary.Write(&buf, binary.BigEndian, TelemetryPayload{Temperature: 21, Battery: 80, Altitude: 500, Signal: -50})
+
+	p, err := parseCCSDSPacket(withPEC(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 1, 1, 1, 2, 3, 4005000, time.UTC); !p.Time.Equal(want) {
+		t.Errorf("time = %v, want %v", p.Time, want)
+	}
+	if p.SubsystemID != 4 || p.Payload.Temperature != 21 || p.Quality != qualityVerified {
+		t.Errorf("subsystem %d, temperature %v, quality %d", p.SubsystemID, p.Payload.Temperature, p.Quality)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// smtpTimeout bounds one email delivery, from dialing the server to QUIT, so
+// a hung server cannot stall the poll loop and the escalations behind it.
+const smtpTimeout = 30 * time.Second
+
+// Sender delivers one notification to one channel.
+type Sender interface {
+	Send(n Notification) error
+}
+
+type Notification struct {
+	Anomaly    Anomaly
+	Route      string
+	Escalation bool
+	Message    string
+}
+
+type WebhookSender struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+type webhookPayload struct {
+	Event   string  `json:"event"`
+	Route   string  `json:"route"`
+	Message string  `json:"message"`
+	Anomaly Anomaly `json:"anomaly"`
+}
+
+func (s *WebhookSender) Send(n Notification) error {
+	event := "anomaly"
+	if n.Escalation {
+		event = "escalation"
+	}
+	body, err := json.Marshal(webhookPayload{Event: event, Route: n.Route, Message: n.Message, Anomaly: n.Anomaly})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.Client, s.URL, s.Headers, body)
+}
+
+// SlackSender posts to a Slack-compatible incoming webhook.
+type SlackSender struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *SlackSender) Send(n Notification) error {
+	body, err := json.Marshal(map[string]string{"text": n.Message})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.Client, s.URL, nil, body)
+}
+
+func postJSON(client *http.Client, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+type EmailSender struct {
+	Addr string
+	From string
+	To   []string
+	Auth smtp.Auth
+	// Timeout bounds one delivery; zero means smtpTimeout.
+	Timeout time.Duration
+}
+
+func (s *EmailSender) Send(n Notification) error {
+	subject := fmt.Sprintf("[%s] %s on spacecraft %d", n.Anomaly.Severity, n.Anomaly.AnomalyType, n.Anomaly.SpacecraftID)
+	if n.Escalation {
+		subject = "ESCALATION " + subject
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n%s\r\n", n.Message)
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = smtpTimeout
+	}
+	return sendMail(s.Addr, s.Auth, s.From, s.To, []byte(msg.String()), timeout)
+}
+
+// sendMail is smtp.SendMail with a deadline on the whole conversation.
+func sendMail(addr string, auth smtp.Auth, from string, to []string, msg []byte, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func newSenders(cfg *Config) map[string]Sender {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var auth smtp.Auth
+	if cfg.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Host)
+	}
+	port := cfg.SMTP.Port
+	if port == 0 {
+		port = 25
+	}
+
+	senders := map[string]Sender{}
+	for name, ch := range cfg.Channels {
+		switch ch.Type {
+		case "webhook":
+			senders[name] = &WebhookSender{URL: ch.URL, Headers: ch.Headers, Client: client}
+		case "slack":
+			senders[name] = &SlackSender{URL: ch.URL, Client: client}
+		case "email":
+			senders[name] = &EmailSender{
+				Addr: fmt.Sprintf("%s:%d", cfg.SMTP.Host, port),
+				From: cfg.SMTP.From,
+				To:   ch.To,
+				Auth: auth,
+			}
+		}
+	}
+	return senders
+}
+
+func formatMessage(a Anomaly, escalation bool, unacknowledgedFor time.Duration) string {
+	msg := fmt.Sprintf("[%s] %s on spacecraft %d: %s=%.2f (threshold %.2f) at %s",
+		a.Severity, a.AnomalyType, a.SpacecraftID, a.ParameterName,
+		a.ParameterValue, a.ThresholdValue, a.Timestamp.UTC().Format(time.RFC3339))
+	if a.IncidentID != nil {
+		msg += fmt.Sprintf(", incident #%d", *a.IncidentID)
+	}
+	if escalation {
+		msg = fmt.Sprintf("ESCALATION: not acknowledged for %s. %s", unacknowledgedFor.Round(time.Minute), msg)
+	}
+	return msg
+}
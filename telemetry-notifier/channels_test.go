@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAnomaly() Anomaly {
+	incident := 12
+	return Anomaly{
+		ID:             42,
+		TelemetryID:    1001,
+		Timestamp:      time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		SpacecraftID:   1,
+		IncidentID:     &incident,
+		AnomalyType:    "LOW_BATTERY",
+		ParameterName:  "battery",
+		ParameterValue: 31.5,
+		ThresholdValue: 40,
+		Severity:       "CRITICAL",
+	}
+}
+
+func TestWebhookSenderPostsAnomaly(t *testing.T) {
+	var got webhookPayload
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sender := &WebhookSender{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}, Client: server.Client()}
+	err := sender.Send(Notification{Anomaly: testAnomaly(), Route: "critical", Escalation: true, Message: "msg"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if got.Event != "escalation" || got.Route != "critical" || got.Anomaly.ID != 42 {
+		t.Errorf("unexpected payload: %+v", got)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("custom header not sent, got %q", auth)
+	}
+}
+
+func TestSlackSenderPostsText(t *testing.T) {
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	sender := &SlackSender{URL: server.URL, Client: server.Client()}
+	if err := sender.Send(Notification{Anomaly: testAnomaly(), Message: "battery low"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if body["text"] != "battery low" {
+		t.Errorf("unexpected slack body: %v", body)
+	}
+}
+
+func TestWebhookSenderReportsHTTPErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	sender := &WebhookSender{URL: server.URL, Client: server.Client()}
+	if err := sender.Send(Notification{Anomaly: testAnomaly()}); err == nil {
+		t.Error("expected an error for a 500 response")
+	}
+}
+
+// fakeSMTPServer accepts a single-recipient-or-more SMTP session and records
+// the envelope and message body.
+type fakeSMTPServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	from     string
+	to       []string
+	data     string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &fakeSMTPServer{listener: l}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		upper := strings.ToUpper(cmd)
+
+		switch {
+		case strings.HasPrefix(upper, "EHLO"), strings.HasPrefix(upper, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(upper, "MAIL FROM:"):
+			s.mu.Lock()
+			s.from = strings.Trim(cmd[len("MAIL FROM:"):], "<> ")
+			s.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(upper, "RCPT TO:"):
+			s.mu.Lock()
+			s.to = append(s.to, strings.Trim(cmd[len("RCPT TO:"):], "<> "))
+			s.mu.Unlock()
+			reply("250 OK")
+		case upper == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			reply("250 OK")
+		case upper == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestEmailSenderDeliversOverSMTP(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.listener.Close()
+
+	sender := &EmailSender{
+		Addr: server.listener.Addr().String(),
+		From: "telemetry@example.com",
+		To:   []string{"oncall@example.com", "lead@example.com"},
+	}
+	a := testAnomaly()
+	if err := sender.Send(Notification{Anomaly: a, Escalation: true, Message: formatMessage(a, true, 15*time.Minute)}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.from != "telemetry@example.com" {
+		t.Errorf("MAIL FROM = %q", server.from)
+	}
+	if len(server.to) != 2 {
+		t.Errorf("RCPT TO = %v", server.to)
+	}
+	if !strings.Contains(server.data, "Subject: ESCALATION [CRITICAL] LOW_BATTERY on spacecraft 1") {
+		t.Errorf("subject missing from message:\n%s", server.data)
+	}
+	if !strings.Contains(server.data, "not acknowledged for 15m0s") || !strings.Contains(server.data, "incident #12") {
+		t.Errorf("body missing details:\n%s", server.data)
+	}
+}
+
+func TestEmailSenderTimesOutOnHungServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		// Accept and never greet.
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	sender := &EmailSender{Addr: l.Addr().String(), From: "telemetry@example.com",
+		To: []string{"oncall@example.com"}, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if err := sender.Send(Notification{Anomaly: testAnomaly(), Message: "test"}); err == nil {
+		t.Fatal("Send succeeded against a server that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send took %s", elapsed)
+	}
+}
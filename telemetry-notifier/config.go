@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is loaded from the JSON file named by NOTIFIER_CONFIG.
+//
+//	{
+//	  "dedup_window_minutes": 10,
+//	  "smtp": {"host": "mail", "port": 25, "from": "telemetry@example.com"},
+//	  "channels": {
+//	    "ops-slack": {"type": "slack", "url": "https://hooks.slack.com/..."},
+//	    "oncall":    {"type": "email", "to": ["oncall@example.com"]}
+//	  },
+//	  "routes": [
+//	    {"name": "critical", "severity": ["CRITICAL"], "channels": ["ops-slack"],
+//	     "escalate_after_minutes": 15, "escalate_to": ["oncall"]}
+//	  ]
+//	}
+type Config struct {
+	DedupWindowMinutes int                      `json:"dedup_window_minutes"`
+	SMTP               SMTPConfig               `json:"smtp"`
+	Channels           map[string]ChannelConfig `json:"channels"`
+	Routes             []Route                  `json:"routes"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	From     string `json:"from"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type ChannelConfig struct {
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	To      []string          `json:"to"`
+}
+
+// Route selects anomalies by severity, spacecraft, parameter and anomaly type.
+// An empty list matches everything. Every matching route is notified.
+type Route struct {
+	Name                 string   `json:"name"`
+	Severity             []string `json:"severity"`
+	SpacecraftIDs        []int    `json:"spacecraft_ids"`
+	Parameters           []string `json:"parameters"`
+	AnomalyTypes         []string `json:"anomaly_types"`
+	Channels             []string `json:"channels"`
+	EscalateAfterMinutes int      `json:"escalate_after_minutes"`
+	EscalateTo           []string `json:"escalate_to"`
+}
+
+func (c *Config) DedupWindow() time.Duration {
+	if c.DedupWindowMinutes <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.DedupWindowMinutes) * time.Minute
+}
+
+func (r Route) EscalateAfter() time.Duration {
+	return time.Duration(r.EscalateAfterMinutes) * time.Minute
+}
+
+func (r Route) Matches(a Anomaly) bool {
+	return matchString(r.Severity, a.Severity) &&
+		matchInt(r.SpacecraftIDs, a.SpacecraftID) &&
+		matchString(r.Parameters, a.ParameterName) &&
+		matchString(r.AnomalyTypes, a.AnomalyType)
+}
+
+func matchString(allowed []string, v string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(a, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchInt(allowed []int, v int) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) Validate() error {
+	for name, ch := range c.Channels {
+		switch ch.Type {
+		case "webhook", "slack":
+			if ch.URL == "" {
+				return fmt.Errorf("channel %s: url is required", name)
+			}
+		case "email":
+			if len(ch.To) == 0 {
+				return fmt.Errorf("channel %s: to is required", name)
+			}
+			if c.SMTP.Host == "" || c.SMTP.From == "" {
+				return fmt.Errorf("channel %s: smtp host and from are required", name)
+			}
+		default:
+			return fmt.Errorf("channel %s: unknown type %q", name, ch.Type)
+		}
+	}
+
+	for i, r := range c.Routes {
+		if r.Name == "" {
+			return fmt.Errorf("route %d: name is required", i)
+		}
+		if len(r.Channels) == 0 {
+			return fmt.Errorf("route %s: at least one channel is required", r.Name)
+		}
+		for _, ch := range append(append([]string{}, r.Channels...), r.EscalateTo...) {
+			if _, ok := c.Channels[ch]; !ok {
+				return fmt.Errorf("route %s: unknown channel %s", r.Name, ch)
+			}
+		}
+		if len(r.EscalateTo) > 0 && r.EscalateAfterMinutes <= 0 {
+			return fmt.Errorf("route %s: escalate_after_minutes is required with escalate_to", r.Name)
+		}
+	}
+	return nil
+}
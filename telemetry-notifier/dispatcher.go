@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const deliveryAttempts = 3
+
+// Dispatcher routes anomalies to channels, suppresses repeats of the same
+// spacecraft/parameter/type within the dedup window and escalates anomalies
+// that are still unacknowledged after a route's escalation delay.
+type Dispatcher struct {
+	cfg     *Config
+	senders map[string]Sender
+	now     func() time.Time
+	backoff time.Duration
+
+	// record is called after every delivery attempt sequence.
+	record func(d Delivery)
+
+	lastSent map[string]time.Time
+	pending  []pendingEscalation
+}
+
+type Delivery struct {
+	AnomalyID  int
+	Route      string
+	Channel    string
+	Escalation bool
+	// EscalateAt is when the route escalates the anomaly if it is still
+	// unacknowledged, or zero if the route does not escalate.
+	EscalateAt time.Time
+	Err        error
+}
+
+type pendingEscalation struct {
+	anomaly Anomaly
+	route   Route
+	due     time.Time
+}
+
+func newDispatcher(cfg *Config, senders map[string]Sender) *Dispatcher {
+	return &Dispatcher{
+		cfg:      cfg,
+		senders:  senders,
+		now:      time.Now,
+		backoff:  time.Second,
+		record:   func(Delivery) {},
+		lastSent: map[string]time.Time{},
+	}
+}
+
+func dedupKey(route string, a Anomaly) string {
+	return fmt.Sprintf("%s|%d|%s|%s", route, a.SpacecraftID, a.ParameterName, a.AnomalyType)
+}
+
+// Handle notifies every route matching the anomaly. It returns the number of
+// routes that were notified.
+func (d *Dispatcher) Handle(a Anomaly) int {
+	now := d.now()
+	d.pruneDedup(now)
+
+	notified := 0
+	for _, route := range d.cfg.Routes {
+		if !route.Matches(a) || d.escalationPending(a.ID, route.Name) {
+			continue
+		}
+
+		key := dedupKey(route.Name, a)
+		if last, ok := d.lastSent[key]; ok && now.Sub(last) < d.cfg.DedupWindow() {
+			continue
+		}
+		d.lastSent[key] = now
+
+		var due time.Time
+		if len(route.EscalateTo) > 0 {
+			due = now.Add(route.EscalateAfter())
+			d.pending = append(d.pending, pendingEscalation{anomaly: a, route: route, due: due})
+		}
+
+		msg := formatMessage(a, false, 0)
+		d.deliver(route.Channels, Notification{Anomaly: a, Route: route.Name, Message: msg}, due)
+		notified++
+	}
+	return notified
+}
+
+// Restore queues an escalation that was scheduled before a restart. It
+// returns false if the route no longer exists or no longer escalates.
+func (d *Dispatcher) Restore(a Anomaly, routeName string, due time.Time) bool {
+	for _, route := range d.cfg.Routes {
+		if route.Name != routeName {
+			continue
+		}
+		if len(route.EscalateTo) == 0 {
+			return false
+		}
+		d.pending = append(d.pending, pendingEscalation{anomaly: a, route: route, due: due})
+		return true
+	}
+	return false
+}
+
+// Escalate sends escalations for pending anomalies whose delay has passed and
+// which are still unacknowledged. acknowledged reports the current state of
+// the given anomaly ids; ids it leaves out are treated as gone.
+func (d *Dispatcher) Escalate(acknowledged func(ids []int) (map[int]bool, error)) error {
+	now := d.now()
+
+	var due []pendingEscalation
+	var waiting []pendingEscalation
+	for _, p := range d.pending {
+		if now.Before(p.due) {
+			waiting = append(waiting, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(due))
+	for i, p := range due {
+		ids[i] = p.anomaly.ID
+	}
+	state, err := acknowledged(ids)
+	if err != nil {
+		return err
+	}
+	d.pending = waiting
+
+	for _, p := range due {
+		acked, ok := state[p.anomaly.ID]
+		if !ok || acked {
+			continue
+		}
+		msg := formatMessage(p.anomaly, true, now.Sub(p.anomaly.Timestamp))
+		d.deliver(p.route.EscalateTo, Notification{Anomaly: p.anomaly, Route: p.route.Name, Escalation: true, Message: msg}, time.Time{})
+	}
+	return nil
+}
+
+// escalationPending reports whether the route already has an escalation queued
+// for the anomaly, such as one restored after a restart, in which case the
+// route has been notified.
+func (d *Dispatcher) escalationPending(id int, route string) bool {
+	for _, p := range d.pending {
+		if p.anomaly.ID == id && p.route.Name == route {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dispatcher) PendingEscalations() int {
+	return len(d.pending)
+}
+
+func (d *Dispatcher) deliver(channels []string, n Notification, escalateAt time.Time) {
+	for _, name := range channels {
+		sender, ok := d.senders[name]
+		if !ok {
+			continue
+		}
+
+		var err error
+		for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+			if err = sender.Send(n); err == nil {
+				break
+			}
+			log.Printf("Delivery of anomaly %d to %s failed (attempt %d/%d): %v",
+				n.Anomaly.ID, name, attempt, deliveryAttempts, err)
+			if attempt < deliveryAttempts {
+				time.Sleep(d.backoff * time.Duration(attempt))
+			}
+		}
+
+		d.record(Delivery{AnomalyID: n.Anomaly.ID, Route: n.Route, Channel: name, Escalation: n.Escalation, EscalateAt: escalateAt, Err: err})
+	}
+}
+
+func (d *Dispatcher) pruneDedup(now time.Time) {
+	window := d.cfg.DedupWindow()
+	for key, last := range d.lastSent {
+		if now.Sub(last) >= window {
+			delete(d.lastSent, key)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type recordingSender struct {
+	sent  []Notification
+	fails int
+}
+
+func (s *recordingSender) Send(n Notification) error {
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("temporary failure")
+	}
+	s.sent = append(s.sent, n)
+	return nil
+}
+
+func newTestDispatcher(routes []Route) (*Dispatcher, map[string]*recordingSender, *time.Time) {
+	senders := map[string]*recordingSender{"slack": {}, "email": {}, "hook": {}}
+	cfg := &Config{DedupWindowMinutes: 10, Routes: routes}
+
+	asSenders := map[string]Sender{}
+	for name, s := range senders {
+		asSenders[name] = s
+	}
+
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	d := newDispatcher(cfg, asSenders)
+	d.now = func() time.Time { return now }
+	d.backoff = 0
+	return d, senders, &now
+}
+
+func TestRouteMatches(t *testing.T) {
+	a := testAnomaly()
+
+	cases := []struct {
+		route Route
+		want  bool
+	}{
+		{Route{}, true},
+		{Route{Severity: []string{"critical"}}, true},
+		{Route{Severity: []string{"WARNING"}}, false},
+		{Route{SpacecraftIDs: []int{1, 2}}, true},
+		{Route{SpacecraftIDs: []int{2}}, false},
+		{Route{Parameters: []string{"battery"}, AnomalyTypes: []string{"LOW_BATTERY"}}, true},
+		{Route{Parameters: []string{"temperature"}}, false},
+	}
+
+	for i, tc := range cases {
+		if got := tc.route.Matches(a); got != tc.want {
+			t.Errorf("case %d: Matches = %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestDispatcherRoutesAndDeduplicates(t *testing.T) {
+	d, senders, now := newTestDispatcher([]Route{
+		{Name: "critical", Severity: []string{"CRITICAL"}, Channels: []string{"slack", "hook"}},
+		{Name: "temperature", Parameters: []string{"temperature"}, Channels: []string{"email"}},
+	})
+
+	a := testAnomaly()
+	if n := d.Handle(a); n != 1 {
+		t.Fatalf("Handle notified %d routes, want 1", n)
+	}
+
+	repeat := a
+	repeat.ID = 43
+	*now = now.Add(5 * time.Minute)
+	if n := d.Handle(repeat); n != 0 {
+		t.Errorf("repeat within dedup window notified %d routes", n)
+	}
+
+	*now = now.Add(6 * time.Minute)
+	if n := d.Handle(repeat); n != 1 {
+		t.Errorf("repeat after dedup window notified %d routes, want 1", n)
+	}
+
+	if len(senders["slack"].sent) != 2 || len(senders["hook"].sent) != 2 {
+		t.Errorf("slack=%d hook=%d deliveries, want 2 each", len(senders["slack"].sent), len(senders["hook"].sent))
+	}
+	if len(senders["email"].sent) != 0 {
+		t.Errorf("email received %d deliveries for a non-matching route", len(senders["email"].sent))
+	}
+}
+
+func TestDispatcherRetriesAndRecordsDeliveries(t *testing.T) {
+	d, senders, _ := newTestDispatcher([]Route{{Name: "all", Channels: []string{"hook"}}})
+	senders["hook"].fails = 2
+
+	var deliveries []Delivery
+	d.record = func(del Delivery) { deliveries = append(deliveries, del) }
+
+	d.Handle(testAnomaly())
+
+	if len(senders["hook"].sent) != 1 {
+		t.Fatalf("expected delivery after retries, got %d", len(senders["hook"].sent))
+	}
+	if len(deliveries) != 1 || deliveries[0].Err != nil || deliveries[0].Channel != "hook" {
+		t.Errorf("unexpected delivery records: %+v", deliveries)
+	}
+}
+
+func TestDispatcherEscalatesUnacknowledged(t *testing.T) {
+	d, senders, now := newTestDispatcher([]Route{{
+		Name: "critical", Channels: []string{"slack"},
+		EscalateAfterMinutes: 15, EscalateTo: []string{"email"},
+	}})
+
+	acked := testAnomaly()
+	acked.ParameterName = "temperature"
+	acked.ID = 50
+	d.Handle(testAnomaly())
+	d.Handle(acked)
+
+	state := map[int]bool{42: false, 50: true}
+	lookup := func(ids []int) (map[int]bool, error) { return state, nil }
+
+	*now = now.Add(10 * time.Minute)
+	if err := d.Escalate(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if len(senders["email"].sent) != 0 || d.PendingEscalations() != 2 {
+		t.Fatalf("escalated before the delay: email=%d pending=%d", len(senders["email"].sent), d.PendingEscalations())
+	}
+
+	*now = now.Add(6 * time.Minute)
+	if err := d.Escalate(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if len(senders["email"].sent) != 1 {
+		t.Fatalf("expected 1 escalation, got %d", len(senders["email"].sent))
+	}
+	if n := senders["email"].sent[0]; !n.Escalation || n.Anomaly.ID != 42 {
+		t.Errorf("unexpected escalation: %+v", n)
+	}
+	if d.PendingEscalations() != 0 {
+		t.Errorf("pending escalations left: %d", d.PendingEscalations())
+	}
+}
+
+func TestDispatcherRestoresEscalations(t *testing.T) {
+	d, senders, now := newTestDispatcher([]Route{
+		{Name: "critical", Channels: []string{"slack"}, EscalateAfterMinutes: 15, EscalateTo: []string{"email"}},
+		{Name: "quiet", Channels: []string{"hook"}},
+	})
+
+	var deliveries []Delivery
+	d.record = func(del Delivery) { deliveries = append(deliveries, del) }
+	d.Handle(testAnomaly())
+	if len(deliveries) != 2 || !deliveries[0].EscalateAt.Equal(now.Add(15*time.Minute)) || !deliveries[1].EscalateAt.IsZero() {
+		t.Fatalf("unexpected escalation due times: %+v", deliveries)
+	}
+
+	restarted, senders, later := newTestDispatcher(d.cfg.Routes)
+	if !restarted.Restore(testAnomaly(), "critical", deliveries[0].EscalateAt) {
+		t.Fatal("escalation for an escalating route not restored")
+	}
+	if restarted.Restore(testAnomaly(), "quiet", *now) || restarted.Restore(testAnomaly(), "removed", *now) {
+		t.Error("restored an escalation for a route that does not escalate")
+	}
+
+	restarted.Handle(testAnomaly())
+	if restarted.PendingEscalations() != 1 || len(senders["slack"].sent) != 0 {
+		t.Errorf("route with a restored escalation notified again: pending=%d slack=%d",
+			restarted.PendingEscalations(), len(senders["slack"].sent))
+	}
+
+	lookup := func(ids []int) (map[int]bool, error) { return map[int]bool{42: false}, nil }
+	*later = now.Add(16 * time.Minute)
+	if err := restarted.Escalate(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if len(senders["email"].sent) != 1 || !senders["email"].sent[0].Escalation {
+		t.Errorf("restored escalation not sent: %+v", senders["email"].sent)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{
+		SMTP: SMTPConfig{Host: "mail", From: "telemetry@example.com"},
+		Channels: map[string]ChannelConfig{
+			"slack": {Type: "slack", URL: "http://example.com/hook"},
+			"email": {Type: "email", To: []string{"oncall@example.com"}},
+		},
+		Routes: []Route{{Name: "all", Channels: []string{"slack"}, EscalateAfterMinutes: 5, EscalateTo: []string{"email"}}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	invalid := []Config{
+		{Channels: map[string]ChannelConfig{"x": {Type: "pager"}}},
+		{Channels: map[string]ChannelConfig{"x": {Type: "webhook"}}},
+		{Channels: map[string]ChannelConfig{"x": {Type: "email", To: []string{"a@b"}}}},
+		{Routes: []Route{{Name: "r", Channels: []string{"missing"}}}},
+		{Channels: valid.Channels, SMTP: valid.SMTP, Routes: []Route{{Name: "r", Channels: []string{"slack"}, EscalateTo: []string{"email"}}}},
+	}
+	for i, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("invalid config %d accepted", i)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+module telemetry-notifier
+
+go 1.22
+
+require github.com/lib/pq v1.10.9
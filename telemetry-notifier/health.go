@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Liveness reports whether the poll loop is still turning. Readiness also
+// checks the database, the LISTEN connection, how many escalations are
+// waiting and how long ago anomalies were last fetched. A threshold of 0
+// reports the value without failing the check.
+
+const healthDBTimeout = 2 * time.Second
+
+var (
+	// loopAt is when the poll loop last started an iteration and polledAt
+	// when anomalies were last fetched, in Unix nanoseconds.
+	loopAt   atomic.Int64
+	polledAt atomic.Int64
+	// queueDepth is the number of escalations waiting for their delay.
+	queueDepth atomic.Int64
+	// listenerState is "connected", "disconnected" or "" in poll mode.
+	listenerState atomic.Value
+
+	startedAt = time.Now()
+)
+
+// healthThresholds configure liveness and readiness. They are read from
+// HEALTH_MAX_LOOP_AGE and HEALTH_MAX_QUEUE_DEPTH. MaxLoopAge defaults to
+// three poll intervals.
+type healthThresholds struct {
+	MaxLoopAge    time.Duration
+	MaxQueueDepth int
+}
+
+var thresholds healthThresholds
+
+func loadHealthThresholds(pollInterval time.Duration) {
+	thresholds.MaxLoopAge = 3 * pollInterval
+	if v := os.Getenv("HEALTH_MAX_LOOP_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatal("Invalid HEALTH_MAX_LOOP_AGE:", v)
+		}
+		thresholds.MaxLoopAge = d
+	}
+	if v := os.Getenv("HEALTH_MAX_QUEUE_DEPTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatal("Invalid HEALTH_MAX_QUEUE_DEPTH:", v)
+		}
+		thresholds.MaxQueueDepth = n
+	}
+}
+
+// HealthCheck is one check of a health report. Value and Threshold are set
+// for checks that measure something.
+type HealthCheck struct {
+	Name      string   `json:"name"`
+	Status    string   `json:"status"`
+	Value     *float64 `json:"value,omitempty"`
+	Threshold *float64 `json:"threshold,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Time   time.Time     `json:"time"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func passed(name string) HealthCheck {
+	return HealthCheck{Name: name, Status: "ok"}
+}
+
+func failed(name, reason string) HealthCheck {
+	return HealthCheck{Name: name, Status: "fail", Error: reason}
+}
+
+// measured checks value against threshold, ignoring a threshold of 0.
+func measured(name string, value, threshold float64) HealthCheck {
+	c := HealthCheck{Name: name, Status: "ok", Value: &value}
+	if threshold > 0 {
+		c.Threshold = &threshold
+		if value > threshold {
+			c.Status = "fail"
+		}
+	}
+	return c
+}
+
+func newHealthReport(checks ...HealthCheck) HealthReport {
+	r := HealthReport{Status: "healthy", Time: time.Now(), Checks: checks}
+	for _, c := range checks {
+		if c.Status != "ok" {
+			r.Status = "unhealthy"
+		}
+	}
+	return r
+}
+
+// ageCheck measures seconds since the time stored in at, or since startup
+// if it has not been set.
+func ageCheck(name string, at *atomic.Int64, now time.Time) HealthCheck {
+	last := startedAt
+	if ns := at.Load(); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	return measured(name, now.Sub(last).Seconds(), thresholds.MaxLoopAge.Seconds())
+}
+
+func listenerCheck() HealthCheck {
+	switch state, _ := listenerState.Load().(string); state {
+	case "", "connected":
+		return passed("listener")
+	default:
+		return failed("listener", "LISTEN connection is "+state)
+	}
+}
+
+func livenessReport() HealthReport {
+	return newHealthReport(ageCheck("poll_loop_age_seconds", &loopAt, time.Now()))
+}
+
+func readinessReport(ctx context.Context) HealthReport {
+	database := passed("database")
+	ctx, cancel := context.WithTimeout(ctx, healthDBTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		log.Printf("Readiness: database ping failed: %v", err)
+		database = failed("database", "database unreachable")
+	}
+
+	return newHealthReport(
+		database,
+		listenerCheck(),
+		measured("escalation_queue_depth", float64(queueDepth.Load()), float64(thresholds.MaxQueueDepth)),
+		ageCheck("last_poll_age_seconds", &polledAt, time.Now()),
+	)
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "healthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, livenessReport())
+}
+
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, readinessReport(r.Context()))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAgeCheck(t *testing.T) {
+	defer func(saved healthThresholds) { thresholds = saved }(thresholds)
+	thresholds.MaxLoopAge = 15 * time.Second
+
+	now := time.Now()
+	var at atomic.Int64
+
+	at.Store(now.Add(-5 * time.Second).UnixNano())
+	if c := ageCheck("poll_loop_age_seconds", &at, now); c.Status != "ok" || *c.Value != 5 {
+		t.Errorf("recent loop: %s, %v", c.Status, *c.Value)
+	}
+
+	at.Store(now.Add(-time.Minute).UnixNano())
+	if c := ageCheck("poll_loop_age_seconds", &at, now); c.Status != "fail" {
+		t.Errorf("stalled loop: %s", c.Status)
+	}
+
+	thresholds.MaxLoopAge = 0
+	if c := ageCheck("poll_loop_age_seconds", &at, now); c.Status != "ok" || c.Threshold != nil {
+		t.Errorf("without threshold: %s, %v", c.Status, c.Threshold)
+	}
+}
+
+func TestListenerCheck(t *testing.T) {
+	defer listenerState.Store("")
+
+	for state, want := range map[string]string{"": "ok", "connected": "ok", "disconnected": "fail"} {
+		listenerState.Store(state)
+		if c := listenerCheck(); c.Status != want {
+			t.Errorf("listener %q: %s, want %s", state, c.Status, want)
+		}
+	}
+}
+
+func TestLivenessFailsWhenLoopStalls(t *testing.T) {
+	defer func(saved healthThresholds) { thresholds = saved }(thresholds)
+	defer loopAt.Store(loopAt.Load())
+	thresholds.MaxLoopAge = 15 * time.Second
+
+	loopAt.Store(time.Now().Add(-time.Minute).UnixNano())
+	rec := httptest.NewRecorder()
+	handleLiveness(rec, httptest.NewRequest("GET", "/health/live", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("stalled loop: status %d", rec.Code)
+	}
+
+	loopAt.Store(time.Now().UnixNano())
+	rec = httptest.NewRecorder()
+	handleLiveness(rec, httptest.NewRequest("GET", "/health/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("running loop: status %d", rec.Code)
+	}
+}
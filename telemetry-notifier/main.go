@@ -0,0 +1,369 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type Anomaly struct {
+	ID             int       `json:"id"`
+	TelemetryID    int       `json:"telemetry_id"`
+	Timestamp      time.Time `json:"timestamp"`
+	SpacecraftID   int       `json:"spacecraft_id"`
+	IncidentID     *int      `json:"incident_id,omitempty"`
+	AnomalyType    string    `json:"anomaly_type"`
+	ParameterName  string    `json:"parameter_name"`
+	ParameterValue float32   `json:"parameter_value"`
+	ThresholdValue float32   `json:"threshold_value"`
+	Severity       string    `json:"severity"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// anomalyCursor is the position of the notifier in anomaly_history: the
+// stream_xid and id of the last anomaly read. As in the API's stream, rows are
+// only read once every transaction older than their own has ended, so a
+// transaction that commits late cannot leave a row behind the cursor.
+type anomalyCursor struct {
+	XID int64
+	ID  int
+}
+
+var db *sql.DB
+
+func main() {
+
+	connStr := databaseConnString()
+	initDatabase(connStr)
+
+	configPath := os.Getenv("NOTIFIER_CONFIG")
+	if configPath == "" {
+		configPath = "/etc/telemetry-notifier/notifier.json"
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal("Failed to load notifier config:", err)
+	}
+
+	pollInterval := 5 * time.Second
+	if v := os.Getenv("POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatal("Invalid POLL_INTERVAL:", v)
+		}
+		pollInterval = d
+	}
+
+	loadHealthThresholds(pollInterval)
+
+	dispatcher := newDispatcher(cfg, newSenders(cfg))
+	dispatcher.record = recordDelivery
+
+	go startHealthServer()
+
+	wake := make(chan struct{}, 1)
+	if os.Getenv("NOTIFIER_MODE") != "poll" {
+		startListener(connStr, wake)
+	}
+
+	cursor, err := loadCursor()
+	if err != nil {
+		log.Fatal("Failed to load notifier cursor:", err)
+	}
+
+	restored, err := restoreEscalations(dispatcher)
+	if err != nil {
+		log.Fatal("Failed to load pending escalations:", err)
+	}
+	if restored > 0 {
+		log.Printf("Restored %d pending escalations", restored)
+	}
+
+	log.Printf("Telemetry notifier started with %d routes and %d channels", len(cfg.Routes), len(cfg.Channels))
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		loopAt.Store(time.Now().UnixNano())
+		anomalies, next, err := fetchAnomalies(cursor)
+		if err != nil {
+			log.Printf("Error fetching anomalies: %v", err)
+		} else {
+			polledAt.Store(time.Now().UnixNano())
+		}
+
+		for _, a := range anomalies {
+			dispatcher.Handle(a)
+		}
+
+		if next != cursor {
+			cursor = next
+			if err := saveCursor(cursor); err != nil {
+				log.Printf("Error saving notifier cursor: %v", err)
+			}
+		}
+
+		if err := dispatcher.Escalate(fetchAcknowledged); err != nil {
+			log.Printf("Error checking escalations: %v", err)
+		}
+		queueDepth.Store(int64(dispatcher.PendingEscalations()))
+
+		select {
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func databaseConnString() string {
+	dbHost := os.Getenv("DB_HOST")
+	dbPort := os.Getenv("DB_PORT")
+	dbName := os.Getenv("DB_NAME")
+	dbUser := os.Getenv("DB_USER")
+	dbPassword := os.Getenv("DB_PASSWORD")
+
+	if dbHost == "" {
+		dbHost = "localhost"
+	}
+	if dbPort == "" {
+		dbPort = "5432"
+	}
+	if dbName == "" {
+		dbName = "telemetry"
+	}
+	if dbUser == "" {
+		dbUser = "telemetry_user"
+	}
+	if dbPassword == "" {
+		dbPassword = "telemetry_pass"
+	}
+
+	return fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
+		dbHost, dbPort, dbName, dbUser, dbPassword)
+}
+
+func initDatabase(connStr string) {
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("Failed to ping database:", err)
+	}
+
+	log.Println("Successfully connected to database")
+}
+
+// startListener wakes the poll loop whenever the anomaly_created channel is
+// notified. Polling continues on its own interval, so a lost connection only
+// adds latency.
+func startListener(connStr string, wake chan<- struct{}) {
+	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Anomaly listener: %v", err)
+		}
+		switch ev {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			listenerState.Store("connected")
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			listenerState.Store("disconnected")
+		}
+	})
+	if err := listener.Listen("anomaly_created"); err != nil {
+		log.Printf("Failed to listen for anomalies, falling back to polling: %v", err)
+		return
+	}
+
+	go func() {
+		for range listener.Notify {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// fetchAnomalies returns live (not reprocessed, not imported, not superseded,
+// not silenced) anomalies after the cursor that have not been notified yet,
+// and the cursor of the last row read. Anomalies already in notification_log
+// were handled before a restart that came before the cursor was saved.
+func fetchAnomalies(after anomalyCursor) ([]Anomaly, anomalyCursor, error) {
+	rows, err := db.Query(`
+		SELECT h.stream_xid, h.id, h.telemetry_id, h.timestamp, h.spacecraft_id, h.incident_id, h.anomaly_type,
+			   h.parameter_name, h.parameter_value, h.threshold_value, h.severity, h.created_at,
+			   h.superseded_at IS NULL AND h.reprocess_job_id IS NULL AND h.import_id IS NULL
+			   AND NOT h.suppressed
+			   AND NOT EXISTS (SELECT 1 FROM notification_log n WHERE n.anomaly_id = h.id)
+		FROM anomaly_history h
+		WHERE (h.stream_xid, h.id) > ($1::xid8, $2)
+		AND h.stream_xid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY h.stream_xid, h.id
+	`, after.XID, after.ID)
+	if err != nil {
+		return nil, after, err
+	}
+	defer rows.Close()
+
+	var anomalies []Anomaly
+	for rows.Next() {
+		var a Anomaly
+		var next anomalyCursor
+		var notify bool
+		err := rows.Scan(
+			&next.XID, &a.ID, &a.TelemetryID, &a.Timestamp, &a.SpacecraftID, &a.IncidentID, &a.AnomalyType,
+			&a.ParameterName, &a.ParameterValue, &a.ThresholdValue, &a.Severity, &a.CreatedAt, &notify,
+		)
+		if err != nil {
+			return anomalies, after, err
+		}
+		next.ID = a.ID
+		after = next
+		if notify {
+			anomalies = append(anomalies, a)
+		}
+	}
+	return anomalies, after, rows.Err()
+}
+
+// fetchAcknowledged reports whether each anomaly still needs attention. An
+// anomaly suppressed by a silence created after it was notified counts as
+// acknowledged, so it is not escalated.
+func fetchAcknowledged(ids []int) (map[int]bool, error) {
+	rows, err := db.Query(`
+		SELECT id, acknowledged OR suppressed
+		FROM anomaly_history
+		WHERE id = ANY($1) AND superseded_at IS NULL
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	state := map[int]bool{}
+	for rows.Next() {
+		var id int
+		var acknowledged bool
+		if err := rows.Scan(&id, &acknowledged); err != nil {
+			return nil, err
+		}
+		state[id] = acknowledged
+	}
+	return state, rows.Err()
+}
+
+// loadCursor returns the position of the last processed anomaly. On first
+// start it begins at the oldest running transaction rather than replaying
+// history.
+func loadCursor() (anomalyCursor, error) {
+	var cursor anomalyCursor
+	err := db.QueryRow(`SELECT last_xid, last_id FROM notifier_state WHERE name = 'anomalies'`).Scan(&cursor.XID, &cursor.ID)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`SELECT pg_snapshot_xmin(pg_current_snapshot())`).Scan(&cursor.XID)
+	}
+	return cursor, err
+}
+
+func saveCursor(cursor anomalyCursor) error {
+	_, err := db.Exec(`
+		INSERT INTO notifier_state (name, last_xid, last_id) VALUES ('anomalies', $1, $2)
+		ON CONFLICT (name) DO UPDATE SET last_xid = EXCLUDED.last_xid, last_id = EXCLUDED.last_id
+	`, cursor.XID, cursor.ID)
+	return err
+}
+
+// restoreEscalations queues the escalations scheduled before the last restart
+// that were never sent, for anomalies that are still unacknowledged. It
+// returns the number queued.
+func restoreEscalations(d *Dispatcher) (int, error) {
+	rows, err := db.Query(`
+		SELECT h.id, h.telemetry_id, h.timestamp, h.spacecraft_id, h.incident_id, h.anomaly_type,
+			   h.parameter_name, h.parameter_value, h.threshold_value, h.severity, h.created_at,
+			   p.route, p.due_at
+		FROM (
+			SELECT anomaly_id, route, MIN(due_at) AS due_at
+			FROM notification_log n
+			WHERE due_at IS NOT NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM notification_log e
+				WHERE e.anomaly_id = n.anomaly_id AND e.route = n.route AND e.escalation
+			)
+			GROUP BY anomaly_id, route
+		) p
+		JOIN anomaly_history h ON h.id = p.anomaly_id
+		WHERE h.superseded_at IS NULL
+		AND NOT h.acknowledged
+		AND NOT h.suppressed
+		ORDER BY p.due_at
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	restored := 0
+	for rows.Next() {
+		var a Anomaly
+		var route string
+		var due time.Time
+		err := rows.Scan(
+			&a.ID, &a.TelemetryID, &a.Timestamp, &a.SpacecraftID, &a.IncidentID, &a.AnomalyType,
+			&a.ParameterName, &a.ParameterValue, &a.ThresholdValue, &a.Severity, &a.CreatedAt,
+			&route, &due,
+		)
+		if err != nil {
+			return restored, err
+		}
+		if d.Restore(a, route, due) {
+			restored++
+		}
+	}
+	return restored, rows.Err()
+}
+
+func recordDelivery(d Delivery) {
+	status := "SENT"
+	var errMsg *string
+	if d.Err != nil {
+		status = "FAILED"
+		msg := d.Err.Error()
+		errMsg = &msg
+	}
+	var escalateAt *time.Time
+	if !d.EscalateAt.IsZero() {
+		escalateAt = &d.EscalateAt
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO notification_log (anomaly_id, route, channel, escalation, status, error, due_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, d.AnomalyID, d.Route, d.Channel, d.Escalation, status, errMsg, escalateAt)
+	if err != nil {
+		log.Printf("Error recording delivery: %v", err)
+	}
+}
+
+func startHealthServer() {
+	port := os.Getenv("HEALTH_PORT")
+	if port == "" {
+		port = "8092"
+	}
+
+	http.HandleFunc("/health", handleLiveness)
+	http.HandleFunc("/health/live", handleLiveness)
+	http.HandleFunc("/health/ready", handleReadiness)
+
+	log.Printf("Health server started on :%s", port)
+	if err := http.ListenAndServe(":"+port, nil); err != nil {
+		log.Printf("Health server error: %v", err)
+	}
+}